@@ -0,0 +1,156 @@
+package rscp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* POSIX ACLs live in these attributes in the kernel's binary format */
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+
+	aclVersion   = 2
+	aclUndefined = 0xffffffff
+)
+
+var aclTags = []struct {
+	tag  uint16
+	text string
+	ids  bool
+}{
+	{0x01, "u", false}, /* owning user */
+	{0x02, "u", true},
+	{0x04, "g", false}, /* owning group */
+	{0x08, "g", true},
+	{0x10, "m", false},
+	{0x20, "o", false},
+}
+
+var errBadACL = errors.New("malformed ACL")
+
+/* aclText turns a binary ACL into short text form */
+func aclText(b []byte) (string, error) {
+	if len(b) < 4 || binary.LittleEndian.Uint32(b) != aclVersion || (len(b)-4)%8 != 0 {
+		return "", errBadACL
+	}
+	var entries []string
+	for b = b[4:]; len(b) > 0; b = b[8:] {
+		tag := binary.LittleEndian.Uint16(b)
+		perm := binary.LittleEndian.Uint16(b[2:])
+		id := binary.LittleEndian.Uint32(b[4:])
+
+		entry := ""
+		for _, t := range aclTags {
+			if t.tag == tag {
+				entry = t.text + ":"
+				if t.ids {
+					entry += strconv.FormatUint(uint64(id), 10)
+				}
+			}
+		}
+		if entry == "" {
+			return "", errBadACL
+		}
+		rwx := []byte("rwx")
+		for i := range rwx {
+			if perm&(4>>i) == 0 {
+				rwx[i] = '-'
+			}
+		}
+		entries = append(entries, entry+":"+string(rwx))
+	}
+	return strings.Join(entries, ","), nil
+}
+
+/* aclBinary turns short text form back into a binary ACL */
+func aclBinary(text string) ([]byte, error) {
+	b := binary.LittleEndian.AppendUint32(nil, aclVersion)
+	for _, entry := range strings.Split(text, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 || len(fields[2]) != 3 {
+			return nil, errBadACL
+		}
+
+		tag, id := uint16(0), uint64(aclUndefined)
+		for _, t := range aclTags {
+			if t.text == fields[0] && t.ids == (fields[1] != "") {
+				tag = t.tag
+			}
+		}
+		if tag == 0 {
+			return nil, errBadACL
+		}
+		if fields[1] != "" {
+			var err error
+			if id, err = strconv.ParseUint(fields[1], 10, 32); err != nil {
+				return nil, errBadACL
+			}
+		}
+
+		var perm uint16
+		for i, c := range fields[2] {
+			if c == rune("rwx"[i]) {
+				perm |= 4 >> i
+			} else if c != '-' {
+				return nil, errBadACL
+			}
+		}
+		b = binary.LittleEndian.AppendUint16(b, tag)
+		b = binary.LittleEndian.AppendUint16(b, perm)
+		b = binary.LittleEndian.AppendUint32(b, uint32(id))
+	}
+	return b, nil
+}
+
+/* acls reads the ACLs of local, none where the FS has none */
+func (s *session) acls(local string) ([]protocol.PMsg, error) {
+	names, err := s.fs.Listxattr(local)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ms []protocol.PMsg
+	for _, name := range names {
+		if name != aclAccessXattr && name != aclDefaultXattr {
+			continue
+		}
+		value, err := s.fs.Getxattr(local, name)
+		if err != nil {
+			return nil, err
+		}
+		text, err := aclText(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", local, err)
+		}
+		ms = append(ms, protocol.PMsg{Default: name == aclDefaultXattr, ACL: text})
+	}
+	return ms, nil
+}
+
+/* setACLs applies ACLs, leaving the plain mode bits where the FS has no ACLs */
+func (s *session) setACLs(name string, ms []protocol.PMsg) error {
+	for _, m := range ms {
+		value, err := aclBinary(m.ACL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		attr := aclAccessXattr
+		if m.Default {
+			attr = aclDefaultXattr
+		}
+		if err := s.fs.Setxattr(name, attr, value); errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
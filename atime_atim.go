@@ -0,0 +1,16 @@
+//go:build linux || openbsd || dragonfly || solaris || illumos || aix
+
+package rscp
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func statAtime(st os.FileInfo) time.Time {
+	if sysStat, ok := st.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(sysStat.Atim.Unix())
+	}
+	return time.Unix(0, 0)
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || openbsd || dragonfly || solaris || illumos || aix || darwin || freebsd || netbsd || windows)
+
+package rscp
+
+import (
+	"os"
+	"time"
+)
+
+func statAtime(st os.FileInfo) time.Time {
+	return time.Unix(0, 0)
+}
@@ -0,0 +1,14 @@
+package rscp
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func statAtime(st os.FileInfo) time.Time {
+	if attrs, ok := st.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, attrs.LastAccessTime.Nanoseconds())
+	}
+	return time.Unix(0, 0)
+}
@@ -0,0 +1,113 @@
+package rscp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+)
+
+/* Unless InPlace is set the sink receives a file into a temporary one
+   next to it and renames that over the name once data and attributes
+   are in, so that the name holds the old file or the new one whole but
+   never part of either. The temporary file is removed when the data
+   cannot be written or the transfer is canceled, the old file staying
+   as it was. Files that fail --checksum are still put in place.
+
+   With TempDir the temporary file is received there instead and moved
+   next to the name once its data is in, copied when it can not be
+   renamed there, as from another file system. */
+
+const tempSuffix = ".rscp-tmp-"
+
+/* tempFor is where the sink receives name into and what name is now,
+   "" to write name in place: with InPlace, with resume which takes up
+   what name holds, or when name is something else than a regular file */
+func (s *session) tempFor(name string) (string, os.FileInfo) {
+	if s.opts.InPlace || s.ext["resume"] {
+		return "", nil
+	}
+	old, err := s.fs.Lstat(name)
+	if err == nil && !old.Mode().IsRegular() || err != nil && !os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		old = nil
+	}
+	id := tempID()
+	if id == "" {
+		return "", nil
+	}
+	if s.staging() {
+		return tempPrefix(path.Join(s.opts.TempDir, path.Base(name))) + id, old
+	}
+	return tempPrefix(name) + id, old
+}
+
+/* tempID tells temporary files for the same name apart, "" when no
+   random bytes are to be had */
+func tempID() string {
+	var id [6]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+/* tempPrefix is what the names of temporary files for name start with */
+func tempPrefix(name string) string {
+	dir, base := path.Split(name)
+	if len(base) > 200 { /* the suffix must fit into NAME_MAX */
+		base = base[:200]
+	}
+	return dir + base + tempSuffix
+}
+
+/* staging tells whether temporary files go into TempDir, tees taking
+   theirs next to their names alone */
+func (s *session) staging() bool {
+	return s.opts.TempDir != "" && len(s.opts.Tee) == 0
+}
+
+/* unstage moves tmp, received into TempDir through f, next to name as
+   a temporary file still, p following; f is then open on that */
+func (s *session) unstage(f File, tmp, name string, p *partialFile) (File, string, error) {
+	local := tempPrefix(name) + tempID()
+	if err := s.fs.Rename(tmp, local); err == nil {
+		p.moved(local)
+		return f, local, nil
+	}
+	lf, err := s.fs.OpenFile(local, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return f, tmp, err
+	}
+	r, err := s.fs.Open(tmp)
+	if err == nil {
+		_, err = io.Copy(lf, r)
+		r.Close()
+	}
+	if err != nil {
+		lf.Close()
+		s.fs.Remove(local)
+		return f, tmp, err
+	}
+	f.Close()
+	s.fs.Remove(tmp)
+	p.moved(local)
+	return lf, local, nil
+}
+
+/* keepOwner gives tmp the owner of the old file it replaces as far as
+   permitted, writing in place would have kept it */
+func (s *session) keepOwner(tmp string, st, old os.FileInfo) {
+	if old == nil {
+		return
+	}
+	uid, gid, ok := s.fs.Owner(old)
+	if tuid, tgid, tok := s.fs.Owner(st); !ok || tok && tuid == uid && tgid == gid {
+		return
+	}
+	if s.fs.Chown(tmp, uid, gid) != nil {
+		s.fs.Chown(tmp, -1, gid) /* a group of ours still */
+	}
+}
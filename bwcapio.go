@@ -1,15 +1,21 @@
-package main
+package rscp
 
 import (
 	"io"
+	"net"
+	"sync"
 	"time"
 )
 
+const MinCopyChunk = 4096
+
 type BwStats struct {
 	Last   time.Time /* time of last observed event */
 	Wnd    uint      /* unmetered bytes */
 	Thresh uint      /* delay after at least this much bytes */
 	Rate   uint      /* bandwidth limit in bits/second */
+
+	mu sync.Mutex /* reads and writes of a mux meter concurrently */
 }
 
 func NewBwStats(rate uint) *BwStats {
@@ -52,10 +58,50 @@ func (w *BwCapWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
+/* CapListener meters all connections accepted on ln against st together */
+func CapListener(ln net.Listener, st *BwStats) net.Listener {
+	if st == nil {
+		panic("nil stats")
+	}
+	return &BwCapListener{ln, st}
+}
+
+type BwCapListener struct {
+	net.Listener
+	Stats *BwStats
+}
+
+func (l *BwCapListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &BwCapConn{conn, l.Stats}, nil
+}
+
+type BwCapConn struct {
+	net.Conn
+	Stats *BwStats
+}
+
+func (c *BwCapConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	bwCap(c.Stats, n)
+	return n, err
+}
+
+func (c *BwCapConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	bwCap(c.Stats, n)
+	return n, err
+}
+
 func bwCap(st *BwStats, transfered int) {
 	if transfered <= 0 {
 		return 
 	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
 	if st.Last.IsZero() {
 		st.Last = time.Now()
 		return
@@ -81,3 +127,66 @@ func bwCap(st *BwStats, transfered int) {
 	st.Wnd = 0
 	st.Last = time.Now()
 }
+
+/* forward to the base ReaderFrom metering each Thresh sized chunk */
+func (w *BwCapWriter) ReadFrom(r io.Reader) (int64, error) {
+	return copyChunked(w.Base, r, w.Stats.chunk, func(n int64) error {
+		bwCap(w.Stats, int(n))
+		return nil
+	})
+}
+
+/* forward to the WriterTo of the underlying reader metering each Thresh sized chunk */
+func (r *BwCapReader) WriteTo(w io.Writer) (int64, error) {
+	return copyChunked(w, r.Base, r.Stats.chunk, func(n int64) error {
+		bwCap(r.Stats, int(n))
+		return nil
+	})
+}
+
+func (st *BwStats) chunk() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.Thresh < MinCopyChunk {
+		return MinCopyChunk
+	}
+	return int64(st.Thresh)
+}
+
+/*
+ * io.Copy src to dst in chunks calling step after each one, so wrappers can
+ * account for data without hiding the ReaderFrom/WriterTo fast paths of what
+ * they wrap; a limited src is narrowed in place rather than nested, nested
+ * limits would defeat the zero-copy paths of os.File and net conns
+ */
+func copyChunked(dst io.Writer, src io.Reader, chunk func() int64, step func(int64) error) (int64, error) {
+	base := src
+	lr, limited := src.(*io.LimitedReader)
+	if limited {
+		base = lr.R
+	}
+
+	var written int64
+	for {
+		part := &io.LimitedReader{R: base, N: chunk()}
+		if limited && lr.N < part.N {
+			part.N = lr.N
+		}
+		want := part.N
+		if want <= 0 {
+			return written, nil
+		}
+
+		n, err := io.Copy(dst, part)
+		written += n
+		if limited {
+			lr.N -= want - part.N /* consumed, a failed write may have read more than it wrote */
+		}
+		if err := step(n); err != nil {
+			return written, err
+		}
+		if err != nil || n < want {
+			return written, err
+		}
+	}
+}
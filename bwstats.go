@@ -0,0 +1,109 @@
+package rscp
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* TransferStats counts protocol bytes of a session, safe to query while it runs */
+type TransferStats struct {
+	in    atomic.Int64
+	out   atomic.Int64
+	start time.Time
+
+	mu    sync.Mutex
+	last  time.Time /* time of previous snapshot */
+	lastN int64     /* bytes at previous snapshot */
+}
+
+type StatsSnapshot struct {
+	BytesIn  int64
+	BytesOut int64
+	Elapsed  time.Duration
+	AvgRate  float64 /* bytes/second since start */
+	CurRate  float64 /* bytes/second since previous snapshot */
+}
+
+func NewTransferStats() *TransferStats {
+	now := time.Now()
+	return &TransferStats{start: now, last: now}
+}
+
+func (st *TransferStats) Snapshot() StatsSnapshot {
+	now := time.Now()
+	snap := StatsSnapshot{
+		BytesIn:  st.in.Load(),
+		BytesOut: st.out.Load(),
+		Elapsed:  now.Sub(st.start),
+	}
+	total := snap.BytesIn + snap.BytesOut
+	if secs := snap.Elapsed.Seconds(); secs > 0 {
+		snap.AvgRate = float64(total) / secs
+	}
+
+	st.mu.Lock()
+	if secs := now.Sub(st.last).Seconds(); secs > 0 {
+		snap.CurRate = float64(total-st.lastN) / secs
+	}
+	st.last, st.lastN = now, total
+	st.mu.Unlock()
+
+	return snap
+}
+
+func CountReader(r io.Reader, st *TransferStats) io.Reader {
+	if st == nil {
+		panic("nil stats")
+	}
+	return &StatsReader{r, st}
+}
+
+func CountWriter(w io.Writer, st *TransferStats) io.Writer {
+	if st == nil {
+		panic("nil stats")
+	}
+	return &StatsWriter{w, st}
+}
+
+type StatsReader struct {
+	Base  io.Reader
+	Stats *TransferStats
+}
+
+func (r *StatsReader) Read(p []byte) (int, error) {
+	n, err := r.Base.Read(p)
+	r.Stats.in.Add(int64(n))
+	return n, err
+}
+
+type StatsWriter struct {
+	Base  io.Writer
+	Stats *TransferStats
+}
+
+func (w *StatsWriter) Write(p []byte) (int, error) {
+	n, err := w.Base.Write(p)
+	w.Stats.out.Add(int64(n))
+	return n, err
+}
+
+func (r *StatsReader) WriteTo(w io.Writer) (int64, error) {
+	return copyChunked(w, r.Base, statsCopyChunk, func(n int64) error {
+		r.Stats.in.Add(n)
+		return nil
+	})
+}
+
+func (w *StatsWriter) ReadFrom(r io.Reader) (int64, error) {
+	return copyChunked(w.Base, r, statsCopyChunk, func(n int64) error {
+		w.Stats.out.Add(n)
+		return nil
+	})
+}
+
+/* small enough for live rates to stay live */
+func statsCopyChunk() int64 {
+	return 256 << 10
+}
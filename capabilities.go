@@ -0,0 +1,181 @@
+package rscp
+
+import (
+	"io"
+	"sort"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* protocol features this build speaks, extensions register themselves here */
+var capabilities = map[string]string{
+	"times":     "T messages preserving modification and access times (-p)",
+	"recursion": "D and E messages transferring directory trees (-r)",
+	"owner":     "O messages preserving file ownership (-o)",
+	"xattrs":    "A messages preserving extended attributes (--xattrs)",
+	"acls":      "P messages preserving POSIX ACLs (-p --acls)",
+	"links":     "L messages sending symlinks as such (--links)",
+	"hardlinks": "I and H messages recreating hard links (--hardlinks)",
+	"sparse":    "K messages sending only the data of files with holes (--sparse)",
+	"nsec":      "N messages preserving times to the nanosecond (-p --nsec)",
+	"checksum":  "Z messages verifying each file against its SHA-256 digest (--checksum)",
+	"gzip":      "gzip compression of everything the source sends, preferred to deflate (--compress)",
+	"deflate":   "deflate compression of everything the source sends (--compress)",
+	"mux":       "M message and framing sending files over parallel streams (--streams)",
+	"keepalive": "B messages beating while the transfer is idle (--keepalive)",
+	"resume":    "R replies taking up partial files where they end (--resume)",
+	"summary":   "S messages comparing what both sides made of the transfer (--summary)",
+	"names":     "octal escapes for control characters in names (--escape-names)",
+	"nul":       "protocol lines ending with NUL rather than newline (--nul-framing)",
+	"totals":    "G message announcing files and bytes in all ahead of them (--totals)",
+	"specials":  "F messages recreating FIFOs, sockets and device nodes (--specials)",
+	"fflags":    "U messages preserving BSD file flags (-p --fflags)",
+	"sealed":    "file data encrypted to a key of the sink (--seal-to, --open-with)",
+	"skip":      "Y replies declining files the sink already has (--on-conflict=skip, -n, -u)",
+}
+
+/* Capabilities lists the protocol features this build supports, sorted by name */
+func Capabilities() []string {
+	caps := make([]string, 0, len(capabilities))
+	for name := range capabilities {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+/* DescribeCapability tells what the feature name is, empty for one this build lacks */
+func DescribeCapability(name string) string {
+	return capabilities[name]
+}
+
+/* extensions lists the protocol extensions opts ask for, a source
+   offers them and a sink accepts those it was asked for too */
+func (o Options) extensions() []string {
+	var caps []string
+	if o.Owner {
+		caps = append(caps, "owner")
+	}
+	if o.Xattrs || o.SecurityXattrs {
+		caps = append(caps, "xattrs")
+	}
+	if o.ACLs && o.Preserve {
+		caps = append(caps, "acls")
+	}
+	if o.Links {
+		caps = append(caps, "links")
+	}
+	if o.Hardlinks {
+		caps = append(caps, "hardlinks")
+	}
+	if o.Sparse {
+		caps = append(caps, "sparse")
+	}
+	if o.NanoTimes && o.Preserve {
+		caps = append(caps, "nsec")
+	}
+	if o.Checksum {
+		caps = append(caps, "checksum")
+	}
+	if o.Compress {
+		caps = append(caps, compressors...)
+	}
+	if o.Streams > 1 && !o.Transactional && !o.Hardlinks { /* streams would each stage the trees they enter, or keep apart links to one file */
+		caps = append(caps, "mux")
+	}
+	if o.Keepalive > 0 {
+		caps = append(caps, "keepalive")
+	}
+	if o.Resume && len(o.Tee) == 0 {
+		caps = append(caps, "resume")
+	}
+	if o.Summary {
+		caps = append(caps, "summary")
+	}
+	if o.EscapeNames {
+		caps = append(caps, "names")
+	}
+	if o.NulFraming {
+		caps = append(caps, "nul")
+	}
+	if o.Totals || o.CheckSpace {
+		caps = append(caps, "totals")
+	}
+	if o.Specials {
+		caps = append(caps, "specials")
+	}
+	if o.FileFlags && o.Preserve {
+		caps = append(caps, "fflags")
+	}
+	if o.SealTo != nil || o.OpenWith != nil {
+		caps = append(caps, "sealed")
+	}
+	if o.OnConflict == ConflictSkip || o.Update {
+		caps = append(caps, "skip")
+	}
+	return caps
+}
+
+/* offer negotiates extensions with the sink. Other scp sinks end the
+   session on the X message, so it goes only to peers known to be rscp
+   and only when extensions were asked for. */
+func (s *session) offer() error {
+	want := s.opts.extensions()
+	if len(want) == 0 || !s.opts.RscpPeer {
+		return nil
+	}
+	if err := s.enc.Encode(protocol.XMsg{Caps: want}); err != nil {
+		return err
+	}
+
+	line, err := s.dec.Next()
+	if err == io.EOF {
+		return FatalError{Err: io.ErrUnexpectedEOF}
+	} else if err != nil {
+		return err
+	}
+	if line[0] == '\x01' || line[0] == '\x02' {
+		return FatalError{Err: RemoteError{Msg: line[1:]}}
+	}
+
+	var m protocol.XMsg
+	if err := m.UnmarshalText([]byte(line)); err != nil {
+		return err
+	}
+	s.agree(want, m.Caps)
+	s.codec()
+	s.compressOut()
+	s.startKeepalive()
+	return nil
+}
+
+/* accept answers the extensions offered by the source with those agreed on */
+func (s *session) accept(line string) error {
+	var m protocol.XMsg
+	if err := m.UnmarshalText([]byte(line)); err != nil {
+		return s.teeError(err)
+	}
+	agreed := s.agree(s.opts.extensions(), m.Caps)
+	if err := s.enc.Encode(protocol.XMsg{Caps: agreed}); err != nil {
+		return err
+	}
+	s.codec()
+	s.compressIn()
+	s.startKeepalive()
+	return nil
+}
+
+/* agree enables the extensions both mine and theirs list */
+func (s *session) agree(mine, theirs []string) []string {
+	var agreed []string
+	s.ext = map[string]bool{}
+	for _, c := range theirs {
+		for _, m := range mine {
+			if c == m && !s.ext[c] {
+				s.ext[c] = true
+				agreed = append(agreed, c)
+			}
+		}
+	}
+	return agreed
+}
@@ -0,0 +1,132 @@
+package rscp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/* stockSink plays a sink other than rscp, as OpenSSH scp is: it takes
+   C messages and their data into files, and on a line it does not know
+   reports a protocol error and exits */
+func stockSink(in io.Reader, out io.WriteCloser, files map[string]string) {
+	defer out.Close()
+	r := bufio.NewReader(in)
+	io.WriteString(out, "\x00")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(line, "C") {
+			io.WriteString(out, "\x01scp: protocol error: unexpected <"+line[:1]+">\n")
+			return
+		}
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+		size, _ := strconv.Atoi(fields[1])
+		io.WriteString(out, "\x00")
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return
+		}
+		files[fields[2]] = string(data[:size])
+		io.WriteString(out, "\x00")
+	}
+}
+
+/* A source offers extensions only to a peer it knows to be rscp, others
+   exiting on the X message */
+func TestOfferStockSink(t *testing.T) {
+	for _, rscpPeer := range []bool{false, true} {
+		src := NewMemFS()
+		src.WriteFile("/f", []byte("hello"), 0644)
+
+		sinkIn, sourceOut := io.Pipe()
+		sourceIn, sinkOut := io.Pipe()
+		files := map[string]string{}
+		done := make(chan struct{})
+		go func() {
+			stockSink(sinkIn, sinkOut, files)
+			sinkIn.Close()
+			close(done)
+		}()
+
+		opts := Options{In: sourceIn, Out: sourceOut, FS: src, Checksum: true, RscpPeer: rscpPeer}
+		err := SourceContext(context.Background(), opts, []string{"/f"})
+		sourceOut.Close()
+		<-done
+
+		if !rscpPeer {
+			if err != nil {
+				t.Errorf("plain peer: %v", err)
+			}
+			if files["f"] != "hello" {
+				t.Errorf("plain peer: received %q", files["f"])
+			}
+		} else {
+			var remote RemoteError
+			if !isFatal(err) || !errors.As(err, &remote) {
+				t.Errorf("rscp peer: got %v, want the refusal of the sink", err)
+			}
+		}
+	}
+}
+
+/* the two ends of a loopback know each other for rscp and agree */
+func TestOfferLoopback(t *testing.T) {
+	src, dst := NewMemFS(), NewMemFS()
+	src.WriteFile("/f", []byte("hello"), 0644)
+	dst.Mkdir("/dst", 0755)
+	var summed bool
+	opts := Options{Summary: true, OnSummary: func(own, peer Tally) { summed = true }}
+	if err := LoopbackFS(context.Background(), opts, src, []string{"/f"}, dst, "/dst"); err != nil {
+		t.Fatal(err)
+	}
+	if !summed {
+		t.Errorf("summary extension not agreed on")
+	}
+}
+
+/* Hard links reach the sink as links with streams asked for too, which
+   are not used then: a file and its links going over different streams
+   would each be taken for a file of its own */
+func TestHardlinksNoMux(t *testing.T) {
+	src, dst := NewMemFS(), NewMemFS()
+	src.Mkdir("/src", 0755)
+	for i := 0; i < 8; i++ {
+		name := "/src/f" + strconv.Itoa(i)
+		src.WriteFile(name, []byte(name), 0644)
+		src.Link(name, name+"-link")
+	}
+	dst.Mkdir("/dst", 0755)
+
+	opts := Options{Recursive: true, Hardlinks: true, Streams: 4}
+	for _, c := range opts.extensions() {
+		if c == "mux" {
+			t.Errorf("mux offered with hardlinks")
+		}
+	}
+	if err := LoopbackFS(context.Background(), opts, src, []string{"/src"}, dst, "/dst"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		name := "/dst/src/f" + strconv.Itoa(i)
+		a, err := dst.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := dst.Stat(name + "-link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ia, n, _ := dst.Inode(a)
+		_, ib, _, _ := dst.Inode(b)
+		if ia != ib || n != 2 {
+			t.Errorf("%s: inodes %d and %d, %d links, want one inode linked twice", name, ia, ib, n)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package rscp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+var ErrChecksum = errors.New("checksum mismatch")
+
+/* checksum hashes file data when the checksum extension is on, nil otherwise */
+func (s *session) checksum() hash.Hash {
+	if !s.ext["checksum"] {
+		return nil
+	}
+	return sha256.New()
+}
+
+/* hashed tees r into h when there is one */
+func hashed(r io.Reader, h hash.Hash) io.Reader {
+	if h == nil {
+		return r
+	}
+	return io.TeeReader(r, h)
+}
+
+func (s *session) sendSum(h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+	return s.enc.Encode(protocol.ZMsg{Sum: h.Sum(nil)})
+}
+
+/* verify compares the digest sent after the data of name with h */
+func (s *session) verify(name string, h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+	line, err := s.dec.Next()
+	if err == io.EOF {
+		return FatalError{Err: io.ErrUnexpectedEOF}
+	} else if err != nil {
+		return err
+	}
+	var m protocol.ZMsg
+	if err := m.UnmarshalText([]byte(line)); err != nil {
+		return s.teeError(err)
+	}
+	if !bytes.Equal(m.Sum, h.Sum(nil)) {
+		return fmt.Errorf("%s: %w", name, ErrChecksum)
+	}
+	return nil
+}
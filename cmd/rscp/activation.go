@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/sftpplease/rscp"
+)
+
+/* systemdSocket is the first socket systemd passed on as
+   sd_listen_fds(3) describes, nil when started otherwise */
+func systemdSocket() *os.File {
+	pid := os.Getpid()
+	if os.Getenv(sandboxEnv) != "" {
+		pid = os.Getppid() /* passed on by the process that sandboxed this one */
+	}
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil
+	}
+	if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || n < 1 {
+		return nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return os.NewFile(3, "LISTEN_FDS")
+}
+
+/* listening is the socket of listenFirst */
+var listening *os.File
+
+/* listenFirst listens on addr, on UDP for QUIC, and has the socket
+   passed on to the copy of the process enterSandbox starts as systemd
+   would have */
+func listenFirst(addr string, quic bool) error {
+	var sock interface {
+		File() (*os.File, error)
+		Close() error
+	}
+	if quic {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		sock = pc.(*net.UDPConn)
+	} else {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		sock = ln.(*net.TCPListener)
+	}
+	defer sock.Close()
+	var err error
+	if listening, err = sock.File(); err != nil {
+		return err
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	return nil
+}
+
+/* listenFiles are the sockets systemd passed on to this process, or
+   that of listenFirst, for one it starts to take over */
+func listenFiles() []*os.File {
+	if listening != nil {
+		return []*os.File{listening}
+	}
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil
+	}
+	var files []*os.File
+	for fd := 3; fd < 3+n; fd++ {
+		files = append(files, os.NewFile(uintptr(fd), "LISTEN_FDS"))
+	}
+	return files
+}
+
+/* serveOne serves the one connection a super-server accepted, in being
+   the socket unless testing with pipes */
+func serveOne(in, out *os.File, root string, secret []byte, opts rscp.Options, config *tls.Config) error {
+	conn, err := net.FileConn(in)
+	if err != nil {
+		if config != nil {
+			return err
+		}
+		return serveConn(struct {
+			io.Reader
+			io.Writer
+		}{in, out}, root, secret, opts)
+	}
+	defer conn.Close()
+	if config != nil {
+		conn = tls.Server(conn, config)
+	}
+	return serveConn(conn, root, secret, opts)
+}
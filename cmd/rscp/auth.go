@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/sftpplease/rscp"
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* Clients of rscp serve knowing a shared secret open with a line "auth"
+   in place of a request. The server replies a random challenge in hex,
+   the client answers the HMAC-SHA256 of it keyed with the secret, also
+   in hex, and goes on with its request. A server without a secret takes
+   "auth" for an unknown request, one with a secret refuses any other. */
+
+var ErrAuth = errors.New("authentication failed")
+
+const ChallengeLen = 32
+
+/* readSecret reads a shared secret from file, a final newline not
+   being part of it */
+func readSecret(file string) ([]byte, error) {
+	secret, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSuffix(secret, []byte("\n"))
+	if len(secret) == 0 {
+		return nil, errors.New(file + ": empty secret")
+	}
+	return secret, nil
+}
+
+func answer(secret, challenge []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/* serverAuth has a client of rscp serve prove it knows secret */
+func serverAuth(conn io.ReadWriter, secret []byte) error {
+	dec, enc := protocol.NewDecoder(conn), protocol.NewEncoder(conn)
+	if line, err := dec.ReadLimited(MaxRequestLen); err != nil {
+		return err
+	} else if line != "auth" {
+		enc.Encode(protocol.ErrMsg{Fatal: true, Msg: "authentication required"})
+		return ErrAuth
+	}
+
+	challenge := make([]byte, ChallengeLen)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, hex.EncodeToString(challenge)+"\n"); err != nil {
+		return err
+	}
+	line, err := dec.ReadLimited(2 * sha256.Size)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(line), []byte(answer(secret, challenge))) {
+		enc.Encode(protocol.ErrMsg{Fatal: true, Msg: ErrAuth.Error()})
+		return ErrAuth
+	}
+	return nil
+}
+
+/* clientAuth proves to rscp serve that the client knows secret */
+func clientAuth(conn io.ReadWriter, secret []byte) error {
+	if _, err := io.WriteString(conn, "auth\n"); err != nil {
+		return err
+	}
+	line, err := protocol.NewDecoder(conn).ReadLimited(MaxRequestLen)
+	if err != nil {
+		return err
+	}
+	if line != "" && (line[0] == '\x01' || line[0] == '\x02') {
+		return rscp.RemoteError{Msg: line[1:]}
+	}
+	challenge, err := hex.DecodeString(line)
+	if err != nil || len(challenge) != ChallengeLen {
+		return rscp.ErrProtocol
+	}
+	_, err = io.WriteString(conn, answer(secret, challenge)+"\n")
+	return err
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sftpplease/rscp"
+	"github.com/sftpplease/rscp/protocol"
+)
+
+const (
+	MaxRequestLen    = 4096
+	DefaultServePort = "2222"
+)
+
+var subcommands = map[string]func(args []string) int{
+	"to":     cmdTo,
+	"from":   cmdFrom,
+	"copy":   cmdCopy,
+	"serve":  cmdServe,
+	"replay": cmdReplay,
+	"keygen": cmdKeygen,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	var opts rscp.Options
+	var iamSource, iamSink, showCaps bool
+	var client clientOpts
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.BoolVar(&iamSource, "f", false, "Run in source mode")
+	flags.BoolVar(&iamSink, "t", false, "Run in sink mode")
+	flags.StringVar(&client.ssh, "S", "ssh", "Connect to remote hosts with `program`")
+	flags.StringVar(&client.port, "P", "", "Connect to `port` on remote hosts")
+	flags.StringVar(&client.jump, "J", "", "Reach remote hosts through `jumphosts`, a comma separated list as for ssh -J")
+	flags.StringVar(&client.key, "i", "", "Log in to remote hosts with the private key in `file`, as for ssh -i")
+	flags.DurationVar(&client.reuse, "reuse", 0, "Keep ssh connections open for `duration` after use and send later transfers to the same hosts over them")
+	flags.StringVar(&client.tlsCA, "tls-ca", "", "Verify rscps:// and rscp+quic:// servers against the CA certificates in `file` instead of the system ones")
+	flags.StringVar(&client.tlsCert, "tls-cert", "", "Show rscps:// and rscp+quic:// servers the certificate in `file`")
+	flags.StringVar(&client.tlsKey, "tls-key", "", "Private key of -tls-cert in `file`")
+	flags.Func("secret-file", "Prove to rscp://, rscps:// and rscp+quic:// servers to know the secret in `file`", func(file string) (err error) {
+		client.secret, err = readSecret(file)
+		return err
+	})
+	flags.StringVar(&client.remote, "remote-scp", "rscp", "Start the remote end with `command`, scp for OpenSSH")
+	flags.BoolVar(&client.sftp, "sftp", false, "Reach remote hosts through their SFTP subsystem instead of running scp there")
+	flags.BoolVar(&client.native, "native-ssh", false, "Connect to remote hosts with an SSH client of its own instead of -S, going by ~/.ssh/config, checking host keys against known_hosts and logging in with ssh-agent, identity files or a password")
+	flags.Func("host-key-check", "Check host keys with --native-ssh as `how` says: strict refuses hosts not in known_hosts, accept-new adds them, off takes any key; StrictHostKeyChecking of ~/.ssh/config otherwise, strict by default", func(how string) error {
+		if !slices.Contains(hostKeyChecks, how) {
+			return fmt.Errorf("%s is none of %s", how, strings.Join(hostKeyChecks, ", "))
+		}
+		client.hostKeyCheck = how
+		return nil
+	})
+	flags.BoolVar(&client.anyNames, "T", false, "Take whatever names remote sources send instead of only those the paths asked for give")
+	flags.BoolVar(&showCaps, "capabilities", false, "Print supported protocol features and exit")
+	addTransferFlags(flags, &opts)
+	flags.Usage = func() { usage(flags) }
+
+	flags.Parse(os.Args[1:])
+	var args = flags.Args()
+
+	if showCaps {
+		for _, c := range rscp.Capabilities() {
+			fmt.Printf("%s\t%s\n", c, rscp.DescribeCapability(c))
+		}
+		return
+	}
+
+	if !iamSource && !iamSink && len(args) > 1 {
+		client.flags = remoteFlags(flags)
+		os.Exit(exitCode(runClient(rscp.Interruptible(), opts, client, args)))
+	}
+
+	var validMode = (iamSource || iamSink) && !(iamSource && iamSink)
+	var validArgc = (iamSource && len(args) > 0) || (iamSink && len(args) == 1)
+
+	if !validMode || !validArgc {
+		usage(flags)
+	}
+
+	var err error
+
+	var writable []string
+	if iamSink {
+		writable = append(opts.Tee, args[0])
+	}
+	if err := enterSandbox(flags, writable...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctx := rscp.Interruptible()
+	opts.RscpPeer = true /* only an rscp client asks the remote end for extensions */
+	if iamSource {
+		err = rscp.SourceContext(ctx, opts, args)
+	} else {
+		err = rscp.SinkContext(ctx, opts, args[0])
+	}
+
+	os.Exit(exitCode(err))
+}
+
+func addTransferFlags(flags *flag.FlagSet, opts *rscp.Options) {
+	flags.UintVar(&opts.BwLimit, "l", 0, "Limit the bandwidth, specified in Kbit/s")
+	flags.BoolVar(&opts.Recursive, "r", false, "Copy directoires recursively following any symlinks")
+	flags.BoolVar(&opts.TargetDir, "d", false, "Target should be a directory")
+	flags.BoolFunc("mkdir", "Create the target directory when missing, implies -d", func(string) error {
+		opts.TargetDir, opts.Mkdir = true, true
+		return nil
+	})
+	flags.BoolVar(&opts.Parents, "parents", false, "Create missing directories leading to the target, like mkdir -p")
+	flags.BoolVar(&opts.Preserve, "p", false, "Preserve modification and access times and mode from original file")
+	flags.BoolVar(&opts.Owner, "o", false, "Preserve file ownership, the peer must be rscp and the sink privileged")
+	flags.Var(&funcFlag{set: func(text string) (err error) {
+		opts.Chown, err = rscp.ParseOwnership(text)
+		return err
+	}}, "owner", "Give all that is received the owner `user:group`, either by name or id and either left out to keep it, the sink must be privileged")
+	flags.BoolVar(&opts.NumericIDs, "numeric-ids", false, "Give received files the user and group ids -o sends instead of going by their names")
+	flags.IntVar(&opts.UidOffset, "uid-offset", 0, "Add `n` to the user ids -o gives received files, as for a user namespace")
+	flags.IntVar(&opts.GidOffset, "gid-offset", 0, "Add `n` to the group ids -o gives received files")
+	flags.BoolVar(&opts.Xattrs, "xattrs", false, "Preserve user.* extended attributes, the peer must be rscp")
+	flags.BoolVar(&opts.SecurityXattrs, "xattrs-security", false, "Preserve security.* extended attributes too, the sink must be privileged")
+	flags.BoolVar(&opts.ACLs, "acls", false, "Preserve POSIX ACLs along with -p, the peer must be rscp")
+	flags.BoolVar(&opts.Links, "links", false, "Copy symlinks as symlinks instead of following them, the peer must be rscp")
+	flags.BoolFunc("no-dereference", "Skip symlinks when sending instead of following them, telling which, or with --links copy them as such", func(string) error {
+		opts.NoDereference, opts.Hooks.OnFileDone = true, printSkipped
+		return nil
+	})
+	flags.BoolFunc("H", "Follow symlinks given as files to send but, as with --no-dereference, none found in directories", func(string) error {
+		opts.DereferenceArgs, opts.NoDereference, opts.Hooks.OnFileDone = true, true, printSkipped
+		return nil
+	})
+	flags.BoolVar(&opts.Hardlinks, "hardlinks", false, "Recreate hard links instead of copying their data again, the peer must be rscp")
+	flags.BoolVar(&opts.Sparse, "sparse", false, "Send only the data of files with holes and recreate the holes, the peer must be rscp")
+	flags.BoolVar(&opts.NanoTimes, "nsec", false, "Preserve times to the nanosecond along with -p, the peer must be rscp")
+	flags.BoolVar(&opts.Checksum, "checksum", false, "Verify each file against a SHA-256 digest, the peer must be rscp")
+	flags.BoolVar(&opts.DeleteCorrupt, "delete-corrupt", false, "Remove received files failing --checksum")
+	flags.BoolVar(&opts.Compress, "compress", false, "Compress the transfer, the peer must be rscp")
+	flags.IntVar(&opts.Streams, "streams", 0, "Send up to `n` files at once over the one connection, the peer must be rscp; one at a time with --hardlinks or --transactional")
+	flags.DurationVar(&opts.Keepalive, "keepalive", 0, "Send heartbeats after `interval` without traffic and give up on a silent peer, the peer must be rscp")
+	flags.DurationVar(&opts.IdleTimeout, "idle-timeout", 0, "Give up on a peer sending nothing for `duration` while waited on")
+	flags.DurationVar(&opts.Timeout, "timeout", 0, "Give up on transfers taking longer than `duration`, removing the file underway and exiting with 124")
+	flags.BoolVar(&opts.Resume, "resume", false, "Send only what partial files at the sink lack, the peer must be rscp")
+	flags.BoolFunc("summary", "Compare what both sides made of the transfer and print it, the peer must be rscp", func(string) error {
+		opts.Summary, opts.OnSummary = true, printSummary
+		return nil
+	})
+	flags.BoolVar(&opts.EscapeNames, "escape-names", false, "Send names with newlines and other control characters escaped, the peer must be rscp")
+	flags.BoolVar(&opts.NulFraming, "nul-framing", false, "End protocol lines with NUL so names may hold newlines, the peer must be rscp")
+	flags.BoolVar(&opts.Totals, "totals", false, "Count files and bytes before sending and announce them to an rscp peer")
+	flags.BoolVar(&opts.Specials, "specials", false, "Copy FIFOs, sockets and device nodes, the peer must be rscp and privileged for devices")
+	flags.BoolVar(&opts.FileFlags, "fflags", false, "Preserve file flags like uchg and nodump along with -p where supported, the peer must be rscp")
+	flags.Var(&funcFlag{set: func(text string) (err error) {
+		opts.SealTo, err = rscp.ParseSealKey(text)
+		return err
+	}}, "seal-to", "Encrypt file data for the holder of the private half of `key`, given in hex, the peer must be rscp")
+	flags.Var(&funcFlag{set: func(file string) (err error) {
+		opts.OpenWith, err = rscp.ReadOpenKey(file)
+		return err
+	}}, "open-with", "Decrypt sealed file data with the private key in `file`, see rscp keygen")
+	flags.Var(&funcFlag{set: func(dir string) error {
+		opts.Tee = append(opts.Tee, dir)
+		return nil
+	}}, "tee", "Write what is received to `directory` as well, may be given several times")
+	flags.BoolVar(&opts.InPlace, "inplace", false, "Write into existing files in place, keeping their hard links, instead of replacing them once complete")
+	flags.BoolVar(&opts.Preallocate, "preallocate", false, "Reserve the space of received files first, failing them early when there is none")
+	flags.StringVar(&opts.TempDir, "temp-dir", "", "Receive files into `directory` first, moving them into place once complete")
+	flags.BoolVar(&opts.UseUmask, "use-umask", false, "Give files and directories created without -p the modes sent less the umask, as OpenSSH scp does")
+	flags.Var(&funcFlag{set: func(text string) (err error) {
+		opts.Umask, err = rscp.ParseMask(text)
+		return err
+	}}, "umask", "Clear the mode bits of octal `mask` from the modes of all that is received, with -p too")
+	flags.BoolVar(&opts.NoSpecialBits, "no-special-bits", false, "Clear setuid and setgid bits from received modes, sticky bits too with --umask 1000")
+	flags.Var(&funcFlag{set: func(text string) (err error) {
+		if opts.OnConflict, err = rscp.ParseConflict(text); opts.OnConflict == rscp.ConflictSkip {
+			opts.Hooks.OnFileDone = printSkipped
+		}
+		return err
+	}}, "on-conflict", "What to do with what the target already has: overwrite it, skip it telling which files, error or backup as name~ first")
+	noClobber := func(string) error {
+		opts.OnConflict, opts.Hooks.OnFileDone = rscp.ConflictSkip, printSkipped
+		return nil
+	}
+	flags.BoolFunc("n", "Leave what the target already has alone instead of overwriting it, telling which files, same as --on-conflict=skip", noClobber)
+	flags.BoolFunc("no-clobber", "Same as -n", noClobber)
+	flags.BoolFunc("windows-safe", "Fail files coming under names Windows cannot take, like CON, a:b or ones differing only in case, as on Windows", func(string) error {
+		if opts.WindowsNames == rscp.WinNamesAllow {
+			opts.WindowsNames = rscp.WinNamesError
+		}
+		return nil
+	})
+	flags.BoolFunc("windows-rename", "Receive files coming under names Windows cannot take under names it can, a:b as a%3Ab and a second A as A~2", func(string) error {
+		opts.WindowsNames = rscp.WinNamesRename
+		return nil
+	})
+	flags.Var(&funcFlag{set: func(text string) (err error) {
+		opts.Normalize, err = rscp.ParseNorm(text)
+		return err
+	}}, "normalize", "Put received names into Unicode `form` nfc, as most systems write them, or nfd, as macOS does")
+	flags.BoolVar(&opts.Update, "u", false, "Skip files the target has that are no older than those sent, going by the times sent along")
+	flags.BoolVar(&opts.Delete, "delete", false, "Delete what directories received recursively hold besides what is sent, once all went well")
+	flags.IntVar(&opts.MaxDelete, "max-delete", 0, "Delete no more than `n` files with --delete, failing for the rest")
+	flags.BoolVar(&opts.Transactional, "transactional", false, "Receive each directory into a staging directory and move it into place only if all in it came")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Receive and check all as usual but write nothing, dropping the data")
+	flags.BoolVar(&opts.CheckSpace, "check-space", false, "Fail files the target lacks free space for before receiving them, and with --totals the whole transfer up front")
+	flags.Int64Var(&opts.MaxTotalBytes, "max-total-bytes", 0, "Abort receiving rather than take files adding up to more than `bytes`")
+	flags.Int64Var(&opts.MaxFileSize, "max-file-size", 0, "Refuse receiving files of more than `bytes`, going on with the rest")
+	flags.BoolVar(&opts.Strict, "strict", false, "Refuse malformed or out of place messages when receiving")
+	flags.BoolVar(&opts.Lenient, "lenient", false, "Accept CRLF line ends, extra acks and trailing blanks from other scp implementations")
+	flags.IntVar(&opts.MaxLineLen, "max-line", rscp.DefaultMaxLineLen, "Give up on a peer sending protocol lines longer than `bytes`")
+	flags.Var(&funcFlag{set: func(name string) error {
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		opts.Record = rscp.NewRecorder(f)
+		return nil
+	}}, "record", "Capture all that goes over the transfer channel into `file` for rscp replay")
+	flags.BoolVar(&sandboxed, "sandbox", false, "Run with writes confined to the target and tees by Landlock, Linux only")
+	addUserFlags(flags)
+}
+
+/* addUserFlags adds the flags of runAs */
+func addUserFlags(flags *flag.FlagSet) {
+	flags.StringVar(&runAs.user, "user", "", "Run as `user` and its groups once started, reading the files other flags name as that user too")
+	flags.StringVar(&runAs.group, "group", "", "Run as `group` once started, instead of the groups of -user")
+	flags.BoolVar(&runAs.keepChown, "keep-chown", false, "Keep the privilege to give files any owner for -o and --owner when dropping to -user, Linux only")
+}
+
+/* funcFlag is a flag.Func keeping the values it was given, for
+   remoteFlags to pass on */
+type funcFlag struct {
+	set    func(string) error
+	values []string
+}
+
+func (f *funcFlag) String() string {
+	if f == nil || len(f.values) == 0 {
+		return ""
+	}
+	return f.values[len(f.values)-1]
+}
+
+func (f *funcFlag) Set(text string) error {
+	if err := f.set(text); err != nil {
+		return err
+	}
+	f.values = append(f.values, text)
+	return nil
+}
+
+/* parse subcommand flags, false when the argument count is off */
+func parseCmd(name, synopsis string, args []string, argc func(int) bool, opts *rscp.Options) (*flag.FlagSet, bool) {
+	flags := flag.NewFlagSet("rscp "+name, flag.ExitOnError)
+	if opts != nil {
+		addTransferFlags(flags, opts)
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: rscp %s %s\n", name, synopsis)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if !argc(flags.NArg()) {
+		flags.Usage()
+		return flags, false
+	}
+	return flags, true
+}
+
+func printSkipped(name string, err error) {
+	if errors.Is(err, rscp.ErrNotOverwritten) || errors.Is(err, rscp.ErrLinkSkipped) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func printSummary(own, peer rscp.Tally) {
+	fmt.Fprintf(os.Stderr, "%v; peer: %v\n", own, peer)
+}
+
+const ExitTimeout = 124 /* for --timeout, as timeout(1) exits */
+
+func exitCode(err error) int {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, rscp.ErrDeadline) {
+			return ExitTimeout
+		}
+		return 1
+	}
+	return 0
+}
+
+/* rscp to: receive into a directory, same as -t */
+func cmdTo(args []string) int {
+	var opts rscp.Options
+	flags, ok := parseCmd("to", "[-noprud] [-l limit] directory", args,
+		func(n int) bool { return n == 1 }, &opts)
+	if !ok {
+		return 1
+	}
+	if err := enterSandbox(flags, append(opts.Tee, flags.Arg(0))...); err != nil {
+		return exitCode(err)
+	}
+	return exitCode(rscp.SinkContext(rscp.Interruptible(), opts, flags.Arg(0)))
+}
+
+/* rscp from: send files, same as -f */
+func cmdFrom(args []string) int {
+	var opts rscp.Options
+	flags, ok := parseCmd("from", "[-opr] [-l limit] file1 ...", args,
+		func(n int) bool { return n > 0 }, &opts)
+	if !ok {
+		return 1
+	}
+	if err := enterSandbox(flags); err != nil {
+		return exitCode(err)
+	}
+	opts.RscpPeer = true
+	return exitCode(rscp.SourceContext(rscp.Interruptible(), opts, flags.Args()))
+}
+
+/* rscp copy: local copy through the file system, or with -loopback
+   through a source and a sink joined by pipes */
+func cmdCopy(args []string) int {
+	var opts rscp.Options
+	var viaProtocol bool
+
+	flags := flag.NewFlagSet("rscp copy", flag.ExitOnError)
+	flags.BoolVar(&viaProtocol, "loopback", false, "Copy through a source and a sink running the full protocol")
+	addTransferFlags(flags, &opts)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: rscp copy [-noprud] [-l limit] [-loopback] file1 ... target\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return 1
+	}
+	srcs := flags.Args()[:flags.NArg()-1]
+	target := flags.Arg(flags.NArg() - 1)
+	if len(srcs) > 1 {
+		opts.TargetDir = true
+	}
+	if err := enterSandbox(flags, append(opts.Tee, target)...); err != nil {
+		return exitCode(err)
+	}
+	if viaProtocol {
+		return exitCode(rscp.Loopback(rscp.Interruptible(), opts, srcs, target))
+	}
+	return exitCode(rscp.Copy(rscp.Interruptible(), opts, srcs, target))
+}
+
+/* rscp replay: run a source or sink against what the peer sent in a
+   capture, failing where it does not do as recorded */
+func cmdReplay(args []string) int {
+	var opts rscp.Options
+	var iamSource, iamSink bool
+
+	flags := flag.NewFlagSet("rscp replay", flag.ExitOnError)
+	flags.BoolVar(&iamSource, "f", false, "Replay a source")
+	flags.BoolVar(&iamSink, "t", false, "Replay a sink")
+	addTransferFlags(flags, &opts)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: rscp replay -f|-t [flags] capture file1 ...|target\n"+
+			"Give the flags and arguments of the recorded run.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if iamSource == iamSink || flags.NArg() < 2 || iamSink && flags.NArg() != 2 {
+		flags.Usage()
+		return 1
+	}
+
+	var writable []string
+	if iamSink {
+		writable = append(opts.Tee, flags.Arg(1))
+	}
+	if err := enterSandbox(flags, writable...); err != nil {
+		return exitCode(err)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return exitCode(err)
+	}
+	opts.In, opts.Out, err = rscp.Replay(f)
+	f.Close()
+	if err != nil {
+		return exitCode(err)
+	}
+	opts.Record = nil
+	opts.RscpPeer = true /* as the capture has it */
+	if iamSource {
+		return exitCode(rscp.Source(opts, flags.Args()[1:]))
+	}
+	return exitCode(rscp.Sink(opts, flags.Arg(1)))
+}
+
+/* rscp keygen: make a key for sealed transfers, the private half going
+   into a file for --open-with and the public one to stdout for --seal-to */
+func cmdKeygen(args []string) int {
+	flags, ok := parseCmd("keygen", "file", args, func(n int) bool { return n == 1 }, nil)
+	if !ok {
+		return 1
+	}
+	private, public, err := rscp.KeyGen()
+	if err != nil {
+		return exitCode(err)
+	}
+	f, err := os.OpenFile(flags.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return exitCode(err) /* never overwriting a key */
+	}
+	_, err = fmt.Fprintln(f, private)
+	if err := f.Close(); err != nil {
+		return exitCode(err)
+	}
+	if err != nil {
+		return exitCode(err)
+	}
+	fmt.Println(public)
+	return 0
+}
+
+/* rscp serve: accept raw TCP connections each carrying one request line */
+func cmdServe(args []string) int {
+	var opts rscp.Options
+	var listen, root string
+	var tlsCert, tlsKey, tlsClientCA string
+	var inetd, overQUIC bool
+	var secret []byte
+	var totalLimit uint
+
+	flags := flag.NewFlagSet("rscp serve", flag.ExitOnError)
+	flags.StringVar(&listen, "listen", ":"+DefaultServePort, "Address to listen on")
+	flags.StringVar(&root, "root", ".", "Directory requests are confined to")
+	flags.BoolVar(&inetd, "inetd", false, "Serve the one connection on stdin and stdout as started by inetd")
+	flags.BoolVar(&overQUIC, "quic", false, "Listen on UDP for QUIC connections instead of TCP, experimental, with -tls-cert required")
+	flags.UintVar(&opts.BwLimit, "l", 0, "Limit the bandwidth of each connection, specified in Kbit/s")
+	flags.UintVar(&totalLimit, "total-limit", 0, "Limit the bandwidth of all connections together, specified in Kbit/s")
+	flags.BoolVar(&opts.Strict, "strict", false, "Refuse malformed or out of place messages from clients")
+	flags.BoolVar(&opts.NoSpecialBits, "no-special-bits", false, "Clear setuid and setgid bits from the modes clients send")
+	flags.DurationVar(&opts.IdleTimeout, "idle-timeout", 0, "Drop clients sending nothing for `duration` while waited on")
+	flags.DurationVar(&opts.Timeout, "timeout", 0, "Drop clients whose transfers take longer than `duration`")
+	flags.Func("owner", "Give all clients send the owner `user:group`, either by name or id and either left out to keep it", func(text string) (err error) {
+		opts.Chown, err = rscp.ParseOwnership(text)
+		return err
+	})
+	flags.IntVar(&opts.UidOffset, "uid-offset", 0, "Add `n` to the user ids clients give files with -o, as for a user namespace")
+	flags.IntVar(&opts.GidOffset, "gid-offset", 0, "Add `n` to the group ids clients give files with -o")
+	flags.BoolVar(&sandboxed, "sandbox", false, "Serve with writes confined to -root by Landlock, Linux only")
+	addUserFlags(flags)
+	flags.IntVar(&opts.MaxLineLen, "max-line", rscp.DefaultMaxLineLen, "Drop clients sending protocol lines longer than `bytes`")
+	flags.Int64Var(&opts.MaxTotalBytes, "max-total-bytes", 0, "Abort receiving from a client rather than take files adding up to more than `bytes`")
+	flags.Int64Var(&opts.MaxFileSize, "max-file-size", 0, "Refuse receiving files of more than `bytes` from clients")
+	flags.Func("umask", "Clear the mode bits of octal `mask` from the modes of all clients send, whatever mask they ask for", func(text string) (err error) {
+		opts.Umask, err = rscp.ParseMask(text)
+		return err
+	})
+	flags.StringVar(&tlsCert, "tls-cert", "", "Speak TLS showing clients the certificate in `file`")
+	flags.StringVar(&tlsKey, "tls-key", "", "Private key of -tls-cert in `file`")
+	flags.StringVar(&tlsClientCA, "tls-client-ca", "", "Require client certificates signed by the CA certificates in `file`")
+	flags.Func("open-with", "Decrypt file data clients seal with the private key in `file`", func(file string) (err error) {
+		opts.OpenWith, err = rscp.ReadOpenKey(file)
+		return err
+	})
+	flags.Func("secret-file", "Require clients to prove they know the secret in `file`", func(file string) (err error) {
+		secret, err = readSecret(file)
+		return err
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: rscp serve [-listen addr] [-root dir] [-l limit] [-total-limit limit] [-tls-cert file -tls-key file [-quic]]\n"+
+			"Each connection sends one line \"to [-noprud] dir\" or \"from [-opr] file1 ...\"\n"+
+			"with arguments quoted as for a POSIX shell, then speaks the scp protocol.\n"+
+			"Started by systemd with a socket, that is listened on or served if connected.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 1
+	}
+
+	if tlsClientCA != "" && tlsCert == "" || overQUIC && (tlsCert == "" || inetd) {
+		flags.Usage()
+		return 1
+	}
+
+	if (runAs.user != "" || runAs.group != "") && !inetd && os.Getenv("LISTEN_FDS") == "" {
+		if err := listenFirst(listen, overQUIC); err != nil { /* while privileged still */
+			return exitCode(err)
+		}
+	}
+	if err := enterSandbox(flags, root); err != nil {
+		return exitCode(err)
+	}
+	rscp.Interruptible() /* served sinks go on regardless, but their partial files are removed */
+
+	var config *tls.Config
+	if tlsCert != "" {
+		var err error
+		if config, err = serverTLS(tlsCert, tlsKey, tlsClientCA); err != nil {
+			return exitCode(err)
+		}
+	}
+
+	if inetd {
+		if serveOne(os.Stdin, os.Stdout, root, secret, opts, config) != nil {
+			return 1 /* not printed, stderr may be the connection too */
+		}
+		return 0
+	}
+	if overQUIC {
+		return exitCode(listenQUIC(listen, root, secret, opts, config, totalLimit))
+	}
+	var ln net.Listener
+	var err error
+	if sock := systemdSocket(); sock != nil {
+		if conn, err := net.FileConn(sock); err == nil && conn.RemoteAddr() != nil {
+			conn.Close() /* Accept=yes, passed the connection rather than a listening socket */
+			return exitCode(serveOne(sock, sock, root, secret, opts, config))
+		}
+		if ln, err = net.FileListener(sock); err != nil {
+			return exitCode(err)
+		}
+	} else if ln, err = net.Listen("tcp", listen); err != nil {
+		return exitCode(err)
+	}
+	if totalLimit > 0 {
+		ln = rscp.CapListener(ln, rscp.NewBwStats(totalLimit*1024))
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+	return exitCode(serve(ln, root, secret, opts))
+}
+
+func serve(ln net.Listener, root string, secret []byte, opts rscp.Options) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := serveConn(conn, root, secret, opts); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func serveConn(conn io.ReadWriter, root string, secret []byte, opts rscp.Options) error {
+	if secret != nil {
+		if err := serverAuth(conn, secret); err != nil {
+			return err
+		}
+	}
+	line, err := protocol.NewDecoder(conn).ReadLimited(MaxRequestLen)
+	if err != nil {
+		return err
+	}
+	args, err := shellSplit(line)
+	if err != nil || len(args) == 0 {
+		return protocol.NewEncoder(conn).Encode(protocol.ErrMsg{Fatal: true, Msg: "malformed request"})
+	}
+
+	var cmd string
+	cmd, args = args[0], args[1:]
+	if cmd != "to" && cmd != "from" {
+		return protocol.NewEncoder(conn).Encode(protocol.ErrMsg{Fatal: true, Msg: "unknown request " + rscp.Sanitize(cmd)})
+	}
+
+	flags := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.BoolVar(&opts.Recursive, "r", false, "")
+	flags.BoolVar(&opts.TargetDir, "d", false, "")
+	flags.BoolFunc("mkdir", "", func(string) error {
+		opts.TargetDir, opts.Mkdir = true, true
+		return nil
+	})
+	flags.BoolVar(&opts.Parents, "parents", false, "")
+	flags.BoolVar(&opts.Preserve, "p", false, "")
+	flags.BoolVar(&opts.Owner, "o", false, "")
+	flags.BoolVar(&opts.NumericIDs, "numeric-ids", false, "")
+	flags.String("owner", "", "")  /* not for a client to give files away, -owner of serve holds */
+	flags.Int("uid-offset", 0, "") /* nor to shift them out of the range of -uid-offset */
+	flags.Int("gid-offset", 0, "")
+	flags.BoolVar(&opts.Xattrs, "xattrs", false, "")
+	flags.BoolVar(&opts.ACLs, "acls", false, "")
+	flags.BoolVar(&opts.Links, "links", false, "")
+	flags.BoolVar(&opts.NoDereference, "no-dereference", false, "")
+	flags.BoolFunc("H", "", func(string) error {
+		opts.DereferenceArgs, opts.NoDereference = true, true
+		return nil
+	})
+	flags.BoolVar(&opts.Hardlinks, "hardlinks", false, "")
+	flags.BoolVar(&opts.Sparse, "sparse", false, "")
+	flags.BoolVar(&opts.NanoTimes, "nsec", false, "")
+	flags.BoolVar(&opts.Checksum, "checksum", false, "")
+	flags.BoolVar(&opts.Compress, "compress", false, "")
+	flags.IntVar(&opts.Streams, "streams", 0, "")
+	flags.DurationVar(&opts.Keepalive, "keepalive", 0, "")
+	flags.Func("idle-timeout", "", lowerTimeout(&opts.IdleTimeout))
+	flags.Func("timeout", "", lowerTimeout(&opts.Timeout))
+	flags.BoolVar(&opts.Resume, "resume", false, "")
+	flags.BoolVar(&opts.Summary, "summary", false, "")
+	flags.BoolVar(&opts.EscapeNames, "escape-names", false, "")
+	flags.BoolVar(&opts.NulFraming, "nul-framing", false, "")
+	flags.BoolVar(&opts.Totals, "totals", false, "")
+	flags.BoolVar(&opts.Specials, "specials", false, "")
+	flags.BoolVar(&opts.FileFlags, "fflags", false, "")
+	flags.BoolVar(&opts.InPlace, "inplace", false, "")
+	flags.BoolVar(&opts.Preallocate, "preallocate", false, "")
+	flags.String("temp-dir", "", "") /* not for a client to write elsewhere than the target */
+	flags.BoolVar(&opts.UseUmask, "use-umask", false, "")
+	flags.Func("umask", "", addMask(&opts.Umask))
+	flags.BoolFunc("no-special-bits", "", func(string) error { /* =false not undoing that of serve */
+		opts.NoSpecialBits = true
+		return nil
+	})
+	flags.Func("on-conflict", "", func(text string) (err error) {
+		opts.OnConflict, err = rscp.ParseConflict(text)
+		return err
+	})
+	noClobber := func(string) error {
+		opts.OnConflict = rscp.ConflictSkip
+		return nil
+	}
+	flags.BoolFunc("n", "", noClobber)
+	flags.BoolFunc("no-clobber", "", noClobber)
+	flags.BoolVar(&opts.Update, "u", false, "")
+	flags.Func("normalize", "", func(text string) (err error) {
+		opts.Normalize, err = rscp.ParseNorm(text)
+		return err
+	})
+	flags.BoolFunc("windows-safe", "", func(string) error {
+		if opts.WindowsNames == rscp.WinNamesAllow {
+			opts.WindowsNames = rscp.WinNamesError
+		}
+		return nil
+	})
+	flags.BoolFunc("windows-rename", "", func(string) error {
+		opts.WindowsNames = rscp.WinNamesRename
+		return nil
+	})
+	flags.BoolVar(&opts.Delete, "delete", false, "")
+	flags.IntVar(&opts.MaxDelete, "max-delete", 0, "")
+	flags.BoolVar(&opts.Transactional, "transactional", false, "")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "")
+	flags.BoolVar(&opts.CheckSpace, "check-space", false, "")
+	flags.Func("max-total-bytes", "", lowerLimit(&opts.MaxTotalBytes))
+	flags.Func("max-file-size", "", lowerLimit(&opts.MaxFileSize))
+	flags.Func("seal-to", "", func(text string) (err error) {
+		opts.SealTo, err = rscp.ParseSealKey(text)
+		return err
+	})
+	flags.Func("open-with", "", func(string) error { return nil }) /* a file of the client, -open-with of serve holds */
+	flags.Bool("sandbox", false, "")                               /* the client's wishes, those of serve decide */
+	flags.String("user", "", "")
+	flags.String("group", "", "")
+	flags.Bool("keep-chown", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 || cmd == "to" && flags.NArg() != 1 {
+		return protocol.NewEncoder(conn).Encode(protocol.ErrMsg{Fatal: true, Msg: "malformed request"})
+	}
+
+	dir, err := openRoot(root)
+	if err != nil {
+		return protocol.NewEncoder(conn).Encode(protocol.ErrMsg{Fatal: true, Msg: rscp.Sanitize(err.Error())})
+	}
+	defer dir.Close()
+	opts.FS = rscp.ConfineFS(dir) /* symlinks leading out of root fail */
+
+	var paths []string
+	for _, p := range flags.Args() {
+		name := path.Clean("/" + p)
+		if cmd == "to" {
+			paths = append(paths, path.Join(filepath.ToSlash(dir.Name()), name))
+			continue
+		}
+		for _, m := range glob(dir, name) {
+			paths = append(paths, path.Join(filepath.ToSlash(dir.Name()), m))
+		}
+	}
+	opts.In, opts.Out = conn, conn
+	opts.RscpPeer = true
+
+	if cmd == "to" {
+		return rscp.Sink(opts, paths[0])
+	}
+	return rscp.Source(opts, paths)
+}
+
+/* glob is what pattern matches in root, as a shell would expand it for
+   scp -f, or pattern itself when nothing does */
+func glob(root *os.Root, pattern string) []string {
+	if pattern == "/" {
+		return []string{pattern}
+	}
+	matches, err := fs.Glob(root.FS(), pattern[1:])
+	if err != nil || len(matches) == 0 {
+		return []string{pattern}
+	}
+	return matches
+}
+
+/* openRoot opens root for serving, by its absolute name for the
+   directory to be sent under a name of its own */
+func openRoot(root string) (*os.Root, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenRoot(abs)
+}
+
+/* lowerLimit sets the limit of serve at limit to one a client asks
+   for, only lowering it */
+func lowerLimit(limit *int64) func(string) error {
+	return func(text string) error {
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err == nil && n > 0 && (*limit == 0 || n < *limit) {
+			*limit = n
+		}
+		return err
+	}
+}
+
+/* lowerTimeout is lowerLimit for durations */
+func lowerTimeout(limit *time.Duration) func(string) error {
+	return func(text string) error {
+		d, err := time.ParseDuration(text)
+		if err == nil && d > 0 && (*limit == 0 || d < *limit) {
+			*limit = d
+		}
+		return err
+	}
+}
+
+/* addMask has a client add to the mask of serve, never taking from it */
+func addMask(mask *os.FileMode) func(string) error {
+	return func(text string) error {
+		m, err := rscp.ParseMask(text)
+		*mask |= m
+		return err
+	}
+}
+
+/* shellSplit splits a line into words honoring POSIX shell quotes and backslashes */
+func shellSplit(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i++; i == len(line) {
+				return nil, errors.New("trailing backslash")
+			}
+			word.WriteByte(line[i])
+			inWord = true
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, errors.New("unterminated quote")
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+/* shellQuote quotes s to survive shellSplit and POSIX shells as a single word */
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: rscp [-noprud] [-l limit] [-S program] [-P port] [-J jumphosts] [[user@]host:]file1 ... [[user@]host:]target\n"+
+		"            remote files may also be scp://, rscp://, rscps:// or rscp+quic:// URLs\n"+
+		"       rscp -f [-opr] [-l limit] file1 ...\n"+
+		"       rscp -t [-noprud] [-l limit] directory\n"+
+		"       rscp from [-opr] [-l limit] file1 ...\n"+
+		"       rscp to [-noprud] [-l limit] directory\n"+
+		"       rscp copy [-noprud] [-l limit] [-loopback] file1 ... target\n"+
+		"       rscp serve [-listen addr] [-root dir] [-l limit]\n"+
+		"       rscp replay -f|-t [flags] capture file1 ...|target\n"+
+		"       rscp keygen file\n"+
+		"       rscp --capabilities\n")
+	flags.PrintDefaults()
+	os.Exit(1)
+}
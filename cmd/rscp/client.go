@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sftpplease/rscp"
+)
+
+/* clientOpts say how the client reaches the other end of a transfer */
+type clientOpts struct {
+	ssh    string   /* ssh program */
+	port   string   /* of the remote host, that of ssh when empty */
+	jump   string   /* jump hosts to go through, as for ssh -J */
+	key    string   /* identity file to log in with, as for ssh -i */
+	remote string   /* command starting scp at the remote end, left to its shell */
+	flags  []string /* transfer flags passed on to it */
+
+	/* keep connections open that long after use for the transfers to
+	   come to go over, an ssh ControlMaster of its own */
+	reuse time.Duration
+
+	/* CA certificates verifying rscps and rscp+quic servers, the system
+	   ones when empty, and the certificate to show them if any */
+	tlsCA, tlsCert, tlsKey string
+
+	secret []byte /* shared with rscp serve */
+
+	sftp bool /* reach remote hosts through their SFTP subsystem */
+
+	native       bool   /* over an SSH client of our own rather than the ssh program */
+	hostKeyCheck string /* of the native client, as ssh_config says when empty */
+
+	anyNames bool /* take what remote sources send under any name */
+}
+
+/* remoteArg is a [user@]host:path argument or a URL, the scheme empty
+   for ssh and rscp, rscps or rscp+quic to connect to rscp serve */
+type remoteArg struct {
+	scheme, user, host, port, path string
+}
+
+/* parseRemote tells a [user@]host:path argument or scp:// URL from a local
+   name, a colon after a slash or at the start belongs to a local name as
+   for scp, and so does that of a drive letter on Windows. IPv6 addresses
+   go in brackets, user@[::1]:path. */
+func parseRemote(arg string) (remoteArg, bool) {
+	for _, scheme := range []string{"scp", "rscp", "rscps", "rscp+quic"} {
+		if strings.HasPrefix(arg, scheme+"://") {
+			return parseURL(arg)
+		}
+	}
+	colon := strings.IndexByte(arg, ':')
+	if colon <= 0 || strings.IndexByte(arg[:colon], '/') >= 0 || filepath.VolumeName(arg) != "" {
+		return remoteArg{}, false
+	}
+	var r remoteArg
+	if bracket := strings.IndexByte(arg, '['); bracket >= 0 && bracket < colon &&
+		(bracket == 0 || arg[bracket-1] == '@') {
+		/* [address]:path, the address holding colons itself */
+		end := strings.IndexByte(arg, ']')
+		if end < bracket || end+1 == len(arg) || arg[end+1] != ':' {
+			return remoteArg{}, false
+		}
+		r.host, r.path = arg[bracket+1:end], arg[end+2:]
+		if bracket > 0 {
+			r.user = arg[:bracket-1]
+		}
+	} else {
+		r.host, r.path = arg[:colon], arg[colon+1:]
+		if at := strings.LastIndexByte(r.host, '@'); at >= 0 {
+			r.user, r.host = r.host[:at], r.host[at+1:]
+		}
+	}
+	if r.path == "" {
+		r.path = "." /* the login directory */
+	}
+	return r, r.host != ""
+}
+
+/* parseURL takes scp://[user@]host[:port][/path] with percent escapes,
+   the path being relative to the login directory unless it starts with
+   a second slash; rscp://, rscps:// and rscp+quic:// alike with no
+   user, the path being relative to the root of the server */
+func parseURL(arg string) (remoteArg, bool) {
+	u, err := url.Parse(arg)
+	if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return remoteArg{}, false
+	}
+	r := remoteArg{host: u.Hostname(), port: u.Port(), path: strings.TrimPrefix(u.Path, "/")}
+	if u.Scheme != "scp" {
+		r.scheme = u.Scheme
+		if u.User != nil {
+			return remoteArg{}, false
+		}
+	}
+	if u.User != nil {
+		r.user = u.User.Username()
+		if semi := strings.IndexByte(r.user, ';'); semi >= 0 {
+			r.user = r.user[:semi] /* connection parameters, none taken */
+		}
+	}
+	if r.path == "" {
+		r.path = "."
+	}
+	return r, r.host != ""
+}
+
+/* remoteFlags are the transfer flags set on the command line the remote
+   end needs to know of too, bandwidth and capture are applied locally */
+func remoteFlags(flags *flag.FlagSet) []string {
+	local := map[string]bool{
+		"f": true, "t": true, "S": true, "P": true, "J": true, "i": true, "reuse": true, "remote-scp": true, "sftp": true, "native-ssh": true, "host-key-check": true,
+		"tls-ca": true, "tls-cert": true, "tls-key": true, "secret-file": true,
+		"capabilities": true, "l": true, "record": true, "T": true,
+	}
+	var args []string
+	flags.Visit(func(f *flag.Flag) {
+		if local[f.Name] {
+			return
+		}
+		dash := "--"
+		if len(f.Name) == 1 {
+			dash = "-"
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			args = append(args, dash+f.Name)
+		} else if ff, ok := f.Value.(*funcFlag); ok {
+			for _, v := range ff.values {
+				args = append(args, dash+f.Name, v)
+			}
+		} else {
+			args = append(args, dash+f.Name, f.Value.String())
+		}
+	})
+	return args
+}
+
+/* command runs the remote end of a transfer through ssh, mode being -f
+   or -t; the transfer channel is its stdin and stdout */
+func (c clientOpts) command(ctx context.Context, r remoteArg, mode string, paths []string) *exec.Cmd {
+	args := append(c.sshArgs(r), "--", r.host, c.remoteCommand(mode, paths))
+	cmd := exec.CommandContext(ctx, c.ssh, args...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+/* remoteCommand is the command line of the remote end for its shell.
+   Paths to send go to the remote shell as they are, as with OpenSSH
+   scp, for it to expand patterns in them; Requested checks what comes
+   of them. */
+func (c clientOpts) remoteCommand(mode string, paths []string) string {
+	words := []string{c.remote, mode}
+	for _, w := range c.flags {
+		words = append(words, shellQuote(w))
+	}
+	words = append(words, "--")
+	for _, p := range paths {
+		if mode == "-t" {
+			p = shellQuote(p)
+		}
+		words = append(words, p)
+	}
+	return strings.Join(words, " ")
+}
+
+/* sshArgs are the options of ssh connecting to r */
+func (c clientOpts) sshArgs(r remoteArg) []string {
+	args := []string{"-x", "-oForwardAgent=no", "-oPermitLocalCommand=no", "-oClearAllForwardings=yes"}
+	if r.port != "" {
+		args = append(args, "-p", r.port)
+	} else if c.port != "" {
+		args = append(args, "-p", c.port)
+	}
+	if c.reuse > 0 {
+		persist := int64((c.reuse + time.Second - 1) / time.Second)
+		args = append(args, "-oControlMaster=auto", "-oControlPath=~/.ssh/rscp-%C",
+			fmt.Sprintf("-oControlPersist=%d", persist))
+	}
+	if c.key != "" {
+		args = append(args, "-i", c.key)
+	}
+	if c.jump != "" {
+		args = append(args, "-J", c.jump)
+	}
+	if r.user != "" {
+		args = append(args, "-l", r.user)
+	}
+	return args
+}
+
+/* remoteEnd is the transfer channel to the remote end of a transfer */
+type remoteEnd struct {
+	in  io.Reader
+	out io.WriteCloser /* closing it ends what is sent */
+
+	/* waits for the remote end to be over, failed when the transfer
+	   failed and it may be stuck */
+	wait func(failed bool) error
+}
+
+/* relayEnd is e as a relay takes it */
+func (e *remoteEnd) relayEnd() rscp.RelayEnd {
+	return rscp.RelayEnd{In: e.in, Out: e.out, Wait: func() error { return e.wait(false) }}
+}
+
+/* rscpPeer tells whether the remote end at r is rscp, as serve is and
+   what runs through ssh is unless --remote-scp names some other scp */
+func (c clientOpts) rscpPeer(r remoteArg) bool {
+	if r.scheme != "" {
+		return true
+	}
+	for _, w := range strings.Fields(c.remote) {
+		if path.Base(w) == "rscp" {
+			return true
+		}
+	}
+	return false
+}
+
+/* start starts the remote end of a transfer at r, mode being -f or -t */
+func (c clientOpts) start(ctx context.Context, r remoteArg, mode string, paths []string) (*remoteEnd, error) {
+	if r.scheme != "" {
+		return c.dial(ctx, r, mode, paths)
+	}
+	if c.native {
+		return c.nativeStart(ctx, r, c.remoteCommand(mode, paths), "")
+	}
+	return startCmd(c.command(ctx, r, mode, paths), r.host)
+}
+
+/* startCmd starts cmd reaching host, its stdin and stdout becoming the
+   channel to the remote end */
+func startCmd(cmd *exec.Cmd, host string) (*remoteEnd, error) {
+	in, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, rscp.FatalError{Err: err}
+	}
+	out, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, rscp.FatalError{Err: err}
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, rscp.FatalError{Err: err}
+	}
+	return &remoteEnd{in, out, func(failed bool) error {
+		if failed {
+			cmd.Process.Kill() /* it may be stuck writing what is no longer read */
+			io.Copy(io.Discard, in)
+		}
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("%s: %w", host, err)
+		}
+		return nil
+	}}, nil
+}
+
+/* dial connects to rscp serve at r, with TLS for rscps, over QUIC for
+   rscp+quic, and sends the request line for mode; serve expands the
+   patterns in paths itself */
+func (c clientOpts) dial(ctx context.Context, r remoteArg, mode string, paths []string) (*remoteEnd, error) {
+	port := r.port
+	if port == "" {
+		port = DefaultServePort
+	}
+	addr := net.JoinHostPort(r.host, port)
+
+	var conn net.Conn
+	var err error
+	if r.scheme == "rscps" || r.scheme == "rscp+quic" {
+		var config *tls.Config
+		if config, err = clientTLS(c.tlsCA, c.tlsCert, c.tlsKey); err != nil {
+			return nil, rscp.FatalError{Err: err}
+		}
+		if r.scheme == "rscp+quic" {
+			conn, err = dialQUIC(ctx, addr, config)
+		} else {
+			conn, err = (&tls.Dialer{Config: config}).DialContext(ctx, "tcp", addr)
+		}
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, rscp.FatalError{Err: err}
+	}
+
+	if c.secret != nil {
+		if err := clientAuth(conn, c.secret); err != nil {
+			conn.Close()
+			return nil, rscp.FatalError{Err: err}
+		}
+	}
+
+	words := []string{"from"}
+	if mode == "-t" {
+		words[0] = "to"
+	}
+	for _, w := range c.flags {
+		words = append(words, shellQuote(w))
+	}
+	words = append(words, "--")
+	for _, p := range paths {
+		words = append(words, shellQuote(p))
+	}
+	if _, err := io.WriteString(conn, strings.Join(words, " ")+"\n"); err != nil {
+		conn.Close()
+		return nil, rscp.FatalError{Err: err}
+	}
+	return &remoteEnd{conn, halfCloser{conn}, func(bool) error {
+		conn.Close()
+		return nil
+	}}, nil
+}
+
+/* halfCloser closes only the sending half of a connection */
+type halfCloser struct {
+	net.Conn
+}
+
+func (c halfCloser) Close() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+/* isFatal tells whether err ended the transfer rather than failing some files */
+func isFatal(err error) bool {
+	return errors.As(err, &rscp.FatalError{})
+}
+
+/* runRemote runs transfer over the transfer channel of end, once it is
+   over the remote end is waited for and its failure reported unless the
+   transfer failed itself */
+func runRemote(end *remoteEnd, opts rscp.Options, transfer func(rscp.Options) error) error {
+	opts.In, opts.Out = end.in, end.out
+	err := transfer(opts)
+	end.out.Close()
+	if werr := end.wait(isFatal(err)); err == nil && werr != nil {
+		err = rscp.FatalError{Err: werr}
+	}
+	return err
+}
+
+/* runClient copies the sources in args to the target last in args, any of
+   which may be on a remote host reached with ssh */
+func runClient(ctx context.Context, opts rscp.Options, c clientOpts, args []string) error {
+	srcs, target := args[:len(args)-1], args[len(args)-1]
+	if len(srcs) > 1 && !opts.TargetDir {
+		opts.TargetDir = true
+		c.flags = append(c.flags, "-d")
+	}
+
+	/* one connection for the sources on each host, in the order given */
+	var local []string
+	var hosts []remoteArg
+	paths := map[remoteArg][]string{}
+	for _, src := range srcs {
+		r, ok := parseRemote(src)
+		if !ok {
+			local = append(local, src)
+			continue
+		}
+		host := remoteArg{scheme: r.scheme, user: r.user, host: r.host, port: r.port}
+		if paths[host] == nil {
+			hosts = append(hosts, host)
+		}
+		paths[host] = append(paths[host], r.path)
+	}
+
+	var errs []error
+	dst, toRemote := parseRemote(target)
+	if len(local) > 0 {
+		var err error
+		if toRemote {
+			err = c.upload(ctx, opts, local, dst)
+		} else {
+			err = rscp.Copy(ctx, opts, local, target)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, host := range hosts {
+		var err error
+		if toRemote {
+			err = c.relay(ctx, opts, host, paths[host], dst)
+		} else {
+			err = c.download(ctx, opts, host, paths[host], target)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return rscp.AccError{Errors: errs}
+	}
+	return nil
+}
+
+/* upload copies local paths to the remote target */
+func (c clientOpts) upload(ctx context.Context, opts rscp.Options, paths []string, to remoteArg) error {
+	if c.sftp {
+		return c.sftpCopy(ctx, opts, remoteArg{}, paths, to)
+	}
+	end, err := c.start(ctx, to, "-t", []string{to.path})
+	if err != nil {
+		return err
+	}
+	opts.RscpPeer = c.rscpPeer(to)
+	return runRemote(end, opts, func(opts rscp.Options) error {
+		return rscp.SourceContext(ctx, opts, paths)
+	})
+}
+
+/* download copies paths on a remote host to the local target */
+func (c clientOpts) download(ctx context.Context, opts rscp.Options, from remoteArg, paths []string, target string) error {
+	if c.sftp {
+		return c.sftpCopy(ctx, opts, from, paths, remoteArg{path: target})
+	}
+	end, err := c.start(ctx, from, "-f", paths)
+	if err != nil {
+		return err
+	}
+	if !c.anyNames {
+		opts.Requested = paths
+	}
+	return runRemote(end, opts, func(opts rscp.Options) error {
+		return rscp.SinkContext(ctx, opts, target)
+	})
+}
+
+/* relay copies paths on one remote host to another, joining the remote
+   source and sink through this host as scp -3 does */
+func (c clientOpts) relay(ctx context.Context, opts rscp.Options, from remoteArg, paths []string, to remoteArg) error {
+	if c.sftp {
+		return c.sftpCopy(ctx, opts, from, paths, to)
+	}
+	source, err := c.start(ctx, from, "-f", paths)
+	if err != nil {
+		return err
+	}
+	sink, err := c.start(ctx, to, "-t", []string{to.path})
+	if err != nil {
+		source.out.Close()
+		source.wait(true)
+		return err
+	}
+
+	return rscp.Relay(ctx, opts, source.relayEnd(), sink.relayEnd())
+}
+
+/* sftpCopy copies paths on from to to, running the source and sink here
+   on SftpFS of the hosts, an empty host being this one */
+func (c clientOpts) sftpCopy(ctx context.Context, opts rscp.Options, from remoteArg, paths []string, to remoteArg) error {
+	var ends []*remoteEnd
+	open := func(r remoteArg) (rscp.FS, error) {
+		if r.host == "" {
+			return rscp.OsFS{}, nil
+		}
+		if r.scheme != "" {
+			return nil, rscp.FatalError{Err: fmt.Errorf("%s://%s: %w", r.scheme, r.host, rscp.ErrNoSftp)}
+		}
+		var end *remoteEnd
+		var err error
+		if c.native {
+			end, err = c.nativeStart(ctx, r, "", "sftp")
+		} else {
+			end, err = startCmd(exec.CommandContext(ctx, c.ssh, append(c.sshArgs(r), "-s", "--", r.host, "sftp")...), r.host)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ends = append(ends, end)
+		fs, err := rscp.NewSftpFS(end.in, end.out)
+		if err != nil {
+			return nil, rscp.FatalError{Err: fmt.Errorf("%s: %w", r.host, err)}
+		}
+		return fs, nil
+	}
+
+	srcFS, err := open(from)
+	var dstFS rscp.FS
+	if err == nil {
+		dstFS, err = open(to)
+	}
+	if err == nil {
+		err = rscp.LoopbackFS(ctx, opts, srcFS, paths, dstFS, to.path)
+	}
+	for _, end := range ends {
+		end.out.Close()
+		if werr := end.wait(isFatal(err)); err == nil && werr != nil {
+			err = rscp.FatalError{Err: werr}
+		}
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestParseRemote(t *testing.T) {
+	windows := runtime.GOOS == "windows"
+	tests := []struct {
+		arg    string
+		remote bool
+		want   remoteArg
+	}{
+		{"host:path", true, remoteArg{host: "host", path: "path"}},
+		{"user@host:dir/file", true, remoteArg{user: "user", host: "host", path: "dir/file"}},
+		{"host:", true, remoteArg{host: "host", path: "."}},
+		{"host:a:b", true, remoteArg{host: "host", path: "a:b"}},
+		{"user@host:a@b", true, remoteArg{user: "user", host: "host", path: "a@b"}},
+		{"us@er@host:path", true, remoteArg{user: "us@er", host: "host", path: "path"}},
+
+		/* IPv6 addresses in brackets, the colons in them not ending the host */
+		{"[::1]:path", true, remoteArg{host: "::1", path: "path"}},
+		{"[::1]:", true, remoteArg{host: "::1", path: "."}},
+		{"[2001:db8::1]:dir/file", true, remoteArg{host: "2001:db8::1", path: "dir/file"}},
+		{"user@[fe80::1%eth0]:path", true, remoteArg{user: "user", host: "fe80::1%eth0", path: "path"}},
+		{"user@[::1]:2222", true, remoteArg{user: "user", host: "::1", path: "2222"}}, /* a path, ports go in URLs */
+		{"[::1]", false, remoteArg{}},
+		{"[::1]path", false, remoteArg{}},
+		{"[::1:path", false, remoteArg{}},
+		{"[]:path", false, remoteArg{}},
+
+		/* a colon after a slash or at the start is part of a local name */
+		{"file", false, remoteArg{}},
+		{":path", false, remoteArg{}},
+		{"./a:b", false, remoteArg{}},
+		{"dir/a:b", false, remoteArg{}},
+		{"/abs/a:b", false, remoteArg{}},
+		{"@:path", false, remoteArg{}},
+
+		/* drive letters are local on Windows, single letter hosts elsewhere */
+		{`C:\Users\x`, !windows, remoteArg{host: "C", path: `\Users\x`}},
+		{"c:/x", !windows, remoteArg{host: "c", path: "/x"}},
+
+		{"scp://user@[::1]:2222/path", true, remoteArg{user: "user", host: "::1", port: "2222", path: "path"}},
+		{"scp://host//abs", true, remoteArg{host: "host", path: "/abs"}},
+		{"scp://user;fingerprint=x@host/", true, remoteArg{user: "user", host: "host", path: "."}},
+		{"scp://host/a%20b", true, remoteArg{host: "host", path: "a b"}},
+		{"rscp://[fe80::1%25eth0]:2020/x", true, remoteArg{scheme: "rscp", host: "fe80::1%eth0", port: "2020", path: "x"}},
+		{"rscps://user@host/x", false, remoteArg{}},
+		{"scp://host/x?q", false, remoteArg{}},
+	}
+	for _, tt := range tests {
+		got, remote := parseRemote(tt.arg)
+		if remote != tt.remote {
+			t.Errorf("%q: remote %v, want %v", tt.arg, remote, tt.remote)
+		} else if remote && got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+}
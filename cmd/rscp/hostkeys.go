@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/* The native SSH client checks host keys against known_hosts files, the
+   user ones and the global ones as ssh_config names them, entries with
+   hashed host names too. How is up to --host-key-check or else the
+   StrictHostKeyChecking of ssh_config: strict refuses hosts not known,
+   accept-new adds them to the first user file, off takes any key. A
+   known host showing some other key is refused unless checking is off. */
+
+var ErrHostKey = errors.New("host key verification failed")
+
+/* hostKeyChecks are the values of --host-key-check */
+var hostKeyChecks = []string{"strict", "accept-new", "off"}
+
+/* hostKeyCheck is the --host-key-check a StrictHostKeyChecking value
+   stands for, ask being strict as there is no asking */
+func hostKeyCheck(value string) string {
+	switch strings.ToLower(value) {
+	case "accept-new":
+		return "accept-new"
+	case "no", "off":
+		return "off"
+	}
+	return "strict"
+}
+
+/* knownHosts are the known_hosts files for a host with cfg, the user
+   ones first */
+func knownHosts(cfg sshConfig) (user, global []string) {
+	user = cfg["userknownhostsfile"]
+	if user == nil {
+		user = []string{filepath.Join(sshDir(), "known_hosts"), filepath.Join(sshDir(), "known_hosts2")}
+	}
+	global = cfg["globalknownhostsfile"]
+	if global == nil {
+		global = []string{"/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2"}
+	}
+	for i := range user {
+		user[i] = expandHome(user[i])
+	}
+	return user, global
+}
+
+/* hostKeys checks the keys of h as it is configured to, and tells the
+   host key algorithms to ask it for: those of the keys known for it,
+   any when none are */
+func hostKeys(h sshHop) (check ssh.HostKeyCallback, algorithms []string, err error) {
+	if h.checking == "off" {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+	var files []string
+	for _, file := range append(h.knownHosts, h.globalKnownHosts...) {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	db, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var kerr *knownhosts.KeyError
+	if err := db(h.addr(), &net.TCPAddr{}, noKey{}); errors.As(err, &kerr) {
+		for _, k := range kerr.Want {
+			algorithms = append(algorithms, keyAlgorithms(k.Key.Type())...)
+		}
+	}
+
+	check = func(addr string, remote net.Addr, key ssh.PublicKey) error {
+		err := db(addr, remote, key)
+		var kerr *knownhosts.KeyError
+		switch {
+		case errors.As(err, &kerr) && len(kerr.Want) == 0 && h.checking == "accept-new":
+			return h.addKnown(addr, key)
+		case errors.As(err, &kerr) && len(kerr.Want) == 0:
+			return fmt.Errorf("%s: %w: %s key %s not known, in none of %s", addr, ErrHostKey,
+				key.Type(), ssh.FingerprintSHA256(key), strings.Join(files, ", "))
+		case errors.As(err, &kerr):
+			return fmt.Errorf("%s: %w: %s key %s differs from the one at %s:%d, REMOTE HOST IDENTIFICATION HAS CHANGED",
+				addr, ErrHostKey, key.Type(), ssh.FingerprintSHA256(key), kerr.Want[0].Filename, kerr.Want[0].Line)
+		case err != nil:
+			return fmt.Errorf("%s: %w: %v", addr, ErrHostKey, err)
+		}
+		return nil
+	}
+	return check, algorithms, nil
+}
+
+/* addKnown adds key for addr to the first user known_hosts file, the
+   host name hashed if so configured, as ssh does for accept-new */
+func (h sshHop) addKnown(addr string, key ssh.PublicKey) error {
+	if len(h.knownHosts) == 0 {
+		return fmt.Errorf("%s: %w: no known_hosts file to add its key to", addr, ErrHostKey)
+	}
+	file := h.knownHosts[0]
+	host := knownhosts.Normalize(addr)
+	if h.hashKnown {
+		host = knownhosts.HashHostname(host)
+	}
+	os.MkdirAll(filepath.Dir(file), 0700)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", addr, ErrHostKey, err)
+	}
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{host}, key))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", addr, ErrHostKey, err)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: Permanently added '%s' (%s) to the list of known hosts.\n", knownhosts.Normalize(addr), key.Type())
+	return nil
+}
+
+/* noKey matches no known key, for looking up those that are */
+type noKey struct{}
+
+func (noKey) Type() string                        { return "none" }
+func (noKey) Marshal() []byte                     { return []byte("none") }
+func (noKey) Verify([]byte, *ssh.Signature) error { return ErrHostKey }
+
+/* keyAlgorithms are the host key algorithms of a key type, those signing
+   with SHA-2 ahead for RSA */
+func keyAlgorithms(typ string) []string {
+	if typ == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{typ}
+}
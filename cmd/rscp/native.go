@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sftpplease/rscp"
+)
+
+/* With --native-ssh the client reaches remote hosts over an SSH client of
+   its own rather than running the ssh program, for systems without one.
+   Host keys are checked as hostkeys.go tells, logging in goes as
+   sshauth.go tells, and ssh_config says what host, port and user a name
+   given stands for as it does for ssh. */
+
+const DefaultSSHPort = "22"
+
+/* sshDir is where ssh keeps the files of the user, ~/.ssh */
+func sshDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh")
+}
+
+/* loginName is the user to log in as where none is given, as for ssh */
+func loginName() string {
+	if u, err := user.Current(); err == nil {
+		if i := strings.LastIndexByte(u.Username, '\\'); i >= 0 {
+			return u.Username[i+1:] /* DOMAIN\user on Windows */
+		}
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+/* identityFiles are the private keys ssh tries by default */
+func identityFiles() []string {
+	var files []string
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		files = append(files, filepath.Join(sshDir(), name))
+	}
+	return files
+}
+
+/* sshHop is a host to connect to, the target or a jump host on the way */
+type sshHop struct {
+	name             string /* as given, which ssh_config goes by */
+	user, host, port string
+	identities       []string /* files of the keys to log in with */
+
+	checking         string   /* of host keys, one of hostKeyChecks */
+	knownHosts       []string /* user known_hosts files, new keys going to the first */
+	globalKnownHosts []string
+	hashKnown        bool /* hash the names of hosts added to known_hosts */
+
+	methods        []string /* of authMethods, in the order to try them */
+	agent          string   /* socket of ssh-agent, none when empty */
+	identitiesOnly bool     /* of the keys of ssh-agent, offer only those of identities */
+	batch          bool     /* ask the user nothing */
+	prompts        int      /* for passwords at most */
+}
+
+/* configure fills in what ssh_config has for h where the command line
+   said nothing, and the defaults where neither did */
+func (h *sshHop) configure() {
+	cfg := hostConfig(h.name)
+	h.host = h.name
+	if v := cfg.get("hostname"); v != "" {
+		h.host = expandTokens(v, *h)
+	}
+	if h.port == "" {
+		h.port = cfg.get("port")
+	}
+	if h.port == "" {
+		h.port = DefaultSSHPort
+	}
+	if h.user == "" {
+		h.user = cfg.get("user")
+	}
+	if h.user == "" {
+		h.user = loginName()
+	}
+	for _, file := range cfg["identityfile"] {
+		h.identities = append(h.identities, expandHome(expandTokens(file, *h)))
+	}
+	if len(h.identities) == 0 {
+		h.identities = identityFiles()
+	}
+	if h.checking == "" {
+		h.checking = hostKeyCheck(cfg.get("stricthostkeychecking"))
+	}
+	h.knownHosts, h.globalKnownHosts = knownHosts(cfg)
+	h.hashKnown = cfg.flag("hashknownhosts", false)
+	h.configureAuth(cfg)
+}
+
+/* addr is the address of h as known_hosts has it */
+func (h sshHop) addr() string {
+	return net.JoinHostPort(h.host, h.port)
+}
+
+/* hops are the jump hosts to go through, then r itself, as configured */
+func (c clientOpts) hops(r remoteArg) ([]sshHop, error) {
+	var hops []sshHop
+	if c.jump != "" {
+		for _, jump := range strings.Split(c.jump, ",") {
+			h := sshHop{name: strings.TrimPrefix(jump, "ssh://"), checking: c.hostKeyCheck}
+			if at := strings.LastIndexByte(h.name, '@'); at >= 0 {
+				h.user, h.name = h.name[:at], h.name[at+1:]
+			}
+			if host, port, err := net.SplitHostPort(h.name); err == nil {
+				h.name, h.port = host, port
+			}
+			if h.name == "" {
+				return nil, fmt.Errorf("-J %s: no host", jump)
+			}
+			hops = append(hops, h)
+		}
+	}
+	target := sshHop{name: r.host, user: r.user, port: r.port, checking: c.hostKeyCheck}
+	if c.key != "" {
+		target.identities = []string{c.key}
+	}
+	if target.port == "" {
+		target.port = c.port
+	}
+	hops = append(hops, target)
+	for i := range hops {
+		hops[i].configure()
+	}
+	return hops, nil
+}
+
+/* sshDial connects to r through any jump hosts */
+func (c clientOpts) sshDial(ctx context.Context, r remoteArg) (*ssh.Client, error) {
+	hops, err := c.hops(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var client *ssh.Client
+	for _, h := range hops {
+		check, algorithms, err := hostKeys(h)
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil, err
+		}
+		auth, done := h.auth()
+		config := &ssh.ClientConfig{
+			User:              h.user,
+			Auth:              auth,
+			HostKeyCallback:   check,
+			HostKeyAlgorithms: algorithms,
+		}
+
+		var conn net.Conn
+		if client == nil {
+			conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", h.addr())
+		} else {
+			conn, err = client.DialContext(ctx, "tcp", h.addr())
+		}
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil, err
+		}
+
+		stop := context.AfterFunc(ctx, func() { conn.Close() }) /* the handshake heeds no context */
+		sconn, chans, reqs, err := ssh.NewClientConn(conn, h.addr(), config)
+		stop()
+		done()
+		if err != nil {
+			conn.Close()
+			if client != nil {
+				client.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", h.host, err)
+		}
+		next := ssh.NewClient(sconn, chans, reqs)
+		if client != nil {
+			via := client
+			go func() { /* the jump host goes once the hop through it does */
+				next.Wait()
+				via.Close()
+			}()
+		}
+		client = next
+	}
+	return client, nil
+}
+
+/* nativeStart starts what start does through ssh over a connection of
+   its own, running command or else starting subsystem */
+func (c clientOpts) nativeStart(ctx context.Context, r remoteArg, command, subsystem string) (*remoteEnd, error) {
+	client, err := c.sshDial(ctx, r)
+	if err != nil {
+		return nil, rscp.FatalError{Err: err}
+	}
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	fail := func(err error) (*remoteEnd, error) {
+		stop()
+		client.Close()
+		return nil, rscp.FatalError{Err: fmt.Errorf("%s: %w", r.host, err)}
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fail(err)
+	}
+	in, err := session.StdoutPipe()
+	if err != nil {
+		return fail(err)
+	}
+	out, err := session.StdinPipe()
+	if err != nil {
+		return fail(err)
+	}
+	if subsystem != "" {
+		err = session.RequestSubsystem(subsystem)
+	} else {
+		session.Stderr = os.Stderr
+		err = session.Start(command)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	return &remoteEnd{in, out, func(failed bool) error {
+		defer client.Close()
+		defer stop()
+		if failed {
+			client.Close() /* it may be stuck writing what is no longer read */
+			io.Copy(io.Discard, in)
+		}
+		if subsystem != "" { /* no exit status to wait for, a subsystem is not started as a command is */
+			return nil
+		}
+		if err := session.Wait(); err != nil {
+			return fmt.Errorf("%s: %w", r.host, err)
+		}
+		return nil
+	}}, nil
+}
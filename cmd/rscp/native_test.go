@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/sftpplease/rscp"
+)
+
+/* testServer is an SSH server on a local port running rscp for exec
+   requests and SFTP for the subsystem, jumping to other hosts too */
+type testServer struct {
+	addr    string
+	hostKey ssh.PublicKey
+	clients []ssh.PublicKey /* keys users may log in with */
+
+	mu       sync.Mutex
+	commands []string /* run so far */
+	logins   []string /* the methods of those so far */
+}
+
+/* testPassword is the password of all users of test servers */
+const testPassword = "open sesame"
+
+func (srv *testServer) ran() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.commands
+}
+
+func (srv *testServer) loggedIn() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.logins
+}
+
+/* testKey is a key pair, signing and to be written out */
+type testKey struct {
+	ssh.Signer
+	priv ed25519.PrivateKey
+}
+
+func newKey(t *testing.T) testKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{signer, priv}
+}
+
+func sshServer(t *testing.T, clients ...ssh.PublicKey) *testServer {
+	t.Helper()
+	host := newKey(t)
+	srv := &testServer{hostKey: host.PublicKey(), clients: clients}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range srv.clients {
+				if string(k.Marshal()) == string(key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("unknown key")
+		},
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != testPassword {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+		KeyboardInteractiveCallback: func(meta ssh.ConnMetadata, ask ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := ask("test", "say the word", []string{"Password: "}, []bool{false})
+			if err != nil || len(answers) != 1 || answers[0] != testPassword {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+		AuthLogCallback: func(meta ssh.ConnMetadata, method string, err error) {
+			if err == nil {
+				srv.mu.Lock()
+				srv.logins = append(srv.logins, method)
+				srv.mu.Unlock()
+			}
+		},
+	}
+	config.AddHostKey(host)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv.addr = ln.Addr().String()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn, config)
+		}
+	}()
+	return srv
+}
+
+func (srv *testServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go srv.session(ch, reqs)
+		case "direct-tcpip":
+			var to struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			ssh.Unmarshal(nc.ExtraData(), &to)
+			next, err := net.Dial("tcp", net.JoinHostPort(to.Host, strconv.Itoa(int(to.Port))))
+			if err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				next.Close()
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				io.Copy(next, ch)
+				next.(*net.TCPConn).CloseWrite()
+			}()
+			go func() {
+				io.Copy(ch, next)
+				ch.Close()
+			}()
+		default:
+			nc.Reject(ssh.UnknownChannelType, "")
+		}
+	}
+}
+
+/* session runs the rscp command of an exec request in process, as rscp
+   -f or -t would, or serves SFTP */
+func (srv *testServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		var arg struct{ Text string }
+		ssh.Unmarshal(req.Payload, &arg)
+		switch req.Type {
+		case "exec":
+			req.Reply(true, nil)
+			srv.mu.Lock()
+			srv.commands = append(srv.commands, arg.Text)
+			srv.mu.Unlock()
+			status := uint32(0)
+			if err := runCommand(arg.Text, ch); err != nil {
+				status = 1
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		case "subsystem":
+			req.Reply(arg.Text == "sftp", nil)
+			if server, err := sftp.NewServer(ch); err == nil {
+				server.Serve()
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+/* runCommand runs "rscp -f|-t [flags] -- paths" on ch */
+func runCommand(line string, ch ssh.Channel) error {
+	words, err := shellSplit(line)
+	if err != nil || len(words) < 4 || words[0] != "rscp" {
+		return errors.New("unknown command")
+	}
+	var args []string
+	for i, w := range words {
+		if w == "--" {
+			args = words[i+1:]
+		}
+	}
+	opts := rscp.Options{In: ch, Out: ch, RscpPeer: true}
+	if words[1] == "-f" {
+		return rscp.SourceContext(context.Background(), opts, args)
+	}
+	return rscp.SinkContext(context.Background(), opts, args[0])
+}
+
+/* sshHome is a home directory holding key as the default identity and
+   known_hosts with hosts, for the client to find as ssh would, with no
+   ssh-agent and no terminal to ask the user on */
+func sshHome(t *testing.T, key *testKey, hosts map[string]ssh.PublicKey) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	answerUser(t)
+	dir := filepath.Join(home, ".ssh")
+	os.Mkdir(dir, 0700)
+	if key != nil {
+		writeKey(t, filepath.Join(dir, "id_ed25519"), *key, "")
+	}
+	var lines []string
+	for addr, k := range hosts {
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(addr)}, k))
+	}
+	os.WriteFile(filepath.Join(dir, "known_hosts"), []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	return home
+}
+
+/* answerUser has the questions the user is asked answered in turn
+   with answers, those asked going to the slice returned, and fails
+   with no terminal once out of answers */
+func answerUser(t *testing.T, answers ...string) *[]string {
+	var asked []string
+	ask := askUser
+	t.Cleanup(func() { askUser = ask })
+	askUser = func(question string, echo bool) (string, error) {
+		asked = append(asked, question)
+		if len(asked) > len(answers) {
+			return "", errNoTerminal
+		}
+		return answers[len(asked)-1], nil
+	}
+	return &asked
+}
+
+/* writeKey writes the private half of key to file, encrypted with
+   passphrase unless empty */
+func writeKey(t *testing.T, file string, key testKey, passphrase string) {
+	t.Helper()
+	priv := key.priv
+	var block *pem.Block
+	var err error
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(priv, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* with --native-ssh files go up and down over the SSH client of rscp,
+   through jump hosts too, and over SFTP */
+func TestNativeSSH(t *testing.T) {
+	user := newKey(t)
+	srv := sshServer(t, user.PublicKey())
+	jump := sshServer(t, user.PublicKey())
+	sshHome(t, &user, map[string]ssh.PublicKey{srv.addr: srv.hostKey, jump.addr: jump.hostKey})
+
+	host, port, _ := net.SplitHostPort(srv.addr)
+	local, remote := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(local, "up"), []byte("up"), 0644)
+	os.WriteFile(filepath.Join(remote, "down"), []byte("down"), 0644)
+
+	ctx := context.Background()
+	for _, c := range []clientOpts{
+		{native: true, remote: "rscp"},
+		{native: true, remote: "rscp", jump: "me@" + jump.addr},
+		{native: true, sftp: true},
+	} {
+		r := remoteArg{user: "me", host: host, port: port, path: remote}
+		os.Remove(filepath.Join(remote, "up"))
+		os.Remove(filepath.Join(local, "down"))
+		if err := c.upload(ctx, rscp.Options{}, []string{filepath.Join(local, "up")}, r); err != nil {
+			t.Errorf("%+v: upload: %v", c, err)
+		}
+		if err := c.download(ctx, rscp.Options{}, r, []string{filepath.Join(remote, "down")}, local); err != nil {
+			t.Errorf("%+v: download: %v", c, err)
+		}
+		for _, name := range []string{filepath.Join(remote, "up"), filepath.Join(local, "down")} {
+			if _, err := os.Stat(name); err != nil {
+				t.Errorf("%+v: %v", c, err)
+			}
+		}
+	}
+	if ran := srv.ran(); len(ran) != 4 || !strings.HasPrefix(ran[0], "rscp -t -- ") {
+		t.Errorf("ran %q, want rscp -t and -f twice", ran)
+	}
+}
+
+/* a host whose key is unknown or changed is not logged in to, nor is
+   one not taking the key of the user */
+func TestNativeSSHRefused(t *testing.T) {
+	user := newKey(t)
+	srv := sshServer(t, user.PublicKey())
+	host, port, _ := net.SplitHostPort(srv.addr)
+	r := remoteArg{user: "me", host: host, port: port, path: t.TempDir()}
+	c := clientOpts{native: true, remote: "rscp"}
+	local := filepath.Join(t.TempDir(), "f")
+	os.WriteFile(local, []byte("f"), 0644)
+
+	for _, tt := range []struct {
+		name  string
+		key   testKey
+		known map[string]ssh.PublicKey
+		want  error
+	}{
+		{"unknown host", user, nil, ErrHostKey},
+		{"changed host key", user, map[string]ssh.PublicKey{srv.addr: newKey(t).PublicKey()}, ErrHostKey},
+		{"unknown user key", newKey(t), map[string]ssh.PublicKey{srv.addr: srv.hostKey}, nil},
+	} {
+		sshHome(t, &tt.key, tt.known)
+		err := c.upload(context.Background(), rscp.Options{}, []string{local}, r)
+		if err == nil || !isFatal(err) || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v, want a fatal %v", tt.name, err, tt.want)
+		}
+	}
+	if ran := srv.ran(); len(ran) != 0 {
+		t.Errorf("ran %q", ran)
+	}
+}
+
+/* a host name given may be an alias ssh_config has the host, port, user
+   and identity file for */
+func TestNativeSSHConfig(t *testing.T) {
+	user := newKey(t)
+	srv := sshServer(t, user.PublicKey())
+	home := sshHome(t, nil, map[string]ssh.PublicKey{srv.addr: srv.hostKey})
+	writeKey(t, filepath.Join(home, ".ssh", "elsewhere"), user, "")
+	host, port, _ := net.SplitHostPort(srv.addr)
+	os.WriteFile(filepath.Join(home, ".ssh", "config"), []byte("Host alias\n"+
+		"\tHostName "+host+"\n\tPort "+port+"\n\tUser me\n\tIdentityFile ~/.ssh/elsewhere\n"), 0600)
+
+	local := filepath.Join(t.TempDir(), "f")
+	os.WriteFile(local, []byte("f"), 0644)
+	remote := t.TempDir()
+	c := clientOpts{native: true, remote: "rscp"}
+	if err := c.upload(context.Background(), rscp.Options{}, []string{local}, remoteArg{host: "alias", path: remote}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "f")); err != nil {
+		t.Error(err)
+	}
+}
+
+/* hosts are checked against hashed known_hosts entries too, ones not
+   known added with accept-new, any key taken with checking off */
+func TestNativeSSHHostKeyCheck(t *testing.T) {
+	user := newKey(t)
+	srv := sshServer(t, user.PublicKey())
+	host, port, _ := net.SplitHostPort(srv.addr)
+	r := remoteArg{user: "me", host: host, port: port, path: t.TempDir()}
+	local := filepath.Join(t.TempDir(), "f")
+	os.WriteFile(local, []byte("f"), 0644)
+	upload := func(check string) error {
+		c := clientOpts{native: true, remote: "rscp", hostKeyCheck: check}
+		return c.upload(context.Background(), rscp.Options{}, []string{local}, r)
+	}
+
+	home := sshHome(t, &user, nil)
+	known := filepath.Join(home, ".ssh", "known_hosts")
+	hashed := knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(srv.addr))}, srv.hostKey)
+	os.WriteFile(known, []byte(hashed+"\n"), 0600)
+	if err := upload(""); err != nil {
+		t.Errorf("hashed entry: %v", err)
+	}
+
+	home = sshHome(t, &user, nil)
+	known = filepath.Join(home, ".ssh", "known_hosts")
+	os.WriteFile(filepath.Join(home, ".ssh", "config"), []byte("HashKnownHosts yes\n"), 0600)
+	if err := upload("accept-new"); err != nil {
+		t.Errorf("accept-new: %v", err)
+	}
+	if data, _ := os.ReadFile(known); !strings.Contains(string(data), "|1|") ||
+		!strings.Contains(string(data), string(ssh.MarshalAuthorizedKey(srv.hostKey)[:40])) {
+		t.Errorf("known_hosts after accept-new: %q, want the key with the host hashed", data)
+	}
+	if err := upload(""); err != nil {
+		t.Errorf("strict once added: %v", err)
+	}
+
+	sshHome(t, &user, map[string]ssh.PublicKey{srv.addr: newKey(t).PublicKey()})
+	if err := upload("accept-new"); !errors.Is(err, ErrHostKey) {
+		t.Errorf("accept-new with the key changed: %v, want %v", err, ErrHostKey)
+	}
+	if err := upload("off"); err != nil {
+		t.Errorf("off with the key changed: %v", err)
+	}
+
+	home = sshHome(t, &user, nil)
+	os.WriteFile(filepath.Join(home, ".ssh", "config"), []byte("Host "+host+"\n\tStrictHostKeyChecking accept-new\n"), 0600)
+	if err := upload(""); err != nil {
+		t.Errorf("StrictHostKeyChecking accept-new: %v", err)
+	}
+	if err := upload("strict"); err != nil {
+		t.Errorf("strict once added by ssh_config: %v", err)
+	}
+}
+
+func TestHostKeyCheck(t *testing.T) {
+	for value, want := range map[string]string{
+		"": "strict", "yes": "strict", "ask": "strict", "accept-new": "accept-new",
+		"no": "off", "off": "off", "No": "off",
+	} {
+		if got := hostKeyCheck(value); got != want {
+			t.Errorf("%q: %q, want %q", value, got, want)
+		}
+	}
+}
+
+/* keys come from ssh-agent and identity files, with a passphrase asked
+   for once the server takes them, passwords are asked for once no key
+   is taken, and ssh_config has a say in which goes first */
+func TestNativeSSHAuth(t *testing.T) {
+	user := newKey(t)
+	srv := sshServer(t, user.PublicKey())
+	host, port, _ := net.SplitHostPort(srv.addr)
+	r := remoteArg{user: "me", host: host, port: port, path: t.TempDir()}
+	local := filepath.Join(t.TempDir(), "f")
+	os.WriteFile(local, []byte("f"), 0644)
+	known := map[string]ssh.PublicKey{srv.addr: srv.hostKey}
+	c := clientOpts{native: true, remote: "rscp"}
+	login := func(want string, answers []string, wantAsked ...string) {
+		t.Helper()
+		asked := answerUser(t, answers...)
+		before := len(srv.loggedIn())
+		err := c.upload(context.Background(), rscp.Options{}, []string{local}, r)
+		if logins := srv.loggedIn()[before:]; want == "" && err == nil || want != "" && (err != nil || len(logins) != 1 || logins[0] != want) {
+			t.Errorf("logged in by %q, %v, want %q", logins, err, want)
+		}
+		if len(*asked) != len(wantAsked) {
+			t.Errorf("asked %q, want %q", *asked, wantAsked)
+		}
+		for i := range min(len(*asked), len(wantAsked)) {
+			if !strings.Contains((*asked)[i], wantAsked[i]) {
+				t.Errorf("asked %q, want %q", (*asked)[i], wantAsked[i])
+			}
+		}
+	}
+
+	/* a passphrase is asked for a key the server takes, again when wrong,
+	   and none for one it does not take, passwords coming next */
+	home := sshHome(t, nil, known)
+	id := filepath.Join(home, ".ssh", "id_ed25519")
+	writeKey(t, id, user, "secret")
+	login("publickey", []string{"secret"}, "Enter passphrase for key '"+id+"': ")
+	login("publickey", []string{"wrong", "secret"}, "Enter passphrase", "Enter passphrase")
+	login("keyboard-interactive", []string{"", testPassword}, "Enter passphrase", "test\nsay the word\nPassword: ")
+	writeKey(t, id, newKey(t), "secret")
+	login("keyboard-interactive", []string{testPassword}, "Password: ")
+	login("", nil, "Password: ", "me@"+host+"'s password: ")
+
+	/* -i names the identity file, ssh_config may take methods out or
+	   put them first */
+	sshHome(t, nil, known)
+	c.key = filepath.Join(t.TempDir(), "key")
+	writeKey(t, c.key, user, "")
+	login("publickey", nil)
+	c.key = ""
+	home = sshHome(t, &user, known)
+	config := filepath.Join(home, ".ssh", "config")
+	os.WriteFile(config, []byte("PreferredAuthentications password,publickey\n"), 0600)
+	login("password", []string{testPassword}, "'s password: ")
+	os.WriteFile(config, []byte("Host "+host+"\n\tPubkeyAuthentication no\n\tKbdInteractiveAuthentication no\n"), 0600)
+	login("password", []string{testPassword}, "'s password: ")
+	os.WriteFile(config, []byte("Host "+host+"\n\tPubkeyAuthentication no\n\tBatchMode yes\n"), 0600)
+	login("", []string{testPassword})
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	/* keys of ssh-agent go first, unless IdentitiesOnly leaves out those
+	   of no identity file or IdentityAgent none the agent */
+	dir, err := os.MkdirTemp("", "agent") /* short enough a name for a socket */
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ln, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: user.priv})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	home = sshHome(t, nil, known)
+	t.Setenv("SSH_AUTH_SOCK", ln.Addr().String())
+	login("publickey", nil)
+	config = filepath.Join(home, ".ssh", "config")
+	os.WriteFile(config, []byte("IdentitiesOnly yes\n"), 0600)
+	login("", nil, "Password: ", "password: ")
+	writeKey(t, filepath.Join(home, ".ssh", "id_ed25519"), user, "secret")
+	login("publickey", nil)
+	os.WriteFile(config, []byte("IdentityAgent none\n"), 0600)
+	login("publickey", []string{"secret"}, "Enter passphrase")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/sftpplease/rscp"
+)
+
+/* rscp serve -quic takes connections over QUIC on UDP instead of TCP, an
+   experimental transport for links losing packets. TLS being part of
+   QUIC, -tls-cert is required and clients verify servers as they do
+   for rscps. Each stream a client opens carries one request as a TCP
+   connection does, -secret-file proven on each, and clients open one
+   connection with one stream for each transfer as yet. Clients reach
+   such servers with rscp+quic:// URLs. */
+
+/* QuicProto is the ALPN protocol of rscp over QUIC */
+const QuicProto = "rscp"
+
+/* QuicLinger is how long closing a connection waits for the server to
+   be done with its stream, as closing the connection drops what is
+   still underway */
+const QuicLinger = 5 * time.Second
+
+var quicConfig = &quic.Config{KeepAlivePeriod: 15 * time.Second}
+
+/* quicTLS is config speaking rscp over QUIC */
+func quicTLS(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.NextProtos = []string{QuicProto}
+	return config
+}
+
+/* listenQUIC serves on addr or the socket systemd passed on, limiting
+   all connections together to totalLimit Kbit/s unless 0 */
+func listenQUIC(addr, root string, secret []byte, opts rscp.Options, config *tls.Config, totalLimit uint) error {
+	var pc net.PacketConn
+	var err error
+	if sock := systemdSocket(); sock != nil {
+		pc, err = net.FilePacketConn(sock)
+	} else {
+		pc, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	ln, err := quic.Listen(pc, quicTLS(config), quicConfig)
+	if err != nil {
+		return err
+	}
+	var total *rscp.BwStats
+	if totalLimit > 0 {
+		total = rscp.NewBwStats(totalLimit * 1024)
+	}
+	return serveQUIC(ln, root, secret, opts, total)
+}
+
+/* serveQUIC serves the requests of each stream clients open, those of
+   all streams metered against total together unless nil */
+func serveQUIC(ln *quic.Listener, root string, secret []byte, opts rscp.Options, total *rscp.BwStats) error {
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.CancelRead(0)
+					defer stream.Close()
+					var rw io.ReadWriter = stream
+					if total != nil {
+						rw = struct {
+							io.Reader
+							io.Writer
+						}{rscp.CapReader(stream, total), rscp.CapWriter(stream, total)}
+					}
+					if err := serveConn(rw, root, secret, opts); err != nil {
+						fmt.Fprintf(os.Stderr, "%s: %v\n", conn.RemoteAddr(), err)
+					}
+				}()
+			}
+		}()
+	}
+}
+
+/* dialQUIC connects to rscp serve -quic at addr, a stream of its own
+   connection standing for a TCP connection */
+func dialQUIC(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	conn, err := quic.DialAddr(ctx, addr, quicTLS(config), quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return quicStream{stream, conn}, nil
+}
+
+/* quicStream is the one stream of a connection: closing it closes the
+   connection, CloseWrite the sending half of the stream */
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+func (s quicStream) Close() error {
+	s.Stream.Close()
+	s.SetReadDeadline(time.Now().Add(QuicLinger))
+	io.Copy(io.Discard, s.Stream)
+	return s.conn.CloseWithError(0, "")
+}
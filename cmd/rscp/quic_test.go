@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/sftpplease/rscp"
+)
+
+/* selfSigned writes a certificate for 127.0.0.1 signing itself and its
+   key to dir */
+func selfSigned(t *testing.T, dir string) (cert, key string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rscp test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+/* files go up to and down from serve over QUIC, several streams of one
+   connection each carrying a request; servers not verified are refused */
+func TestServeQUIC(t *testing.T) {
+	cert, key := selfSigned(t, t.TempDir())
+	config, err := serverTLS(cert, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenAddr("127.0.0.1:0", quicTLS(config), quicConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	root := t.TempDir()
+	secret := []byte("shared")
+	go serveQUIC(ln, root, secret, rscp.Options{}, rscp.NewBwStats(1<<30))
+
+	local := t.TempDir()
+	os.WriteFile(filepath.Join(local, "up"), []byte("up"), 0644)
+	os.WriteFile(filepath.Join(root, "down"), []byte("down"), 0644)
+	r, ok := parseRemote("rscp+quic://" + ln.Addr().String() + "/")
+	if !ok || r.scheme != "rscp+quic" {
+		t.Fatalf("%+v, %v", r, ok)
+	}
+
+	ctx := context.Background()
+	c := clientOpts{tlsCA: cert, secret: secret}
+	if err := c.upload(ctx, rscp.Options{}, []string{filepath.Join(local, "up")}, r); err != nil {
+		t.Errorf("upload: %v", err)
+	}
+	if err := c.download(ctx, rscp.Options{}, r, []string{"down"}, local); err != nil {
+		t.Errorf("download: %v", err)
+	}
+	for _, name := range []string{filepath.Join(root, "up"), filepath.Join(local, "down")} {
+		if _, err := os.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	/* the streams of one connection are requests of their own */
+	conn, err := dialQUIC(ctx, ln.Addr().String(), &tls.Config{RootCAs: mustPool(t, cert)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream := conn.(quicStream).Stream
+	for i := range 3 {
+		if i > 0 {
+			if stream, err = conn.(quicStream).conn.OpenStreamSync(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := clientAuth(stream, secret); err != nil {
+			t.Fatal(err)
+		}
+		end := &remoteEnd{stream, stream, func(bool) error { return nil }}
+		stream.Write([]byte("from -- down\n"))
+		dst := t.TempDir()
+		err = runRemote(end, rscp.Options{}, func(opts rscp.Options) error { return rscp.SinkContext(ctx, opts, dst) })
+		if got, _ := os.ReadFile(filepath.Join(dst, "down")); err != nil || string(got) != "down" {
+			t.Errorf("another stream: %q, %v", got, err)
+		}
+	}
+
+	c.tlsCA = ""
+	if err := c.upload(ctx, rscp.Options{}, []string{filepath.Join(local, "up")}, r); err == nil || !isFatal(err) {
+		t.Errorf("upload to a server not verified: %v", err)
+	}
+}
+
+func mustPool(t *testing.T, file string) *x509.CertPool {
+	t.Helper()
+	pool, err := loadPool(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+/* set by -sandbox for enterSandbox */
+var sandboxed bool
+
+/* set by -user, -group and -keep-chown for enterSandbox */
+var runAs struct {
+	user, group string
+	keepChown   bool
+}
+
+/* marks the copy of the process sandbox runs the rest in; anyone can set
+   it, so the copy checks what it was to be instead of believing it */
+const sandboxEnv = "RSCP_SANDBOXED"
+
+var ErrNotRestricted = errors.New("not run as restricted as asked for")
+
+/* rerunning tells whether this is the copy of the process rerun started,
+   no longer passing that on to what it runs in turn */
+func rerunning() bool {
+	child := os.Getenv(sandboxEnv) != ""
+	os.Unsetenv(sandboxEnv)
+	return child
+}
+
+/* credential is who the rest of the run goes on as */
+type credential struct {
+	uid, gid  uint32
+	groups    []uint32
+	keepChown bool /* CAP_CHOWN and what else giving files any owner takes */
+}
+
+/* enterSandbox has the rest of the run go on sandboxed with -sandbox,
+   free to write only under writable, each a directory or a file in
+   one, the nearest directory there is for one missing, and where the
+   file of -record and the directory of -temp-dir are; and as the user
+   and group of -user and -group */
+func enterSandbox(flags *flag.FlagSet, writable ...string) error {
+	if !sandboxed && runAs.user == "" && runAs.group == "" {
+		return nil
+	}
+	var dirs []string
+	if sandboxed {
+		if f := flags.Lookup("record"); f != nil {
+			writable = append(writable, f.Value.(*funcFlag).values...)
+		}
+		if f := flags.Lookup("temp-dir"); f != nil && f.Value.String() != "" {
+			writable = append(writable, f.Value.String())
+		}
+		for _, name := range writable {
+			name = filepath.Clean(name)
+			for st, err := os.Stat(name); (err != nil || !st.IsDir()) && filepath.Dir(name) != name; st, err = os.Stat(name) {
+				name = filepath.Dir(name)
+			}
+			dirs = append(dirs, name)
+		}
+	}
+	cred, err := lookupCredential()
+	if err != nil {
+		return err
+	}
+	return restrict(dirs, cred)
+}
+
+/* lookupCredential is who -user and -group name, by name or number;
+   -user alone brings the groups of the user, -group alone keeps the
+   user. Numbers no entry has stand for themselves, a user such needing
+   -group. nil when neither is given. */
+func lookupCredential() (*credential, error) {
+	if runAs.user == "" && runAs.group == "" {
+		return nil, nil
+	}
+	cred := &credential{uid: uint32(os.Getuid()), keepChown: runAs.keepChown}
+	if runAs.user != "" {
+		u, err := user.Lookup(runAs.user)
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(runAs.user)
+		}
+		if err == nil {
+			err = userIDs(u, cred)
+		} else if uid, perr := parseID(runAs.user); perr == nil && runAs.group != "" {
+			cred.uid, err = uid, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", runAs.user, err)
+		}
+	}
+	if runAs.group != "" {
+		g, err := user.LookupGroup(runAs.group)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(runAs.group)
+		}
+		if err == nil {
+			cred.gid, err = parseID(g.Gid)
+		} else if gid, perr := parseID(runAs.group); perr == nil {
+			cred.gid, err = gid, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %w", runAs.group, err)
+		}
+		cred.groups = []uint32{cred.gid}
+	}
+	return cred, nil
+}
+
+/* userIDs has cred be u with its groups */
+func userIDs(u *user.User, cred *credential) (err error) {
+	if cred.uid, err = parseID(u.Uid); err != nil {
+		return err
+	}
+	if cred.gid, err = parseID(u.Gid); err != nil {
+		return err
+	}
+	gids, _ := u.GroupIds()
+	for _, g := range gids {
+		if gid, err := parseID(g); err == nil {
+			cred.groups = append(cred.groups, gid)
+		}
+	}
+	return nil
+}
+
+/* check fails unless the process runs as cred, nil checking nothing */
+func (cred *credential) check() error {
+	if cred == nil {
+		return nil
+	}
+	if uint32(os.Getuid()) != cred.uid || uint32(os.Geteuid()) != cred.uid ||
+		uint32(os.Getgid()) != cred.gid || uint32(os.Getegid()) != cred.gid {
+		return fmt.Errorf("user %d, group %d: %w", cred.uid, cred.gid, ErrNotRestricted)
+	}
+	return nil
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+/* rerun runs the rest in a copy of this process started with attr,
+   waits for it and exits as it does, passing on signals meanwhile */
+func rerun(attr *syscall.SysProcAttr) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), sandboxEnv+"=1")
+	cmd.ExtraFiles = listenFiles()
+	cmd.SysProcAttr = attr
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	cmd.Wait()
+	if code := cmd.ProcessState.ExitCode(); code >= 0 {
+		os.Exit(code)
+	}
+	os.Exit(1)
+	return nil
+}
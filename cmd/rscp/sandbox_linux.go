@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+/* Landlock, see landlock(7) */
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	prSetNoNewPrivs = 38
+
+	/* see capabilities(7) */
+	capChown  = 0
+	capFowner = 3
+	capFsetid = 4
+)
+
+/* access rights */
+const (
+	llExecute = 1 << iota
+	llWriteFile
+	llReadFile
+	llReadDir
+	llRemoveDir
+	llRemoveFile
+	llMakeChar
+	llMakeDir
+	llMakeReg
+	llMakeSock
+	llMakeFifo
+	llMakeBlock
+	llMakeSym
+	llRefer    /* ABI 2 */
+	llTruncate /* ABI 3 */
+)
+
+/* restrict has the rest of the run go on in a copy of this process,
+   with -sandbox one that Landlock keeps from changing anything but what
+   is under the directories writable, reading and running programs still
+   allowed; with cred one running as that. Landlock restricts the thread
+   asking only, so the copy is started from a thread restricted first
+   and inherits that; the copy makes sure it did. */
+func restrict(writable []string, cred *credential) error {
+	if rerunning() {
+		if sandboxed {
+			if err := landlocked(writable); err != nil {
+				return err
+			}
+		}
+		return cred.check()
+	}
+	if sandboxed {
+		if err := landlock(writable); err != nil {
+			return err
+		}
+	}
+	attr := &syscall.SysProcAttr{}
+	if cred != nil {
+		attr.Credential = &syscall.Credential{Uid: cred.uid, Gid: cred.gid, Groups: cred.groups}
+		if cred.keepChown {
+			/* the mode and times of files given away go on needing
+			   CAP_FOWNER, CAP_FSETID keeps setuid bits through chown */
+			attr.AmbientCaps = []uintptr{capChown, capFowner, capFsetid}
+		}
+	}
+	return rerun(attr)
+}
+
+/* landlock restricts the calling thread to writing under writable,
+   locking the goroutine to it for good */
+func landlock(writable []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("sandbox: landlock: %w", errno)
+	}
+	handled := uint64(llRefer - 1)
+	if abi >= 2 {
+		handled |= llRefer
+	}
+	if abi >= 3 {
+		handled |= llTruncate
+	}
+	ruleset, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&handled)), 8, 0)
+	if errno != 0 {
+		return fmt.Errorf("sandbox: landlock: %w", errno)
+	}
+	defer syscall.Close(int(ruleset))
+	if err := landlockAllow(ruleset, "/", llExecute|llReadFile|llReadDir); err != nil {
+		return err
+	}
+	for _, dir := range writable {
+		if err := landlockAllow(ruleset, dir, handled); err != nil {
+			return err
+		}
+	}
+
+	runtime.LockOSThread() /* for good, the thread stays restricted */
+	if _, _, errno := syscall.Syscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("sandbox: %w", errno)
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, ruleset, 0, 0); errno != 0 {
+		return fmt.Errorf("sandbox: landlock: %w", errno)
+	}
+	return nil
+}
+
+/* landlocked fails unless Landlock keeps the process from writing to
+   /dev/null, which anyone may otherwise; that under writable passes */
+func landlocked(writable []string) error {
+	for _, dir := range writable {
+		dir, _ = filepath.Abs(dir)
+		if rel, err := filepath.Rel(dir, "/dev/null"); err == nil && filepath.IsLocal(rel) {
+			return nil
+		}
+	}
+	f, err := os.OpenFile("/dev/null", os.O_WRONLY, 0)
+	if err == nil {
+		f.Close()
+		return fmt.Errorf("sandbox: %w", ErrNotRestricted)
+	}
+	return nil
+}
+
+/* landlockAllow allows access to what is under dir */
+func landlockAllow(ruleset uintptr, dir string, access uint64) error {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("sandbox: %s: %w", dir, err)
+	}
+	defer syscall.Close(fd)
+	var attr [12]byte /* struct landlock_path_beneath_attr, packed */
+	binary.NativeEndian.PutUint64(attr[:8], access)
+	binary.NativeEndian.PutUint32(attr[8:], uint32(fd))
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, ruleset, landlockRulePathBeneath,
+		uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("sandbox: %s: %w", dir, errno)
+	}
+	return nil
+}
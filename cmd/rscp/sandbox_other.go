@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+func restrict(writable []string, cred *credential) error {
+	return fmt.Errorf("sandbox: %w", errors.ErrUnsupported)
+}
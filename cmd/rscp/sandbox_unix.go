@@ -0,0 +1,25 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+/* restrict has the rest of the run go on in a copy of this process
+   running as cred, which the copy makes sure of; there is no sandbox to
+   put it in here, nor a way to keep CAP_CHOWN */
+func restrict(writable []string, cred *credential) error {
+	if sandboxed {
+		return fmt.Errorf("sandbox: %w", errors.ErrUnsupported)
+	}
+	if cred.keepChown {
+		return fmt.Errorf("keep-chown: %w", errors.ErrUnsupported)
+	}
+	if rerunning() {
+		return cred.check()
+	}
+	return rerun(&syscall.SysProcAttr{Credential: &syscall.Credential{Uid: cred.uid, Gid: cred.gid, Groups: cred.groups}})
+}
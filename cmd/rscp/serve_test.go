@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sftpplease/rscp"
+)
+
+/* serveTree is a root for serve holding symlinks that lead out of it,
+   absolute and relative, to a file and to a directory */
+func serveTree(t *testing.T) (root, outside string) {
+	t.Helper()
+	top := t.TempDir()
+	root, outside = filepath.Join(top, "root"), filepath.Join(top, "outside")
+	for _, err := range []error{
+		os.Mkdir(root, 0755),
+		os.Mkdir(outside, 0755),
+		os.Mkdir(filepath.Join(root, "sub"), 0755),
+		os.WriteFile(filepath.Join(root, "ok"), []byte("inside"), 0644),
+		os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600),
+		os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "evil")),
+		os.Symlink("../outside/secret", filepath.Join(root, "up")),
+		os.Symlink(outside, filepath.Join(root, "out")),
+		os.Symlink("../../outside", filepath.Join(root, "sub", "rel")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+/* request runs serveConn on root for line, with the client end given to client */
+func request(root, line string, client func(conn net.Conn) error) (clientErr, serveErr error) {
+	c, s := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := serveConn(s, root, nil, rscp.Options{})
+		s.Close()
+		done <- err
+	}()
+	io.WriteString(c, line+"\n")
+	clientErr = client(c)
+	c.Close()
+	return clientErr, <-done
+}
+
+func TestServeConfined(t *testing.T) {
+	root, outside := serveTree(t)
+
+	for _, line := range []string{"from evil", "from up", "from sub/rel/secret", "from -r /", "from -r sub"} {
+		dst := t.TempDir()
+		request(root, line, func(conn net.Conn) error {
+			opts := rscp.Options{In: conn, Out: conn, Recursive: true, TargetDir: true}
+			return rscp.SinkContext(context.Background(), opts, dst)
+		})
+		filepath.WalkDir(dst, func(name string, d fs.DirEntry, err error) error {
+			if b, _ := os.ReadFile(name); bytes.Equal(b, []byte("secret")) {
+				t.Errorf("%q: received %s from outside the root", line, name)
+			}
+			return nil
+		})
+	}
+
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "f"), []byte("upload"), 0644)
+	for _, line := range []string{"to out", "to -d out", "to sub/rel", "to -d sub/rel", "to out/f", "to evil"} {
+		request(root, line, func(conn net.Conn) error {
+			opts := rscp.Options{In: conn, Out: conn}
+			return rscp.SourceContext(context.Background(), opts, []string{filepath.Join(src, "f")})
+		})
+		if left, _ := os.ReadDir(outside); len(left) != 1 {
+			t.Errorf("%q: wrote outside the root", line)
+		}
+		if b, _ := os.ReadFile(filepath.Join(outside, "secret")); string(b) != "secret" {
+			t.Errorf("%q: overwrote a file outside the root", line)
+		}
+	}
+
+	/* what is inside is served as ever */
+	dst := t.TempDir()
+	if _, err := request(root, "from ok", func(conn net.Conn) error {
+		return rscp.SinkContext(context.Background(), rscp.Options{In: conn, Out: conn, TargetDir: true}, dst)
+	}); err != nil {
+		t.Errorf("from ok: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dst, "ok")); err != nil || string(b) != "inside" {
+		t.Errorf("from ok: received %q, %v", b, err)
+	}
+	if _, err := request(root, "to -d sub", func(conn net.Conn) error {
+		return rscp.SourceContext(context.Background(), rscp.Options{In: conn, Out: conn}, []string{filepath.Join(src, "f")})
+	}); err != nil {
+		t.Errorf("to -d sub: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "sub", "f")); err != nil || string(b) != "upload" {
+		t.Errorf("to -d sub: wrote %q, %v", b, err)
+	}
+}
+
+/* serve expands patterns in what it is asked to send, as the remote
+   shell does for scp -f */
+func TestServeGlob(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.log"} {
+		os.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+	}
+	dst := t.TempDir()
+	if _, err := request(root, "from '*.txt' none", func(conn net.Conn) error {
+		opts := rscp.Options{In: conn, Out: conn, TargetDir: true, Requested: []string{"*.txt", "none"}}
+		return rscp.SinkContext(context.Background(), opts, dst)
+	}); err == nil {
+		t.Errorf("no error for the name nothing matched")
+	}
+	got, _ := os.ReadDir(dst)
+	if len(got) != 2 || got[0].Name() != "a.txt" || got[1].Name() != "b.txt" {
+		t.Errorf("received %v, want a.txt and b.txt", got)
+	}
+}
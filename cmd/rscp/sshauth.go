@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+
+	"github.com/sftpplease/rscp"
+)
+
+/* The native SSH client logs in as ssh does, with public keys first,
+   those of ssh-agent and then those of the identity files, then by
+   keyboard-interactive and password authentication asking the user on
+   the terminal. Per host, ssh_config may reorder methods with
+   PreferredAuthentications or leave them out with PubkeyAuthentication,
+   KbdInteractiveAuthentication and PasswordAuthentication, name another
+   agent with IdentityAgent, have IdentitiesOnly keep to the keys of the
+   identity files and BatchMode ask nothing. An identity file with a
+   passphrase is offered by its public key, from the file or the .pub
+   beside it, and the passphrase asked for once the server takes it;
+   declining to give it goes on with the methods after public keys, the
+   keys after it left untried. */
+
+var errNoTerminal = errors.New("no terminal to ask on")
+
+/* authMethods are the methods ssh tries, in its order */
+var authMethods = []string{"publickey", "keyboard-interactive", "password"}
+
+/* methodOptions are the ssh_config options turning methods off */
+var methodOptions = map[string][]string{
+	"publickey":            {"pubkeyauthentication"},
+	"keyboard-interactive": {"kbdinteractiveauthentication", "challengeresponseauthentication"},
+	"password":             {"passwordauthentication"},
+}
+
+/* askUser asks question on the terminal, echoing the answer or not */
+var askUser = func(question string, echo bool) (string, error) {
+	in, out := os.Stdin, os.Stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		in, out = tty, tty
+	}
+	if !term.IsTerminal(int(in.Fd())) {
+		return "", errNoTerminal
+	}
+	fmt.Fprint(out, question)
+	if !echo {
+		answer, err := term.ReadPassword(int(in.Fd()))
+		fmt.Fprintln(out)
+		return string(answer), err
+	}
+	var answer []byte
+	for b := make([]byte, 1); ; { /* a byte at a time, leaving what follows the line */
+		if _, err := in.Read(b); err != nil {
+			return "", err
+		} else if b[0] == '\n' {
+			return strings.TrimSuffix(string(answer), "\r"), nil
+		}
+		answer = append(answer, b[0])
+	}
+}
+
+/* configureAuth sets how to log in to h as cfg says */
+func (h *sshHop) configureAuth(cfg sshConfig) {
+	h.methods = authMethods
+	if v := cfg.get("preferredauthentications"); v != "" {
+		h.methods = nil
+		for _, m := range strings.Split(v, ",") {
+			if slices.Contains(authMethods, m) && !slices.Contains(h.methods, m) {
+				h.methods = append(h.methods, m)
+			}
+		}
+	}
+	h.methods = slices.DeleteFunc(slices.Clone(h.methods), func(m string) bool {
+		for _, option := range methodOptions[m] {
+			if v := cfg.get(option); v != "" {
+				return !cfg.flag(option, true)
+			}
+		}
+		return false
+	})
+
+	h.agent = os.Getenv("SSH_AUTH_SOCK")
+	switch v := cfg.get("identityagent"); {
+	case v == "" || v == "SSH_AUTH_SOCK":
+	case v == "none":
+		h.agent = ""
+	case strings.HasPrefix(v, "$"):
+		h.agent = os.Getenv(v[1:])
+	default:
+		h.agent = expandHome(expandTokens(v, *h))
+	}
+	h.identitiesOnly = cfg.flag("identitiesonly", false)
+	h.batch = cfg.flag("batchmode", false)
+	h.prompts = 3
+	if n, err := strconv.Atoi(cfg.get("numberofpasswordprompts")); err == nil && n > 0 {
+		h.prompts = n
+	}
+}
+
+/* auth are the methods to log in to h with in order, and what to call
+   once logged in to let go of ssh-agent */
+func (h sshHop) auth() (methods []ssh.AuthMethod, done func()) {
+	done = func() {}
+	for _, m := range h.methods {
+		switch {
+		case m == "publickey":
+			var keys []ssh.Signer
+			keys, done = h.keys()
+			methods = append(methods, ssh.PublicKeys(keys...))
+		case h.batch:
+		case m == "keyboard-interactive":
+			methods = append(methods, ssh.RetryableAuthMethod(ssh.KeyboardInteractive(challenge), h.prompts))
+		case m == "password":
+			methods = append(methods, ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+				return askUser(fmt.Sprintf("%s@%s's password: ", h.user, h.host), false)
+			}), h.prompts))
+		}
+	}
+	return methods, done
+}
+
+/* keys are those to offer h, those of ssh-agent first, only those of
+   identity files too with IdentitiesOnly, then those of the identity
+   files the agent lacks, and what to call to let go of the agent */
+func (h sshHop) keys() ([]ssh.Signer, func()) {
+	var files []ssh.Signer
+	for _, file := range h.identities {
+		if key := h.identity(file); key != nil {
+			files = append(files, key)
+		}
+	}
+
+	var keys []ssh.Signer
+	done := func() {}
+	if h.agent != "" {
+		if conn, err := net.Dial("unix", h.agent); err == nil {
+			done = func() { conn.Close() }
+			held, _ := agent.NewClient(conn).Signers()
+			for _, key := range held {
+				if !h.identitiesOnly || slices.ContainsFunc(files, sameKey(key)) {
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+	for _, key := range files {
+		if !slices.ContainsFunc(keys, sameKey(key)) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, done
+}
+
+func sameKey(key ssh.Signer) func(ssh.Signer) bool {
+	return func(other ssh.Signer) bool {
+		return string(other.PublicKey().Marshal()) == string(key.PublicKey().Marshal())
+	}
+}
+
+/* identity is the key in file, nil when there is none to use. One with
+   a passphrase is unlocked once it is to sign, or right away when its
+   public key is not at hand, and left out in batch mode. */
+func (h sshHop) identity(file string) ssh.Signer {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	key, err := ssh.ParsePrivateKey(pem)
+	var missing *ssh.PassphraseMissingError
+	if err == nil {
+		return key
+	} else if !errors.As(err, &missing) || h.batch {
+		return nil
+	}
+
+	locked := &lockedKey{file: file, pem: pem, pub: missing.PublicKey}
+	if locked.pub == nil {
+		if data, err := os.ReadFile(file + ".pub"); err == nil {
+			locked.pub, _, _, _, _ = ssh.ParseAuthorizedKey(data)
+		}
+	}
+	if locked.pub == nil {
+		if err := locked.unlock(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil
+		}
+		return locked.key
+	}
+	return locked
+}
+
+/* lockedKey is a key with a passphrase, shown by its public key until
+   it is to sign */
+type lockedKey struct {
+	file string
+	pem  []byte
+	pub  ssh.PublicKey
+	key  ssh.AlgorithmSigner /* once unlocked */
+}
+
+func (k *lockedKey) PublicKey() ssh.PublicKey {
+	return k.pub
+}
+
+func (k *lockedKey) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return k.SignWithAlgorithm(rand, data, "")
+}
+
+func (k *lockedKey) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if k.key == nil {
+		if err := k.unlock(); err != nil {
+			return nil, err
+		}
+	}
+	return k.key.SignWithAlgorithm(rand, data, algorithm)
+}
+
+/* unlock asks for the passphrase of the key, again when wrong up to
+   three times and not when none is given */
+func (k *lockedKey) unlock() error {
+	for range 3 {
+		passphrase, err := askUser(fmt.Sprintf("Enter passphrase for key '%s': ", k.file), false)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k.file, err)
+		} else if passphrase == "" {
+			break
+		}
+		key, err := ssh.ParsePrivateKeyWithPassphrase(k.pem, []byte(passphrase))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", k.file, err)
+		}
+		signer, ok := key.(ssh.AlgorithmSigner)
+		if !ok {
+			return fmt.Errorf("%s: %w", k.file, errors.ErrUnsupported)
+		}
+		k.key = signer
+		return nil
+	}
+	return fmt.Errorf("%s: no passphrase given", k.file)
+}
+
+/* challenge asks the user what the server asks with keyboard-interactive
+   authentication, its name and instructions ahead */
+func challenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	var header strings.Builder
+	for _, text := range []string{name, instruction} {
+		for line := range strings.Lines(text) {
+			header.WriteString(rscp.Sanitize(strings.TrimSuffix(line, "\n")) + "\n")
+		}
+	}
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		var err error
+		if answers[i], err = askUser(header.String()+rscp.Sanitize(q), echos[i]); err != nil {
+			return nil, err
+		}
+		header.Reset()
+	}
+	return answers, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* sshConfig is what ssh_config files give one host, keywords in lower
+   case to their values. The first value obtained for a keyword is the
+   one used, as for ssh, IdentityFile collecting all of them. Match
+   blocks are not evaluated and their options never apply. */
+type sshConfig map[string][]string
+
+/* sshConfigFiles are the ssh_config files read, in order */
+func sshConfigFiles() []string {
+	return []string{filepath.Join(sshDir(), "config"), "/etc/ssh/ssh_config"}
+}
+
+/* multiValued are keywords whose values add up over all blocks that apply */
+var multiValued = map[string]bool{"identityfile": true, "certificatefile": true}
+
+/* hostConfig reads the ssh_config files for what applies to host */
+func hostConfig(host string) sshConfig {
+	cfg := sshConfig{}
+	for _, file := range sshConfigFiles() {
+		cfg.read(file, host, 0)
+	}
+	return cfg
+}
+
+/* get is the value of key, empty when not set */
+func (cfg sshConfig) get(key string) string {
+	if v := cfg[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+/* flag is whether key is yes, def when it is neither yes nor no */
+func (cfg sshConfig) flag(key string, def bool) bool {
+	switch strings.ToLower(cfg.get(key)) {
+	case "yes":
+		return true
+	case "no":
+		return false
+	}
+	return def
+}
+
+/* read adds what file gives host, depth counting the Include
+   directives it is reached through */
+func (cfg sshConfig) read(file, host string, depth int) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	cfg.parse(f, host, depth)
+}
+
+func (cfg sshConfig) parse(r io.Reader, host string, depth int) {
+	applies := true /* options ahead of any Host line apply to all */
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		key, args := configLine(sc.Text())
+		switch key {
+		case "":
+			continue
+		case "host":
+			applies = matchHost(host, args)
+		case "match":
+			applies = false
+		case "include":
+			if applies && depth < 16 {
+				for _, pattern := range args {
+					if !filepath.IsAbs(expandHome(pattern)) {
+						pattern = filepath.Join(sshDir(), pattern)
+					}
+					names, _ := filepath.Glob(expandHome(pattern))
+					for _, name := range names {
+						cfg.read(name, host, depth+1)
+					}
+				}
+			}
+		default:
+			if !applies || len(args) == 0 {
+				continue
+			}
+			if multiValued[key] {
+				cfg[key] = append(cfg[key], args[0])
+			} else if cfg[key] == nil {
+				cfg[key] = args
+			}
+		}
+	}
+}
+
+/* configLine splits a line into its keyword in lower case and its
+   arguments, either separated from it by blanks or by =, with double
+   quotes around those holding blanks */
+func configLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil
+	}
+	key, rest := strings.ToLower(line[:end]), strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+	var args []string
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			close := strings.IndexByte(rest[1:], '"')
+			if close < 0 {
+				return key, nil /* unterminated, the line is not taken */
+			}
+			arg, rest = rest[1:close+1], rest[close+2:]
+		} else if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			arg, rest = rest[:i], rest[i:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return key, args
+}
+
+/* matchHost tells whether host matches the patterns of a Host line, any
+   of them and none negated with ! */
+func matchHost(host string, patterns []string) bool {
+	matched := false
+	for _, p := range patterns {
+		if negated := strings.HasPrefix(p, "!"); negated {
+			if wildcard(p[1:], host) {
+				return false
+			}
+		} else if wildcard(p, host) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+/* wildcard matches s against pattern with * for any characters and ?
+   for one, case aside as host names go */
+func wildcard(pattern, s string) bool {
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+/* expandHome puts the home directory for a leading ~ */
+func expandHome(name string) string {
+	if name == "~" || strings.HasPrefix(name, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, name[1:])
+		}
+	}
+	return name
+}
+
+/* expandTokens puts what they stand for for the % tokens ssh_config
+   takes in IdentityFile: %h the host name, %n the name given, %p the
+   port, %r the remote user, %u the local user, %d the home directory */
+func expandTokens(s string, h sshHop) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	home, _ := os.UserHomeDir()
+	return strings.NewReplacer("%%", "%", "%h", h.host, "%n", h.name, "%p", h.port,
+		"%r", h.user, "%u", loginName(), "%d", home).Replace(s)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHostConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	os.Mkdir(filepath.Join(home, ".ssh"), 0700)
+	os.Mkdir(filepath.Join(home, ".ssh", "config.d"), 0700)
+	os.WriteFile(filepath.Join(home, ".ssh", "config.d", "work"), []byte(`
+Host *.work
+	User worker
+	IdentityFile ~/.ssh/work_%h
+`), 0600)
+	os.WriteFile(filepath.Join(home, ".ssh", "config"), []byte(`
+# first values win, identity files add up
+Include config.d/*
+Host alias other
+	HostName=real.example.org
+	Port 2222
+	IdentityFile "~/.ssh/with blank"
+Host al?as !nothere
+	User aliasuser
+	Port 1
+Match host alias
+	User matched
+Host *
+	User everyone
+	IdentityFile ~/.ssh/id_rsa
+`), 0600)
+
+	tests := []struct {
+		host string
+		want sshConfig
+	}{
+		{"alias", sshConfig{
+			"hostname":     {"real.example.org"},
+			"port":         {"2222"},
+			"user":         {"aliasuser"},
+			"identityfile": {"~/.ssh/with blank", "~/.ssh/id_rsa"},
+		}},
+		{"ALIAS", sshConfig{
+			"hostname":     {"real.example.org"},
+			"port":         {"2222"},
+			"user":         {"aliasuser"},
+			"identityfile": {"~/.ssh/with blank", "~/.ssh/id_rsa"},
+		}},
+		{"nothere", sshConfig{"user": {"everyone"}, "identityfile": {"~/.ssh/id_rsa"}}},
+		{"box.work", sshConfig{"user": {"worker"}, "identityfile": {"~/.ssh/work_%h", "~/.ssh/id_rsa"}}},
+	}
+	for _, tt := range tests {
+		got := hostConfig(tt.host)
+		for key := range got { /* what the system ssh_config adds is not of interest */
+			if _, ok := tt.want[key]; !ok {
+				delete(got, key)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	h := sshHop{name: "box.work"}
+	h.configure()
+	if h.host != "box.work" || h.port != DefaultSSHPort || h.user != "worker" ||
+		len(h.identities) != 2 || h.identities[0] != filepath.Join(home, ".ssh", "work_box.work") {
+		t.Errorf("configured %+v", h)
+	}
+	h = sshHop{name: "alias", user: "given", port: "22"}
+	h.configure()
+	if h.host != "real.example.org" || h.port != "22" || h.user != "given" {
+		t.Errorf("the command line not going first: %+v", h)
+	}
+}
+
+func TestConfigLine(t *testing.T) {
+	for line, want := range map[string][]string{
+		"Host a b":             {"host", "a", "b"},
+		"  HostName = x":       {"hostname", "x"},
+		"Port=22":              {"port", "22"},
+		`IdentityFile "a b" c`: {"identityfile", "a b", "c"},
+		"# Port 22":            {""},
+		"":                     {""},
+		`IdentityFile "a b`:    {"identityfile"},
+		"\tUser\tme":           {"user", "me"},
+	} {
+		key, args := configLine(line)
+		if got := append([]string{key}, args...); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%q: got %q, want %q", line, got, want)
+		}
+	}
+}
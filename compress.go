@@ -0,0 +1,104 @@
+package rscp
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+)
+
+/* compressors in order of preference, each also names its extension.
+   gzip is deflate with a CRC-32 of all sent, deflate is kept for rscp
+   peers without gzip. */
+var compressors = []string{"gzip", "deflate"}
+
+/* compressWriter is what a source compresses through, flushed before it
+   waits for the sink and closed at the end */
+type compressWriter interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+/* compression is the negotiated compressor, empty for none */
+func (s *session) compression() string {
+	for _, c := range compressors {
+		if s.ext[c] {
+			return c
+		}
+	}
+	return ""
+}
+
+/* compressOut compresses what the source sends from now on */
+func (s *session) compressOut() {
+	switch s.compression() {
+	case "gzip":
+		w, _ := gzip.NewWriterLevel(s.out, gzip.DefaultCompression)
+		s.compressor = w
+		s.out = w
+		s.codec()
+	case "deflate":
+		w, _ := flate.NewWriter(s.out, flate.DefaultCompression)
+		s.compressor = w
+		s.out = w
+		s.codec()
+	}
+}
+
+/* compressIn decompresses what the sink receives from now on */
+func (s *session) compressIn() {
+	switch s.compression() {
+	case "gzip":
+		s.in = &gzipReader{r: s.in}
+		s.codec()
+	case "deflate":
+		s.in = flate.NewReader(s.in)
+		s.codec()
+	}
+}
+
+/* gzipReader decompresses the gzip stream on r, reading its header on
+   the first read since it comes with the first message of the source */
+type gzipReader struct {
+	r io.Reader
+	z *gzip.Reader
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	if g.z == nil {
+		z, err := gzip.NewReader(g.r)
+		if err != nil {
+			return 0, err
+		}
+		z.Multistream(false) /* the end of the stream is that of the session */
+		g.z = z
+	}
+	return g.z.Read(p)
+}
+
+/* flush pushes compressed data out before the source waits for a reply */
+func (s *session) flush() error {
+	if s.compressor == nil {
+		return nil
+	}
+	s.keepalive.lock()
+	defer s.keepalive.unlock()
+	if err := s.compressor.Flush(); err != nil {
+		return FatalError{Err: err}
+	}
+	return nil
+}
+
+/* endCompress ends the compressed stream so the sink sees a clean end */
+func (s *session) endCompress() error {
+	if s.compressor == nil {
+		return nil
+	}
+	s.keepalive.stop() /* heartbeats would follow the end */
+	w := s.compressor
+	s.compressor = nil
+	if err := w.Close(); err != nil {
+		return FatalError{Err: err}
+	}
+	return nil
+}
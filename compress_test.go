@@ -0,0 +1,69 @@
+package rscp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+/* What a compressing source sends reaches the sink whole, with gzip
+   preferred and deflate as a peer without gzip would have it */
+func TestCompress(t *testing.T) {
+	defer func(c []string) { compressors = c }(compressors)
+
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(big[:len(big)/2]) /* half random, half zeros */
+	files := map[string][]byte{
+		"/src/big":       big,
+		"/src/text":      []byte(strings.Repeat("all work and no play\n", 1000)),
+		"/src/empty":     nil,
+		"/src/sub/short": []byte("x"),
+	}
+
+	for _, list := range [][]string{{"gzip", "deflate"}, {"deflate"}} {
+		compressors = list
+		src, dst := NewMemFS(), NewMemFS()
+		src.Mkdir("/src", 0755)
+		src.Mkdir("/src/sub", 0755)
+		for name, data := range files {
+			src.WriteFile(name, data, 0644)
+		}
+		dst.Mkdir("/dst", 0755)
+
+		sinkIn, sourceOut := io.Pipe()
+		sourceIn, sinkOut := io.Pipe()
+		var sent bytes.Buffer
+		sinkErr := make(chan error, 1)
+		go func() {
+			opts := Options{In: io.TeeReader(sinkIn, &sent), Out: sinkOut, FS: dst, Recursive: true, Compress: true}
+			err := SinkContext(context.Background(), opts, "/dst")
+			sinkOut.Close()
+			sinkErr <- err
+		}()
+		opts := Options{In: sourceIn, Out: sourceOut, FS: src, Recursive: true, Compress: true, RscpPeer: true}
+		err := SourceContext(context.Background(), opts, []string{"/src"})
+		sourceOut.Close()
+		if err2 := <-sinkErr; err == nil {
+			err = err2
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", list, err)
+		}
+
+		for name, data := range files {
+			got, err := dst.ReadFile("/dst" + name)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%v: %s: received %d bytes, %v, want %d", list, name, len(got), err, len(data))
+			}
+		}
+		if sent.Len() > len(big) {
+			t.Errorf("%v: %d bytes sent, not compressed", list, sent.Len())
+		}
+		if gzipped := bytes.Contains(sent.Bytes(), []byte{0x1f, 0x8b, 8}); gzipped != (list[0] == "gzip") {
+			t.Errorf("%v: gzip stream sent: %v", list, gzipped)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package rscp
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+/* rootFS confines what a sink does under the target directory to it
+   through an os.Root, which resolves names a component at a time the
+   way openat with RESOLVE_BENEATH does: names reaching out through a
+   symlink or "..", whether found in the target or slipped in while the
+   transfer runs, fail instead. Names not under the directory, those of
+   tees, go to the host file system as they are. */
+type rootFS struct {
+	OsFS
+	dir  string
+	root *os.Root
+	jail bool /* names not under dir are refused, see ConfineFS */
+}
+
+/* ConfineFS is the host file system confined to root, as a sink keeps
+   to its target: names under the directory root was opened on are
+   looked up through it, none reaching out through a symlink or "..",
+   and other names are refused. Closing root is left to the caller. */
+func ConfineFS(root *os.Root) FS {
+	return &rootFS{dir: path.Clean(filepath.ToSlash(root.Name())), root: root, jail: true}
+}
+
+/* confineTo has the sink into target keep within it, with the host
+   file system and a directory as target */
+func (s *session) confineTo(target string) error {
+	under := &s.fs
+	if dry, ok := s.fs.(*dryFS); ok { /* a dry run reads as confined */
+		under = &dry.FS
+	}
+	if _, ok := (*under).(OsFS); !ok {
+		return nil
+	}
+	if st, err := (*under).Stat(target); err != nil || !st.IsDir() {
+		return nil
+	}
+	root, err := os.OpenRoot(target)
+	if err != nil {
+		return FatalError{Err: err}
+	}
+	s.root = root
+	*under = &rootFS{dir: path.Clean(target), root: root}
+	return nil
+}
+
+/* beneath is name relative to the root when under it. Names a jail
+   does not hold are taken as lying above the root, which it refuses
+   as escaping it. */
+func (r *rootFS) beneath(name string) (string, bool) {
+	rel, ok := beneath(r.dir, name)
+	if !ok && r.jail {
+		return path.Join("..", name), true
+	}
+	return rel, ok
+}
+
+/* named has errors tell name rather than the name within the root */
+func (r *rootFS) named(name string, err error) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		pe.Path = name
+	}
+	return err
+}
+
+func (r *rootFS) renamed(oldname, newname string, err error) error {
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		le.Old, le.New = oldname, newname
+	}
+	return r.named(newname, err)
+}
+
+func (r *rootFS) Open(name string) (File, error) {
+	return r.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (r *rootFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	rel, ok := r.beneath(name)
+	if !ok {
+		return r.OsFS.OpenFile(name, flag, perm)
+	}
+	f, err := r.root.OpenFile(rel, flag, perm&os.ModePerm) /* no special bits, the chmod after sets them */
+	if err != nil {
+		return nil, r.named(name, err) /* keep nil File interface nil */
+	}
+	if rel == "." { /* named "." by the root, a source sends the name of the directory */
+		return &rootDir{f, path.Base(r.dir)}, nil
+	}
+	return f, nil
+}
+
+/* rootDir is the directory of the root opened through it, its name
+   that of the directory rather than "." */
+type rootDir struct {
+	*os.File
+	base string
+}
+
+func (d *rootDir) Stat() (os.FileInfo, error) {
+	st, err := d.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return rootDirInfo{st, d.base}, nil
+}
+
+type rootDirInfo struct {
+	os.FileInfo
+	base string
+}
+
+func (st rootDirInfo) Name() string { return st.base }
+
+func (r *rootFS) Stat(name string) (os.FileInfo, error) {
+	if rel, ok := r.beneath(name); ok {
+		st, err := r.root.Stat(rel)
+		return st, r.named(name, err)
+	}
+	return r.OsFS.Stat(name)
+}
+
+func (r *rootFS) Lstat(name string) (os.FileInfo, error) {
+	if rel, ok := r.beneath(name); ok {
+		st, err := r.root.Lstat(rel)
+		return st, r.named(name, err)
+	}
+	return r.OsFS.Lstat(name)
+}
+
+func (r *rootFS) Mkdir(name string, perm os.FileMode) error {
+	if rel, ok := r.beneath(name); ok {
+		return r.named(name, r.root.Mkdir(rel, perm&os.ModePerm))
+	}
+	return r.OsFS.Mkdir(name, perm)
+}
+
+func (r *rootFS) Chmod(name string, perm os.FileMode) error {
+	if rel, ok := r.beneath(name); ok {
+		return r.named(name, r.root.Chmod(rel, perm))
+	}
+	return r.OsFS.Chmod(name, perm)
+}
+
+func (r *rootFS) Chtimes(name string, atime, mtime time.Time) error {
+	if rel, ok := r.beneath(name); ok {
+		return r.named(name, r.root.Chtimes(rel, atime, mtime))
+	}
+	return r.OsFS.Chtimes(name, atime, mtime)
+}
+
+func (r *rootFS) Chown(name string, uid, gid int) error {
+	if rel, ok := r.beneath(name); ok {
+		return r.named(name, r.root.Chown(rel, uid, gid))
+	}
+	return r.OsFS.Chown(name, uid, gid)
+}
+
+func (r *rootFS) Lchown(name string, uid, gid int) error {
+	if rel, ok := r.beneath(name); ok {
+		return r.named(name, r.root.Lchown(rel, uid, gid))
+	}
+	return r.OsFS.Lchown(name, uid, gid)
+}
+
+func (r *rootFS) Symlink(target, name string) error {
+	if rel, ok := r.beneath(name); ok {
+		return r.named(name, r.root.Symlink(target, rel))
+	}
+	return r.OsFS.Symlink(target, name)
+}
+
+func (r *rootFS) Link(oldname, newname string) error {
+	oldRel, oldOk := r.beneath(oldname)
+	newRel, newOk := r.beneath(newname)
+	switch {
+	case oldOk && newOk:
+		return r.renamed(oldname, newname, r.root.Link(oldRel, newRel))
+	case !oldOk && !newOk:
+		return r.OsFS.Link(oldname, newname)
+	}
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrPermission}
+}
+
+func (r *rootFS) Readlink(name string) (string, error) {
+	if rel, ok := r.beneath(name); ok {
+		target, err := r.root.Readlink(rel)
+		return target, r.named(name, err)
+	}
+	return r.OsFS.Readlink(name)
+}
+
+func (r *rootFS) Remove(name string) error {
+	if rel, ok := r.beneath(name); ok {
+		return r.named(name, r.root.Remove(rel))
+	}
+	return r.OsFS.Remove(name)
+}
+
+func (r *rootFS) Rename(oldname, newname string) error {
+	oldRel, oldOk := r.beneath(oldname)
+	newRel, newOk := r.beneath(newname)
+	switch {
+	case oldOk && newOk:
+		return r.renamed(oldname, newname, r.root.Rename(oldRel, newRel))
+	case !oldOk && !newOk:
+		return r.OsFS.Rename(oldname, newname)
+	}
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrPermission}
+}
+
+/* os.Root has no calls for the rest: they go on a descriptor of what
+   name is, opened through it, or of the directory it is in */
+
+/* handle opens rel through the root for calls on its descriptor, not a
+   device, whose opening could do anything */
+func (r *rootFS) handle(rel string) (*os.File, error) {
+	st, err := r.root.Lstat(rel)
+	if err != nil {
+		return nil, err
+	}
+	if st.Mode()&(os.ModeDevice|os.ModeSymlink) != 0 {
+		return nil, &os.PathError{Op: "open", Path: rel, Err: errors.ErrUnsupported}
+	}
+	f, err := r.root.OpenFile(rel, os.O_RDONLY|oHandle, 0)
+	if os.IsPermission(err) && !st.IsDir() { /* write only, as received */
+		f, err = r.root.OpenFile(rel, os.O_WRONLY|oHandle, 0)
+	}
+	return f, err
+}
+
+/* onHandle has call made on a descriptor of name when under the root */
+func (r *rootFS) onHandle(name string, call func(f *os.File) error) (bool, error) {
+	rel, ok := r.beneath(name)
+	if !ok {
+		return false, nil
+	}
+	f, err := r.handle(rel)
+	if err != nil {
+		return true, r.named(name, err)
+	}
+	defer f.Close()
+	return true, r.named(name, call(f))
+}
+
+func (r *rootFS) Listxattr(name string) (attrs []string, err error) {
+	if ok, err := r.onHandle(name, func(f *os.File) (err error) {
+		attrs, err = flistxattr(f)
+		return err
+	}); ok {
+		return attrs, err
+	}
+	return r.OsFS.Listxattr(name)
+}
+
+func (r *rootFS) Getxattr(name, attr string) (value []byte, err error) {
+	if ok, err := r.onHandle(name, func(f *os.File) (err error) {
+		value, err = fgetxattr(f, attr)
+		return err
+	}); ok {
+		return value, err
+	}
+	return r.OsFS.Getxattr(name, attr)
+}
+
+func (r *rootFS) Setxattr(name, attr string, value []byte) error {
+	if ok, err := r.onHandle(name, func(f *os.File) error { return fsetxattr(f, attr, value) }); ok {
+		return err
+	}
+	return r.OsFS.Setxattr(name, attr, value)
+}
+
+func (r *rootFS) Chflags(name string, flags uint32) error {
+	if ok, err := r.onHandle(name, func(f *os.File) error { return fchflags(f, flags) }); ok {
+		return err
+	}
+	return r.OsFS.Chflags(name, flags)
+}
+
+func (r *rootFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	rel, ok := r.beneath(name)
+	if !ok {
+		return r.OsFS.Mknod(name, mode, major, minor)
+	}
+	dir, err := r.root.Open(path.Dir(rel))
+	if err != nil {
+		return r.named(name, err)
+	}
+	defer dir.Close()
+	return r.named(name, mknodat(dir, path.Base(rel), mode, major, minor))
+}
+
+func (r *rootFS) Avail(name string) (int64, error) {
+	if rel, ok := r.beneath(name); ok { /* only looked at, checked through the root */
+		if _, err := r.root.Lstat(rel); err != nil {
+			return 0, r.named(name, err)
+		}
+	}
+	return r.OsFS.Avail(name)
+}
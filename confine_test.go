@@ -0,0 +1,145 @@
+package rscp
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/* confineTree is a target directory holding symlinks that lead out of
+   it, absolute and relative, to a file and to a directory, and the
+   directory outside they lead to */
+func confineTree(t *testing.T) (target, outside string) {
+	t.Helper()
+	top := filepath.ToSlash(t.TempDir())
+	target, outside = path.Join(top, "target"), path.Join(top, "outside")
+	for _, err := range []error{
+		os.Mkdir(target, 0755),
+		os.Mkdir(outside, 0755),
+		os.Mkdir(path.Join(target, "sub"), 0755),
+		os.WriteFile(path.Join(outside, "secret"), []byte("secret"), 0600),
+		os.Symlink(outside, path.Join(target, "out")),
+		os.Symlink("../../outside", path.Join(target, "sub", "up")),
+		os.Symlink(path.Join(outside, "secret"), path.Join(target, "evil")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return target, outside
+}
+
+/* untouched fails t if anything in outside was added or changed */
+func untouched(t *testing.T, outside, what string) {
+	t.Helper()
+	if left, _ := os.ReadDir(outside); len(left) != 1 {
+		t.Errorf("%s: wrote outside the target", what)
+	}
+	if b, _ := os.ReadFile(path.Join(outside, "secret")); string(b) != "secret" {
+		t.Errorf("%s: changed a file outside the target", what)
+	}
+}
+
+func TestRootFS(t *testing.T) {
+	target, outside := confineTree(t)
+	root, err := os.OpenRoot(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	fs := &rootFS{dir: target, root: root}
+
+	/* names are joined, not cleaned, as a sink never sends these */
+	for _, name := range []string{"../outside/new", "sub/../../outside/new", "out/new", "sub/up/new"} {
+		f, err := fs.OpenFile(target+"/"+name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err == nil {
+			f.Close()
+			t.Errorf("%s: opened for writing", name)
+		}
+		if err := fs.Mkdir(target+"/"+name+"-dir", 0755); err == nil {
+			t.Errorf("%s: made a directory", name)
+		}
+		if err := fs.Symlink("/", target+"/"+name+"-link"); err == nil {
+			t.Errorf("%s: made a symlink", name)
+		}
+	}
+	if f, err := fs.OpenFile(path.Join(target, "evil"), os.O_WRONLY|os.O_TRUNC, 0); err == nil {
+		f.Close()
+		t.Errorf("opened for writing through a symlink out of the target")
+	}
+	if err := fs.Rename(path.Join(target, "sub"), path.Join(target, "out", "sub")); err == nil {
+		t.Errorf("renamed out of the target")
+	}
+	if err := fs.Chmod(path.Join(target, "evil"), 0666); err == nil {
+		t.Errorf("chmod through a symlink out of the target")
+	}
+	if _, err := fs.Stat(path.Join(target, "out")); err == nil {
+		t.Errorf("stat through a symlink out of the target")
+	}
+	untouched(t, outside, "rootFS")
+
+	/* what stays inside works as on the host, symlinks themselves too */
+	if err := fs.Mkdir(path.Join(target, "sub", "new"), 0755); err != nil {
+		t.Error(err)
+	}
+	if st, err := fs.Lstat(path.Join(target, "evil")); err != nil || st.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat of a symlink: %v", err)
+	}
+	if _, err := fs.Stat(target + "/"); err != nil {
+		t.Errorf("target with a slash: %v", err)
+	}
+
+	/* confined to the root alone, names elsewhere are refused */
+	jail := ConfineFS(root)
+	for _, name := range []string{path.Join(outside, "secret"), "/", "relative", path.Join(target, "..", "outside")} {
+		if _, err := jail.Stat(name); err == nil {
+			t.Errorf("ConfineFS: %s: no error", name)
+		}
+	}
+	if _, err := jail.Stat(path.Join(target, "sub")); err != nil {
+		t.Errorf("ConfineFS: %v", err)
+	}
+}
+
+/* a sink receiving into a target with symlinks leading out of it
+   writes nothing outside, whatever the names sent */
+func TestSinkConfined(t *testing.T) {
+	target, outside := confineTree(t)
+	src := filepath.ToSlash(t.TempDir())
+	for _, err := range []error{
+		os.Mkdir(path.Join(src, "out"), 0755),
+		os.WriteFile(path.Join(src, "out", "new"), []byte("new"), 0644),
+		os.Mkdir(path.Join(src, "sub"), 0755),
+		os.Mkdir(path.Join(src, "sub", "up"), 0755),
+		os.WriteFile(path.Join(src, "sub", "up", "new"), []byte("new"), 0644),
+		os.WriteFile(path.Join(src, "evil"), []byte("overwritten"), 0644),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{Recursive: true}
+	srcs := []string{path.Join(src, "out"), path.Join(src, "sub"), path.Join(src, "evil")}
+	if err := LoopbackFS(context.Background(), opts, OsFS{}, srcs, OsFS{}, target); err == nil {
+		t.Errorf("no error")
+	}
+	untouched(t, outside, "sink")
+
+	/* a hostile source naming what lies above or outside the target */
+	for _, lines := range []string{
+		"C0644 3 ../outside/new\nnew\x00",
+		"C0644 3 " + path.Join(outside, "new") + "\nnew\x00",
+		"D0755 0 ..\nD0755 0 outside\nC0644 3 new\nnew\x00E\nE\n",
+		"D0755 0 out\nC0644 3 new\nnew\x00E\n",
+	} {
+		opts := Options{In: strings.NewReader(lines), Out: io.Discard, Recursive: true}
+		if err := SinkContext(context.Background(), opts, target); err == nil {
+			t.Errorf("%q: no error", lines)
+		}
+		untouched(t, outside, lines)
+	}
+}
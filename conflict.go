@@ -0,0 +1,131 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* Conflict is what a sink does when it already has something under a
+   name it receives a file, symlink, special file or hard link as.
+   Directories are received into those there, not conflicting. */
+type Conflict int
+
+const (
+	ConflictOverwrite Conflict = iota /* replace it */
+	ConflictSkip                      /* keep it, not failing */
+	ConflictError                     /* keep it and fail the file */
+	ConflictBackup                    /* keep it as the name with BackupSuffix and replace it */
+)
+
+var conflictNames = []string{
+	ConflictOverwrite: "overwrite",
+	ConflictSkip:      "skip",
+	ConflictError:     "error",
+	ConflictBackup:    "backup",
+}
+
+func (c Conflict) String() string {
+	if c >= 0 && int(c) < len(conflictNames) {
+		return conflictNames[c]
+	}
+	return "unknown"
+}
+
+/* ParseConflict is the Conflict named text */
+func ParseConflict(text string) (Conflict, error) {
+	for c, name := range conflictNames {
+		if name == text {
+			return Conflict(c), nil
+		}
+	}
+	return 0, fmt.Errorf("%q: %w", text, ErrUnknownConflict)
+}
+
+const BackupSuffix = "~" /* replaces backups from before */
+
+var (
+	ErrNotOverwritten  = errors.New("exists, not overwritten")
+	ErrNewer           = errors.New("is no older, not overwritten") /* with Update */
+	ErrUnknownConflict = errors.New("not overwrite, skip, error or backup")
+
+	errDeclined = protocol.ErrDeclined /* a Y reply */
+)
+
+/* A sink skipping, for OnConflict or Update, declines a file with a Y
+   reply to its C message when the skip extension is agreed, which
+   spares sending the data, and with a warning otherwise, which the
+   source counts as failed. Skipped files do not fail at the sink. */
+
+/* onConflict has what is at name dealt with as OnConflict says before
+   something is received as name; true when it is to be skipped */
+func (s *session) onConflict(name string) (bool, error) {
+	if s.opts.OnConflict == ConflictOverwrite {
+		return false, nil
+	}
+	st, err := s.fs.Lstat(name)
+	if err != nil {
+		return false, nil
+	}
+	switch s.opts.OnConflict {
+	case ConflictSkip:
+		return true, nil
+	case ConflictError:
+		return false, fmt.Errorf("%s: %w", name, os.ErrExist)
+	case ConflictBackup:
+		return false, s.backup(name, st)
+	}
+	return false, nil
+}
+
+/* backup keeps what is at name as name with BackupSuffix. A regular
+   file replaced by renaming a temporary file over it is linked there,
+   so that name is never missing; anything else moves there. */
+func (s *session) backup(name string, st os.FileInfo) error {
+	bak := name + BackupSuffix
+	if err := s.fs.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if st.Mode().IsRegular() && !s.opts.InPlace && !s.ext["resume"] {
+		if s.fs.Link(name, bak) == nil {
+			return nil
+		}
+	}
+	return s.fs.Rename(name, bak)
+}
+
+/* newer tells whether Update keeps name for being no older than the
+   file coming with times */
+func (s *session) newer(name string, times *protocol.TMsg) bool {
+	if !s.opts.Update || times == nil {
+		return false
+	}
+	st, err := s.fs.Lstat(name)
+	return err == nil && !times.Mtime.After(st.ModTime())
+}
+
+/* setsTimes tells whether times received are set rather than only
+   compared for Update */
+func (s *session) setsTimes() bool {
+	return s.opts.Preserve || !s.opts.Update
+}
+
+/* skipFile declines the file the C message of name announces, why
+   being ErrNotOverwritten or ErrNewer */
+func (s *session) skipFile(name string, why error) error {
+	err := fmt.Errorf("%s: %w", name, why)
+	s.fileSkipped(name, err)
+	if s.ext["skip"] {
+		return s.enc.Encode(protocol.YMsg{})
+	}
+	return s.sendError(err)
+}
+
+/* skipEntry passes over a symlink, special file or hard link coming
+   without data */
+func (s *session) skipEntry(name string) error {
+	s.fileSkipped(name, fmt.Errorf("%s: %w", name, ErrNotOverwritten))
+	return s.enc.Ack()
+}
@@ -0,0 +1,103 @@
+package rscp
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+const CtxCopyChunk = 1 << 20 /* bytes copied between cancellation checks */
+
+func CancelReader(r io.Reader, ctx context.Context) io.Reader {
+	if ctx == nil {
+		panic("nil context")
+	}
+	return &CtxReader{r, ctx}
+}
+
+func CancelWriter(w io.Writer, ctx context.Context) io.Writer {
+	if ctx == nil {
+		panic("nil context")
+	}
+	return &CtxWriter{w, ctx}
+}
+
+type CtxReader struct {
+	Base io.Reader
+	Ctx  context.Context
+}
+
+func (r *CtxReader) Read(p []byte) (int, error) {
+	if r.Ctx.Err() != nil {
+		return 0, ErrCanceled
+	}
+	n, err := r.Base.Read(p)
+	if err != nil && r.Ctx.Err() != nil {
+		err = ErrCanceled
+	}
+	return n, err
+}
+
+type CtxWriter struct {
+	Base io.Writer
+	Ctx  context.Context
+}
+
+func (w *CtxWriter) Write(p []byte) (int, error) {
+	if w.Ctx.Err() != nil {
+		return 0, ErrCanceled
+	}
+	n, err := w.Base.Write(p)
+	if err != nil && w.Ctx.Err() != nil {
+		err = ErrCanceled
+	}
+	return n, err
+}
+
+func (r *CtxReader) WriteTo(w io.Writer) (int64, error) {
+	return copyChunked(w, r.Base, ctxCopyChunk, r.canceled)
+}
+
+func (w *CtxWriter) ReadFrom(r io.Reader) (int64, error) {
+	return copyChunked(w.Base, r, ctxCopyChunk, w.canceled)
+}
+
+func ctxCopyChunk() int64 {
+	return CtxCopyChunk
+}
+
+func (r *CtxReader) canceled(int64) error {
+	if r.Ctx.Err() != nil {
+		return ErrCanceled
+	}
+	return nil
+}
+
+func (w *CtxWriter) canceled(int64) error {
+	if w.Ctx.Err() != nil {
+		return ErrCanceled
+	}
+	return nil
+}
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+/* unblock pending i/o on ends supporting deadlines (pipes, sockets) once
+   ctx is done; the ends are the caller's, others are left as they are */
+func interruptOnDone(ctx context.Context, ends ...interface{}) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, end := range ends {
+				if d, ok := end.(deadliner); ok {
+					d.SetDeadline(time.Now())
+				}
+			}
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,35 @@
+package rscp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"testing"
+)
+
+/* A session without timeouts reads its input no further than the protocol
+   takes it, and leaves the ends it was given open for the caller */
+func TestSessionLeavesInput(t *testing.T) {
+	src := NewMemFS()
+	src.WriteFile("/f", []byte("hello"), 0644)
+	sourceIn, sinkOut := io.Pipe()
+	fromSource, sourceOut := io.Pipe()
+
+	go func() {
+		r := bufio.NewReader(fromSource)
+		io.WriteString(sinkOut, "\x00")
+		r.ReadString('\n') /* C0644 5 f */
+		io.WriteString(sinkOut, "\x00")
+		io.ReadFull(r, make([]byte, len("hello\x00")))
+		io.WriteString(sinkOut, "\x00")
+	}()
+	if err := SourceContext(context.Background(), Options{In: sourceIn, Out: sourceOut, FS: src}, []string{"/f"}); err != nil {
+		t.Fatal(err)
+	}
+
+	go io.WriteString(sinkOut, "after")
+	b := make([]byte, len("after"))
+	if _, err := io.ReadFull(sourceIn, b); err != nil || string(b) != "after" {
+		t.Errorf("read %q, %v past the session, want what followed it", b, err)
+	}
+}
@@ -0,0 +1,410 @@
+package rscp
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* dryFS is the FS of a sink with DryRun. It reads what is there from
+   the FS under it but writes nothing there, keeping just enough of what
+   would have been made, changed, removed or renamed for the rest of the
+   transfer to find it so; of file data only the sizes. */
+type dryFS struct {
+	FS
+	mu   sync.Mutex
+	made map[string]*dryNode /* what the dry run made, by clean name */
+	gone map[string]bool     /* what it removed or renamed away, below it too */
+}
+
+func newDryFS(under FS) *dryFS {
+	return &dryFS{FS: under, made: map[string]*dryNode{}, gone: map[string]bool{}}
+}
+
+/* dryNode is a file, directory or other the dry run made, its own
+   os.FileInfo */
+type dryNode struct {
+	name         string
+	mode         os.FileMode
+	size         int64
+	mtime        time.Time
+	target       string /* symlink target */
+	major, minor uint32
+}
+
+func (n *dryNode) Name() string       { return path.Base(n.name) }
+func (n *dryNode) Size() int64        { return n.size }
+func (n *dryNode) Mode() os.FileMode  { return n.mode }
+func (n *dryNode) ModTime() time.Time { return n.mtime }
+func (n *dryNode) IsDir() bool        { return n.mode.IsDir() }
+func (n *dryNode) Sys() interface{}   { return nil }
+
+/* find is what the dry run made of name, nil when it removed it; false
+   when it leaves name to the FS under it. Callers hold mu. */
+func (d *dryFS) find(name string) (*dryNode, bool) {
+	name = path.Clean(name)
+	if n, ok := d.made[name]; ok {
+		return n, true
+	}
+	for p := name; ; p = path.Dir(p) {
+		if d.gone[p] {
+			return nil, true
+		}
+		if path.Dir(p) == p {
+			return nil, false
+		}
+	}
+}
+
+/* lstat is name as the dry run has it, a copy of a node it made. Callers
+   hold mu. */
+func (d *dryFS) lstat(op, name string) (os.FileInfo, error) {
+	n, ok := d.find(name)
+	if !ok {
+		return d.FS.Lstat(name)
+	}
+	if n == nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+	}
+	c := *n
+	return &c, nil
+}
+
+/* node is what the dry run made of name, made from what the FS under
+   it has at first change. Callers hold mu. */
+func (d *dryFS) node(op, name string) (*dryNode, error) {
+	st, err := d.lstat(op, name)
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := d.made[path.Clean(name)]; ok {
+		return n, nil
+	}
+	n := &dryNode{name: path.Clean(name), mode: st.Mode(), size: st.Size(), mtime: st.ModTime()}
+	if n.mode&os.ModeSymlink != 0 {
+		n.target, _ = d.FS.Readlink(name)
+	}
+	d.made[n.name] = n
+	return n, nil
+}
+
+/* create records n as made, failing like the system would when its
+   name is taken or its directory missing. Callers hold mu. */
+func (d *dryFS) create(op string, n *dryNode) error {
+	n.name = path.Clean(n.name)
+	if _, err := d.lstat(op, n.name); err == nil {
+		return &os.PathError{Op: op, Path: n.name, Err: syscall.EEXIST}
+	}
+	if dir, err := d.stat(op, path.Dir(n.name), 0); err != nil {
+		return err
+	} else if !dir.IsDir() {
+		return &os.PathError{Op: op, Path: n.name, Err: syscall.ENOTDIR}
+	}
+	if n.mtime.IsZero() {
+		n.mtime = time.Now()
+	}
+	d.made[n.name] = n
+	return nil
+}
+
+/* stat is lstat following symlinks. Callers hold mu. */
+func (d *dryFS) stat(op, name string, hops int) (os.FileInfo, error) {
+	st, err := d.lstat(op, name)
+	if err != nil || st.Mode()&os.ModeSymlink == 0 {
+		return st, err
+	}
+	if hops == MaxSymlinkHops {
+		return nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+	}
+	n, ok := d.made[path.Clean(name)]
+	if !ok {
+		return d.FS.Stat(name) /* a link of the FS under it, going there */
+	}
+	target := n.target
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(name), target)
+	}
+	return d.stat(op, target, hops+1)
+}
+
+func (d *dryFS) Stat(name string) (os.FileInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stat("stat", name, 0)
+}
+
+func (d *dryFS) Lstat(name string) (os.FileInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lstat("lstat", name)
+}
+
+func (d *dryFS) Open(name string) (File, error) {
+	return d.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (d *dryFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if _, made := d.find(name); !made && !write {
+		return d.FS.OpenFile(name, flag, perm)
+	}
+	st, err := d.stat("open", name, 0)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+	case err == nil && st.IsDir() && write:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		err = d.create("open", &dryNode{name: name, mode: perm & os.ModePerm})
+	}
+	if err != nil {
+		return nil, err
+	}
+	var n *dryNode
+	if write {
+		if n, err = d.node("open", name); err != nil {
+			return nil, err
+		}
+		if flag&os.O_TRUNC != 0 {
+			n.size = 0
+		}
+	} else {
+		n, _ = d.find(name)
+	}
+	return &dryFile{fs: d, node: n, path: name}, nil
+}
+
+func (d *dryFS) Mkdir(name string, perm os.FileMode) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.create("mkdir", &dryNode{name: name, mode: os.ModeDir | perm&os.ModePerm})
+}
+
+/* change has f make the change of op to name, which must be there */
+func (d *dryFS) change(op, name string, f func(n *dryNode)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.node(op, name)
+	if err == nil && f != nil {
+		f(n)
+	}
+	return err
+}
+
+func (d *dryFS) Chmod(name string, perm os.FileMode) error {
+	return d.change("chmod", name, func(n *dryNode) { n.mode = n.mode&os.ModeType | perm&^os.ModeType })
+}
+
+func (d *dryFS) Chtimes(name string, atime, mtime time.Time) error {
+	return d.change("chtimes", name, func(n *dryNode) { n.mtime = mtime })
+}
+
+func (d *dryFS) Chown(name string, uid, gid int) error      { return d.change("chown", name, nil) }
+func (d *dryFS) Lchown(name string, uid, gid int) error     { return d.change("lchown", name, nil) }
+func (d *dryFS) Chflags(name string, flags uint32) error    { return d.change("chflags", name, nil) }
+func (d *dryFS) Setxattr(name, attr string, v []byte) error { return d.change("setxattr", name, nil) }
+
+func (d *dryFS) Symlink(target, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.create("symlink", &dryNode{name: name, mode: os.ModeSymlink | 0777, target: target})
+}
+
+func (d *dryFS) Link(oldname, newname string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st, err := d.lstat("link", oldname)
+	if err != nil {
+		return err
+	}
+	return d.create("link", &dryNode{name: newname, mode: st.Mode(), size: st.Size(), mtime: st.ModTime()})
+}
+
+func (d *dryFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.create("mknod", &dryNode{name: name, mode: mode, major: major, minor: minor})
+}
+
+func (d *dryFS) Readlink(name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, ok := d.find(name)
+	if !ok {
+		return d.FS.Readlink(name)
+	}
+	if n == nil || n.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return n.target, nil
+}
+
+func (d *dryFS) Remove(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.lstat("remove", name); err != nil {
+		return err
+	}
+	name = path.Clean(name)
+	delete(d.made, name)
+	d.gone[name] = true
+	return nil
+}
+
+/* Rename moves what the dry run made below oldname along; what the FS
+   under it has there stays behind, out of sight */
+func (d *dryFS) Rename(oldname, newname string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.node("rename", oldname)
+	if err != nil {
+		return err
+	}
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	if dir, err := d.stat("rename", path.Dir(newname), 0); err != nil {
+		return err
+	} else if !dir.IsDir() {
+		return &os.PathError{Op: "rename", Path: newname, Err: syscall.ENOTDIR}
+	}
+	for name, c := range d.made {
+		if rest, ok := strings.CutPrefix(name, oldname+"/"); ok {
+			delete(d.made, name)
+			c.name = newname + "/" + rest
+			d.made[c.name] = c
+		}
+	}
+	delete(d.made, oldname)
+	d.gone[oldname], d.gone[newname] = true, true
+	n.name = newname
+	d.made[newname] = n
+	return nil
+}
+
+func (d *dryFS) Listxattr(name string) ([]string, error) {
+	d.mu.Lock()
+	n, ok := d.find(name)
+	d.mu.Unlock()
+	if ok && n != nil {
+		return nil, nil
+	}
+	return d.FS.Listxattr(name)
+}
+
+func (d *dryFS) Atime(st os.FileInfo) time.Time {
+	if n, ok := st.(*dryNode); ok {
+		return n.mtime
+	}
+	return d.FS.Atime(st)
+}
+
+func (d *dryFS) Owner(st os.FileInfo) (int, int, bool) {
+	if _, ok := st.(*dryNode); ok {
+		return 0, 0, false
+	}
+	return d.FS.Owner(st)
+}
+
+func (d *dryFS) Inode(st os.FileInfo) (uint64, uint64, uint64, bool) {
+	if _, ok := st.(*dryNode); ok {
+		return 0, 0, 0, false
+	}
+	return d.FS.Inode(st)
+}
+
+func (d *dryFS) Rdev(st os.FileInfo) (uint32, uint32, bool) {
+	if n, ok := st.(*dryNode); ok {
+		return n.major, n.minor, true
+	}
+	return d.FS.Rdev(st)
+}
+
+func (d *dryFS) Flags(st os.FileInfo) (uint32, bool) {
+	if _, ok := st.(*dryNode); ok {
+		return 0, false
+	}
+	return d.FS.Flags(st)
+}
+
+/* dryFile is a file the dry run made or writes, its data read back as
+   zeros */
+type dryFile struct {
+	fs   *dryFS
+	node *dryNode
+	path string
+	off  int64
+}
+
+func (f *dryFile) Name() string { return f.path }
+
+func (f *dryFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.off >= f.node.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), f.node.size-f.off))
+	clear(p[:n])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *dryFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.off += int64(len(p))
+	f.node.size = max(f.node.size, f.off)
+	return len(p), nil
+}
+
+func (f *dryFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.node.size
+	}
+	if offset < 0 {
+		return f.off, &os.PathError{Op: "seek", Path: f.path, Err: syscall.EINVAL}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *dryFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	c := *f.node
+	return &c, nil
+}
+
+func (f *dryFile) Readdir(n int) ([]os.FileInfo, error) {
+	if n > 0 {
+		return nil, io.EOF
+	}
+	return nil, nil
+}
+
+func (f *dryFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.node.size = size
+	return nil
+}
+
+func (f *dryFile) Chmod(mode os.FileMode) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.node.mode = f.node.mode&os.ModeType | mode&^os.ModeType
+	return nil
+}
+
+func (f *dryFile) Sync() error  { return nil }
+func (f *dryFile) Close() error { return nil }
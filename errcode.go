@@ -0,0 +1,67 @@
+package rscp
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* ErrorCode classifies transfer failures for automated callers */
+type ErrorCode int
+
+const (
+	CodeOK         ErrorCode = iota
+	CodeProtocol             /* malformed or unexpected protocol message */
+	CodePermission           /* access denied by the local system */
+	CodeNoSpace              /* local disk or quota exhausted */
+	CodeRemote               /* failure reported by the peer */
+	CodeLocalIO              /* any other local failure */
+	CodeCanceled             /* transfer canceled by the caller */
+	CodeTimeout              /* transfer took longer than Options.Timeout */
+)
+
+var codeNames = []string{
+	CodeOK:         "ok",
+	CodeProtocol:   "protocol error",
+	CodePermission: "permission denied",
+	CodeNoSpace:    "no space left",
+	CodeRemote:     "remote error",
+	CodeLocalIO:    "local i/o error",
+	CodeCanceled:   "canceled",
+	CodeTimeout:    "timed out",
+}
+
+func (c ErrorCode) String() string {
+	if c >= 0 && int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "unknown error"
+}
+
+/* Code tells the kind of err, for accumulated errors the most severe one wins */
+func Code(err error) ErrorCode {
+	var remote RemoteError
+	switch {
+	case err == nil:
+		return CodeOK
+	case errors.Is(err, ErrDeadline):
+		return CodeTimeout
+	case errors.Is(err, ErrCanceled):
+		return CodeCanceled
+	case errors.Is(err, ErrProtocol):
+		return CodeProtocol
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return CodeNoSpace
+	case errors.Is(err, os.ErrPermission):
+		return CodePermission
+	case errors.As(err, &remote):
+		return CodeRemote
+	default:
+		return CodeLocalIO
+	}
+}
+
+/* RemoteError carries an error message received from the peer */
+type RemoteError = protocol.RemoteError
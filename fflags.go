@@ -0,0 +1,74 @@
+package rscp
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* file flags travel by name, their bits are those BSD and macOS share */
+var fileFlags = []struct {
+	name string
+	bit  uint32
+}{
+	{"nodump", 0x1},
+	{"uchg", 0x2},
+	{"uappnd", 0x4},
+	{"opaque", 0x8},
+	{"hidden", 0x8000},
+	{"arch", 0x10000},
+	{"schg", 0x20000},
+	{"sappnd", 0x40000},
+}
+
+/* flagNames lists the flags set in bits, dropping those without a name */
+func flagNames(bits uint32) []string {
+	var names []string
+	for _, f := range fileFlags {
+		if bits&f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+/* flagBits is the inverse of flagNames, ignoring unknown names */
+func flagBits(names []string) uint32 {
+	var bits uint32
+	for _, name := range names {
+		for _, f := range fileFlags {
+			if name == f.name {
+				bits |= f.bit
+			}
+		}
+	}
+	return bits
+}
+
+/* sendFlags sends the file flags of st, if any */
+func (s *session) sendFlags(st os.FileInfo) error {
+	bits, ok := s.fs.Flags(st)
+	if !ok || len(flagNames(bits)) == 0 {
+		return nil
+	}
+	if err := s.enc.Encode(protocol.UMsg{Flags: flagNames(bits)}); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+/* setFlags sets the flags of m on name last of all attributes, as
+   uchg and the like forbid any further change; skipped where the file
+   system has none */
+func (s *session) setFlags(name string, m *protocol.UMsg) error {
+	if m == nil {
+		return nil
+	}
+	err := s.fs.Chflags(name, flagBits(m.Flags))
+	if errors.Is(err, errors.ErrUnsupported) || errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,29 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+
+package rscp
+
+import (
+	"os"
+	"syscall"
+)
+
+func statFlags(st os.FileInfo) (uint32, bool) {
+	if sysStat, ok := st.Sys().(*syscall.Stat_t); ok {
+		return uint32(sysStat.Flags), true
+	}
+	return 0, false
+}
+
+func chflags(name string, flags uint32) error {
+	if err := syscall.Chflags(name, int(flags)); err != nil {
+		return &os.PathError{Op: "chflags", Path: name, Err: err}
+	}
+	return nil
+}
+
+func fchflags(f *os.File, flags uint32) error {
+	if err := syscall.Fchflags(int(f.Fd()), int(flags)); err != nil {
+		return &os.PathError{Op: "fchflags", Path: f.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !(darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package rscp
+
+import (
+	"errors"
+	"os"
+)
+
+func statFlags(st os.FileInfo) (uint32, bool) {
+	return 0, false
+}
+
+func chflags(name string, flags uint32) error {
+	return &os.PathError{Op: "chflags", Path: name, Err: errors.ErrUnsupported}
+}
+
+func fchflags(f *os.File, flags uint32) error {
+	return &os.PathError{Op: "fchflags", Path: f.Name(), Err: errors.ErrUnsupported}
+}
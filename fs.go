@@ -0,0 +1,153 @@
+package rscp
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+/* FS is the file system sessions read from and write to, OsFS by default */
+type FS interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	Chmod(name string, perm os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Chown(name string, uid, gid int) error
+	Lchown(name string, uid, gid int) error
+	Symlink(target, name string) error
+	Link(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+
+	/* extended attributes, errors.ErrUnsupported where the FS has none */
+	Listxattr(name string) ([]string, error)
+	Getxattr(name, attr string) ([]byte, error)
+	Setxattr(name, attr string, value []byte) error
+
+	/* access time of a FileInfo returned by this FS, zero Unix time when unknown */
+	Atime(st os.FileInfo) time.Time
+	/* owner of a FileInfo returned by this FS, false when unknown */
+	Owner(st os.FileInfo) (uid, gid int, ok bool)
+	/* identity and link count of a FileInfo returned by this FS, false when unknown */
+	Inode(st os.FileInfo) (dev, ino, nlink uint64, ok bool)
+
+	/* creates a FIFO, socket or device node, its type given by mode */
+	Mknod(name string, mode os.FileMode, major, minor uint32) error
+	/* device numbers of a FileInfo returned by this FS, false when unknown */
+	Rdev(st os.FileInfo) (major, minor uint32, ok bool)
+
+	/* BSD file flags, errors.ErrUnsupported where the FS has none */
+	Flags(st os.FileInfo) (flags uint32, ok bool)
+	Chflags(name string, flags uint32) error
+
+	/* bytes free to unprivileged users on the file system holding name,
+	   errors.ErrUnsupported where that is unknown */
+	Avail(name string) (int64, error)
+}
+
+/* File is the subset of *os.File sessions need */
+type File interface {
+	io.ReadWriteCloser
+	io.Seeker
+	Name() string
+	Stat() (os.FileInfo, error)
+	Readdir(n int) ([]os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Chmod(mode os.FileMode) error
+}
+
+/* OsFS is the host file system */
+type OsFS struct{}
+
+func (OsFS) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err /* keep nil File interface nil */
+	}
+	return f, nil
+}
+
+func (OsFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OsFS) Stat(name string) (os.FileInfo, error)  { return os.Stat(name) }
+func (OsFS) Lstat(name string) (os.FileInfo, error) { return os.Lstat(name) }
+
+func (OsFS) Mkdir(name string, perm os.FileMode) error { return os.Mkdir(name, perm) }
+func (OsFS) Chmod(name string, perm os.FileMode) error { return os.Chmod(name, perm) }
+
+func (OsFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (OsFS) Chown(name string, uid, gid int) error  { return os.Chown(name, uid, gid) }
+func (OsFS) Lchown(name string, uid, gid int) error { return os.Lchown(name, uid, gid) }
+
+func (OsFS) Symlink(target, name string) error     { return os.Symlink(target, name) }
+func (OsFS) Link(oldname, newname string) error    { return os.Link(oldname, newname) }
+func (OsFS) Readlink(name string) (string, error) { return os.Readlink(name) }
+
+func (OsFS) Remove(name string) error { return os.Remove(name) }
+
+func (OsFS) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+
+func (OsFS) Listxattr(name string) ([]string, error)        { return listxattr(name) }
+func (OsFS) Getxattr(name, attr string) ([]byte, error)     { return getxattr(name, attr) }
+func (OsFS) Setxattr(name, attr string, value []byte) error { return setxattr(name, attr, value) }
+
+func (OsFS) Atime(st os.FileInfo) time.Time {
+	return statAtime(st)
+}
+
+func (OsFS) Owner(st os.FileInfo) (int, int, bool) {
+	return statOwner(st)
+}
+
+func (OsFS) Inode(st os.FileInfo) (uint64, uint64, uint64, bool) {
+	return statInode(st)
+}
+
+func (OsFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	return mknod(name, mode, major, minor)
+}
+
+func (OsFS) Rdev(st os.FileInfo) (uint32, uint32, bool) {
+	return statRdev(st)
+}
+
+func (OsFS) Flags(st os.FileInfo) (uint32, bool)      { return statFlags(st) }
+func (OsFS) Chflags(name string, flags uint32) error { return chflags(name, flags) }
+
+func (OsFS) Avail(name string) (int64, error) { return availSpace(name) }
+
+/* beneath is name relative to dir, "." for dir itself, false when name
+   is not under dir; both are cleaned paths as the sink joins them */
+func beneath(dir, name string) (string, bool) {
+	switch {
+	case name == dir:
+		return ".", true
+	case dir == ".":
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return "", false
+		}
+		return name, true
+	case strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/"):
+		if rest := name[len(strings.TrimSuffix(dir, "/"))+1:]; rest != "" {
+			return rest, true
+		}
+		return ".", true /* dir itself, with a slash */
+	}
+	return "", false
+}
@@ -0,0 +1,16 @@
+module github.com/sftpplease/rscp
+
+go 1.25
+
+require (
+	github.com/pkg/sftp v1.13.9
+	github.com/quic-go/quic-go v0.59.0
+	golang.org/x/crypto v0.41.0
+	golang.org/x/term v0.34.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+)
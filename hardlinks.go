@@ -0,0 +1,104 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+var ErrLinkSource = errors.New("hard link source was not received")
+
+type inode struct {
+	dev, ino uint64
+}
+
+/* hardlink tells whether st is another name of a multiply linked file
+   sent before, numbering it on first sight */
+func (s *session) hardlink(st os.FileInfo) (id int, seen bool) {
+	if !s.ext["hardlinks"] || !st.Mode().IsRegular() {
+		return 0, false
+	}
+	dev, ino, nlink, ok := s.fs.Inode(st)
+	if !ok || nlink < 2 {
+		return 0, false
+	}
+	if s.inodes == nil {
+		s.inodes = map[inode]int{}
+	}
+	if id, seen = s.inodes[inode{dev, ino}]; !seen {
+		id = len(s.inodes) + 1
+		s.inodes[inode{dev, ino}] = id
+	}
+	return id, seen
+}
+
+/* linkID is the number hardlink gave st, zero for none */
+func (s *session) linkID(st os.FileInfo) int {
+	if s.inodes == nil {
+		return 0
+	}
+	dev, ino, _, _ := s.fs.Inode(st)
+	return s.inodes[inode{dev, ino}]
+}
+
+func (s *session) sendHardlink(id int, st os.FileInfo) error {
+	name, err := s.wireName(st.Name())
+	if err != nil {
+		return s.teeError(err)
+	}
+	if err := s.enc.Encode(protocol.HMsg{ID: id, Name: name}); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+func (s *session) sinkHardlink(name, line string) error {
+	var m protocol.HMsg
+	var err error
+	if err = m.UnmarshalText([]byte(line)); err != nil || !s.ext["hardlinks"] {
+		return s.teeError(protocolErr)
+	}
+	if m.Name, err = s.localName(m.Name); err != nil {
+		return s.teeError(err)
+	}
+	if err = s.requested(name, m.Name); err != nil {
+		return s.teeError(err)
+	}
+
+	if st, err := s.fs.Stat(name); err == nil && st.IsDir() {
+		if name, err = s.winName(path.Join(name, m.Name)); err != nil {
+			return s.fileDone(name, s.teeError(err))
+		}
+	}
+	s.mirror.keep(name)
+	first, ok := s.linked[m.ID]
+	if first != name {
+		if skip, err := s.onConflict(name); skip {
+			return s.skipEntry(name)
+		} else if err != nil {
+			return s.fileDone(name, s.teeError(err))
+		}
+	}
+	s.fileStart(name, 0, 0)
+
+	if !ok {
+		return s.fileDone(name, s.teeError(fmt.Errorf("%s: %w", name, ErrLinkSource)))
+	} else if first == name { /* the same path sent twice */
+		return s.fileDone(name, s.enc.Ack())
+	}
+	if st, err := s.fs.Lstat(name); err == nil {
+		if st.IsDir() {
+			return s.fileDone(name, s.teeError(&os.PathError{Op: "link", Path: name, Err: ErrIsDirectory}))
+		}
+		if err := s.fs.Remove(name); err != nil {
+			return s.fileDone(name, s.teeError(err))
+		}
+	}
+	if err := s.fs.Link(first, name); err != nil {
+		return s.fileDone(name, s.teeError(err))
+	}
+	return s.fileDone(name, s.enc.Ack())
+}
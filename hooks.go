@@ -0,0 +1,136 @@
+package rscp
+
+import (
+	"io"
+	"os"
+)
+
+/* Hooks observe a running transfer, any of them may be left nil.
+   Names are local paths; OnFileDone also reports files failing
+   before their data could be transferred. */
+type Hooks struct {
+	OnFileStart func(name string, size int64)
+	OnFileDone  func(name string, err error)
+	OnDirEnter  func(name string)
+	OnDirLeave  func(name string, err error)
+	OnBytes     func(n int) /* file data moved since the last call */
+}
+
+/* set tells whether any hook is set */
+func (h Hooks) set() bool {
+	return h.OnFileStart != nil || h.OnFileDone != nil || h.OnDirEnter != nil ||
+		h.OnDirLeave != nil || h.OnBytes != nil
+}
+
+func (s *session) fileStart(name string, size int64, mode os.FileMode) {
+	if h := s.opts.Hooks.OnFileStart; h != nil {
+		h(name, size)
+	}
+	s.progress.fileStart(name)
+	s.manifest.fileStart(name, size, mode)
+}
+
+func (s *session) fileDone(name string, err error) error {
+	if h := s.opts.Hooks.OnFileDone; h != nil {
+		h(name, err)
+	}
+	s.manifest.fileDone(name, err)
+	s.tally.Files++
+	if err != nil {
+		s.tally.Failed++
+	}
+	return err
+}
+
+/* fileSkipped is fileDone for what is left out on purpose, not failing */
+func (s *session) fileSkipped(name string, err error) {
+	if h := s.opts.Hooks.OnFileDone; h != nil {
+		h(name, err)
+	}
+	s.manifest.fileDone(name, err)
+	s.tally.Files++
+}
+
+func (s *session) dirEnter(name string) {
+	if h := s.opts.Hooks.OnDirEnter; h != nil {
+		h(name)
+	}
+}
+
+func (s *session) dirLeave(name string, err error) error {
+	if h := s.opts.Hooks.OnDirLeave; h != nil {
+		h(name, err)
+	}
+	return err
+}
+
+func (s *session) moved(n int) {
+	if h := s.opts.Hooks.OnBytes; h != nil {
+		h(n)
+	}
+	s.progress.moved(n)
+	s.manifest.moved(n)
+	s.tally.Bytes += int64(n)
+}
+
+func (s *session) counting() bool {
+	return s.opts.Hooks.OnBytes != nil || s.progress != nil || s.manifest != nil || s.ext["summary"]
+}
+
+func (s *session) countReader(r io.Reader) io.Reader {
+	if !s.counting() {
+		return r
+	}
+	return &bytesHookReader{r, s.moved}
+}
+
+func (s *session) countWriter(w io.Writer) io.Writer {
+	if !s.counting() {
+		return w
+	}
+	return &bytesHookWriter{w, s.moved}
+}
+
+type bytesHookReader struct {
+	base    io.Reader
+	onBytes func(int)
+}
+
+func (r *bytesHookReader) Read(p []byte) (int, error) {
+	n, err := r.base.Read(p)
+	if n > 0 {
+		r.onBytes(n)
+	}
+	return n, err
+}
+
+type bytesHookWriter struct {
+	base    io.Writer
+	onBytes func(int)
+}
+
+func (w *bytesHookWriter) Write(p []byte) (int, error) {
+	n, err := w.base.Write(p)
+	if n > 0 {
+		w.onBytes(n)
+	}
+	return n, err
+}
+
+func (r *bytesHookReader) WriteTo(w io.Writer) (int64, error) {
+	return copyChunked(w, r.base, statsCopyChunk, func(n int64) error {
+		if n > 0 {
+			r.onBytes(int(n))
+		}
+		return nil
+	})
+}
+
+func (w *bytesHookWriter) ReadFrom(r io.Reader) (int64, error) {
+	return copyChunked(w.base, r, statsCopyChunk, func(n int64) error {
+		if n > 0 {
+			w.onBytes(int(n))
+		}
+		return nil
+	})
+}
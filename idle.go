@@ -0,0 +1,109 @@
+package rscp
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrIdleTimeout = errors.New("peer sent nothing for longer than the idle timeout")
+	ErrDeadline    = errors.New("transfer took longer than its timeout")
+)
+
+const idleChunk = 32 << 10 /* bytes read from the peer at a time */
+
+/* idleReader has a read waiting on the peer for longer than IdleTimeout
+   end the session with ErrIdleTimeout, any peer, heartbeats or not.
+   Reads happen on a goroutine of their own for the session to leave
+   behind one that nothing interrupts, as on a terminal or a pipe the
+   session was started with, once given up on or past Timeout; the
+   goroutine reads one chunk ahead. */
+type idleReader struct {
+	s       *session
+	chunks  chan idleChunkRead
+	free    chan []byte
+	buf     []byte /* left of the chunk being read */
+	whole   []byte /* the buffer buf is in */
+	err     error
+	waiting atomic.Int64 /* unix nanoseconds a pending read started, zero if none */
+}
+
+type idleChunkRead struct {
+	data []byte
+	err  error
+}
+
+/* watchIdle is r given up on as IdleTimeout says, or left once the
+   session is done */
+func (s *session) watchIdle(r io.Reader) io.Reader {
+	ir := &idleReader{s: s, chunks: make(chan idleChunkRead), free: make(chan []byte, 2)}
+	ir.free <- make([]byte, idleChunk)
+	ir.free <- make([]byte, idleChunk)
+	go ir.pump(r)
+	if s.opts.IdleTimeout > 0 {
+		go ir.watch()
+	}
+	return ir
+}
+
+func (r *idleReader) pump(base io.Reader) {
+	for {
+		var buf []byte
+		select {
+		case buf = <-r.free:
+		case <-r.s.ctx.Done():
+			return
+		}
+		n, err := base.Read(buf)
+		select {
+		case r.chunks <- idleChunkRead{buf[:n], err}:
+		case <-r.s.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *idleReader) watch() {
+	tick := time.NewTicker(max(r.s.opts.IdleTimeout/4, time.Millisecond))
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if w := r.waiting.Load(); w != 0 && time.Since(time.Unix(0, w)) > r.s.opts.IdleTimeout {
+				r.s.cancel(ErrIdleTimeout)
+				return
+			}
+		case <-r.s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 && r.err == nil {
+		if r.whole != nil {
+			r.free <- r.whole[:cap(r.whole)]
+			r.whole = nil
+		}
+		r.waiting.Store(time.Now().UnixNano())
+		select {
+		case c := <-r.chunks:
+			r.buf, r.whole, r.err = c.data, c.data, c.err
+		case <-r.s.ctx.Done():
+			r.waiting.Store(0)
+			return 0, ErrCanceled
+		}
+		r.waiting.Store(0)
+	}
+	if len(r.buf) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,138 @@
+package rscp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* Files a sink is writing are partial until their data is in. A
+   transfer broken off in one, by an interrupt or a fatal error, removes
+   it rather than leave something looking complete to whatever comes
+   next; so does the interrupt handler for sinks that are stuck. Partial
+   files are kept with resume, which takes them up again. The staging
+   directories of Transactional are partial with all below them. */
+
+const InterruptGrace = 2 * time.Second /* for transfers to wind down once interrupted */
+
+var partials = struct {
+	sync.Mutex
+	files map[*partialFile]bool
+}{files: map[*partialFile]bool{}}
+
+type partialFile struct {
+	fs   FS
+	name string
+	tree bool /* a directory, removed with what is below it */
+}
+
+func addPartial(fsys FS, name string) *partialFile {
+	return trackPartial(&partialFile{fs: fsys, name: name})
+}
+
+/* addPartialTree registers the directory name as partial */
+func addPartialTree(fsys FS, name string) *partialFile {
+	return trackPartial(&partialFile{fs: fsys, name: name, tree: true})
+}
+
+func trackPartial(p *partialFile) *partialFile {
+	partials.Lock()
+	partials.files[p] = true
+	partials.Unlock()
+	return p
+}
+
+/* moved has p follow its file to name */
+func (p *partialFile) moved(name string) {
+	if p == nil {
+		return
+	}
+	partials.Lock()
+	p.name = name
+	partials.Unlock()
+}
+
+/* partial registers file, which the data of a file goes into, as
+   partial; nil when it is to be kept anyway */
+func (s *session) partial(file string, st os.FileInfo) *partialFile {
+	if !st.Mode().IsRegular() || s.ext["resume"] {
+		return nil
+	}
+	return addPartial(s.fs, file)
+}
+
+/* done has p complete, kept from now on */
+func (p *partialFile) done() {
+	if p == nil {
+		return
+	}
+	partials.Lock()
+	delete(partials.files, p)
+	partials.Unlock()
+}
+
+/* discard removes p */
+func (p *partialFile) discard() {
+	if p == nil {
+		return
+	}
+	p.done()
+	p.remove()
+}
+
+func (p *partialFile) remove() {
+	if p.tree {
+		removeTree(p.fs, p.name)
+	} else {
+		p.fs.Remove(p.name)
+	}
+}
+
+func removePartials() {
+	partials.Lock()
+	defer partials.Unlock()
+	for p := range partials.files {
+		p.remove()
+		delete(partials.files, p)
+	}
+}
+
+/* Interruptible is a context canceled by SIGINT or SIGTERM, whereupon
+   transfers have InterruptGrace to end and remove their partial files.
+   After that, or on a second signal, those left are removed and the
+   process exits. */
+func Interruptible() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+		deadline := time.After(InterruptGrace)
+		tick := time.NewTicker(InterruptGrace / 40)
+	wait:
+		for {
+			partials.Lock()
+			left := len(partials.files)
+			partials.Unlock()
+			if left == 0 {
+				break
+			}
+			select {
+			case <-sigs:
+				break wait
+			case <-deadline:
+				break wait
+			case <-tick.C:
+			}
+		}
+		removePartials()
+		fmt.Fprintln(os.Stderr, ErrCanceled)
+		os.Exit(1)
+	}()
+	return ctx
+}
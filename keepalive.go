@@ -0,0 +1,209 @@
+package rscp
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* KeepaliveMisses is how many heartbeats of the peer may go missing
+   while waiting on it before it is given up on */
+const KeepaliveMisses = 3
+
+var ErrPeerTimeout = errors.New("peer timed out")
+
+/* keepalive sends heartbeats while neither side has anything to say and
+   gives up on the peer once it stays silent while being waited on. Both
+   sides beat, the interval travels with every heartbeat so each knows
+   how long to wait for the other. */
+type keepalive struct {
+	interval time.Duration
+	dead     func()
+
+	mu      sync.Mutex /* serializes writes with heartbeats */
+	w       io.Writer
+	eol     byte
+	flush   func() error
+	paused  int /* raw data underway, nothing may come in between */
+	stopped bool
+	done    chan struct{}
+
+	beating atomic.Bool  /* a heartbeat is on its way, maybe stuck */
+	sent    atomic.Int64 /* unix nanoseconds of the last write */
+	recvd   atomic.Int64 /* unix nanoseconds of the last byte read */
+	waiting atomic.Int64 /* unix nanoseconds a pending read started, zero if none */
+	peer    atomic.Int64 /* heartbeat interval of the peer, zero until known */
+}
+
+/* startKeepalive beats on what the session sends once keepalive was agreed on */
+func (s *session) startKeepalive() {
+	if !s.ext["keepalive"] {
+		return
+	}
+	ka := &keepalive{interval: s.opts.Keepalive, w: s.out, eol: s.enc.EOL, done: make(chan struct{})}
+	ka.sent.Store(time.Now().UnixNano())
+	ka.recvd.Store(time.Now().UnixNano())
+	ka.dead = func() { s.cancel(ErrPeerTimeout) }
+	if s.compressor != nil {
+		ka.flush = s.compressor.Flush
+	}
+	s.keepalive = ka
+	s.in = &keepaliveReader{s.in, ka}
+	s.out = &keepaliveWriter{s.out, ka}
+	s.codec()
+	s.dec.Beat = func(m protocol.BMsg) { ka.peer.Store(int64(m.Interval)) }
+	go ka.run()
+}
+
+func (ka *keepalive) run() {
+	tick := time.NewTicker(ka.interval / 2)
+	defer tick.Stop()
+	for beat := true; ; beat = false {
+		if (beat || ka.idle()) && ka.beating.CompareAndSwap(false, true) {
+			go func() { /* not to hold up watching the peer */
+				ka.beat()
+				ka.beating.Store(false)
+			}()
+		}
+		if ka.silent() {
+			ka.dead()
+			return
+		}
+		select {
+		case <-tick.C:
+		case <-ka.done:
+			return
+		}
+	}
+}
+
+/* idle is true once nothing was sent or received for an interval */
+func (ka *keepalive) idle() bool {
+	sent, recvd := time.Unix(0, ka.sent.Load()), time.Unix(0, ka.recvd.Load())
+	return time.Since(sent) >= ka.interval && time.Since(recvd) >= ka.interval
+}
+
+/* silent is true once a read waited for longer than the peer lets pass
+   between heartbeats */
+func (ka *keepalive) silent() bool {
+	waiting, peer := ka.waiting.Load(), time.Duration(ka.peer.Load())
+	return waiting != 0 && peer > 0 && time.Since(time.Unix(0, waiting)) > KeepaliveMisses*peer
+}
+
+func (ka *keepalive) beat() {
+	if !ka.mu.TryLock() {
+		return /* busy sending */
+	}
+	defer ka.mu.Unlock()
+	if ka.stopped || ka.paused > 0 {
+		return
+	}
+	text, _ := protocol.BMsg{Interval: ka.interval}.MarshalText()
+	if _, err := ka.w.Write(append(text, ka.eol)); err != nil {
+		return /* the session runs into it too */
+	}
+	if ka.flush != nil {
+		ka.flush()
+	}
+	ka.sent.Store(time.Now().UnixNano())
+}
+
+/* pause holds heartbeats back while raw data is sent */
+func (ka *keepalive) pause() {
+	if ka == nil {
+		return
+	}
+	ka.mu.Lock()
+	ka.paused++
+	ka.mu.Unlock()
+}
+
+func (ka *keepalive) resume() {
+	if ka == nil {
+		return
+	}
+	ka.mu.Lock()
+	ka.paused--
+	ka.mu.Unlock()
+}
+
+/* lock keeps heartbeats out while the session works on what it wrote */
+func (ka *keepalive) lock() {
+	if ka != nil {
+		ka.mu.Lock()
+	}
+}
+
+func (ka *keepalive) unlock() {
+	if ka != nil {
+		ka.mu.Unlock()
+	}
+}
+
+/* stop ends heartbeats, none is sent once it returns */
+func (ka *keepalive) stop() {
+	if ka == nil {
+		return
+	}
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	if !ka.stopped {
+		ka.stopped = true
+		close(ka.done)
+	}
+}
+
+type keepaliveWriter struct {
+	base io.Writer
+	ka   *keepalive
+}
+
+func (w *keepaliveWriter) Write(p []byte) (int, error) {
+	w.ka.mu.Lock()
+	defer w.ka.mu.Unlock()
+	n, err := w.base.Write(p)
+	w.ka.sent.Store(time.Now().UnixNano())
+	return n, err
+}
+
+type keepaliveReader struct {
+	base io.Reader
+	ka   *keepalive
+}
+
+func (r *keepaliveReader) Read(p []byte) (int, error) {
+	r.ka.waiting.Store(time.Now().UnixNano())
+	n, err := r.base.Read(p)
+	r.ka.waiting.Store(0)
+	if n > 0 {
+		r.ka.recvd.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (w *keepaliveWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.ka.mu.Lock()
+	defer w.ka.mu.Unlock()
+	return copyChunked(w.base, r, statsCopyChunk, func(int64) error {
+		w.ka.sent.Store(time.Now().UnixNano())
+		return nil
+	})
+}
+
+/* a copy counts as one long read restarting with every chunk */
+func (r *keepaliveReader) WriteTo(w io.Writer) (int64, error) {
+	r.ka.waiting.Store(time.Now().UnixNano())
+	defer r.ka.waiting.Store(0)
+	return copyChunked(w, r.base, statsCopyChunk, func(n int64) error {
+		now := time.Now().UnixNano()
+		r.ka.waiting.Store(now)
+		if n > 0 {
+			r.ka.recvd.Store(now)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,101 @@
+package rscp
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+var (
+	ErrSymlink     = errors.New("is a symlink, not written through")
+	ErrLinkSkipped = errors.New("is a symlink, skipped") /* with NoDereference */
+	ErrDirLoop     = errors.New("is a directory it is in already, reached again through a symlink; not descended into")
+)
+
+/* dirID tells directories apart to find loops by, false where the FS
+   cannot; following symlinks, a source could otherwise descend into
+   one it is in over and over */
+func (s *session) dirID(st os.FileInfo) (inode, bool) {
+	dev, ino, _, ok := s.fs.Inode(st)
+	return inode{dev, ino}, ok
+}
+
+/* follows tells whether the source goes by what symlinks point to, not
+   sending them as such nor passing over them; top for those among the
+   paths it was given */
+func (s *session) follows(top bool) bool {
+	return top && s.opts.DereferenceArgs || !s.ext["links"] && !s.opts.NoDereference
+}
+
+/* sendLink sends the symlink local as such instead of following it */
+func (s *session) sendLink(local string, st os.FileInfo) error {
+	target, err := s.fs.Readlink(local)
+	if err != nil {
+		return s.teeError(err)
+	}
+	name, err := s.wireName(st.Name())
+	if err != nil {
+		return s.teeError(err)
+	}
+	if err := s.enc.Encode(protocol.LMsg{Target: target, Name: name}); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+func (s *session) sinkLink(name, line string) error {
+	var m protocol.LMsg
+	var err error
+	if err = m.UnmarshalText([]byte(line)); err != nil || !s.ext["links"] {
+		return s.teeError(protocolErr)
+	}
+	if m.Name, err = s.localName(m.Name); err != nil {
+		return s.teeError(err)
+	}
+	if err = s.requested(name, m.Name); err != nil {
+		return s.teeError(err)
+	}
+
+	if st, err := s.fs.Stat(name); err == nil && st.IsDir() {
+		if name, err = s.winName(path.Join(name, m.Name)); err != nil {
+			return s.fileDone(name, s.teeError(err))
+		}
+	}
+	s.mirror.keep(name)
+	if skip, err := s.onConflict(name); skip {
+		return s.skipEntry(name)
+	} else if err != nil {
+		return s.fileDone(name, s.teeError(err))
+	}
+	s.fileStart(name, 0, os.ModeSymlink|os.ModePerm)
+
+	if st, err := s.fs.Lstat(name); err == nil {
+		if st.IsDir() {
+			return s.fileDone(name, s.teeError(&os.PathError{Op: "symlink", Path: name, Err: ErrIsDirectory}))
+		}
+		if err := s.fs.Remove(name); err != nil {
+			return s.fileDone(name, s.teeError(err))
+		}
+	}
+	if err := s.fs.Symlink(m.Target, name); err != nil {
+		return s.fileDone(name, s.teeError(err))
+	}
+	return s.fileDone(name, s.enc.Ack())
+}
+
+/* replaceLink removes a symlink where a file or directory is received,
+   with links on the peer may have just created it to redirect writes.
+   Without, the symlink was there before and is refused instead, for
+   otherwise the peer could write wherever it points. */
+func (s *session) replaceLink(name string) error {
+	st, err := s.fs.Lstat(name)
+	if err != nil || st.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if !s.ext["links"] {
+		return &os.PathError{Op: "open", Path: name, Err: ErrSymlink}
+	}
+	return s.fs.Remove(name)
+}
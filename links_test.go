@@ -0,0 +1,99 @@
+package rscp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/* unconfined is the host file system without the os.Root a sink puts
+   under OsFS, for checks made before it to be tested alone */
+type unconfined struct {
+	OsFS
+}
+
+/* A symlink the target has where a file or directory is received is
+   not written through; with links agreed on it is replaced */
+func TestSinkSymlinkRefused(t *testing.T) {
+	for _, links := range []bool{false, true} {
+		target, outside := confineTree(t)
+		src := filepath.ToSlash(t.TempDir())
+		os.WriteFile(path.Join(src, "evil"), []byte("overwritten"), 0644)
+		os.Mkdir(path.Join(src, "out"), 0755)
+		os.WriteFile(path.Join(src, "out", "new"), []byte("new"), 0644)
+
+		opts := Options{Recursive: true, Links: links}
+		srcs := []string{path.Join(src, "evil"), path.Join(src, "out")}
+		err := LoopbackFS(context.Background(), opts, OsFS{}, srcs, unconfined{}, target)
+		untouched(t, outside, fmt.Sprintf("links %v", links))
+		if !links {
+			var remote RemoteError /* as the source hears of it */
+			if !errors.As(err, &remote) || !strings.Contains(remote.Msg, ErrSymlink.Error()) {
+				t.Errorf("got %v, want ErrSymlink", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("links: %v", err)
+		}
+		if b, err := os.ReadFile(path.Join(target, "evil")); err != nil || string(b) != "overwritten" {
+			t.Errorf("links: symlink not replaced by the file: %q, %v", b, err)
+		}
+		if st, err := os.Lstat(path.Join(target, "out")); err != nil || !st.IsDir() {
+			t.Errorf("links: symlink not replaced by the directory: %v", err)
+		}
+	}
+}
+
+/* A source following symlinks reports a directory it is in reached again
+   through one and goes on with the rest, rather than descending into it
+   until out of descriptors: over one stream, over several, counting
+   totals first, and copying locally */
+func TestDirLoop(t *testing.T) {
+	src := filepath.ToSlash(t.TempDir())
+	for _, err := range []error{
+		os.Mkdir(path.Join(src, "a"), 0755),
+		os.WriteFile(path.Join(src, "a", "f"), []byte("f"), 0644),
+		os.Symlink("..", path.Join(src, "a", "up")),
+		os.Symlink(".", path.Join(src, "a", "here")),
+		os.Symlink("a", path.Join(src, "b")), /* not a loop, a second way in */
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+		copy func(ctx context.Context, opts Options, srcs []string, target string) error
+	}{
+		{"one stream", Options{Recursive: true}, Loopback},
+		{"streams", Options{Recursive: true, Streams: 4}, Loopback},
+		{"totals", Options{Recursive: true, Totals: true}, Loopback},
+		{"local", Options{Recursive: true}, Copy},
+	}
+	for _, tt := range tests {
+		dst := filepath.ToSlash(t.TempDir())
+		err := tt.copy(context.Background(), tt.opts, []string{src}, dst)
+		if !errors.Is(err, ErrDirLoop) || isFatal(err) {
+			t.Errorf("%s: got %v, want the loops failing alone", tt.name, err)
+		}
+		top := path.Join(dst, path.Base(src))
+		for _, name := range []string{"a/f", "b/f"} {
+			if _, err := os.Stat(path.Join(top, name)); err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		}
+		for _, name := range []string{"a/up", "a/here"} {
+			if _, err := os.Lstat(path.Join(top, name)); err == nil {
+				t.Errorf("%s: loop %s descended into", tt.name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package rscp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* Copy copies srcs into target on this host through the file system
+   instead of a source and a sink, doing what they would with Recursive,
+   Preserve, TargetDir and Timeout. Data goes by io.Copy between the files, which
+   takes copy_file_range and with it reflinks where the system has them.
+   Options that only the protocol carries out take the loopback. */
+func Copy(ctx context.Context, opts Options, srcs []string, target string) error {
+	if len(opts.extensions()) > 0 || opts.BwLimit > 0 || opts.Stats != nil || opts.Record != nil ||
+		opts.Progress != nil || opts.OnResult != nil || opts.FS != nil || opts.Hooks.set() ||
+		opts.OnConflict != ConflictOverwrite || opts.Delete || opts.MaxTotalBytes > 0 || opts.MaxFileSize > 0 ||
+		opts.Preallocate || opts.TempDir != "" || opts.UseUmask || opts.Umask != 0 ||
+		opts.NoSpecialBits || opts.Chown != nil || opts.WindowsNames != WinNamesAllow ||
+		opts.Normalize != NormNone || opts.Transactional || opts.DryRun || opts.NoDereference ||
+		len(opts.Tee) > 0 || opts.IdleTimeout > 0 {
+		return Loopback(ctx, opts, srcs, target)
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout, ErrDeadline)
+		defer cancel()
+	}
+	if err := makeDirs(OsFS{}, opts, target); err != nil {
+		return FatalError{Err: err}
+	}
+	if opts.TargetDir {
+		if st, err := os.Stat(target); err != nil {
+			return FatalError{Err: err}
+		} else if !st.IsDir() {
+			return FatalError{Err: fmt.Errorf("%s: %w", target, ErrNotDirectory)}
+		}
+	}
+	c := &localCopier{ctx: ctx, opts: opts}
+	var errs []error
+	for _, src := range srcs {
+		if ctx.Err() != nil {
+			return c.canceled()
+		}
+		if err := c.copy(src, target); isFatal(err) {
+			return err
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return AccError{errs}
+	}
+	return nil
+}
+
+/* canceled is the error a copy stopped for c.ctx ends with */
+func (c *localCopier) canceled() error {
+	if context.Cause(c.ctx) == ErrDeadline {
+		return FatalError{Err: ErrDeadline}
+	}
+	return canceledErr
+}
+
+const LocalCopyChunk = 64 << 20 /* copied between checks for cancellation */
+
+type localCopier struct {
+	ctx  context.Context
+	opts Options
+	in   []os.FileInfo /* directories being copied, to find loops by */
+}
+
+/* copy copies src into the directory dst, or a file to dst itself when
+   that is not a directory */
+func (c *localCopier) copy(src, dst string) error {
+	st, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(src)
+	into := func() error {
+		if err := protocol.CheckName(name); err != nil {
+			return err
+		}
+		dst = filepath.Join(dst, name)
+		if st, err := os.Lstat(dst); err == nil && st.Mode()&os.ModeSymlink != 0 {
+			return &os.PathError{Op: "open", Path: dst, Err: ErrSymlink}
+		}
+		return nil
+	}
+
+	switch mode := st.Mode(); {
+	case mode.IsDir():
+		if !c.opts.Recursive {
+			return fmt.Errorf("%s: %w", name, ErrIsDirectory)
+		}
+		if err := into(); err != nil { /* a sink puts directories into the target always */
+			return err
+		}
+		for _, in := range c.in {
+			if os.SameFile(in, st) {
+				return fmt.Errorf("%s: %w", src, ErrDirLoop)
+			}
+		}
+		c.in = append(c.in, st)
+		defer func() { c.in = c.in[:len(c.in)-1] }()
+		return c.copyDir(src, dst, st)
+	case mode.IsRegular():
+		if dstSt, err := os.Stat(dst); err == nil && dstSt.IsDir() {
+			if err := into(); err != nil {
+				return err
+			}
+		}
+		return c.copyFile(src, dst, st)
+	default:
+		return fmt.Errorf("%s: %w", name, ErrNotRegular)
+	}
+}
+
+func (c *localCopier) copyDir(src, dst string, st os.FileInfo) error {
+	perm := protocol.ToStdPerm(protocol.ToPosixPerm(st.Mode()))
+	resetPerm := false
+	if dstSt, err := os.Stat(dst); err == nil {
+		if !dstSt.IsDir() {
+			return fmt.Errorf("%s: %w", dst, ErrNotDirectory)
+		}
+		if c.opts.Preserve {
+			if err := os.Chmod(dst, perm); err != nil {
+				return err
+			}
+		}
+	} else if os.IsNotExist(err) {
+		if err := os.Mkdir(dst, perm|S_IRWXU); err != nil {
+			return err
+		}
+		resetPerm = true
+	} else {
+		return err
+	}
+
+	dir, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	var errs []error
+	for {
+		children, err := dir.Readdirnames(DirScanBatchSize)
+		for _, child := range children {
+			if c.ctx.Err() != nil {
+				return c.canceled()
+			}
+			if err := c.copy(filepath.Join(src, child), dst); isFatal(err) {
+				return err
+			} else if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	errs = append(errs, c.setAttrs(dst, st)...)
+	if resetPerm || c.opts.Preserve {
+		if err := os.Chmod(dst, perm); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return AccError{errs}
+	}
+	return nil
+}
+
+func (c *localCopier) copyFile(src, dst string, st os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = os.Stat(dst)
+	exists := err == nil
+	perm := protocol.ToStdPerm(protocol.ToPosixPerm(st.Mode()))
+	file, flag, mode := dst, os.O_WRONLY|os.O_CREATE, perm|S_IWUSR
+	tmp, old := c.tempFor(dst)
+	if tmp != "" {
+		file, flag, mode = tmp, flag|os.O_EXCL, 0600
+	}
+	out, err := os.OpenFile(file, flag, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	outSt, err := out.Stat()
+	if err != nil {
+		return err
+	}
+
+	var p *partialFile
+	if outSt.Mode().IsRegular() {
+		p = addPartial(OsFS{}, file)
+	}
+
+	var errs []error
+	var n int64
+	for err == nil && c.ctx.Err() == nil { /* in pieces to stop when canceled */
+		var piece int64
+		piece, err = io.CopyN(out, in, LocalCopyChunk)
+		n += piece
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if c.ctx.Err() != nil {
+		p.discard()
+		return c.canceled()
+	} else if err != nil {
+		if tmp != "" {
+			p.discard() /* the old file stays as it was */
+			return err
+		}
+		errs = append(errs, err)
+	}
+	if !exists || outSt.Mode().IsRegular() {
+		if err := out.Truncate(n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := out.Sync(); err != nil {
+		errs = append(errs, err)
+	}
+	if old != nil {
+		if uid, gid, ok := (OsFS{}).Owner(old); ok {
+			out.Chown(uid, gid) /* as far as permitted */
+		}
+	}
+	if c.opts.Preserve || !exists {
+		if err := out.Chmod(perm); err != nil {
+			errs = append(errs, err)
+		}
+	} else if old != nil {
+		if err := out.Chmod(old.Mode().Perm()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, c.setAttrs(file, st)...)
+	if tmp != "" {
+		err := out.Close() /* ahead of the rename, which Windows refuses for open files */
+		if err == nil {
+			err = os.Rename(tmp, dst)
+		}
+		if err != nil {
+			p.discard()
+			errs = append(errs, err)
+		}
+	}
+	p.done()
+	if len(errs) > 0 {
+		return AccError{errs}
+	}
+	return nil
+}
+
+/* tempFor is where a file is copied to before it is renamed to dst and
+   what dst is now, as the sink does */
+func (c *localCopier) tempFor(dst string) (string, os.FileInfo) {
+	s := &session{opts: c.opts, fs: OsFS{}}
+	return s.tempFor(dst)
+}
+
+/* setAttrs sets the times of st on dst with Preserve, to the microsecond
+   as the protocol would */
+func (c *localCopier) setAttrs(dst string, st os.FileInfo) []error {
+	if !c.opts.Preserve {
+		return nil
+	}
+	atime := OsFS{}.Atime(st).Truncate(time.Microsecond)
+	if err := os.Chtimes(dst, atime, st.ModTime().Truncate(time.Microsecond)); err != nil {
+		return []error{err}
+	}
+	return nil
+}
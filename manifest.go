@@ -0,0 +1,88 @@
+package rscp
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+/* FileResult tells what became of a single file of a transfer */
+type FileResult struct {
+	Path             string /* local path */
+	Size             int64  /* announced size */
+	BytesTransferred int64
+	Mode             os.FileMode
+	Err              error /* nil when the file landed intact, ErrNotOverwritten or ErrNewer when skipped */
+	Duration         time.Duration
+}
+
+type manifest struct {
+	emit    func(FileResult) /* streams results when set */
+	keep    bool             /* accumulates results */
+	results []FileResult
+	cur     *FileResult
+	start   time.Time
+}
+
+func (m *manifest) fileStart(name string, size int64, mode os.FileMode) {
+	if m == nil {
+		return
+	}
+	m.cur = &FileResult{Path: name, Size: size, Mode: mode}
+	m.start = time.Now()
+}
+
+func (m *manifest) moved(n int) {
+	if m == nil || m.cur == nil {
+		return
+	}
+	m.cur.BytesTransferred += int64(n)
+}
+
+/* fileDone also records files that failed before starting */
+func (m *manifest) fileDone(name string, err error) {
+	if m == nil {
+		return
+	}
+	r := FileResult{Path: name}
+	if m.cur != nil && m.cur.Path == name {
+		r = *m.cur
+		r.Duration = time.Since(m.start)
+	}
+	r.Err = err
+	if m.emit != nil {
+		m.emit(r)
+	}
+	if m.keep {
+		m.results = append(m.results, r)
+	}
+	m.cur = nil
+}
+
+const MaxSummaryErrors = 16
+
+/* SummaryError stands for the non-fatal failures of a run streaming
+   its results, only the first MaxSummaryErrors of them are kept */
+type SummaryError struct {
+	Failed int
+	Errors []error
+}
+
+func (e *SummaryError) add(err error) {
+	e.Failed++
+	if len(e.Errors) < MaxSummaryErrors {
+		e.Errors = append(e.Errors, err)
+	}
+}
+
+func (e SummaryError) Unwrap() []error {
+	return e.Errors
+}
+
+func (e SummaryError) Error() string {
+	msg := AccError{e.Errors}.Error()
+	if more := e.Failed - len(e.Errors); more > 0 {
+		msg += fmt.Sprintf("and %d more errors\n", more)
+	}
+	return msg
+}
@@ -0,0 +1,749 @@
+package rscp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const MaxSymlinkHops = 40
+
+/*
+ * MemFS is an in-memory FS for hermetic round-trips. Relative names are
+ * taken from the root. Failures can be staged with Inject, Capacity makes
+ * writes fail with ENOSPC and ReadChunk makes file reads short.
+ */
+type MemFS struct {
+	Capacity  int64 /* total bytes of file data, unlimited when zero */
+	ReadChunk int   /* max bytes per file read, unlimited when zero */
+
+	mu     sync.Mutex
+	nodes  map[string]*memNode
+	used   int64
+	inos   uint64
+	faults map[memFault]error
+}
+
+type memFault struct {
+	op, name string
+}
+
+type memNode struct {
+	mode         os.FileMode
+	data         []byte
+	target       string /* symlink target */
+	mtime, atime time.Time
+	uid, gid     int
+	xattrs       map[string][]byte
+	ino, nlink   uint64
+	major, minor uint32 /* device numbers */
+	flags        uint32
+}
+
+func NewMemFS() *MemFS {
+	now := time.Now()
+	return &MemFS{
+		nodes: map[string]*memNode{
+			"/": {mode: os.ModeDir | 0755, mtime: now, atime: now},
+		},
+		faults: map[memFault]error{},
+	}
+}
+
+/*
+ * Inject makes op on name fail with err until cleared with a nil err; ops are
+ * FS method names in lower case plus "read" and "write" for file data
+ */
+func (m *MemFS) Inject(op, name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memFault{op, memClean(name)}
+	if err == nil {
+		delete(m.faults, key)
+	} else {
+		m.faults[key] = err
+	}
+}
+
+/* WriteFile creates or replaces a regular file, a convenience for setting up trees */
+func (m *MemFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/* ReadFile returns a copy of the contents of a regular file */
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	f, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func memClean(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (m *MemFS) fault(op, name string) error {
+	if err, ok := m.faults[memFault{op, memClean(name)}]; ok {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+/* resolve walks name through symlinks, the last component only when follow is set */
+func (m *MemFS) resolve(name string, follow bool) (string, *memNode, error) {
+	p := "/"
+	rest := strings.Split(strings.Trim(memClean(name), "/"), "/")
+	hops := 0
+
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		if elem == "" {
+			continue
+		}
+		if dir := m.nodes[p]; !dir.mode.IsDir() {
+			return "", nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ENOTDIR}
+		}
+
+		next := path.Join(p, elem)
+		n, ok := m.nodes[next]
+		if !ok {
+			if len(rest) > 0 {
+				return "", nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+			}
+			return next, nil, nil
+		}
+		if n.mode&os.ModeSymlink != 0 && (len(rest) > 0 || follow) {
+			if hops++; hops > MaxSymlinkHops {
+				return "", nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ELOOP}
+			}
+			target := n.target
+			if !path.IsAbs(target) {
+				target = path.Join(p, target)
+			}
+			rest = append(strings.Split(strings.Trim(path.Clean(target), "/"), "/"), rest...)
+			p = "/"
+			continue
+		}
+		p = next
+	}
+	return p, m.nodes[p], nil
+}
+
+func (m *MemFS) lookup(op, name string, follow bool) (string, *memNode, error) {
+	if err := m.fault(op, name); err != nil {
+		return "", nil, err
+	}
+	p, n, err := m.resolve(name, follow)
+	if err != nil {
+		err.(*os.PathError).Op = op
+		return "", nil, err
+	}
+	if n == nil {
+		return p, nil, &os.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return p, n, nil
+}
+
+/* create adds a node where name resolves, its parent must be an existing directory */
+func (m *MemFS) create(op, name string, n *memNode) (string, error) {
+	if err := m.fault(op, name); err != nil {
+		return "", err
+	}
+	p, old, err := m.resolve(name, false)
+	if err != nil {
+		err.(*os.PathError).Op = op
+		return "", err
+	}
+	if old != nil {
+		return "", &os.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	if dir := m.nodes[path.Dir(p)]; dir == nil || !dir.mode.IsDir() {
+		return "", &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	now := time.Now()
+	n.mtime, n.atime = now, now
+	m.inos++
+	n.ino, n.nlink = m.inos, 1
+	m.nodes[p] = n
+	return p, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, n, err := m.lookup("open", name, true)
+	if n == nil && flag&os.O_CREATE != 0 && os.IsNotExist(err) {
+		n = &memNode{mode: perm & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)}
+		if p, err = m.create("open", name, n); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if n.mode.IsDir() && writable {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if writable && flag&os.O_TRUNC != 0 {
+		m.used -= int64(len(n.data))
+		n.data = nil
+	}
+
+	f := &memFile{fs: m, name: name, path: p, node: n, flag: flag}
+	if flag&os.O_APPEND != 0 {
+		f.off = int64(len(n.data))
+	}
+	return f, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, n, err := m.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return memInfo(p, n), nil
+}
+
+func (m *MemFS) Lstat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, n, err := m.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return memInfo(p, n), nil
+}
+
+func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.create("mkdir", name, &memNode{mode: os.ModeDir | perm&os.ModePerm})
+	return err
+}
+
+func (m *MemFS) Chmod(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&os.ModeType | perm&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	return nil
+}
+
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	n.atime, n.mtime = atime, mtime
+	return nil
+}
+
+func (m *MemFS) Chown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("chown", name, true)
+	if err != nil {
+		return err
+	}
+	n.uid, n.gid = uid, gid
+	return nil
+}
+
+func (m *MemFS) Lchown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("lchown", name, false)
+	if err != nil {
+		return err
+	}
+	n.uid, n.gid = uid, gid
+	return nil
+}
+
+func (m *MemFS) Symlink(target, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.create("symlink", name, &memNode{mode: os.ModeSymlink | 0777, target: target})
+	return err
+}
+
+/* Link makes newname another name of the file at oldname */
+func (m *MemFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("link", oldname, false)
+	if err != nil {
+		return err
+	}
+	if n.mode.IsDir() {
+		return &os.PathError{Op: "link", Path: oldname, Err: syscall.EPERM}
+	}
+	p, old, err := m.resolve(newname, false)
+	if err != nil {
+		err.(*os.PathError).Op = "link"
+		return err
+	}
+	if old != nil {
+		return &os.PathError{Op: "link", Path: newname, Err: fs.ErrExist}
+	}
+	if dir := m.nodes[path.Dir(p)]; dir == nil || !dir.mode.IsDir() {
+		return &os.PathError{Op: "link", Path: newname, Err: syscall.ENOTDIR}
+	}
+	n.nlink++
+	m.nodes[p] = n
+	return nil
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if n.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return n.target, nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, n, err := m.lookup("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if p == "/" || n.mode.IsDir() && len(m.children(p)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	if n.nlink--; n.nlink == 0 {
+		m.used -= int64(len(n.data))
+	}
+	delete(m.nodes, p)
+	return nil
+}
+
+/* Rename moves oldname to newname, replacing what is there as rename(2) does */
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, n, err := m.lookup("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+	to, old, err := m.resolve(newname, false)
+	if err != nil {
+		err.(*os.PathError).Op = "rename"
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if from == "/" || to == "/" {
+		return &os.PathError{Op: "rename", Path: newname, Err: syscall.EBUSY}
+	}
+	if dir := m.nodes[path.Dir(to)]; dir == nil || !dir.mode.IsDir() {
+		return &os.PathError{Op: "rename", Path: newname, Err: syscall.ENOTDIR}
+	}
+	if n.mode.IsDir() && strings.HasPrefix(to, from+"/") {
+		return &os.PathError{Op: "rename", Path: newname, Err: syscall.EINVAL}
+	}
+	if old != nil {
+		switch {
+		case old.mode.IsDir() && !n.mode.IsDir():
+			return &os.PathError{Op: "rename", Path: newname, Err: syscall.EISDIR}
+		case !old.mode.IsDir() && n.mode.IsDir():
+			return &os.PathError{Op: "rename", Path: newname, Err: syscall.ENOTDIR}
+		case old.mode.IsDir() && len(m.children(to)) > 0:
+			return &os.PathError{Op: "rename", Path: newname, Err: syscall.ENOTEMPTY}
+		}
+		if old.nlink--; old.nlink == 0 {
+			m.used -= int64(len(old.data))
+		}
+	}
+
+	moved := map[string]*memNode{}
+	for p, n := range m.nodes {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			moved[to+p[len(from):]] = n
+			delete(m.nodes, p)
+		}
+	}
+	for p, n := range moved {
+		m.nodes[p] = n
+	}
+	return nil
+}
+
+func (m *MemFS) Listxattr(name string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("listxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([]string, 0, len(n.xattrs))
+	for attr := range n.xattrs {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	return attrs, nil
+}
+
+func (m *MemFS) Getxattr(name, attr string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("getxattr", name, true)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := n.xattrs[attr]
+	if !ok {
+		return nil, &os.PathError{Op: "getxattr", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (m *MemFS) Setxattr(name, attr string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("setxattr", name, true)
+	if err != nil {
+		return err
+	}
+	if n.xattrs == nil {
+		n.xattrs = map[string][]byte{}
+	}
+	n.xattrs[attr] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *MemFS) Atime(st os.FileInfo) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := st.Sys().(*memNode); ok {
+		return n.atime
+	}
+	return time.Unix(0, 0)
+}
+
+func (m *MemFS) Inode(st os.FileInfo) (dev, ino, nlink uint64, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := st.Sys().(*memNode); ok {
+		return 0, n.ino, n.nlink, true
+	}
+	return 0, 0, 0, false
+}
+
+/* Mknod creates a special file, which reads and writes as an empty one */
+func (m *MemFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	if mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice) == 0 {
+		return &os.PathError{Op: "mknod", Path: name, Err: syscall.EINVAL}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := &memNode{mode: mode & (os.ModeType | os.ModePerm), major: major, minor: minor}
+	_, err := m.create("mknod", name, n)
+	return err
+}
+
+func (m *MemFS) Rdev(st os.FileInfo) (uint32, uint32, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := st.Sys().(*memNode); ok {
+		return n.major, n.minor, true
+	}
+	return 0, 0, false
+}
+
+func (m *MemFS) Flags(st os.FileInfo) (uint32, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := st.Sys().(*memNode); ok {
+		return n.flags, true
+	}
+	return 0, false
+}
+
+/* Chflags only records flags, none of them is enforced */
+func (m *MemFS) Chflags(name string, flags uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, n, err := m.lookup("chflags", name, true)
+	if err != nil {
+		return err
+	}
+	n.flags = flags
+	return nil
+}
+
+/* Avail is what Capacity leaves, unknown without */
+func (m *MemFS) Avail(name string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, _, err := m.lookup("statfs", name, true); err != nil {
+		return 0, err
+	}
+	if m.Capacity == 0 {
+		return 0, &os.PathError{Op: "statfs", Path: name, Err: errors.ErrUnsupported}
+	}
+	return m.Capacity - m.used, nil
+}
+
+func (m *MemFS) Owner(st os.FileInfo) (int, int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := st.Sys().(*memNode); ok {
+		return n.uid, n.gid, true
+	}
+	return 0, 0, false
+}
+
+func (m *MemFS) children(dir string) []string {
+	var names []string
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for p := range m.nodes {
+		if p != "/" && strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			names = append(names, p)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type memFile struct {
+	fs      *MemFS
+	name    string /* as opened */
+	path    string /* resolved */
+	node    *memNode
+	flag    int
+	off     int64
+	dirRead int /* directory entries returned by Readdir */
+	closed  bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if err := f.fs.fault(op, f.path); err != nil {
+		return err
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.node.mode.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if f.off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	if c := f.fs.ReadChunk; c > 0 && len(p) > c {
+		p = p[:c]
+	}
+	n := copy(p, f.node.data[f.off:])
+	f.off += int64(n)
+	f.node.atime = time.Now()
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+
+	end := f.off + int64(len(p))
+	n := len(p)
+	var err error
+	if grow := end - int64(len(f.node.data)); grow > 0 && f.fs.Capacity > 0 {
+		if room := f.fs.Capacity - f.fs.used; grow > room {
+			n -= int(grow - room)
+			if n < 0 {
+				n = 0
+			}
+			end = f.off + int64(n)
+			err = &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+		}
+	}
+	f.resize(end)
+	copy(f.node.data[f.off:], p[:n])
+	f.off = end
+	f.node.mtime = time.Now()
+	return n, err
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("seek", false); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default: /* no holes to seek */
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+/* resize grows data to at least size, zero filled */
+func (f *memFile) resize(size int64) {
+	if size <= int64(len(f.node.data)) {
+		return
+	}
+	f.fs.used += size - int64(len(f.node.data))
+	f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("close", false); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("stat", false); err != nil {
+		return nil, err
+	}
+	return memInfo(memClean(f.name), f.node), nil /* named as opened like os.File */
+}
+
+func (f *memFile) Readdir(n int) ([]os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("readdir", false); err != nil {
+		return nil, err
+	}
+	if !f.node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	names := f.fs.children(f.path)[f.dirRead:]
+	if n > 0 && len(names) > n {
+		names = names[:n]
+	}
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, p := range names {
+		infos = append(infos, memInfo(p, f.fs.nodes[p]))
+	}
+	f.dirRead += len(names)
+
+	if n > 0 && len(infos) == 0 {
+		return infos, io.EOF
+	}
+	return infos, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < int64(len(f.node.data)) {
+		f.fs.used -= int64(len(f.node.data)) - size
+		f.node.data = f.node.data[:size]
+	} else {
+		f.resize(size)
+	}
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.check("sync", false)
+}
+
+func (f *memFile) Chmod(mode os.FileMode) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("chmod", false); err != nil {
+		return err
+	}
+	f.node.mode = f.node.mode&os.ModeType | mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+	mod  time.Time
+	node *memNode
+}
+
+func memInfo(p string, n *memNode) os.FileInfo {
+	return &memFileInfo{path.Base(p), int64(len(n.data)), n.mode, n.mtime, n}
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.mod }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return fi.node }
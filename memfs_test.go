@@ -0,0 +1,122 @@
+package rscp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/* memTree is a source tree on a MemFS and an empty target on another */
+func memTree(t *testing.T) (src, dst *MemFS) {
+	t.Helper()
+	src, dst = NewMemFS(), NewMemFS()
+	big := bytes.Repeat([]byte("0123456789abcdef"), 8<<10)
+	for _, err := range []error{
+		src.Mkdir("/src", 0755),
+		src.Mkdir("/src/sub", 0750),
+		src.Mkdir("/src/empty", 0700),
+		src.WriteFile("/src/my report.txt", []byte("hello\n"), 0644),
+		src.WriteFile("/src/-rf", nil, 0600),
+		src.WriteFile("/src/sub/big", big, 0640),
+		dst.Mkdir("/dst", 0755),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Unix(1700000000, 0)
+	src.Chtimes("/src/sub/big", mtime, mtime)
+	return src, dst
+}
+
+/* sameTree fails t unless name on dst has the files and modes of /src */
+func sameTree(t *testing.T, src, dst *MemFS, name string) {
+	t.Helper()
+	for _, rel := range []string{"", "/sub", "/empty", "/my report.txt", "/-rf", "/sub/big"} {
+		want, err := src.Stat("/src" + rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dst.Stat(name + rel)
+		if err != nil {
+			t.Errorf("%s: %v", rel, err)
+			continue
+		}
+		if got.Mode() != want.Mode() {
+			t.Errorf("%s: mode %v, want %v", rel, got.Mode(), want.Mode())
+		}
+		if want.Mode().IsRegular() {
+			a, _ := src.ReadFile("/src" + rel)
+			b, _ := dst.ReadFile(name + rel)
+			if !bytes.Equal(a, b) {
+				t.Errorf("%s: %d bytes differ from the %d sent", rel, len(b), len(a))
+			}
+		}
+	}
+}
+
+func TestMemFSRoundTrip(t *testing.T) {
+	src, dst := memTree(t)
+	src.ReadChunk = 1000 /* short reads along the way */
+	opts := Options{Recursive: true, Preserve: true}
+	if err := LoopbackFS(context.Background(), opts, src, []string{"/src"}, dst, "/dst"); err != nil {
+		t.Fatal(err)
+	}
+	sameTree(t, src, dst, "/dst/src")
+	if st, err := dst.Stat("/dst/src/sub/big"); err != nil || !st.ModTime().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("mtime not preserved: %v", err)
+	}
+}
+
+/* a file failing at the source fails alone, the rest arrive */
+func TestMemFSReadFault(t *testing.T) {
+	src, dst := memTree(t)
+	src.Inject("read", "/src/my report.txt", syscall.EIO)
+	opts := Options{Recursive: true}
+	err := LoopbackFS(context.Background(), opts, src, []string{"/src"}, dst, "/dst")
+	if !errors.Is(err, syscall.EIO) || isFatal(err) {
+		t.Fatalf("got %v, want the file failing alone", err)
+	}
+	if b, err := dst.ReadFile("/dst/src/sub/big"); err != nil || len(b) != 128<<10 {
+		t.Errorf("other files: %d bytes, %v", len(b), err)
+	}
+}
+
+/* a sink running out of space leaves no partial file */
+func TestMemFSNoSpace(t *testing.T) {
+	src, dst := memTree(t)
+	dst.Capacity = 64 << 10
+	opts := Options{Recursive: true}
+	err := LoopbackFS(context.Background(), opts, src, []string{"/src"}, dst, "/dst")
+	var remote RemoteError
+	if !errors.As(err, &remote) || !strings.Contains(remote.Msg, syscall.ENOSPC.Error()) {
+		t.Fatalf("got %v, want ENOSPC from the sink", err)
+	}
+	d, err := dst.Open("/dst/src/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if left, _ := d.Readdir(-1); len(left) > 0 {
+		t.Errorf("partial file %s left behind", left[0].Name())
+	}
+}
+
+/* denied creating a file at the sink, the source hears of it */
+func TestMemFSSinkFault(t *testing.T) {
+	src, dst := memTree(t)
+	opts := Options{InPlace: true} /* opening the file itself */
+	dst.Inject("open", "/dst/-rf", syscall.EACCES)
+	err := LoopbackFS(context.Background(), opts, src, []string{"/src/-rf", "/src/my report.txt"}, dst, "/dst")
+	var remote RemoteError
+	if !errors.As(err, &remote) {
+		t.Fatalf("got %v, want the error of the sink", err)
+	}
+	if b, err := dst.ReadFile("/dst/my report.txt"); err != nil || string(b) != "hello\n" {
+		t.Errorf("other file: %q, %v", b, err)
+	}
+}
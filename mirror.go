@@ -0,0 +1,141 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrMaxDelete  = errors.New("more to delete than --max-delete allows, not deleted")
+	ErrNotDeleted = errors.New("nothing deleted for the errors of the transfer")
+)
+
+/* mirror is what a sink with Delete removes by once the transfer is
+   done, shared by the sessions of a mux */
+type mirror struct {
+	mu       sync.Mutex
+	dirs     map[string]bool /* received as D messages */
+	received map[string]bool /* names received, skipped and failed ones too */
+	failed   bool            /* what failed to come could be taken for gone */
+}
+
+func newMirror() *mirror {
+	return &mirror{dirs: map[string]bool{}, received: map[string]bool{}}
+}
+
+/* keep records name as received */
+func (m *mirror) keep(name string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received[name] = true
+}
+
+/* dir records name as a directory to mirror */
+func (m *mirror) dir(name string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dirs[name] = true
+}
+
+func (m *mirror) fail() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failed = true
+}
+
+/* prune removes what the directories mirrored hold besides what was
+   received, with OnConflict backup keeping backups */
+func (s *session) prune() []error {
+	m := s.mirror
+	if m.failed {
+		return []error{ErrNotDeleted}
+	}
+	dirs := make([]string, 0, len(m.dirs))
+	for dir := range m.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	left := s.opts.MaxDelete
+	var errs []error
+	for _, dir := range dirs {
+		names, err := readDir(s.fs, dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, name := range names {
+			if m.received[name] || s.opts.OnConflict == ConflictBackup && strings.HasSuffix(name, BackupSuffix) {
+				continue
+			}
+			if err := s.removeAll(name, &left); errors.Is(err, ErrMaxDelete) {
+				return append(errs, err)
+			} else if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+/* readDir is the names of what is in dir */
+func readDir(fsys FS, dir string) ([]string, error) {
+	f, err := fsys.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var names []string
+	for {
+		children, err := f.Readdir(DirScanBatchSize)
+		for _, child := range children {
+			names = append(names, path.Join(dir, child.Name()))
+		}
+		if err == io.EOF {
+			return names, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+/* removeAll removes name and what is below it, counting each against
+   left when MaxDelete is set */
+func (s *session) removeAll(name string, left *int) error {
+	st, err := s.fs.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		names, err := readDir(s.fs, name)
+		if err != nil {
+			return err
+		}
+		for _, child := range names {
+			if err := s.removeAll(child, left); err != nil {
+				return err
+			}
+		}
+	}
+	if s.opts.MaxDelete > 0 {
+		if *left == 0 {
+			return fmt.Errorf("%s: %w", name, ErrMaxDelete)
+		}
+		*left--
+	}
+	return s.fs.Remove(name)
+}
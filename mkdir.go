@@ -0,0 +1,66 @@
+package rscp
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+/* makeDirs creates what Parents and Mkdir have a sink create of target
+   before receiving into it, the mode left to the umask and Umask. A
+   target that cannot be received into is refused before anything is
+   created, and directories made before a later failure are removed. */
+func makeDirs(fs FS, opts Options, target string) error {
+	if opts.TargetDir {
+		if st, err := fs.Stat(target); err == nil && !st.IsDir() {
+			return fmt.Errorf("%s: %w", target, ErrNotDirectory)
+		} else if err != nil && !opts.Mkdir {
+			return err /* its parents are no use without it */
+		}
+	}
+
+	perm := 0777 &^ opts.Umask
+	var made []string
+	if opts.Parents {
+		if err := mkdirAll(fs, path.Dir(path.Clean(target)), perm, &made); err != nil {
+			removeDirs(fs, made)
+			return err
+		}
+	}
+	if opts.TargetDir && opts.Mkdir {
+		if err := fs.Mkdir(target, perm); err != nil && !os.IsExist(err) {
+			removeDirs(fs, made)
+			return err
+		}
+	}
+	return nil
+}
+
+/* mkdirAll is os.MkdirAll on fs, adding the directories it made to made */
+func mkdirAll(fs FS, dir string, perm os.FileMode, made *[]string) error {
+	if st, err := fs.Stat(dir); err == nil {
+		if !st.IsDir() {
+			return fmt.Errorf("%s: %w", dir, ErrNotDirectory)
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := mkdirAll(fs, parent, perm, made); err != nil {
+			return err
+		}
+	}
+	if err := fs.Mkdir(dir, perm); os.IsExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	*made = append(*made, dir)
+	return nil
+}
+
+/* removeDirs undoes mkdirAll, deepest first */
+func removeDirs(fs FS, made []string) {
+	for i := len(made) - 1; i >= 0; i-- {
+		fs.Remove(made[i])
+	}
+}
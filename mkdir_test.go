@@ -0,0 +1,48 @@
+package rscp
+
+import (
+	"context"
+	"syscall"
+	"testing"
+)
+
+/* Parents leaves nothing behind when the target is refused */
+func TestParentsTargetRefused(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		target string
+		setup  func(*MemFS)
+	}{
+		{"missing -d target", Options{Parents: true, TargetDir: true}, "/a/b/c/t", func(*MemFS) {}},
+		{"target a file", Options{Parents: true, TargetDir: true}, "/a/b/c", func(fs *MemFS) {
+			fs.Mkdir("/a", 0755)
+			fs.Mkdir("/a/b", 0755)
+			fs.WriteFile("/a/b/c", nil, 0644)
+		}},
+		{"mkdir failing", Options{Parents: true, TargetDir: true, Mkdir: true}, "/a/b/c/t", func(fs *MemFS) {
+			fs.Inject("mkdir", "/a/b/c/t", syscall.EACCES)
+		}},
+	}
+	for _, tt := range tests {
+		src, dst := NewMemFS(), NewMemFS()
+		src.WriteFile("/f", []byte("hello"), 0644)
+		tt.setup(dst)
+		if err := LoopbackFS(context.Background(), tt.opts, src, []string{"/f"}, dst, tt.target); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		if st, err := dst.Stat("/a/b/c"); err == nil && st.IsDir() {
+			t.Errorf("%s: leading directories left behind", tt.name)
+		}
+	}
+
+	src, dst := NewMemFS(), NewMemFS()
+	src.WriteFile("/f", []byte("hello"), 0644)
+	opts := Options{Parents: true, TargetDir: true, Mkdir: true}
+	if err := LoopbackFS(context.Background(), opts, src, []string{"/f"}, dst, "/a/b/c/t"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := dst.ReadFile("/a/b/c/t/f"); err != nil || string(b) != "hello" {
+		t.Errorf("received %q, %v", b, err)
+	}
+}
@@ -0,0 +1,374 @@
+package rscp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* muxGroup is what the sessions running on the streams of a mux share */
+type muxGroup struct {
+	mu    sync.Mutex /* serializes hooks, results and the fields below */
+	hooks Hooks
+	emit  func(FileResult)
+	fatal error         /* the first fatal error of any stream */
+	dirs  []muxDirAttrs /* sink directories to finish once all streams are done */
+}
+
+type muxDirAttrs struct {
+	name      string
+	perm      os.FileMode
+	resetPerm bool
+	pend      attrs
+}
+
+/* muxItem is a path the source walker hands to the next idle stream */
+type muxItem struct {
+	local string
+	dirs  []muxDir /* directories leading to local, local itself for a directory */
+	dir   bool
+	err   error /* reading the directory failed */
+}
+
+type muxDir struct {
+	local string
+	st    os.FileInfo
+}
+
+func (s *session) newMuxGroup() *muxGroup {
+	g := &muxGroup{}
+	h := s.opts.Hooks
+	if h.OnFileStart != nil {
+		g.hooks.OnFileStart = func(name string, size int64) { g.locked(func() { h.OnFileStart(name, size) }) }
+	}
+	if h.OnFileDone != nil {
+		g.hooks.OnFileDone = func(name string, err error) { g.locked(func() { h.OnFileDone(name, err) }) }
+	}
+	if h.OnDirEnter != nil {
+		g.hooks.OnDirEnter = func(name string) { g.locked(func() { h.OnDirEnter(name) }) }
+	}
+	if h.OnDirLeave != nil {
+		g.hooks.OnDirLeave = func(name string, err error) { g.locked(func() { h.OnDirLeave(name, err) }) }
+	}
+	if h.OnBytes != nil {
+		g.hooks.OnBytes = func(n int) { g.locked(func() { h.OnBytes(n) }) }
+	}
+	if s.manifest != nil && s.manifest.emit != nil {
+		emit := s.manifest.emit
+		g.emit = func(r FileResult) { g.locked(func() { emit(r) }) }
+	}
+	return g
+}
+
+func (g *muxGroup) locked(fn func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fn()
+}
+
+/* fail records err if it is the first fatal error, true if it is */
+func (g *muxGroup) fail(err error) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.fatal != nil {
+		return false
+	}
+	g.fatal = err
+	return true
+}
+
+func (g *muxGroup) deferDir(name string, perm os.FileMode, resetPerm bool, pend attrs) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.dirs = append(g.dirs, muxDirAttrs{name, perm, resetPerm, pend})
+}
+
+/* child is a session on one stream of a mux, it shares options,
+   filesystem and extensions but has its own manifest and summary */
+func (s *session) child(ctx context.Context, st *muxStream, g *muxGroup) *session {
+	c := &session{ctx: ctx, opts: s.opts, fs: s.fs, in: st, out: st, stop: func() {}, cancel: s.cancel, mux: g, mirror: s.mirror, quota: s.quota, caseNames: s.caseNames}
+	c.opts.Hooks = g.hooks
+	c.progress = s.progress
+	if s.manifest != nil {
+		c.manifest = &manifest{emit: g.emit, keep: s.manifest.keep}
+	}
+	if s.summary != nil {
+		c.summary = new(SummaryError)
+	}
+	c.ext = map[string]bool{}
+	for e := range s.ext {
+		c.ext[e] = e != "mux"
+	}
+	c.codec()
+	c.startKeepalive()
+	return c
+}
+
+/* sourceMux sends paths over opts.Streams streams, a walker hands out
+   files one by one to a plain source running on each stream. Every
+   stream enters the directories leading to its files by itself. */
+func (s *session) sourceMux(paths []string) ([]error, error) {
+	n := min(s.opts.Streams, MaxStreams)
+	s.keepalive.stop() /* the streams beat on their own */
+	if err := s.enc.Encode(protocol.MMsg{Streams: n}); err != nil {
+		return nil, err
+	}
+	if err := s.ack(); err != nil { /* anything after is framed */
+		return nil, err
+	}
+	conn := newMuxConn(s.in, s.out, s.flush, n)
+	defer context.AfterFunc(s.ctx, func() { conn.abort(canceledErr) })()
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	g := s.newMuxGroup()
+	items := make(chan muxItem)
+	children := make([]*session, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range children {
+		st := conn.streams[i]
+		c := s.child(ctx, st, g)
+		children[i] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.sourceStream(items)
+			c.keepalive.stop()
+			if isFatal(errs[i]) {
+				if g.fail(errs[i]) {
+					conn.abort(errs[i])
+				}
+				cancel()
+			} else if err := st.CloseWrite(); err != nil && g.fail(err) {
+				conn.abort(err)
+			}
+		}()
+	}
+
+	for _, local := range paths {
+		if !s.walk(ctx, local, nil, items) {
+			break
+		}
+	}
+	close(items)
+	wg.Wait()
+	if g.fatal == nil {
+		conn.wait() /* for the sink to finish with every stream */
+	}
+	return s.merge(children, errs, g)
+}
+
+/* walk hands local and, for a directory, everything below it to the
+   streams, false once the transfer failed */
+func (s *session) walk(ctx context.Context, local string, dirs []muxDir, items chan<- muxItem) bool {
+	hand := func(it muxItem) bool {
+		select {
+		case items <- it:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	stat := s.fs.Stat
+	if !s.follows(dirs == nil) {
+		stat = s.fs.Lstat
+	}
+	if st, err := stat(local); err != nil || !st.IsDir() || !s.opts.Recursive {
+		return hand(muxItem{local: local, dirs: dirs}) /* send reports what is wrong */
+	}
+	dir, err := s.fs.Open(local)
+	if err != nil {
+		return hand(muxItem{local: local, dirs: dirs})
+	}
+	defer dir.Close()
+	st, err := dir.Stat()
+	if err != nil {
+		return hand(muxItem{local: local, dirs: dirs})
+	}
+	if id, ok := s.dirID(st); ok {
+		for _, d := range dirs {
+			if did, ok := s.dirID(d.st); ok && did == id {
+				return hand(muxItem{local: local, dirs: dirs, err: fmt.Errorf("%s: %w", local, ErrDirLoop)})
+			}
+		}
+	}
+
+	here := append(dirs[:len(dirs):len(dirs)], muxDir{local, st})
+	if !hand(muxItem{local: local, dirs: here, dir: true}) {
+		return false
+	}
+	for {
+		children, err := dir.Readdir(DirScanBatchSize)
+		for _, child := range children {
+			if !s.walk(ctx, path.Join(local, child.Name()), here, items) {
+				return false
+			}
+		}
+		if err == io.EOF {
+			return true
+		} else if err != nil {
+			return hand(muxItem{local: local, dirs: here, dir: true, err: err})
+		}
+	}
+}
+
+/* sourceStream sends the items it gets, moving between directories as needed */
+func (s *session) sourceStream(items <-chan muxItem) error {
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	var sendErrs []error
+	var cwd []muxDir
+	failed := map[string]bool{} /* directories the sink refused */
+	for it := range items {
+		skip := false
+		for _, d := range it.dirs {
+			skip = skip || failed[d.local]
+		}
+		if skip {
+			continue
+		}
+
+		err := s.chdir(&cwd, it.dirs, failed)
+		if err == nil && it.err != nil {
+			err = s.teeError(it.err)
+		} else if err == nil && !it.dir {
+			err = s.send(it.local, it.dirs == nil)
+		}
+		if isFatal(err) {
+			return err
+		} else if err != nil {
+			sendErrs = s.collect(sendErrs, err)
+		}
+	}
+	if err := s.chdir(&cwd, nil, failed); isFatal(err) {
+		return err
+	} else if err != nil {
+		sendErrs = s.collect(sendErrs, err)
+	}
+
+	if len(sendErrs) > 0 {
+		return AccError{sendErrs}
+	}
+	return nil
+}
+
+/* chdir leaves and enters directories at the sink until the stream is in
+   the last of dirs, remembering those it failed to enter */
+func (s *session) chdir(cwd *[]muxDir, dirs []muxDir, failed map[string]bool) error {
+	keep := 0
+	for keep < len(*cwd) && keep < len(dirs) && (*cwd)[keep].local == dirs[keep].local {
+		keep++
+	}
+
+	var errs []error
+	for len(*cwd) > keep {
+		top := (*cwd)[len(*cwd)-1]
+		*cwd = (*cwd)[:len(*cwd)-1]
+		if err := s.leaveDir(top.local, nil); isFatal(err) {
+			return err
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, d := range dirs[keep:] {
+		if err := s.enterDir(d.local, d.st); isFatal(err) {
+			return err
+		} else if err != nil {
+			failed[d.local] = true
+			errs = append(errs, err)
+			break
+		}
+		*cwd = append(*cwd, d)
+	}
+
+	if len(errs) > 0 {
+		return AccError{errs}
+	}
+	return nil
+}
+
+/* sinkMux receives on n streams into target, a plain sink running on
+   each. Directory modes and times are set once all streams are done,
+   deepest first, as any stream may still write into any directory. */
+func (s *session) sinkMux(target string, n int) ([]error, error) {
+	s.keepalive.stop() /* the streams beat on their own */
+	if err := s.enc.Ack(); err != nil {
+		return nil, err
+	}
+	conn := newMuxConn(s.in, s.out, nil, n)
+	defer context.AfterFunc(s.ctx, func() { conn.abort(canceledErr) })()
+
+	g := s.newMuxGroup()
+	children := make([]*session, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range children {
+		st := conn.streams[i]
+		c := s.child(s.ctx, st, g)
+		children[i] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.sink(target, false)
+			c.keepalive.stop()
+			if isFatal(errs[i]) {
+				if g.fail(errs[i]) {
+					conn.abort(errs[i])
+				}
+			} else if err := st.CloseWrite(); err != nil && g.fail(err) {
+				conn.abort(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sinkErrs, err := s.merge(children, errs, g)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(g.dirs, func(i, j int) bool {
+		return strings.Count(g.dirs[i].name, "/") > strings.Count(g.dirs[j].name, "/")
+	})
+	for _, d := range g.dirs {
+		for _, err := range s.setAttrs(d.name, d.perm, d.resetPerm, d.pend) {
+			sinkErrs = s.collect(sinkErrs, err)
+		}
+	}
+	return sinkErrs, nil
+}
+
+/* merge gathers what the sessions of the streams ran into */
+func (s *session) merge(children []*session, errs []error, g *muxGroup) ([]error, error) {
+	var all []error
+	for i, c := range children {
+		s.tally.Files += c.tally.Files
+		s.tally.Bytes += c.tally.Bytes
+		s.tally.Failed += c.tally.Failed
+		if c.manifest != nil {
+			s.manifest.results = append(s.manifest.results, c.manifest.results...)
+		}
+		if c.summary != nil {
+			for _, err := range c.summary.Errors {
+				s.summary.add(err)
+			}
+			s.summary.Failed += c.summary.Failed - len(c.summary.Errors)
+		}
+		if acc, ok := errs[i].(AccError); ok {
+			all = append(all, acc.Errors...)
+		} else if errs[i] != nil && !isFatal(errs[i]) {
+			all = append(all, errs[i])
+		}
+	}
+	return all, g.fatal
+}
@@ -0,0 +1,271 @@
+package rscp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+const (
+	MaxStreams   = protocol.MaxStreams
+	MuxFrameSize = 32 << 10  /* largest data frame, small ones let streams interleave */
+	MuxWindow    = 256 << 10 /* bytes a stream may have unread at the peer */
+)
+
+/* frame kinds */
+const (
+	muxData   = 'd'
+	muxWindow = 'w' /* the reader consumed that many bytes */
+	muxClose  = 'c' /* the writer is done with the stream */
+)
+
+var errStreamClosed = errors.New("stream closed by peer")
+
+/* muxConn carries numbered streams over one connection in frames of a
+   kind byte, a stream byte, a big endian uint32 and a payload. Data in
+   flight is bounded per stream by windows the reading side replenishes,
+   so a stream nobody reads never stalls the others. */
+type muxConn struct {
+	r     io.Reader
+	w     io.Writer
+	flush func() error /* pushes each frame out of a compressor */
+
+	wmu     sync.Mutex
+	streams []*muxStream /* numbered from one */
+	done    chan struct{} /* closed once demux returns */
+}
+
+func newMuxConn(r io.Reader, w io.Writer, flush func() error, n int) *muxConn {
+	c := &muxConn{r: r, w: w, flush: flush, done: make(chan struct{})}
+	for id := 1; id <= n; id++ {
+		st := &muxStream{c: c, id: byte(id), window: MuxWindow}
+		st.cond = sync.NewCond(&st.mu)
+		c.streams = append(c.streams, st)
+	}
+	go c.demux()
+	return c
+}
+
+func (c *muxConn) stream(id byte) *muxStream {
+	if id == 0 || int(id) > len(c.streams) {
+		return nil
+	}
+	return c.streams[id-1]
+}
+
+func (c *muxConn) writeFrame(kind, id byte, n int, payload []byte) error {
+	frame := make([]byte, 6, 6+len(payload))
+	frame[0], frame[1] = kind, id
+	binary.BigEndian.PutUint32(frame[2:], uint32(n))
+	frame = append(frame, payload...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.w.Write(frame); err != nil {
+		return FatalError{Err: err}
+	}
+	if c.flush != nil {
+		return c.flush()
+	}
+	return nil
+}
+
+/* demux hands out incoming frames until every stream is closed by the peer */
+func (c *muxConn) demux() {
+	defer close(c.done)
+	hdr := make([]byte, 6)
+	for open := len(c.streams); open > 0; {
+		if _, err := io.ReadFull(c.r, hdr); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			c.fail(FatalError{Err: err})
+			return
+		}
+		kind, st, n := hdr[0], c.stream(hdr[1]), binary.BigEndian.Uint32(hdr[2:])
+		if st == nil {
+			c.fail(protocolErr)
+			return
+		}
+
+		switch kind {
+		case muxData:
+			if n > MuxFrameSize {
+				c.fail(protocolErr)
+				return
+			}
+			p := make([]byte, n)
+			if _, err := io.ReadFull(c.r, p); err != nil {
+				c.fail(FatalError{Err: io.ErrUnexpectedEOF})
+				return
+			}
+			if !st.deliver(p) {
+				c.fail(protocolErr)
+				return
+			}
+		case muxWindow:
+			st.grant(int(n))
+		case muxClose:
+			if st.closeRead() {
+				open--
+			}
+		default:
+			c.fail(protocolErr)
+			return
+		}
+	}
+}
+
+/* fail ends all streams with err */
+func (c *muxConn) fail(err error) {
+	for _, st := range c.streams {
+		st.fail(err)
+	}
+}
+
+/* abort fails all streams and tells the peer they are closed, so its
+   readers stop waiting for what will never be sent */
+func (c *muxConn) abort(err error) {
+	c.fail(err)
+	for _, st := range c.streams {
+		st.CloseWrite()
+	}
+}
+
+/* wait returns once the peer closed every stream or the connection failed */
+func (c *muxConn) wait() {
+	<-c.done
+}
+
+type muxStream struct {
+	c  *muxConn
+	id byte
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte /* received but unread */
+	unacked int    /* read but not yet granted back to the peer */
+	window  int    /* bytes we may still send */
+	eof     bool   /* peer closed its side */
+	wclosed bool   /* we closed ours */
+	err     error
+}
+
+/* deliver queues received data, false if the peer overran the window */
+func (st *muxStream) deliver(p []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err != nil {
+		return true /* nobody reads anymore */
+	}
+	if st.eof || len(st.buf)+st.unacked+len(p) > MuxWindow {
+		return false
+	}
+	st.buf = append(st.buf, p...)
+	st.cond.Broadcast()
+	return true
+}
+
+func (st *muxStream) grant(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.window += n
+	st.cond.Broadcast()
+}
+
+/* closeRead marks the end of what the peer sends, true the first time */
+func (st *muxStream) closeRead() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.eof {
+		return false
+	}
+	st.eof = true
+	st.cond.Broadcast()
+	return true
+}
+
+func (st *muxStream) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 && !st.eof && st.err == nil {
+		st.cond.Wait()
+	}
+	if len(st.buf) == 0 {
+		defer st.mu.Unlock()
+		if st.err != nil {
+			return 0, st.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, st.buf)
+	st.buf = st.buf[n:]
+	st.unacked += n
+	grant := 0
+	if st.unacked >= MuxWindow/2 {
+		grant, st.unacked = st.unacked, 0
+	}
+	st.mu.Unlock()
+
+	if grant > 0 {
+		if err := st.c.writeFrame(muxWindow, st.id, grant, nil); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.window == 0 && st.err == nil && !st.eof {
+			st.cond.Wait()
+		}
+		if st.err != nil || st.wclosed {
+			err := st.err
+			st.mu.Unlock()
+			if err == nil {
+				err = FatalError{Err: io.ErrClosedPipe}
+			}
+			return written, err
+		}
+		if st.window == 0 { /* the peer went away without reading on */
+			st.mu.Unlock()
+			return written, FatalError{Err: errStreamClosed}
+		}
+		n := min(len(p), st.window, MuxFrameSize)
+		st.window -= n
+		st.mu.Unlock()
+
+		if err := st.c.writeFrame(muxData, st.id, n, p[:n]); err != nil {
+			return written, err
+		}
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+/* CloseWrite tells the peer nothing more is sent on the stream */
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	closed := st.wclosed
+	st.wclosed = true
+	st.mu.Unlock()
+	if closed {
+		return nil
+	}
+	return st.c.writeFrame(muxClose, st.id, 0, nil)
+}
@@ -0,0 +1,73 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+var ErrUnsendableName = errors.New("name contains a line end the peer cannot take")
+
+/* wireName is name as it goes into a C, D, L or H message: escaped when
+   the names extension is on, refused if it would break the line otherwise */
+func (s *session) wireName(name string) (string, error) {
+	if s.ext["names"] {
+		return escapeName(name), nil
+	}
+	if strings.ContainsRune(name, rune(s.enc.EOL)) {
+		return "", fmt.Errorf("%q: %w", name, ErrUnsendableName)
+	}
+	return name, nil
+}
+
+/* localName undoes wireName at the sink, normalizing as Normalize says */
+func (s *session) localName(name string) (string, error) {
+	if !s.ext["names"] {
+		return s.normalize(name), nil
+	}
+	name, err := unescapeName(name)
+	if err != nil {
+		return "", err
+	}
+	return s.normalize(name), protocol.CheckName(name)
+}
+
+/* escapeName writes control characters and backslashes as a backslash
+   and three octal digits */
+func escapeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < ' ' || c == 0x7f || c == '\\' {
+			fmt.Fprintf(&b, "\\%03o", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeName(name string) (string, error) {
+	if !strings.ContainsRune(name, '\\') {
+		return name, nil
+	}
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '\\' {
+			b = append(b, name[i])
+			continue
+		}
+		if i+4 > len(name) {
+			return "", protocolErr
+		}
+		c, err := strconv.ParseUint(name[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", protocolErr
+		}
+		b = append(b, byte(c))
+		i += 3
+	}
+	return string(b), nil
+}
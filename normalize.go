@@ -0,0 +1,197 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+/* Norm is the Unicode normalization form a sink gives the names it
+   receives, that of the same name differing between systems: macOS
+   writes names decomposed, most else composed */
+type Norm int
+
+const (
+	NormNone Norm = iota /* names as they come */
+	NormNFC              /* composed, é as one character */
+	NormNFD              /* decomposed, é as e and a combining accent */
+)
+
+var normNames = []string{
+	NormNone: "none",
+	NormNFC:  "nfc",
+	NormNFD:  "nfd",
+}
+
+var ErrUnknownNorm = errors.New("not none, nfc or nfd")
+
+func (n Norm) String() string {
+	if n >= 0 && int(n) < len(normNames) {
+		return normNames[n]
+	}
+	return "unknown"
+}
+
+/* ParseNorm is the Norm named text */
+func ParseNorm(text string) (Norm, error) {
+	for n, name := range normNames {
+		if name == text {
+			return Norm(n), nil
+		}
+	}
+	return 0, fmt.Errorf("%q: %w", text, ErrUnknownNorm)
+}
+
+/* normalize is name in the form of Normalize */
+func (s *session) normalize(name string) string {
+	switch s.opts.Normalize {
+	case NormNFC:
+		return nfc(name)
+	case NormNFD:
+		return nfd(name)
+	}
+	return name
+}
+
+/* Hangul syllables decompose and compose by arithmetic, not by table */
+const (
+	hangulS      = 0xAC00
+	hangulL      = 0x1100
+	hangulV      = 0x1161
+	hangulT      = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+var (
+	decompositions = map[rune][]rune{}  /* full canonical decompositions */
+	compositions   = map[[2]rune]rune{} /* primary composites by the pair they decompose to */
+)
+
+func init() {
+	excluded := map[rune]bool{}
+	for _, r := range compositionExclusions {
+		excluded[r] = true
+	}
+	for r, d := range canonicalDecompositions {
+		decompositions[r] = decompose(nil, r)
+		if pair := []rune(d); len(pair) == 2 && !excluded[r] && combiningClass(r) == 0 && combiningClass(pair[0]) == 0 {
+			compositions[[2]rune{pair[0], pair[1]}] = r
+		}
+	}
+}
+
+/* combiningClass is the canonical combining class of r, zero for starters */
+func combiningClass(r rune) uint8 {
+	i := sort.Search(len(combiningClasses), func(i int) bool { return combiningClasses[i].hi >= r })
+	if i < len(combiningClasses) && combiningClasses[i].lo <= r {
+		return combiningClasses[i].class
+	}
+	return 0
+}
+
+/* decompose appends the full canonical decomposition of r to dst */
+func decompose(dst []rune, r rune) []rune {
+	if r >= hangulS && r < hangulS+hangulSCount {
+		i := r - hangulS
+		dst = append(dst, hangulL+i/hangulNCount, hangulV+i%hangulNCount/hangulTCount)
+		if t := i % hangulTCount; t != 0 {
+			dst = append(dst, hangulT+t)
+		}
+		return dst
+	}
+	if d, ok := decompositions[r]; ok {
+		return append(dst, d...)
+	}
+	d, ok := canonicalDecompositions[r]
+	if !ok {
+		return append(dst, r)
+	}
+	for _, c := range d {
+		dst = decompose(dst, c)
+	}
+	return dst
+}
+
+/* decomposed is name decomposed and put in canonical order, combining
+   marks following one another sorted by class */
+func decomposed(name string) []rune {
+	var rs []rune
+	for _, r := range name {
+		rs = decompose(rs, r)
+	}
+	for i := 1; i < len(rs); i++ {
+		for j := i; j > 0; j-- {
+			c := combiningClass(rs[j])
+			if c == 0 || combiningClass(rs[j-1]) <= c {
+				break
+			}
+			rs[j-1], rs[j] = rs[j], rs[j-1]
+		}
+	}
+	return rs
+}
+
+/* compose is the primary composite of a and b, false when none */
+func compose(a, b rune) (rune, bool) {
+	if a >= hangulL && a < hangulL+hangulLCount && b >= hangulV && b < hangulV+hangulVCount {
+		return hangulS + ((a-hangulL)*hangulVCount+b-hangulV)*hangulTCount, true
+	}
+	if a >= hangulS && a < hangulS+hangulSCount && (a-hangulS)%hangulTCount == 0 && b > hangulT && b < hangulT+hangulTCount {
+		return a + b - hangulT, true
+	}
+	r, ok := compositions[[2]rune{a, b}]
+	return r, ok
+}
+
+func ascii(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+/* nfd is name in Normalization Form D */
+func nfd(name string) string {
+	if ascii(name) || !utf8.ValidString(name) {
+		return name
+	}
+	return string(decomposed(name))
+}
+
+/* nfc is name in Normalization Form C: decomposed, then each starter
+   composed with what follows it unless blocked by a mark of the same
+   class or another starter in between */
+func nfc(name string) string {
+	if ascii(name) || !utf8.ValidString(name) {
+		return name
+	}
+	rs := decomposed(name)
+	if len(rs) == 0 {
+		return name
+	}
+	out := rs[:1]
+	starter, last := 0, int(combiningClass(rs[0]))
+	if last != 0 {
+		last = 256 /* nothing before it to compose with */
+	}
+	for _, r := range rs[1:] {
+		c := int(combiningClass(r))
+		if composite, ok := compose(out[starter], r); ok && (last == 0 || last < c) {
+			out[starter] = composite
+			continue
+		}
+		if c == 0 {
+			starter = len(out)
+		}
+		last = c
+		out = append(out, r)
+	}
+	return string(out)
+}
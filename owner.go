@@ -0,0 +1,175 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+var (
+	ErrUnknownUser  = errors.New("no such user")
+	ErrUnknownGroup = errors.New("no such group")
+	ErrOwnership    = errors.New("not user, user:group or :group")
+	ErrIDRange      = errors.New("id out of range once offset")
+)
+
+/* Ownership is a user and group to give all a sink receives, by name or
+   id, either empty to leave it; looked up at the sink once needed */
+type Ownership struct {
+	User, Group string
+
+	once     sync.Once
+	uid, gid int
+	err      error
+}
+
+/* ParseOwnership is the Ownership text gives as user, user:group or
+   :group */
+func ParseOwnership(text string) (*Ownership, error) {
+	u, g, _ := strings.Cut(text, ":")
+	if u == "" && g == "" || strings.Contains(g, ":") {
+		return nil, fmt.Errorf("%q: %w", text, ErrOwnership)
+	}
+	return &Ownership{User: u, Group: g}, nil
+}
+
+/* ids are the user and group ids of o here, -1 for those left; names
+   no entry has stand for themselves when numbers */
+func (o *Ownership) ids() (int, int, error) {
+	o.once.Do(func() {
+		o.uid, o.gid = -1, -1
+		if o.User != "" {
+			if u, err := user.Lookup(o.User); err == nil {
+				o.uid, o.err = strconv.Atoi(u.Uid)
+			} else if id, err := strconv.Atoi(o.User); err == nil && id >= 0 {
+				o.uid = id
+			} else {
+				o.err = fmt.Errorf("%s: %w", o.User, ErrUnknownUser)
+				return
+			}
+		}
+		if o.Group != "" {
+			if g, err := user.LookupGroup(o.Group); err == nil {
+				o.gid, o.err = strconv.Atoi(g.Gid)
+			} else if id, err := strconv.Atoi(o.Group); err == nil && id >= 0 {
+				o.gid = id
+			} else {
+				o.err = fmt.Errorf("%s: %w", o.Group, ErrUnknownGroup)
+			}
+		}
+	})
+	return o.uid, o.gid, o.err
+}
+
+/* ownerCache remembers user database lookups, done once per name or id */
+type ownerCache struct {
+	users, groups map[int]string
+	uids, gids    map[string]int
+}
+
+func newOwnerCache() *ownerCache {
+	return &ownerCache{
+		users:  map[int]string{},
+		groups: map[int]string{},
+		uids:   map[string]int{},
+		gids:   map[string]int{},
+	}
+}
+
+/* owner describes the owner of st, falling back to ids for unknown names */
+func (s *session) owner(st os.FileInfo) (protocol.OMsg, bool) {
+	uid, gid, ok := s.fs.Owner(st)
+	if !ok {
+		return protocol.OMsg{}, false
+	}
+	if s.owners == nil {
+		s.owners = newOwnerCache()
+	}
+	c := s.owners
+
+	name, ok := c.users[uid]
+	if !ok {
+		name = strconv.Itoa(uid)
+		if u, err := user.LookupId(name); err == nil {
+			name = u.Username
+		}
+		c.users[uid] = name
+	}
+	group, ok := c.groups[gid]
+	if !ok {
+		group = strconv.Itoa(gid)
+		if g, err := user.LookupGroupId(group); err == nil {
+			group = g.Name
+		}
+		c.groups[gid] = group
+	}
+	return protocol.OMsg{Uid: uid, Gid: gid, User: name, Group: group}, true
+}
+
+/* chown gives name the owner m describes, by name when known here and
+   by id otherwise or with NumericIDs, shifted by UidOffset and
+   GidOffset, and what Chown has in its place; m may be nil */
+func (s *session) chown(name string, m *protocol.OMsg) error {
+	uid, gid := -1, -1
+	if m != nil {
+		uid, gid = s.lookupOwner(m)
+		uid += s.opts.UidOffset
+		gid += s.opts.GidOffset
+		if uid < 0 || int64(uid) >= math.MaxUint32 || gid < 0 || int64(gid) >= math.MaxUint32 {
+			return fmt.Errorf("%s: %d:%d: %w", name, uid, gid, ErrIDRange)
+		}
+	}
+	if o := s.opts.Chown; o != nil {
+		ouid, ogid, err := o.ids()
+		if err != nil {
+			return err
+		}
+		if ouid >= 0 {
+			uid = ouid
+		}
+		if ogid >= 0 {
+			gid = ogid
+		}
+	}
+	return s.fs.Chown(name, uid, gid)
+}
+
+/* lookupOwner is the ids m stands for here, those sent with NumericIDs */
+func (s *session) lookupOwner(m *protocol.OMsg) (int, int) {
+	if s.opts.NumericIDs {
+		return m.Uid, m.Gid
+	}
+	if s.owners == nil {
+		s.owners = newOwnerCache()
+	}
+	c := s.owners
+
+	uid, ok := c.uids[m.User]
+	if !ok {
+		uid = m.Uid
+		if u, err := user.Lookup(m.User); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				uid = id
+			}
+		}
+		c.uids[m.User] = uid
+	}
+	gid, ok := c.gids[m.Group]
+	if !ok {
+		gid = m.Gid
+		if g, err := user.LookupGroup(m.Group); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				gid = id
+			}
+		}
+		c.gids[m.Group] = gid
+	}
+	return uid, gid
+}
@@ -0,0 +1,23 @@
+package rscp
+
+import "os"
+
+/* preallocate reserves the size of the file coming into f with
+   Preallocate, failing only for want of space; sparse files keep their
+   holes and where reserving is not supported nothing is done */
+func (s *session) preallocate(f File, st os.FileInfo, size int64, pend attrs) error {
+	if !s.opts.Preallocate || pend.sparse || size == 0 || !st.Mode().IsRegular() {
+		return nil
+	}
+	return allocate(f, size)
+}
+
+func allocate(f File, size int64) error {
+	switch f := f.(type) {
+	case *teeFile:
+		return f.all(func(f File) error { return allocate(f, size) })
+	case *os.File:
+		return fallocate(f, size)
+	}
+	return nil
+}
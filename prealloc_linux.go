@@ -0,0 +1,16 @@
+package rscp
+
+import (
+	"os"
+	"syscall"
+)
+
+const fallocKeepSize = 1 /* FALLOC_FL_KEEP_SIZE, the writes set the size */
+
+func fallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.ENOSPC || err == syscall.EDQUOT {
+		return err
+	}
+	return nil
+}
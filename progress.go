@@ -0,0 +1,116 @@
+package rscp
+
+import (
+	"sync"
+	"time"
+)
+
+/* Progress is a snapshot of a running transfer. Reports are sent
+   without blocking and dropped while the receiver is busy, except
+   the final one after which the channel is closed. */
+type Progress struct {
+	File  string  /* file currently transferred */
+	Files int     /* files started so far */
+	Bytes int64   /* file data bytes moved so far */
+	Rate  float64 /* bytes/second since the previous report */
+	Done  bool    /* final report */
+
+	/* files and bytes of the whole transfer, zero when unknown, see Options.Totals */
+	TotalFiles int
+	TotalBytes int64
+}
+
+/* Percent is how much of TotalBytes was moved, -1 when unknown */
+func (p Progress) Percent() float64 {
+	if p.TotalBytes <= 0 {
+		return -1
+	}
+	return min(100, 100*float64(p.Bytes)/float64(p.TotalBytes))
+}
+
+/* ETA estimates the time left at the current rate, -1 when unknown */
+func (p Progress) ETA() time.Duration {
+	if p.TotalBytes <= 0 || p.Rate <= 0 {
+		return -1
+	}
+	return time.Duration(float64(max(0, p.TotalBytes-p.Bytes)) / p.Rate * float64(time.Second))
+}
+
+type progressMeter struct {
+	mu       sync.Mutex /* streams of a mux share the meter */
+	ch       chan<- Progress
+	interval time.Duration
+	cur      Progress
+	last     time.Time /* time of last report */
+	lastB    int64     /* bytes at last report */
+}
+
+func newProgressMeter(ch chan<- Progress, interval time.Duration) *progressMeter {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &progressMeter{ch: ch, interval: interval, last: time.Now()}
+}
+
+func (m *progressMeter) fileStart(name string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cur.File = name
+	m.cur.Files++
+	m.tick()
+}
+
+func (m *progressMeter) total(files int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cur.TotalFiles, m.cur.TotalBytes = files, bytes
+}
+
+func (m *progressMeter) moved(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cur.Bytes += int64(n)
+	m.tick()
+}
+
+func (m *progressMeter) tick() {
+	if time.Since(m.last) < m.interval {
+		return
+	}
+	select {
+	case m.ch <- m.snapshot():
+	default:
+	}
+}
+
+func (m *progressMeter) finish() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.snapshot()
+	p.Done = true
+	m.ch <- p
+	close(m.ch)
+}
+
+func (m *progressMeter) snapshot() Progress {
+	now := time.Now()
+	p := m.cur
+	if dt := now.Sub(m.last).Seconds(); dt > 0 {
+		p.Rate = float64(p.Bytes-m.lastB) / dt
+	}
+	m.last = now
+	m.lastB = p.Bytes
+	return p
+}
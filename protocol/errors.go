@@ -0,0 +1,35 @@
+package protocol
+
+import "errors"
+
+var (
+	ErrProtocol    = errors.New("protocol error")
+	ErrNotRegular  = errors.New("not a regular file")
+	ErrInvalidName = errors.New("invalid name")
+	ErrOutOfRange  = errors.New("value out of range")
+	ErrDeclined    = errors.New("declined by the sink") /* a Y reply */
+
+	protocolErr = FatalError{ErrProtocol}
+)
+
+/* FatalError aborts the session, Err tells why */
+type FatalError struct {
+	Err error
+}
+
+func (e FatalError) Error() string {
+	return e.Err.Error()
+}
+
+func (e FatalError) Unwrap() error {
+	return e.Err
+}
+
+/* RemoteError carries an error message received from the peer */
+type RemoteError struct {
+	Msg string
+}
+
+func (e RemoteError) Error() string {
+	return e.Msg
+}
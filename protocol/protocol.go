@@ -0,0 +1,914 @@
+/* Package protocol reads and writes the lines of the scp protocol, the
+   rscp extensions included, and the acks and error replies to them */
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	S_ISUID = 04000
+	S_ISGID = 02000
+	S_ISVTX = 01000
+
+	MaxFileSize       = 1 << 60  /* larger sizes from the peer are refused */
+	DefaultMaxLineLen = 16 << 10 /* fits a symlink target of PATH_MAX escaped in full */
+	MaxExtentsPerMsg  = 128
+	MaxStreams        = 16
+)
+
+/* Encoder writes scp protocol messages, failing writes are fatal */
+type Encoder struct {
+	w   io.Writer
+	EOL byte /* ends every line, NUL with the nul extension */
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w, '\n'}
+}
+
+/* WriteData writes p as it is, the data following a message */
+func (e *Encoder) WriteData(p []byte) error {
+	if _, err := e.w.Write(p); err != nil {
+		return FatalError{err}
+	}
+	return nil
+}
+
+func (e *Encoder) Ack() error {
+	return e.WriteData([]byte{0})
+}
+
+/* Encode writes m as a single line, newline terminated unless agreed otherwise */
+func (e *Encoder) Encode(m encoding.TextMarshaler) error {
+	text, err := m.MarshalText()
+	if err != nil {
+		return err
+	}
+	return e.WriteData(append(text, e.EOL))
+}
+
+/* Decoder reads scp protocol messages byte by byte leaving file data unread */
+type Decoder struct {
+	r       io.Reader
+	EOL     byte
+	MaxLine int        /* longest line taken, a longer one is a protocol error */
+	Beat    func(BMsg) /* takes heartbeats once they were agreed on */
+
+	/* takes CRLF line ends, stray zero bytes ahead of a message and
+	   trailing blanks after T and E messages */
+	Lenient bool
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, EOL: '\n', MaxLine: DefaultMaxLineLen}
+}
+
+/* Next returns the next message line starting with its kind byte,
+   io.EOF on clean end of stream */
+func (d *Decoder) Next() (string, error) {
+	prefix := []byte{0}
+	for {
+		if _, err := d.r.Read(prefix); err != nil {
+			if err == io.EOF {
+				return "", err
+			}
+			return "", FatalError{err}
+		}
+		if d.Lenient && prefix[0] == 0 {
+			continue /* an extra ack */
+		}
+		line, err := d.readLine()
+		if err != nil {
+			return "", FatalError{err}
+		}
+		if d.Lenient && (prefix[0] == 'T' || prefix[0] == 'E') {
+			line = strings.TrimRight(line, " \t")
+		}
+		if beat, err := d.heartbeat(prefix[0], line); err != nil {
+			return "", err
+		} else if !beat {
+			return string(prefix) + line, nil
+		}
+	}
+}
+
+/* Ack consumes a reply turning warnings and fatal replies into errors */
+func (d *Decoder) Ack() error {
+	_, err := d.reply(false, false)
+	return err
+}
+
+/* AckFile is the reply to a C message, Ack also taking an RMsg with
+   resume, returning its offset, and a YMsg with skip, returning
+   ErrDeclined */
+func (d *Decoder) AckFile(resume, skip bool) (int64, error) {
+	return d.reply(resume, skip)
+}
+
+func (d *Decoder) reply(resume, skip bool) (int64, error) {
+	kind := []byte{0}
+	var l string
+	for {
+		if _, err := d.r.Read(kind); err != nil {
+			return 0, FatalError{err}
+		}
+		if kind[0] == 0 {
+			return 0, nil
+		}
+
+		var err error
+		if l, err = d.readLine(); err != nil {
+			return 0, FatalError{err}
+		}
+		if beat, err := d.heartbeat(kind[0], l); err != nil {
+			return 0, err
+		} else if !beat {
+			break
+		}
+	}
+
+	switch kind[0] {
+	case 1:
+		return 0, RemoteError{l}
+	case 2:
+		return 0, FatalError{RemoteError{l}}
+	case 'R':
+		var m RMsg
+		if err := m.UnmarshalText([]byte("R" + l)); err != nil || !resume {
+			return 0, protocolErr
+		}
+		return m.Offset, nil
+	case 'Y':
+		var m YMsg
+		if err := m.UnmarshalText([]byte("Y" + l)); err != nil || !skip {
+			return 0, protocolErr
+		}
+		return 0, ErrDeclined
+	default:
+		return 0, protocolErr
+	}
+}
+
+/* heartbeat passes a B line on to beat, false for any other line */
+func (d *Decoder) heartbeat(kind byte, line string) (bool, error) {
+	if kind != 'B' || d.Beat == nil {
+		return false, nil
+	}
+	var m BMsg
+	if err := m.UnmarshalText([]byte("B" + line)); err != nil {
+		return true, err
+	}
+	d.Beat(m)
+	return true, nil
+}
+
+/* ReadLimited reads a newline terminated line of at most max bytes */
+func (d *Decoder) ReadLimited(max int) (string, error) {
+	l := make([]byte, 0, 64)
+	ch := []byte{0}
+
+	for {
+		if _, err := d.r.Read(ch); err != nil {
+			return "", err
+		}
+		if ch[0] == '\n' {
+			return string(l), nil
+		}
+		if len(l) == max {
+			return "", protocolErr
+		}
+		l = append(l, ch[0])
+	}
+}
+
+func (d *Decoder) readLine() (string, error) {
+	l := make([]byte, 0, 64)
+	ch := []byte{0}
+
+	for {
+		if _, err := d.r.Read(ch); err != nil {
+			return "", err
+		} else {
+			if ch[0] == d.EOL {
+				break
+			}
+			if len(l) == d.MaxLine {
+				return "", ErrProtocol
+			}
+			l = append(l, ch[0])
+		}
+	}
+	if d.Lenient && d.EOL == '\n' && len(l) > 0 && l[len(l)-1] == '\r' {
+		l = l[:len(l)-1]
+	}
+
+	return string(l), nil
+}
+
+/* CMsg announces a file of Size bytes following the message */
+type CMsg struct {
+	Perm os.FileMode
+	Size int64
+	Name string
+}
+
+func (m CMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "C%04o %d %s", ToPosixPerm(m.Perm), m.Size, m.Name), nil
+}
+
+func (m *CMsg) UnmarshalText(text []byte) (err error) {
+	m.Perm, m.Size, m.Name, err = parseSubj('C', text)
+	return
+}
+
+/* DMsg enters a directory, closed by a matching EMsg */
+type DMsg struct {
+	Perm os.FileMode
+	Name string
+}
+
+func (m DMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "D%04o %d %s", ToPosixPerm(m.Perm), 0, m.Name), nil
+}
+
+func (m *DMsg) UnmarshalText(text []byte) (err error) {
+	m.Perm, _, m.Name, err = parseSubj('D', text)
+	return
+}
+
+type EMsg struct{}
+
+func (m EMsg) MarshalText() ([]byte, error) {
+	return []byte("E"), nil
+}
+
+func (m *EMsg) UnmarshalText(text []byte) error {
+	if string(text) != "E" {
+		return protocolErr
+	}
+	return nil
+}
+
+/* TMsg sets times of the following C or D message, with microsecond precision on the wire */
+type TMsg struct {
+	Mtime time.Time
+	Atime time.Time
+}
+
+func (m TMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "T%d %d %d %d",
+		m.Mtime.Unix(), m.Mtime.Nanosecond()/1000,
+		m.Atime.Unix(), m.Atime.Nanosecond()/1000), nil
+}
+
+func (m *TMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'T' {
+		return protocolErr
+	}
+	t, err := parseTimes(text[1:], 1e6)
+	if err != nil {
+		return err
+	}
+	m.Mtime = time.Unix(t[0], t[1]*1000)
+	m.Atime = time.Unix(t[2], t[3]*1000)
+	return nil
+}
+
+/* parseTimes reads the four numbers of a T or N message, seconds and
+   fractions of unit for the mtime and atime. Numbers too large for an
+   int64 are out of range like times too large for a time.Time, the
+   source skips the file and the session goes on. */
+func parseTimes(text []byte, unit int64) (t [4]int64, err error) {
+	fields := strings.Split(string(text), " ")
+	if len(fields) != len(t) {
+		return t, protocolErr
+	}
+	for i, f := range fields {
+		if t[i], err = strconv.ParseInt(f, 10, 64); errors.Is(err, strconv.ErrRange) {
+			return t, fmt.Errorf("time: %w", ErrOutOfRange)
+		} else if err != nil {
+			return t, protocolErr
+		}
+	}
+	return t, checkTimes(t[0], t[1], t[2], t[3], unit)
+}
+
+/* MaxUnixSec bounds times from the peer to what nanoseconds since the epoch hold */
+const MaxUnixSec = math.MaxInt64 / int64(time.Second)
+
+/* checkTimes refuses times that overflow or carry fractions of a
+   second of one unit or more */
+func checkTimes(msec, mfrac, asec, afrac, unit int64) error {
+	if mfrac < 0 || mfrac >= unit || afrac < 0 || afrac >= unit {
+		return fmt.Errorf("fraction of a second: %w", ErrOutOfRange)
+	}
+	if msec < -MaxUnixSec || msec > MaxUnixSec || asec < -MaxUnixSec || asec > MaxUnixSec {
+		return fmt.Errorf("time: %w", ErrOutOfRange)
+	}
+	return nil
+}
+
+/* XMsg offers protocol extensions when sent by the source and accepts
+   some of them when the sink replies, only rscp peers understand it */
+type XMsg struct {
+	Caps []string
+}
+
+func (m XMsg) MarshalText() ([]byte, error) {
+	return []byte("X" + strings.Join(m.Caps, " ")), nil
+}
+
+func (m *XMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'X' {
+		return protocolErr
+	}
+	m.Caps = strings.Fields(string(text[1:]))
+	return nil
+}
+
+/* OMsg sets the owner of the following C or D message, names win over ids
+   where the sink knows them (owner extension) */
+type OMsg struct {
+	Uid, Gid    int
+	User, Group string
+}
+
+func (m OMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "O%d %d %s %s", m.Uid, m.Gid, m.User, m.Group), nil
+}
+
+func (m *OMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'O' {
+		return protocolErr
+	}
+	fields := strings.Fields(string(text[1:]))
+	if len(fields) != 4 {
+		return protocolErr
+	}
+	var err1, err2 error
+	m.Uid, err1 = strconv.Atoi(fields[0])
+	m.Gid, err2 = strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		return protocolErr
+	}
+	m.User, m.Group = fields[2], fields[3]
+	return nil
+}
+
+/* AMsg sets an extended attribute of the following C or D message,
+   Size bytes of value follow the message (xattrs extension) */
+type AMsg struct {
+	Size int
+	Name string
+}
+
+func (m AMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "A%d %s", m.Size, m.Name), nil
+}
+
+func (m *AMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'A' {
+		return protocolErr
+	}
+	fields := strings.SplitN(string(text[1:]), " ", 2)
+	if len(fields) != 2 || fields[1] == "" {
+		return protocolErr
+	}
+	size, err := strconv.Atoi(fields[0])
+	if err != nil || size < 0 {
+		return protocolErr
+	}
+	m.Size, m.Name = size, fields[1]
+	return nil
+}
+
+/* PMsg sets the access or default POSIX ACL of the following C or D
+   message in short text form, e.g. "u::rw-,u:1000:r--,g::r--,m::r--,o::---"
+   (acls extension) */
+type PMsg struct {
+	Default bool
+	ACL     string
+}
+
+func (m PMsg) MarshalText() ([]byte, error) {
+	kind := "a"
+	if m.Default {
+		kind = "d"
+	}
+	return []byte("P" + kind + " " + m.ACL), nil
+}
+
+func (m *PMsg) UnmarshalText(text []byte) error {
+	if len(text) < 3 || text[0] != 'P' || text[2] != ' ' || (text[1] != 'a' && text[1] != 'd') {
+		return protocolErr
+	}
+	m.Default = text[1] == 'd'
+	m.ACL = string(text[3:])
+	return nil
+}
+
+/* LMsg creates a symlink Name pointing to Target, which travels with
+   spaces, newlines and backslashes escaped by a backslash (links extension) */
+type LMsg struct {
+	Target string
+	Name   string
+}
+
+var targetEscaper = strings.NewReplacer(`\`, `\\`, " ", `\ `, "\n", `\n`)
+
+func (m LMsg) MarshalText() ([]byte, error) {
+	return []byte("L" + targetEscaper.Replace(m.Target) + " " + m.Name), nil
+}
+
+func (m *LMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'L' {
+		return protocolErr
+	}
+	var target []byte
+	i := 1
+	for ; i < len(text) && text[i] != ' '; i++ {
+		if text[i] == '\\' {
+			if i++; i == len(text) {
+				return protocolErr
+			}
+			if text[i] == 'n' {
+				target = append(target, '\n')
+				continue
+			}
+		}
+		target = append(target, text[i])
+	}
+	if i == len(text) || len(target) == 0 {
+		return protocolErr
+	}
+	m.Target, m.Name = string(target), string(text[i+1:])
+	return CheckName(m.Name)
+}
+
+/* IMsg numbers the following C message as the first name of a file
+   with several hard links (hardlinks extension) */
+type IMsg struct {
+	ID int
+}
+
+func (m IMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "I%d", m.ID), nil
+}
+
+func (m *IMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'I' {
+		return protocolErr
+	}
+	id, err := strconv.Atoi(string(text[1:]))
+	if err != nil || id <= 0 {
+		return protocolErr
+	}
+	m.ID = id
+	return nil
+}
+
+/* HMsg creates Name as a hard link to the file numbered ID by an IMsg */
+type HMsg struct {
+	ID   int
+	Name string
+}
+
+func (m HMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "H%d %s", m.ID, m.Name), nil
+}
+
+func (m *HMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'H' {
+		return protocolErr
+	}
+	fields := strings.SplitN(string(text[1:]), " ", 2)
+	if len(fields) != 2 {
+		return protocolErr
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil || id <= 0 {
+		return protocolErr
+	}
+	m.ID, m.Name = id, fields[1]
+	return CheckName(m.Name)
+}
+
+/* Extent is a run of data in a sparse file */
+type Extent struct {
+	Off, Len int64
+}
+
+/* KMsg lists data extents of the following C message in ascending order,
+   only their bytes follow it and the rest of the file is holes; several
+   may precede a single C message (sparse extension) */
+type KMsg struct {
+	Extents []Extent
+}
+
+func (m KMsg) MarshalText() ([]byte, error) {
+	text := []byte("K")
+	for i, e := range m.Extents {
+		if i > 0 {
+			text = append(text, ' ')
+		}
+		text = fmt.Appendf(text, "%d:%d", e.Off, e.Len)
+	}
+	return text, nil
+}
+
+func (m *KMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'K' {
+		return protocolErr
+	}
+	fields := strings.Fields(string(text[1:]))
+	if len(fields) > MaxExtentsPerMsg {
+		return protocolErr
+	}
+	m.Extents = m.Extents[:0]
+	for _, f := range fields {
+		var e Extent
+		if n, err := fmt.Sscanf(f, "%d:%d", &e.Off, &e.Len); err != nil || n != 2 || e.Off < 0 || e.Len <= 0 {
+			return protocolErr
+		}
+		m.Extents = append(m.Extents, e)
+	}
+	return nil
+}
+
+/* NMsg is TMsg with nanosecond precision (nsec extension) */
+type NMsg struct {
+	Mtime time.Time
+	Atime time.Time
+}
+
+func (m NMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "N%d %d %d %d",
+		m.Mtime.Unix(), m.Mtime.Nanosecond(),
+		m.Atime.Unix(), m.Atime.Nanosecond()), nil
+}
+
+func (m *NMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'N' {
+		return protocolErr
+	}
+	t, err := parseTimes(text[1:], 1e9)
+	if err != nil {
+		return err
+	}
+	m.Mtime = time.Unix(t[0], t[1])
+	m.Atime = time.Unix(t[2], t[3])
+	return nil
+}
+
+/* ZMsg carries the SHA-256 digest of the file data just sent, ahead of
+   the byte ending it (checksum extension) */
+type ZMsg struct {
+	Sum []byte
+}
+
+func (m ZMsg) MarshalText() ([]byte, error) {
+	return []byte("Z" + hex.EncodeToString(m.Sum)), nil
+}
+
+func (m *ZMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'Z' {
+		return protocolErr
+	}
+	sum, err := hex.DecodeString(string(text[1:]))
+	if err != nil || len(sum) != sha256.Size {
+		return protocolErr
+	}
+	m.Sum = sum
+	return nil
+}
+
+/* MMsg switches the session to Streams multiplexed streams (mux extension) */
+type MMsg struct {
+	Streams int
+}
+
+func (m MMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "M%d", m.Streams), nil
+}
+
+func (m *MMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'M' {
+		return protocolErr
+	}
+	n, err := strconv.Atoi(string(text[1:]))
+	if err != nil || n <= 0 || n > MaxStreams {
+		return protocolErr
+	}
+	m.Streams = n
+	return nil
+}
+
+/* Tally counts what one side of a transfer went through */
+type Tally struct {
+	Files  int   /* files and links, failed ones included */
+	Bytes  int64 /* file data moved */
+	Failed int
+}
+
+func (t Tally) String() string {
+	return fmt.Sprintf("%d files, %d bytes, %d failed", t.Files, t.Bytes, t.Failed)
+}
+
+/* SMsg tells what the sender made of the transfer once the last file is
+   through, the source sends it and the sink replies with its own (summary
+   extension) */
+type SMsg struct {
+	Tally
+}
+
+func (m SMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "S%d %d %d", m.Files, m.Bytes, m.Failed), nil
+}
+
+func (m *SMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'S' {
+		return protocolErr
+	}
+	f := strings.Fields(string(text[1:]))
+	if len(f) != 3 {
+		return protocolErr
+	}
+	files, err1 := strconv.Atoi(f[0])
+	n, err2 := strconv.ParseInt(f[1], 10, 64)
+	failed, err3 := strconv.Atoi(f[2])
+	if err1 != nil || err2 != nil || err3 != nil || files < 0 || n < 0 || failed < 0 || failed > files {
+		return protocolErr
+	}
+	m.Tally = Tally{files, n, failed}
+	return nil
+}
+
+/* GMsg announces how many files and bytes of data the source is about
+   to send in all, ahead of the first of them (totals extension) */
+type GMsg struct {
+	Files int
+	Bytes int64
+}
+
+func (m GMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "G%d %d", m.Files, m.Bytes), nil
+}
+
+func (m *GMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'G' {
+		return protocolErr
+	}
+	f := strings.Fields(string(text[1:]))
+	if len(f) != 2 {
+		return protocolErr
+	}
+	files, err1 := strconv.Atoi(f[0])
+	n, err2 := strconv.ParseInt(f[1], 10, 64)
+	if err1 != nil || err2 != nil || files < 0 || n < 0 {
+		return protocolErr
+	}
+	m.Files, m.Bytes = files, n
+	return nil
+}
+
+/* FMsg creates a FIFO, socket or device node Name, Mode carrying its
+   type, which travels as p, s, c or b ahead of the permissions; Major
+   and Minor are zero but for devices (specials extension) */
+type FMsg struct {
+	Mode         os.FileMode
+	Major, Minor uint32
+	Name         string
+}
+
+func (m FMsg) MarshalText() ([]byte, error) {
+	var kind byte
+	switch t := m.Mode & os.ModeType; {
+	case t&os.ModeNamedPipe != 0:
+		kind = 'p'
+	case t&os.ModeSocket != 0:
+		kind = 's'
+	case t&os.ModeCharDevice != 0:
+		kind = 'c'
+	case t&os.ModeDevice != 0:
+		kind = 'b'
+	default:
+		return nil, ErrNotRegular
+	}
+	return fmt.Appendf(nil, "F%c%04o %d %d %s", kind, ToPosixPerm(m.Mode), m.Major, m.Minor, m.Name), nil
+}
+
+func (m *FMsg) UnmarshalText(text []byte) error {
+	if len(text) < 2 || text[0] != 'F' {
+		return protocolErr
+	}
+	var typ os.FileMode
+	switch text[1] {
+	case 'p':
+		typ = os.ModeNamedPipe
+	case 's':
+		typ = os.ModeSocket
+	case 'c':
+		typ = os.ModeDevice | os.ModeCharDevice
+	case 'b':
+		typ = os.ModeDevice
+	default:
+		return protocolErr
+	}
+	fields := strings.SplitN(string(text[2:]), " ", 4)
+	if len(fields) != 4 {
+		return protocolErr
+	}
+	perm, err1 := strconv.ParseUint(fields[0], 8, 32)
+	major, err2 := strconv.ParseUint(fields[1], 10, 32)
+	minor, err3 := strconv.ParseUint(fields[2], 10, 32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return protocolErr
+	}
+	m.Mode = typ | ToStdPerm(int(perm))
+	m.Major, m.Minor, m.Name = uint32(major), uint32(minor), fields[3]
+	return CheckName(m.Name)
+}
+
+/* UMsg sets the file flags of the following C, D or F message by name,
+   e.g. "uchg,nodump" (fflags extension) */
+type UMsg struct {
+	Flags []string
+}
+
+func (m UMsg) MarshalText() ([]byte, error) {
+	return []byte("U" + strings.Join(m.Flags, ",")), nil
+}
+
+func (m *UMsg) UnmarshalText(text []byte) error {
+	if len(text) < 2 || text[0] != 'U' {
+		return protocolErr
+	}
+	m.Flags = strings.Split(string(text[1:]), ",")
+	return nil
+}
+
+/* BMsg is a heartbeat telling how often the sender beats (keepalive
+   extension), it may come ahead of any message or reply and is not acked */
+type BMsg struct {
+	Interval time.Duration
+}
+
+func (m BMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "B%d", m.Interval.Milliseconds()), nil
+}
+
+func (m *BMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'B' {
+		return protocolErr
+	}
+	ms, err := strconv.ParseInt(string(text[1:]), 10, 64)
+	if err != nil || ms <= 0 {
+		return protocolErr
+	}
+	m.Interval = time.Duration(ms) * time.Millisecond
+	return nil
+}
+
+/* RMsg answers a C message in place of the zero byte with how much of
+   the file the sink already has, the source sends the rest (resume extension) */
+type RMsg struct {
+	Offset int64
+}
+
+func (m RMsg) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "R%d", m.Offset), nil
+}
+
+func (m *RMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || text[0] != 'R' {
+		return protocolErr
+	}
+	off, err := strconv.ParseInt(string(text[1:]), 10, 64)
+	if err != nil || off < 0 {
+		return protocolErr
+	}
+	m.Offset = off
+	return nil
+}
+
+/* YMsg answers a C message in place of the zero byte declining the
+   file, which the sink already has and keeps (skip extension); the
+   source sends nothing of it */
+type YMsg struct{}
+
+func (m YMsg) MarshalText() ([]byte, error) {
+	return []byte("Y"), nil
+}
+
+func (m *YMsg) UnmarshalText(text []byte) error {
+	if string(text) != "Y" {
+		return protocolErr
+	}
+	return nil
+}
+
+/* ErrMsg reports a failure, fatal ones end the session */
+type ErrMsg struct {
+	Fatal bool
+	Msg   string
+}
+
+func (m ErrMsg) MarshalText() ([]byte, error) {
+	kind := byte('\x01')
+	if m.Fatal {
+		kind = '\x02'
+	}
+	return append([]byte{kind}, m.Msg...), nil
+}
+
+func (m *ErrMsg) UnmarshalText(text []byte) error {
+	if len(text) == 0 || (text[0] != '\x01' && text[0] != '\x02') {
+		return protocolErr
+	}
+	m.Fatal = text[0] == '\x02'
+	m.Msg = string(text[1:])
+	return nil
+}
+
+/* parse "<kind><mode> <size> <name>" where name runs to the end of line and may contain spaces */
+func parseSubj(kind byte, text []byte) (perm os.FileMode, size int64, name string, err error) {
+	if len(text) == 0 || text[0] != kind {
+		err = protocolErr
+		return
+	}
+	fields := strings.SplitN(string(text[1:]), " ", 3)
+	if len(fields) != 3 {
+		err = protocolErr
+		return
+	}
+	pperm, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		err = protocolErr
+		return
+	}
+	if size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		err = protocolErr
+		return
+	}
+	perm = ToStdPerm(int(pperm))
+	name = fields[2]
+	if err = CheckName(name); err != nil {
+		return
+	}
+	if pperm > 07777 {
+		err = fmt.Errorf("%s: mode %o: %w", name, pperm, ErrOutOfRange)
+	} else if size < 0 || size > MaxFileSize {
+		err = fmt.Errorf("%s: size %d: %w", name, size, ErrOutOfRange)
+	}
+	return
+}
+
+/* CheckName refuses names escaping the directory they are received
+   into, and those with a NUL no system call would take whole */
+func CheckName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return FatalError{fmt.Errorf("%s: %w", name, ErrInvalidName)}
+	}
+	return nil
+}
+
+/* ToPosixPerm gives the mode bits of perm as the protocol carries them */
+func ToPosixPerm(perm os.FileMode) int {
+	pp := perm & os.ModePerm
+	if perm&os.ModeSetuid != 0 {
+		pp |= S_ISUID
+	}
+	if perm&os.ModeSetgid != 0 {
+		pp |= S_ISGID
+	}
+	if perm&os.ModeSticky != 0 {
+		pp |= S_ISVTX
+	}
+	return int(pp)
+}
+
+/* ToStdPerm is the mode of posixPerm, bits as the protocol carries them */
+func ToStdPerm(posixPerm int) os.FileMode {
+	perm := os.FileMode(posixPerm) & os.ModePerm
+	if posixPerm&S_ISUID != 0 {
+		perm |= os.ModeSetuid
+	}
+	if posixPerm&S_ISGID != 0 {
+		perm |= os.ModeSetgid
+	}
+	if posixPerm&S_ISVTX != 0 {
+		perm |= os.ModeSticky
+	}
+	return perm
+}
@@ -0,0 +1,240 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSubj(t *testing.T) {
+	tests := []struct {
+		line string
+		perm os.FileMode
+		size int64
+		name string
+		err  error /* nil when the line parses */
+	}{
+		{"C0644 12 plain", 0644, 12, "plain", nil},
+		{"C0644 12 my report.txt", 0644, 12, "my report.txt", nil},
+		{"C0644 0 two  spaces ", 0644, 0, "two  spaces ", nil},
+		{"C0644 0  leading space", 0644, 0, " leading space", nil},
+		{"C0600 3 tab\tin it", 0600, 3, "tab\tin it", nil},
+		{"C0755 1 -rf", 0755, 1, "-rf", nil},
+		{"C0755 1 --", 0755, 1, "--", nil},
+		{"C0644 1 ...", 0644, 1, "...", nil},
+		{"C4755 1 suid", 0755 | os.ModeSetuid, 1, "suid", nil},
+
+		{"C0644 1 ", 0, 0, "", ErrInvalidName},
+		{"C0644 1 .", 0, 0, "", ErrInvalidName},
+		{"C0644 1 ..", 0, 0, "", ErrInvalidName},
+		{"C0644 1 a/b", 0, 0, "", ErrInvalidName},
+		{"C0644 1 /etc/passwd", 0, 0, "", ErrInvalidName},
+		{"C0644 1 ../up", 0, 0, "", ErrInvalidName},
+		{"C0644 1 nul\x00name", 0, 0, "", ErrInvalidName},
+
+		{"C0644 1", 0, 0, "", ErrProtocol},
+		{"C0644", 0, 0, "", ErrProtocol},
+		{"C", 0, 0, "", ErrProtocol},
+		{"", 0, 0, "", ErrProtocol},
+		{"D0644 1 dir", 0, 0, "", ErrProtocol},
+		{"C0844 1 octal", 0, 0, "", ErrProtocol},
+		{"C0644 x size", 0, 0, "", ErrProtocol},
+		{"C0644  1 blank", 0, 0, "", ErrProtocol},
+		{"C10644 1 mode", 0, 0, "", ErrOutOfRange},
+		{"C0644 -1 negative", 0, 0, "", ErrOutOfRange},
+		{"C0644 1152921504606846977 huge", 0, 0, "", ErrOutOfRange},
+	}
+	for _, tt := range tests {
+		perm, size, name, err := parseSubj('C', []byte(tt.line))
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%q: error %v, want %v", tt.line, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+		} else if perm != tt.perm || size != tt.size || name != tt.name {
+			t.Errorf("%q: got %v %d %q, want %v %d %q", tt.line, perm, size, name, tt.perm, tt.size, tt.name)
+		}
+	}
+}
+
+/* names refused end the session, a sink cannot go on past them */
+func TestCheckNameFatal(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "a/b", "a\x00"} {
+		err := CheckName(name)
+		if _, fatal := err.(FatalError); !fatal || !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: %v, want a fatal ErrInvalidName", name, err)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	mtime := time.Unix(1700000000, 123456000)
+	atime := time.Unix(-86400, 999999000)
+	tests := []struct {
+		msg  encoding.TextMarshaler
+		into encoding.TextUnmarshaler /* a new message of the same type */
+		line string
+	}{
+		{CMsg{0644, 12, "my report.txt"}, new(CMsg), "C0644 12 my report.txt"},
+		{CMsg{0755 | os.ModeSetuid | os.ModeSticky, 0, "-x"}, new(CMsg), "C5755 0 -x"},
+		{DMsg{0700 | os.ModeSetgid, "dir name"}, new(DMsg), "D2700 0 dir name"},
+		{TMsg{mtime, atime}, new(TMsg), "T1700000000 123456 -86400 999999"},
+		{EMsg{}, new(EMsg), "E"},
+		{ErrMsg{false, "a: no such file"}, new(ErrMsg), "\x01a: no such file"},
+		{ErrMsg{true, "protocol error"}, new(ErrMsg), "\x02protocol error"},
+	}
+	for _, tt := range tests {
+		text, err := tt.msg.MarshalText()
+		if err != nil || string(text) != tt.line {
+			t.Errorf("%#v: marshaled %q, %v; want %q", tt.msg, text, err, tt.line)
+			continue
+		}
+		if err := tt.into.UnmarshalText(text); err != nil {
+			t.Errorf("%q: %v", text, err)
+			continue
+		}
+		if got := reflect.ValueOf(tt.into).Elem().Interface(); !reflect.DeepEqual(got, tt.msg) {
+			t.Errorf("%q: unmarshaled %#v, want %#v", text, got, tt.msg)
+		}
+	}
+}
+
+/* messages of one kind are refused as another */
+func TestUnmarshalWrongKind(t *testing.T) {
+	tests := []struct {
+		line string
+		into encoding.TextUnmarshaler
+	}{
+		{"D0755 0 dir", new(CMsg)},
+		{"C0644 1 file", new(DMsg)},
+		{"E ", new(EMsg)},
+		{"C0644 1 file", new(TMsg)},
+		{"T1 0 1", new(TMsg)},
+		{"T1 1000000 1 0", new(TMsg)},
+		{"E", new(ErrMsg)},
+	}
+	for _, tt := range tests {
+		if err := tt.into.UnmarshalText([]byte(tt.line)); err == nil {
+			t.Errorf("%q into %T: no error", tt.line, tt.into)
+		}
+	}
+}
+
+/* times no time.Time holds fail the one file, malformed ones the session */
+func TestParseTimes(t *testing.T) {
+	tests := []struct {
+		line  string
+		into  encoding.TextUnmarshaler
+		fatal bool
+	}{
+		{"T99999999999999999999 0 0 0", new(TMsg), false},
+		{"T0 0 -99999999999999999999 0", new(TMsg), false},
+		{"T9223372036854775807 0 0 0", new(TMsg), false},
+		{"T0 1000000 0 0", new(TMsg), false},
+		{"N0 0 99999999999999999999 0", new(NMsg), false},
+		{"N0 1000000000 0 0", new(NMsg), false},
+		{"T1 0 x 0", new(TMsg), true},
+		{"T1 0 1", new(TMsg), true},
+		{"T1  0 1 0", new(TMsg), true},
+		{"N1 0 1 0 5", new(NMsg), true},
+	}
+	for _, tt := range tests {
+		err := tt.into.UnmarshalText([]byte(tt.line))
+		_, fatal := err.(FatalError)
+		if fatal != tt.fatal || !fatal && !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("%q: %#v, want fatal %v", tt.line, err, tt.fatal)
+		}
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	for _, eol := range []byte{'\n', 0} {
+		var b bytes.Buffer
+		enc := NewEncoder(&b)
+		enc.EOL = eol
+		msgs := []encoding.TextMarshaler{
+			TMsg{time.Unix(1, 0), time.Unix(2, 0)},
+			DMsg{0755, "d"},
+			CMsg{0644, 0, "f"},
+			EMsg{},
+		}
+		if eol == 0 {
+			msgs = append(msgs, CMsg{0644, 0, "new\nline"})
+		}
+		for _, m := range msgs {
+			if err := enc.Encode(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		enc.Ack()
+
+		dec := NewDecoder(&b)
+		dec.EOL = eol
+		for _, m := range msgs {
+			want, _ := m.MarshalText()
+			if line, err := dec.Next(); err != nil || line != string(want) {
+				t.Errorf("eol %q: read %q, %v; want %q", eol, line, err, want)
+			}
+		}
+		if err := dec.Ack(); err != nil {
+			t.Errorf("eol %q: ack: %v", eol, err)
+		}
+		if _, err := dec.Next(); err != io.EOF {
+			t.Errorf("eol %q: %v at the end, want io.EOF", eol, err)
+		}
+	}
+}
+
+func TestAck(t *testing.T) {
+	dec := NewDecoder(bytes.NewBufferString("\x00\x01no such file\n\x02disk full\nC0644 1 f\n"))
+	if err := dec.Ack(); err != nil {
+		t.Errorf("ack: %v", err)
+	}
+	if err := dec.Ack(); err != (RemoteError{"no such file"}) {
+		t.Errorf("warning: %#v", err)
+	}
+	if err := dec.Ack(); err != (FatalError{RemoteError{"disk full"}}) {
+		t.Errorf("fatal error: %#v", err)
+	}
+	if err := dec.Ack(); !errors.Is(err, ErrProtocol) {
+		t.Errorf("message for an ack: %v", err)
+	}
+}
+
+/* every combination of setuid, setgid and sticky goes both ways */
+func TestPermSpecialBits(t *testing.T) {
+	bits := []struct {
+		posix int
+		std   os.FileMode
+	}{
+		{S_ISUID, os.ModeSetuid},
+		{S_ISGID, os.ModeSetgid},
+		{S_ISVTX, os.ModeSticky},
+	}
+	for combo := 0; combo < 1<<len(bits); combo++ {
+		posix, std := 0755, os.FileMode(0755)
+		for i, b := range bits {
+			if combo&(1<<i) != 0 {
+				posix |= b.posix
+				std |= b.std
+			}
+		}
+		if got := ToPosixPerm(std); got != posix {
+			t.Errorf("ToPosixPerm(%v) = %04o, want %04o", std, got, posix)
+		}
+		if got := ToStdPerm(posix); got != std {
+			t.Errorf("ToStdPerm(%04o) = %v, want %v", posix, got, std)
+		}
+		if got := ToPosixPerm(std | os.ModeDir); got != posix {
+			t.Errorf("ToPosixPerm(%v) = %04o, the type kept", std|os.ModeDir, got)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrQuota        = errors.New("exceeds the quota")
+	ErrFileTooLarge = errors.New("larger than the sink takes")
+)
+
+/* quota is what MaxTotalBytes leaves a sink, shared by the sessions
+   of a mux */
+type quota struct {
+	mu   sync.Mutex
+	left int64
+}
+
+/* takeQuota counts size against the quota for the file name, failing
+   the transfer when it does not fit */
+func (s *session) takeQuota(name string, size int64) error {
+	q := s.quota
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if size > q.left {
+		return FatalError{Err: fmt.Errorf("%s: %w of %d bytes", name, ErrQuota, s.opts.MaxTotalBytes)}
+	}
+	q.left -= size
+	return nil
+}
+
+/* checkFileSize refuses the file name of size beyond MaxFileSize, the
+   source skipping its data on the error */
+func (s *session) checkFileSize(name string, size int64) error {
+	if s.opts.MaxFileSize > 0 && size > s.opts.MaxFileSize {
+		return fmt.Errorf("%s: %w, %d bytes of %d at most", name, ErrFileTooLarge, size, s.opts.MaxFileSize)
+	}
+	return nil
+}
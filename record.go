@@ -0,0 +1,177 @@
+package rscp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/* A capture holds all that went over the transfer channel as records of
+   a line "<seconds> <in|out> <length>" followed by that many bytes and a
+   newline. Seconds count from the start of the capture, in is what came
+   from the peer and out what went to it. Compressed and multiplexed
+   streams are captured as they were on the wire. */
+
+var ErrReplayDiverged = errors.New("replay diverged from the capture")
+
+/* Recorder writes a capture to w. Consecutive reads or writes go into
+   one record of up to RecordChunk bytes stamped with the time of the
+   first, Flush writes out the last. */
+type Recorder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	start   time.Time
+	dir     string
+	at      time.Duration
+	pending []byte
+}
+
+const RecordChunk = 32 << 10
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w, start: time.Now()}
+}
+
+func (rec *Recorder) record(dir string, p []byte) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if dir != rec.dir || len(rec.pending)+len(p) > RecordChunk {
+		if err := rec.flush(); err != nil {
+			return err
+		}
+	}
+	if len(rec.pending) == 0 {
+		rec.dir, rec.at = dir, time.Since(rec.start)
+	}
+	rec.pending = append(rec.pending, p...)
+	return nil
+}
+
+/* Flush writes the record still pending */
+func (rec *Recorder) Flush() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.flush()
+}
+
+func (rec *Recorder) flush() error {
+	if len(rec.pending) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(rec.w, "%.6f %s %d\n", rec.at.Seconds(), rec.dir, len(rec.pending)); err != nil {
+		return err
+	}
+	if _, err := rec.w.Write(rec.pending); err != nil {
+		return err
+	}
+	rec.pending = rec.pending[:0]
+	_, err := io.WriteString(rec.w, "\n")
+	return err
+}
+
+func RecordReader(r io.Reader, rec *Recorder) io.Reader {
+	if rec == nil {
+		panic("nil recorder")
+	}
+	return &RecordingReader{r, rec}
+}
+
+func RecordWriter(w io.Writer, rec *Recorder) io.Writer {
+	if rec == nil {
+		panic("nil recorder")
+	}
+	return &RecordingWriter{w, rec}
+}
+
+/* RecordingReader records what it reads, failing to record fails the read */
+type RecordingReader struct {
+	Base io.Reader
+	Rec  *Recorder
+}
+
+func (r *RecordingReader) Read(p []byte) (int, error) {
+	n, err := r.Base.Read(p)
+	if n > 0 {
+		if rerr := r.Rec.record("in", p[:n]); rerr != nil {
+			return n, rerr
+		}
+	}
+	return n, err
+}
+
+/* RecordingWriter records what it wrote */
+type RecordingWriter struct {
+	Base io.Writer
+	Rec  *Recorder
+}
+
+func (w *RecordingWriter) Write(p []byte) (int, error) {
+	n, err := w.Base.Write(p)
+	if n > 0 {
+		if rerr := w.Rec.record("out", p[:n]); rerr != nil {
+			return n, rerr
+		}
+	}
+	return n, err
+}
+
+/* Replay reads a capture, returning what the peer sent for a session to
+   read in place of the peer and a writer taking what the session writes,
+   failing with ErrReplayDiverged where it differs from what was recorded.
+   The session needs the options of the recorded one; heartbeats depend
+   on timing and do not replay. */
+func Replay(capture io.Reader) (in io.Reader, out io.Writer, err error) {
+	var peer, own bytes.Buffer
+	br := bufio.NewReader(capture)
+	for {
+		head, err := br.ReadString('\n')
+		if err == io.EOF && head == "" {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("capture: %w", io.ErrUnexpectedEOF)
+		}
+
+		var at float64
+		var dir string
+		var n int64
+		if _, err := fmt.Sscanf(head, "%f %s %d\n", &at, &dir, &n); err != nil || n < 0 {
+			return nil, nil, fmt.Errorf("capture: malformed record %q", head)
+		}
+		buf := &peer
+		switch dir {
+		case "in":
+		case "out":
+			buf = &own
+		default:
+			return nil, nil, fmt.Errorf("capture: malformed record %q", head)
+		}
+		if _, err := io.CopyN(buf, br, n); err != nil {
+			return nil, nil, fmt.Errorf("capture: %w", io.ErrUnexpectedEOF)
+		}
+		if nl, err := br.ReadByte(); err != nil || nl != '\n' {
+			return nil, nil, fmt.Errorf("capture: malformed record %q", head)
+		}
+	}
+	return &peer, &replayWriter{want: own.Bytes()}, nil
+}
+
+type replayWriter struct {
+	want []byte
+	off  int64
+}
+
+func (w *replayWriter) Write(p []byte) (int, error) {
+	for i, c := range p {
+		if len(w.want) == 0 || w.want[0] != c {
+			return i, fmt.Errorf("%w at byte %d", ErrReplayDiverged, w.off)
+		}
+		w.want = w.want[1:]
+		w.off++
+	}
+	return len(p), nil
+}
@@ -0,0 +1,230 @@
+package rscp
+
+import (
+	"context"
+	"io"
+	"path"
+	"sync"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* RelayEnd is a remote end of a relay, In what it sends and Out what
+   it is sent, closing Out ends that. Wait, if set, waits for it to be
+   over once both are through. */
+type RelayEnd struct {
+	In   io.Reader
+	Out  io.WriteCloser
+	Wait func() error
+}
+
+/* Relay joins a remote source with a remote sink through this host as
+   scp -3 does, passing on what the source sends and the replies of the
+   sink. The bandwidth limit, stats and capture of opts apply to what
+   goes through here, which is watched for hooks, progress and results,
+   and the errors of both ends come back together. */
+func Relay(ctx context.Context, opts Options, source, sink RelayEnd) error {
+	/* captured as a sink would see it, so that it replays as one */
+	var data, replies io.Reader = source.In, sink.In
+	var toSource io.Writer = source.Out
+	if opts.BwLimit > 0 {
+		data = CapReader(data, NewBwStats(opts.BwLimit*1024))
+	}
+	if opts.Stats != nil {
+		data = CountReader(data, opts.Stats)
+		replies = CountReader(replies, opts.Stats)
+	}
+	if opts.Record != nil {
+		data = RecordReader(data, opts.Record)
+		toSource = RecordWriter(toSource, opts.Record)
+		defer opts.Record.Flush()
+	}
+	watch := newRelayWatch(ctx, opts)
+	data, replies = io.TeeReader(data, watch.data), io.TeeReader(replies, watch.replies)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(sink.Out, data)
+		sink.Out.Close()
+		io.Copy(io.Discard, data) /* lest the source block on a sink gone */
+		close(done)
+	}()
+	io.Copy(toSource, replies)
+	source.Out.Close()
+	io.Copy(io.Discard, replies)
+	<-done
+
+	var errs []error
+	for _, end := range []RelayEnd{source, sink} {
+		if end.Wait == nil {
+			continue
+		}
+		if err := end.Wait(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return watch.result(errs)
+}
+
+/* relayWatch follows the plain protocol going through a relay to report
+   on it as a sink here would, to Hooks, Progress and OnResult, names
+   being those the source sends joined with the directories they are
+   in. What extensions do to the stream is for the two ends to know, so
+   it stops following at an X message; the copy goes on regardless. */
+type relayWatch struct {
+	s       *session  /* for reporting only, it transfers nothing */
+	data    *relayTap /* what the source sends */
+	replies *relayTap /* what the sink answers */
+	errs    []error
+	done    chan struct{}
+}
+
+func newRelayWatch(ctx context.Context, opts Options) *relayWatch {
+	s := &session{ctx: ctx, opts: opts}
+	s.reporting()
+	w := &relayWatch{s: s, data: newRelayTap(), replies: newRelayTap(), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *relayWatch) run() {
+	defer close(w.done)
+	defer w.data.off()
+	defer w.replies.off()
+	data, replies := protocol.NewDecoder(w.data), protocol.NewDecoder(w.replies)
+	if err := replies.Ack(); err != nil { /* the sink not ready */
+		w.errs = w.s.collect(w.errs, err)
+		return
+	}
+	var dirs []string
+	for {
+		line, err := data.Next()
+		if err != nil {
+			return
+		}
+		switch line[0] {
+		case '\x01', '\x02': /* the source failing on something, no reply to it */
+			w.errs = w.s.collect(w.errs, RemoteError{Msg: line[1:]})
+		case 'T':
+			if err := replies.Ack(); err != nil {
+				w.errs = w.s.collect(w.errs, err)
+			}
+		case 'D':
+			var m protocol.DMsg
+			if m.UnmarshalText([]byte(line)) != nil {
+				return
+			}
+			name := path.Join(append(dirs, m.Name)...)
+			if err := replies.Ack(); err != nil {
+				w.errs = w.s.collect(w.errs, w.s.dirLeave(name, err))
+				continue
+			}
+			dirs = append(dirs, m.Name)
+			w.s.dirEnter(name)
+		case 'E':
+			err := replies.Ack()
+			if len(dirs) > 0 {
+				w.s.dirLeave(path.Join(dirs...), err)
+				dirs = dirs[:len(dirs)-1]
+			}
+			if err != nil {
+				w.errs = w.s.collect(w.errs, err)
+			}
+		case 'C':
+			var m protocol.CMsg
+			if m.UnmarshalText([]byte(line)) != nil {
+				return
+			}
+			name := path.Join(append(dirs, m.Name)...)
+			w.s.fileStart(name, m.Size, m.Perm)
+			if err := replies.Ack(); err != nil { /* the sink refused it, no data follows */
+				w.errs = w.s.collect(w.errs, w.s.fileDone(name, err))
+				continue
+			}
+			if n, _ := io.CopyN(io.Discard, w.s.countReader(w.data), m.Size); n < m.Size {
+				return
+			}
+			err := data.Ack() /* the source telling whether it read all */
+			if rerr := replies.Ack(); err == nil {
+				err = rerr
+			}
+			if err := w.s.fileDone(name, err); err != nil {
+				w.errs = w.s.collect(w.errs, err)
+			}
+		default: /* X, or what the two ends agreed on */
+			return
+		}
+	}
+}
+
+/* result is what the watch found the transfer to come to, errs those the
+   relay met besides, once both streams ended */
+func (w *relayWatch) result(errs []error) error {
+	w.data.close()
+	w.replies.close()
+	<-w.done
+	w.s.progress.finish()
+	if len(w.errs) > 0 { /* the ends failing for them is no news */
+		errs = w.errs
+	} else if w.s.summary != nil && w.s.summary.Failed > 0 {
+		return *w.s.summary
+	}
+	if len(errs) > 0 {
+		return AccError{errs}
+	}
+	return nil
+}
+
+/* relayTap passes on what is written to it to a reader, buffering so
+   that the relay never waits on the watch, and dropping all once the
+   reader stopped */
+type relayTap struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	buf     []byte
+	closed  bool /* nothing more is written */
+	ignored bool /* nothing more is read */
+}
+
+func newRelayTap() *relayTap {
+	t := &relayTap{}
+	t.cond.L = &t.mu
+	return t
+}
+
+func (t *relayTap) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.ignored {
+		t.buf = append(t.buf, p...)
+		t.cond.Signal()
+	}
+	return len(p), nil
+}
+
+func (t *relayTap) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.buf) == 0 && !t.closed {
+		t.cond.Wait()
+	}
+	if len(t.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+func (t *relayTap) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	t.cond.Broadcast()
+}
+
+func (t *relayTap) off() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ignored, t.buf = true, nil
+}
@@ -0,0 +1,87 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+/* A client downloading asks the remote source for paths and takes what
+   comes at the top of the transfer only under names those can give, so
+   that a hostile server cannot send .bashrc when asked for a.txt. The
+   paths are patterns too, the remote shell or serve expanding them,
+   and what they match is taken. */
+
+var ErrUnrequested = errors.New("not requested, refusing it")
+
+/* requested fails name, received into parent, when it comes at the top
+   of the transfer without Requested asking for it */
+func (s *session) requested(parent, name string) error {
+	if s.opts.Requested == nil || parent != s.top {
+		return nil
+	}
+	for _, p := range s.opts.Requested {
+		if matchRequested(s.normalize(p), name) {
+			return nil
+		}
+	}
+	return FatalError{Err: fmt.Errorf("%s: %w", name, ErrUnrequested)}
+}
+
+/* matchRequested tells whether a source asked for p may send name: the
+   last element of p, or what that matches with braces expanded. Any
+   name goes for p naming a directory by . or .., the root, or a home
+   directory with ~ alone, what it is called being unknown here. */
+func matchRequested(p, name string) bool {
+	base := path.Base(p)
+	if base == "." || base == ".." || base == "/" || strings.HasPrefix(p, "~") && !strings.Contains(p, "/") {
+		return true
+	}
+	if base == name {
+		return true
+	}
+	for _, pattern := range expandBraces(base) {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/* expandBraces is p with the first {a,b} in it expanded, as shells do,
+   and those in the results in turn; braces without a comma stay */
+func expandBraces(p string) []string {
+	start, depth := -1, 0
+	var commas []int
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				start, commas = i, nil
+			}
+			depth++
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			if depth--; depth > 0 || len(commas) == 0 {
+				continue
+			}
+			var expanded []string
+			from := start + 1
+			for _, end := range append(commas, i) {
+				expanded = append(expanded, expandBraces(p[:start]+p[from:end]+p[i+1:])...)
+				from = end + 1
+			}
+			return expanded
+		}
+	}
+	return []string{p}
+}
@@ -0,0 +1,52 @@
+package rscp
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+/* A downloading sink takes what comes at the top of the transfer only
+   under names the requested paths give, patterns and braces expanded */
+func TestRequested(t *testing.T) {
+	tests := []struct {
+		requested []string
+		sent      []string
+		refused   string /* the name refused, "" for all taken */
+	}{
+		{[]string{"a.txt"}, []string{"a.txt"}, ""},
+		{[]string{"dir/a.txt"}, []string{"a.txt"}, ""},
+		{[]string{"a.txt"}, []string{".bashrc"}, ".bashrc"},
+		{[]string{"a.txt"}, []string{"a.txt", "b.txt"}, "b.txt"},
+		{[]string{"dir/*.txt"}, []string{"a.txt", "b.txt"}, ""},
+		{[]string{"*.txt"}, []string{"a.txt", ".bashrc"}, ".bashrc"},
+		{[]string{"[ab].txt"}, []string{"b.txt"}, ""},
+		{[]string{"{a,b}.txt"}, []string{"a.txt", "b.txt"}, ""},
+		{[]string{"{a,b}.txt"}, []string{"c.txt"}, "c.txt"},
+		{[]string{"x{a,{b,c}}"}, []string{"xa", "xc"}, ""},
+		{[]string{"dir/."}, []string{"anything"}, ""},
+		{[]string{"~"}, []string{"home"}, ""},
+	}
+	for _, tt := range tests {
+		src, dst := NewMemFS(), NewMemFS()
+		var srcs []string
+		for _, name := range tt.sent {
+			src.WriteFile("/"+name, []byte(name), 0644)
+			srcs = append(srcs, "/"+name)
+		}
+		dst.Mkdir("/dst", 0755)
+
+		opts := Options{Requested: tt.requested}
+		err := LoopbackFS(context.Background(), opts, src, srcs, dst, "/dst")
+		if tt.refused == "" && err != nil {
+			t.Errorf("%q sending %q: %v", tt.requested, tt.sent, err)
+		} else if tt.refused != "" {
+			if !errors.Is(err, ErrUnrequested) {
+				t.Errorf("%q sending %q: got %v, want %s refused", tt.requested, tt.sent, err, tt.refused)
+			}
+			if _, err := dst.Stat("/dst/" + tt.refused); err == nil {
+				t.Errorf("%q: %s received", tt.requested, tt.refused)
+			}
+		}
+	}
+}
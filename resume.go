@@ -0,0 +1,69 @@
+package rscp
+
+import (
+	"hash"
+	"io"
+	"os"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* ackResume acks the C message of name, opened as f, with an R message
+   taking it up where it ends when the resume extension allows. Returns
+   where the data goes on; what is kept is hashed into sum so the digest
+   still covers the whole file. */
+func (s *session) ackResume(name string, f File, st os.FileInfo, size int64, pend attrs, sum hash.Hash) (int64, error) {
+	off := st.Size()
+	if !s.ext["resume"] || pend.sparse || !st.Mode().IsRegular() || off == 0 || off > size {
+		return 0, s.enc.Ack()
+	}
+	if sum != nil {
+		if err := s.hashKept(name, off, sum); err != nil { /* start over */
+			sum.Reset()
+			return 0, s.enc.Ack()
+		}
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return 0, s.teeError(err)
+	}
+	return off, s.enc.Encode(protocol.RMsg{Offset: off})
+}
+
+/* hashKept hashes the first n bytes of name into sum */
+func (s *session) hashKept(name string, n int64, sum hash.Hash) error {
+	r, err := s.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return skip(r, n, sum)
+}
+
+/* resumeAt takes the reply to the C message of a file of size, where the
+   sink wants its data from; errDeclined when it wants none */
+func (s *session) resumeAt(size int64, sparse bool) (int64, error) {
+	if !s.ext["resume"] && !s.ext["skip"] {
+		return 0, s.ack()
+	}
+	if err := s.flush(); err != nil {
+		return 0, err
+	}
+	off, err := s.dec.AckFile(s.ext["resume"], s.ext["skip"])
+	if err == nil && (off > size || off > 0 && sparse) {
+		return 0, protocolErr
+	}
+	return off, err
+}
+
+/* skip moves f to off, through sum when there is one */
+func skip(f File, off int64, sum hash.Hash) error {
+	if off == 0 {
+		return nil
+	}
+	if sum == nil {
+		_, err := f.Seek(off, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(sum, f, off)
+	return err
+}
@@ -1,85 +1,441 @@
-package main
+/* Package rscp runs the source and sink of the scp protocol, as the rscp
+   command does, for other programs to embed */
+package rscp
 
 import (
+	"context"
+	"crypto/ecdh"
+	"encoding"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
-	"syscall"
+	"time"
+
+	"github.com/sftpplease/rscp/protocol"
 )
 
 const (
 	S_IWUSR = 00200
 	S_IRWXU = 00700
-	S_ISUID = 04000
-	S_ISGID = 02000
-
-	MaxErrLen = 1024
-	DirScanBatchSize = 256
+	S_ISUID = protocol.S_ISUID
+	S_ISGID = protocol.S_ISGID
+	S_ISVTX = protocol.S_ISVTX
+
+	MaxErrLen         = 1024
+	MaxFileSize       = protocol.MaxFileSize
+	DefaultMaxLineLen = protocol.DefaultMaxLineLen
+	MaxAccErrors      = 256 /* errors kept per directory, the rest are only counted */
+	DirScanBatchSize  = 256
 )
 
 var (
-	iamSource     = flag.Bool("f", false, "Run in source mode")
-	iamSink       = flag.Bool("t", false, "Run in sink mode")
-	bwLimit       = flag.Uint("l", 0, "Limit the bandwidth, specified in Kbit/s")
-	iamRecursive  = flag.Bool("r", false, "Copy directoires recursively following any symlinks")
-	targetDir     = flag.Bool("d", false, "Target should be a directory")
-	preserveAttrs = flag.Bool("p", false, "Preserve modification and access times and mode from original file")
+	ErrProtocol     = protocol.ErrProtocol
+	ErrNotDirectory = errors.New("is not a directory")
+	ErrIsDirectory  = errors.New("is a directory")
+	ErrNotRegular   = protocol.ErrNotRegular
+	ErrInvalidName  = protocol.ErrInvalidName
+	ErrCanceled     = errors.New("transfer canceled")
+	ErrOutOfRange   = protocol.ErrOutOfRange
+
+	protocolErr = FatalError{Err: ErrProtocol}
+	canceledErr = FatalError{Err: ErrCanceled}
+)
 
-	protocolErr = FatalError("protocol error")
+/* Options control a single source or sink run */
+type Options struct {
+	Recursive bool /* copy directories recursively following any symlinks */
+	TargetDir bool /* sink target should be a directory */
+	Mkdir     bool /* with TargetDir, create it when missing, tees too */
+	Parents   bool /* create missing directories leading to the target and tees first */
+	Preserve  bool /* preserve modification and access times and mode */
+	Owner     bool /* preserve ownership, an rscp extension */
 
-	in io.Reader  = os.Stdin
-	out io.Writer = os.Stdout
-)
+	WindowsNames WinNames /* sink handling of names Windows cannot take */
+	Normalize    Norm     /* Unicode form the sink gives received names */
+
+	Chown      *Ownership /* owner the sink gives all it receives */
+	NumericIDs bool       /* sink takes ids from Owner as they are, not by name */
+	UidOffset  int        /* added to user ids from Owner */
+	GidOffset  int        /* added to group ids from Owner */
+
+	Xattrs         bool /* preserve user.* extended attributes, an rscp extension */
+	SecurityXattrs bool /* preserve security.* extended attributes too */
+	ACLs           bool /* preserve POSIX ACLs, needs Preserve */
+
+	Links           bool /* send symlinks as such, an rscp extension */
+	NoDereference   bool /* source passes over symlinks unless Links */
+	DereferenceArgs bool /* source follows symlinks given as paths, as cp -H */
+
+	Hardlinks bool /* recreate hard links, an rscp extension */
+	Sparse    bool /* send only the data of files with holes, an rscp extension */
+	NanoTimes bool /* preserve times to the nanosecond, an rscp extension */
+
+	Checksum      bool /* verify each file by SHA-256, an rscp extension */
+	DeleteCorrupt bool /* sink removes files failing Checksum */
+
+	Compress bool /* compress what the source sends, an rscp extension */
+	Resume   bool /* continue partial files at the sink, an rscp extension */
+
+	Summary   bool                  /* compare counts with the peer at the end, an rscp extension */
+	OnSummary func(own, peer Tally) /* gets the counts of Summary */
+
+	EscapeNames bool /* escape control characters in names, an rscp extension */
+	NulFraming  bool /* end protocol lines with NUL, an rscp extension */
+	Specials    bool /* send FIFOs, sockets and devices, an rscp extension */
+
+	SealTo   *ecdh.PublicKey  /* encrypt file data to this key, an rscp extension */
+	OpenWith *ecdh.PrivateKey /* decrypt sealed file data with this key */
+
+	FileFlags bool /* preserve BSD file flags, an rscp extension */
+
+	RscpPeer bool /* the peer is rscp, a source offers it the extensions asked for */
+	Strict   bool /* sink refuses malformed messages */
+	Lenient  bool /* sink takes quirks of other scp implementations */
+
+	Tee         []string    /* further targets the sink writes to as well */
+	InPlace     bool        /* write into existing files in place */
+	Preallocate bool        /* reserve the space of files before their data */
+	TempDir     string      /* receive files here before moving them in */
+	UseUmask    bool        /* without Preserve, apply the umask as OpenSSH scp does */
+	Umask       os.FileMode /* mode bits the sink always clears */
+
+	NoSpecialBits bool     /* sink clears setuid and setgid bits */
+	OnConflict    Conflict /* what the sink does with names it has */
+	Update        bool     /* sink skips files no older than those coming */
+
+	Delete        bool /* sink removes what received directories hold besides */
+	MaxDelete     int  /* most Delete removes, no limit when zero */
+	Transactional bool /* sink takes each directory whole or not at all */
+	DryRun        bool /* sink writes nothing */
+
+	Requested []string /* names a downloading sink takes, any when nil */
+
+	CheckSpace    bool  /* sink checks free space before taking data */
+	MaxTotalBytes int64 /* most bytes the sink takes in all */
+	MaxFileSize   int64 /* largest file the sink takes */
+	MaxLineLen    int   /* longest protocol line taken, DefaultMaxLineLen when zero */
+
+	Totals bool /* count what is to be sent first, for Progress */
+
+	Keepalive   time.Duration /* heartbeat interval, an rscp extension */
+	IdleTimeout time.Duration /* give up on a peer silent that long */
+	Timeout     time.Duration /* give up on a transfer taking that long */
+
+	Streams int /* files sent at once over one connection, an rscp extension; not with Hardlinks or Transactional */
+
+	BwLimit uint /* bandwidth limit in Kbit/s, zero means unlimited */
+	Hooks   Hooks
+
+	/* counts bytes on the transfer channel when set, see NewTransferStats */
+	Stats *TransferStats
+
+	Record *Recorder /* captures the transfer channel when set, see Replay */
 
-func main() {
-	flag.Parse()
-	var args = flag.Args()
+	/* periodic progress reports, see Progress */
+	Progress         chan<- Progress
+	ProgressInterval time.Duration /* one second when zero */
 
-	var validMode = (*iamSource || *iamSink) && !(*iamSource && *iamSink)
-	var validArgc = (*iamSource && len(args) > 0) || (*iamSink && len(args) == 1)
+	FS FS /* OsFS when nil */
 
-	if !validMode || !validArgc {
-		usage()
+	OnResult func(FileResult) /* gets the result of every file, the run then returning a SummaryError */
+
+	In  io.Reader /* transfer channel from the peer, stdin when nil */
+	Out io.Writer /* transfer channel to the peer, stdout when nil */
+}
+
+type session struct {
+	ctx  context.Context
+	opts Options
+	fs   FS
+	in   io.Reader
+	out  io.Writer
+	enc  *protocol.Encoder
+	dec  *protocol.Decoder
+	stop func()
+
+	progress *progressMeter
+	manifest *manifest
+	summary  *SummaryError
+	tally    Tally
+
+	ext     map[string]bool /* negotiated extensions */
+	owners  *ownerCache
+	inodes  map[inode]int  /* hard link numbers of the source */
+	entered map[inode]bool /* directories the source is in, see dirID */
+	linked  map[int]string /* first names of hard links at the sink */
+
+	compressor compressWriter /* compressing what the source sends */
+	mux        *muxGroup      /* streams this one runs along with */
+	keepalive  *keepalive
+	cancel    context.CancelCauseFunc /* ends the session early, e.g. on a dead peer */
+	root      *os.Root                /* the target directory a sink keeps within */
+	mirror    *mirror                 /* what a sink with Delete removes by */
+	quota     *quota                  /* what is left of MaxTotalBytes */
+	caseNames *caseNames              /* names received, for winNames */
+	failures  int                     /* errors collected, for Transactional */
+	staged    bool                    /* receiving into a staging directory */
+	top       string                  /* what the sink receives into, for Requested */
+}
+
+func newSession(ctx context.Context, opts Options) *session {
+	if opts.In == nil {
+		opts.In = os.Stdin
+	}
+	if opts.Out == nil {
+		opts.Out = os.Stdout
 	}
 
-	if *bwLimit > 0 {
-		st := NewBwStats(*bwLimit * 1024)
-		in = CapReader(in, st)
-		out = CapWriter(out, st)
+	if opts.FS == nil {
+		opts.FS = OsFS{}
 	}
 
-	var err error
+	ctx, cancel := context.WithCancelCause(ctx)
+	if opts.Timeout > 0 {
+		deadline := time.AfterFunc(opts.Timeout, func() { cancel(ErrDeadline) })
+		context.AfterFunc(ctx, func() { deadline.Stop() })
+	}
+	s := &session{ctx: ctx, opts: opts, fs: opts.FS, cancel: cancel}
+	s.stop = interruptOnDone(ctx, opts.In, opts.Out)
+	s.in = CancelReader(opts.In, ctx)
+	s.out = CancelWriter(opts.Out, ctx)
+	if opts.IdleTimeout > 0 || opts.Timeout > 0 {
+		s.in = s.watchIdle(s.in)
+	}
+	if opts.BwLimit > 0 {
+		st := NewBwStats(opts.BwLimit * 1024)
+		s.in = CapReader(s.in, st)
+		s.out = CapWriter(s.out, st)
+	}
+	if opts.Stats != nil {
+		s.in = CountReader(s.in, opts.Stats)
+		s.out = CountWriter(s.out, opts.Stats)
+	}
+	if opts.Record != nil {
+		s.in = RecordReader(s.in, opts.Record)
+		s.out = RecordWriter(s.out, opts.Record)
+	}
+	s.codec()
+	s.reporting()
+	return s
+}
 
-	if *iamSource {
-		err = source(args)
-	} else {
-		err = sink(args[0], false)
+/* reporting sets s up for Progress and OnResult */
+func (s *session) reporting() {
+	if s.opts.Progress != nil {
+		s.progress = newProgressMeter(s.opts.Progress, s.opts.ProgressInterval)
+	}
+	if s.opts.OnResult != nil {
+		s.manifest = &manifest{emit: s.opts.OnResult}
+		s.summary = new(SummaryError)
 	}
+}
 
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+/* codec puts an encoder on s.out and a decoder on s.in, ending lines
+   with NUL once the nul extension was agreed on */
+func (s *session) codec() {
+	s.enc = protocol.NewEncoder(s.out)
+	s.dec = protocol.NewDecoder(s.in)
+	if s.ext["nul"] {
+		s.enc.EOL, s.dec.EOL = 0, 0
+	}
+	s.dec.Lenient = s.opts.Lenient
+	if s.opts.MaxLineLen > 0 {
+		s.dec.MaxLine = s.opts.MaxLineLen
+	}
+}
+
+/* Source sends paths to the peer on opts.In/opts.Out */
+func Source(opts Options, paths []string) error {
+	return SourceContext(context.Background(), opts, paths)
+}
+
+/* Sink receives files from the peer on opts.In/opts.Out into target */
+func Sink(opts Options, target string) error {
+	return SinkContext(context.Background(), opts, target)
+}
+
+/* SourceContext is Source aborting with ErrCanceled once ctx is done */
+func SourceContext(ctx context.Context, opts Options, paths []string) error {
+	s := newSession(ctx, opts)
+	defer s.close()
+	return s.result(s.source(paths))
+}
+
+/* SinkContext is Sink aborting with ErrCanceled once ctx is done */
+func SinkContext(ctx context.Context, opts Options, target string) error {
+	s := newSession(ctx, opts)
+	defer s.close()
+	return s.result(s.sink(target, false))
+}
+
+/* Loopback runs srcs through a source and a sink into target in this
+   process, the two joined by pipes */
+func Loopback(ctx context.Context, opts Options, srcs []string, target string) error {
+	return LoopbackFS(ctx, opts, opts.FS, srcs, opts.FS, target)
+}
+
+/* LoopbackFS is Loopback with the source on srcFS and the sink on dstFS */
+func LoopbackFS(ctx context.Context, opts Options, srcFS FS, srcs []string, dstFS FS, target string) error {
+	sinkIn, sourceOut := io.Pipe()
+	sourceIn, sinkOut := io.Pipe()
+
+	opts.RscpPeer = true
+	sinkOpts := opts
+	sinkOpts.In, sinkOpts.Out = sinkIn, sinkOut
+	sinkOpts.BwLimit = 0 /* metered once on the source side */
+	sinkOpts.OnSummary = nil /* printed once by the source */
+	sinkOpts.Record = nil    /* captured once on the source side */
+	sinkOpts.FS = dstFS
+	opts.In, opts.Out, opts.FS = sourceIn, sourceOut, srcFS
+
+	/* the pipes are ours to close, which is what unblocks them on cancel */
+	stop := context.AfterFunc(ctx, func() {
+		sinkIn.CloseWithError(ErrCanceled)
+		sourceIn.CloseWithError(ErrCanceled)
+	})
+	defer stop()
+
+	sinkErr := make(chan error, 1)
+	go func() {
+		err := SinkContext(ctx, sinkOpts, target)
+		sinkIn.Close()
+		sinkOut.Close()
+		sinkErr <- err
+	}()
+
+	err := SourceContext(ctx, opts, srcs)
+	sourceOut.Close()
+	sourceIn.Close() /* a sink still writing gives up too */
+	if err2 := <-sinkErr; err == nil || isFatal(err2) { /* the sink giving up is why the source did */
+		err = err2
+	}
+	return err
+}
+
+/* SourceReport is SourceContext also telling what became of each file */
+func SourceReport(ctx context.Context, opts Options, paths []string) ([]FileResult, error) {
+	s := newSession(ctx, opts)
+	if s.manifest == nil {
+		s.manifest = new(manifest)
+	}
+	s.manifest.keep = true
+	defer s.close()
+	err := s.result(s.source(paths))
+	return s.manifest.results, err
+}
+
+/* SinkReport is SinkContext also telling what became of each file */
+func SinkReport(ctx context.Context, opts Options, target string) ([]FileResult, error) {
+	s := newSession(ctx, opts)
+	if s.manifest == nil {
+		s.manifest = new(manifest)
+	}
+	s.manifest.keep = true
+	defer s.close()
+	err := s.result(s.sink(target, false))
+	return s.manifest.results, err
+}
+
+func (s *session) close() {
+	s.keepalive.stop()
+	s.endCompress() /* lets the sink read an error sent last */
+	s.stop()
+	s.cancel(nil)
+	s.progress.finish()
+	if s.opts.Record != nil {
+		s.opts.Record.Flush()
+	}
+	if s.root != nil {
+		s.root.Close()
+	}
+}
+
+func (s *session) result(err error) error {
+	if err != nil && s.ctx.Err() != nil {
+		if cause := context.Cause(s.ctx); cause == ErrPeerTimeout || cause == ErrIdleTimeout || cause == ErrDeadline {
+			return FatalError{Err: cause}
+		}
+		return canceledErr
+	}
+	if err == nil && s.summary != nil && s.summary.Failed > 0 {
+		return *s.summary
+	}
+	return err
+}
+
+/* collect adds a non-fatal err to errs, or to the bounded summary when
+   streaming results. Past MaxAccErrors errors are only counted so that a
+   peer sending error after error cannot exhaust memory. */
+func (s *session) collect(errs []error, err error) []error {
+	s.mirror.fail()
+	s.failures++
+	if s.summary != nil {
+		s.summary.add(err)
+		return errs
+	}
+	if len(errs) < MaxAccErrors {
+		return append(errs, err)
 	}
+	if more, ok := errs[len(errs)-1].(*moreErrors); ok {
+		more.n++
+		return errs
+	}
+	return append(errs, &moreErrors{1})
+}
+
+/* moreErrors stands for those collect dropped */
+type moreErrors struct {
+	n int
 }
 
-func source(paths []string) error {
-	if err := ack(); err != nil {
+func (e *moreErrors) Error() string {
+	return fmt.Sprintf("and %d more errors", e.n)
+}
+
+func (s *session) source(paths []string) error {
+	if err := s.ack(); err != nil {
+		return err
+	}
+	if err := s.offer(); err != nil {
+		return err
+	}
+	if s.opts.SealTo != nil && !s.ext["sealed"] {
+		return FatalError{Err: ErrUnsealed}
+	}
+	if err := s.sendTotals(paths); err != nil {
 		return err
 	}
 
 	var sendErrs []error
-	for _, path := range paths {
-		if err := send(path); isFatal(err) {
+	if s.ext["mux"] {
+		errs, err := s.sourceMux(paths)
+		if err != nil {
+			return err
+		}
+		sendErrs = errs
+	} else {
+		for _, path := range paths {
+			if err := s.send(path, true); isFatal(err) {
+				return err
+			} else if err != nil {
+				sendErrs = s.collect(sendErrs, err)
+			}
+		}
+	}
+	if s.ext["summary"] {
+		if err := s.sendSummary(); isFatal(err) {
 			return err
 		} else if err != nil {
-			sendErrs = append(sendErrs, err)
+			sendErrs = s.collect(sendErrs, err)
 		}
 	}
+	if err := s.endCompress(); err != nil {
+		return err
+	}
 
 	if len(sendErrs) > 0 {
 		return AccError{sendErrs}
@@ -87,206 +443,592 @@ func source(paths []string) error {
 	return nil
 }
 
-func sink(path string, recur bool) error {
+func (s *session) sink(path string, recur bool) error {
 	var errs []error
-	var times *FileTimes
+	var pend attrs
 
-	if *targetDir {
-		if st, err := os.Stat(path); err != nil {
-			return teeError(FatalError(err.Error()))
+	if !recur {
+		if s.opts.DryRun && s.mux == nil {
+			s.fs = newDryFS(s.fs)
+		}
+		s.top = path
+		if err := makeDirs(s.fs, s.opts, path); err != nil {
+			return s.teeError(FatalError{Err: err})
+		}
+	}
+	if s.opts.TargetDir {
+		if st, err := s.fs.Stat(path); err != nil {
+			return s.teeError(FatalError{Err: err})
 		} else if !st.IsDir() {
-			return teeError(FatalError(path + ": is not a directory"))
+			return s.teeError(FatalError{Err: fmt.Errorf("%s: %w", path, ErrNotDirectory)})
+		}
+	}
+	if !recur && s.mux == nil { /* streams share the FS of the first */
+		if err := s.confineTo(path); err != nil {
+			return s.teeError(err)
+		}
+		if err := s.teeTo(path); err != nil {
+			return s.teeError(err)
+		}
+		if s.opts.Delete && s.opts.Recursive && !s.opts.Transactional {
+			s.mirror = newMirror()
+		}
+		if s.opts.MaxTotalBytes > 0 {
+			s.quota = &quota{left: s.opts.MaxTotalBytes}
+		}
+		if s.winNames() != WinNamesAllow {
+			s.caseNames = newCaseNames()
+		}
+		if s.opts.Chown != nil {
+			if _, _, err := s.opts.Chown.ids(); err != nil {
+				return s.teeError(FatalError{Err: err})
+			}
 		}
 	}
 
-	if _, err := fmt.Fprint(out, "\x00"); err != nil {
-		return FatalError(err.Error())
+	if err := s.enc.Ack(); err != nil {
+		return err
 	}
 
+loop:
 	for first := true; ; first = false {
-		prefix := []byte{0}
-		if _, err := in.Read(prefix); err != nil {
-			if err == io.EOF {
-				break
+		line, err := s.dec.Next()
+		if err == io.EOF {
+			if s.opts.Strict {
+				if err := checkPending(pend); err != nil {
+					return err
+				}
 			}
-			return FatalError(err.Error())
+			break
+		} else if err != nil {
+			return err
 		}
-		line, err := readLine()
-		if err != nil {
-			return FatalError(err.Error())
+		if s.opts.Strict {
+			if err := checkStrict(line, pend); err != nil {
+				return s.teeError(err)
+			}
 		}
 
-		switch prefix[0] {
-		case '\x01':
-			errs = append(errs, errors.New(line))
-
-		case '\x02':
-			return FatalError(line)
+		switch line[0] {
+		case '\x01', '\x02':
+			var m protocol.ErrMsg
+			m.UnmarshalText([]byte(line))
+			if m.Fatal {
+				return FatalError{Err: RemoteError{Msg: m.Msg}}
+			}
+			errs = s.collect(errs, RemoteError{Msg: m.Msg})
 
 		case 'E':
-			if !recur {
-				return teeError(protocolErr)
+			var m protocol.EMsg
+			if err := m.UnmarshalText([]byte(line)); err != nil || !recur {
+				return s.teeError(protocolErr)
+			}
+			break loop /* sinkDir acks once directory attributes are set */
+
+		case 'X':
+			if !first || recur {
+				return s.teeError(protocolErr)
+			}
+			if err := s.accept(line); err != nil {
+				return err
+			}
+
+		case 'M':
+			var m protocol.MMsg
+			if err := m.UnmarshalText([]byte(line)); err != nil || !s.ext["mux"] || recur {
+				return s.teeError(protocolErr)
+			}
+			muxErrs, err := s.sinkMux(path, m.Streams)
+			if err != nil {
+				return err
+			}
+			errs = append(errs, muxErrs...) /* then the end of what the source sends */
+
+		case 'G':
+			if recur {
+				return s.teeError(protocolErr)
+			}
+			if err := s.sinkTotals(path, line); err != nil {
+				return err
 			}
-			if _, err := fmt.Fprint(out, "\x00"); err != nil {
-				return FatalError(err.Error())
+
+		case 'S':
+			if recur {
+				return s.teeError(protocolErr)
+			}
+			if err := s.sinkSummary(line); isFatal(err) {
+				return err
+			} else if err != nil {
+				errs = s.collect(errs, err)
 			}
 
 		case 'T':
-			if times == nil {
-				times = new(FileTimes)
+			var m protocol.TMsg
+			if err := m.UnmarshalText([]byte(line)); errors.Is(err, ErrOutOfRange) {
+				errs = s.collect(errs, s.teeError(err)) /* the source skips the file */
+				continue
+			} else if err != nil {
+				return s.teeError(err)
+			}
+			pend.times = &m
+			if err := s.enc.Ack(); err != nil {
+				return err
+			}
+
+		case 'N':
+			var m protocol.NMsg
+			if !s.ext["nsec"] {
+				return s.teeError(protocolErr)
+			}
+			if err := m.UnmarshalText([]byte(line)); errors.Is(err, ErrOutOfRange) {
+				errs = s.collect(errs, s.teeError(err))
+				continue
+			} else if err != nil {
+				return s.teeError(protocolErr)
+			}
+			pend.times = &protocol.TMsg{Mtime: m.Mtime, Atime: m.Atime}
+			if err := s.enc.Ack(); err != nil {
+				return err
+			}
+
+		case 'O':
+			pend.owner = new(protocol.OMsg)
+			if err := pend.owner.UnmarshalText([]byte(line)); err != nil || !s.ext["owner"] {
+				return s.teeError(protocolErr)
+			}
+			if err := s.enc.Ack(); err != nil {
+				return err
+			}
+
+		case 'A':
+			if !s.ext["xattrs"] {
+				return s.teeError(protocolErr)
+			}
+			x, err := s.recvXattr(line, pend.xattrSize())
+			if err != nil {
+				return s.teeError(err)
+			}
+			pend.xattrs = append(pend.xattrs, x)
+			if err := s.enc.Ack(); err != nil {
+				return err
+			}
+
+		case 'P':
+			var m protocol.PMsg
+			if err := m.UnmarshalText([]byte(line)); err != nil || !s.ext["acls"] {
+				return s.teeError(protocolErr)
+			}
+			if _, err := aclBinary(m.ACL); err != nil {
+				return s.teeError(protocolErr)
+			}
+			pend.acls = append(pend.acls, m)
+			if err := s.enc.Ack(); err != nil {
+				return err
+			}
+
+		case 'U':
+			pend.flags = new(protocol.UMsg)
+			if err := pend.flags.UnmarshalText([]byte(line)); err != nil || !s.ext["fflags"] {
+				return s.teeError(protocolErr)
+			}
+			if err := s.enc.Ack(); err != nil {
+				return err
+			}
+
+		case 'I':
+			pend.link = new(protocol.IMsg)
+			if err := pend.link.UnmarshalText([]byte(line)); err != nil || !s.ext["hardlinks"] {
+				return s.teeError(protocolErr)
+			}
+			if err := s.enc.Ack(); err != nil {
+				return err
+			}
+
+		case 'K':
+			var m protocol.KMsg
+			if err := m.UnmarshalText([]byte(line)); err != nil || !s.ext["sparse"] ||
+				len(pend.extents)+len(m.Extents) > MaxExtents {
+
+				return s.teeError(protocolErr)
+			}
+			pend.extents = append(pend.extents, m.Extents...)
+			pend.sparse = true
+			if err := s.enc.Ack(); err != nil {
+				return err
 			}
-			if n, err := fmt.Sscanf(line, "%d %d %d %d",
-				&times.Mtime.Sec, &times.Mtime.Usec,
-				&times.Atime.Sec, &times.Atime.Usec); err != nil {
 
-				return teeError(FatalError(err.Error()))
-			} else if n != 4 {
-				return teeError(protocolErr)
+		case 'H':
+			if err := s.sinkHardlink(path, line); isFatal(err) {
+				return err
+			} else if err != nil {
+				errs = s.collect(errs, err)
 			}
-			if _, err := fmt.Fprint(out, "\x00"); err != nil {
-				return FatalError(err.Error())
+			pend = attrs{}
+
+		case 'F':
+			if err := s.sinkSpecial(path, line, pend); isFatal(err) {
+				return err
+			} else if err != nil {
+				errs = s.collect(errs, err)
 			}
+			pend = attrs{}
+
+		case 'L':
+			if err := s.sinkLink(path, line); isFatal(err) {
+				return err
+			} else if err != nil {
+				errs = s.collect(errs, err)
+			}
+			pend = attrs{}
 
 		case 'D':
-			if err := sinkDir(path, line, times); isFatal(err) {
+			if err := s.sinkDir(path, line, pend); isFatal(err) {
 				return err
 			} else if err != nil {
-				errs = append(errs, err)
+				errs = s.collect(errs, err)
 			}
-			times = nil
+			pend = attrs{}
 
 		case 'C':
-			if err := sinkFile(path, line, times); isFatal(err) {
+			if err := s.sinkFile(path, line, pend); isFatal(err) {
 				return err
 			} else if err != nil {
-				errs = append(errs, err)
+				errs = s.collect(errs, err)
 			}
-			times = nil
+			pend = attrs{}
 
 		default:
 			err := protocolErr
 			if first {
-				compLine := append([]byte{prefix[0]}, line...)
-				err = FatalError(string(compLine))
+				err = FatalError{Err: errors.New(line)}
 			}
-			return teeError(err)
+			return s.teeError(err)
 		}
 	}
 
+	if !recur && s.mirror != nil && s.mux == nil {
+		for _, err := range s.prune() {
+			errs = s.collect(errs, err)
+		}
+	}
 	if len(errs) > 0 {
 		return AccError{errs}
 	}
 	return nil
 }
 
-func sinkDir(parent, line string, times *FileTimes) error {
-	if !*iamRecursive {
-		return teeError(FatalError("received directory without -r flag"))
+/* attrs received ahead of a C or D message */
+type attrs struct {
+	times  *protocol.TMsg
+	owner  *protocol.OMsg
+	xattrs []xattr
+	acls   []protocol.PMsg
+	link   *protocol.IMsg
+	flags  *protocol.UMsg
+
+	sparse  bool
+	extents []protocol.Extent
+}
+
+func (a attrs) xattrSize() int {
+	n := 0
+	for _, x := range a.xattrs {
+		n += len(x.name) + len(x.value)
 	}
+	return n
+}
 
-	perm, _, name, err := parseSubj(line)
-	if err != nil {
-		return teeError(FatalError(err.Error()))
+func (s *session) sinkDir(parent, line string, pend attrs) error {
+	if !s.opts.Recursive {
+		return s.teeError(FatalError{Err: errors.New("received directory without -r flag")})
+	}
+
+	var m protocol.DMsg
+	var err error
+	if err = m.UnmarshalText([]byte(line)); errors.Is(err, ErrOutOfRange) {
+		return s.teeError(err) /* the source skips what it announced */
+	} else if err != nil {
+		return s.teeError(FatalError{Err: err})
+	}
+	if m.Name, err = s.localName(m.Name); err != nil {
+		return s.teeError(err)
+	}
+	if err = s.requested(parent, m.Name); err != nil {
+		return s.teeError(err)
+	}
+
+	name, perm := path.Join(parent, m.Name), m.Perm&^s.mask()
+	if name, err = s.winName(name); err != nil {
+		return s.teeError(err)
+	}
+	s.mirror.keep(name)
+	if err := s.replaceLink(name); err != nil {
+		return s.teeError(err)
 	}
 
-	name = path.Join(parent, name)
+	dir, staged := name, s.opts.Transactional && !s.staged
+	var stage *partialFile
+	if staged {
+		if dir, stage, err = s.stageDir(name); err != nil {
+			return s.teeError(err)
+		}
+		s.staged = true
+		defer func() { s.staged = false; stage.discard() }()
+	}
 
-	resetPerm, err := prepareDir(name, perm)
+	resetPerm, err := s.prepareDir(dir, perm)
 	if err != nil {
-		return teeError(err)
+		return s.teeError(err)
 	}
+	s.mirror.dir(name)
+	s.dirEnter(name)
 
 	var errs []error
-	if err := sink(name, true); isFatal(err) {
+	failures := s.failures
+	if err := s.sink(dir, true); isFatal(err) {
 		return err
 	} else if err != nil {
-		errs = append(errs, err)
+		errs = s.collect(errs, err)
 	}
 
 	var pendErrs []error
-	if times != nil {
-		t := []syscall.Timeval{times.Atime, times.Mtime}
-		if err := syscall.Utimes(name, t); err != nil {
-			pendErrs = append(pendErrs, err)
-		}
+	if s.mux != nil {
+		s.mux.deferDir(name, perm, resetPerm, pend)
+	} else {
+		pendErrs = s.setAttrs(dir, perm, resetPerm, pend)
 	}
-	if resetPerm {
-		if err := os.Chmod(name, perm); err != nil {
+	if staged && (s.failures > failures || len(pendErrs) > 0) {
+		pendErrs = append(pendErrs, fmt.Errorf("%s: %w", name, ErrRolledBack))
+	} else if staged {
+		if err := s.commitDir(dir, name); err != nil {
 			pendErrs = append(pendErrs, err)
+		} else {
+			stage.done()
 		}
 	}
 	if len(pendErrs) > 0 {
-		errs = append(errs, pendErrs...)
-		if err := sendError(AccError{pendErrs}); err != nil {
+		for _, err := range pendErrs {
+			errs = s.collect(errs, err)
+		}
+		if err := s.sendError(AccError{pendErrs}); err != nil {
 			return err
 		}
+	} else if err := s.enc.Ack(); err != nil {
+		return err
 	}
 
 	if len(errs) > 0 {
-		return AccError{errs}
+		return s.dirLeave(name, AccError{errs})
 	}
-	return nil
+	return s.dirLeave(name, nil)
 }
 
-func sinkFile(name, line string, times *FileTimes) error {
-	perm, size, subj, err := parseSubj(line)
-	if err != nil {
-		return teeError(FatalError(err.Error()))
+/* setAttrs applies what was received ahead of the D or F message of
+   name once it is in place, for a directory once its contents are */
+func (s *session) setAttrs(name string, perm os.FileMode, resetPerm bool, pend attrs) []error {
+	var errs []error
+	if pend.owner != nil || s.opts.Chown != nil {
+		if err := s.chown(name, pend.owner); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.setXattrs(name, pend.xattrs); err != nil {
+		errs = append(errs, err)
+	}
+	if pend.times != nil && s.setsTimes() {
+		if err := s.fs.Chtimes(name, pend.times.Atime, pend.times.Mtime); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if resetPerm {
+		if err := s.fs.Chmod(name, perm); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.setACLs(name, pend.acls); err != nil { /* after chmod, which would narrow the mask */
+		errs = append(errs, err)
+	}
+	if err := s.setFlags(name, pend.flags); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (s *session) sinkFile(name, line string, pend attrs) error {
+	var m protocol.CMsg
+	var err error
+	if err = m.UnmarshalText([]byte(line)); errors.Is(err, ErrOutOfRange) {
+		return s.teeError(err) /* the source skips what it announced */
+	} else if err != nil {
+		return s.teeError(FatalError{Err: err})
+	}
+	if m.Name, err = s.localName(m.Name); err != nil {
+		return s.teeError(err)
+	}
+	if err = s.requested(name, m.Name); err != nil {
+		return s.teeError(err)
+	}
+	if err := checkExtents(pend.extents, m.Size); err != nil {
+		return s.teeError(err)
+	}
+
+	into := false
+	if st, err := s.fs.Stat(name); err == nil && st.IsDir() {
+		name, into = path.Join(name, m.Name), true
+		if name, err = s.winName(name); err != nil {
+			return s.fileDone(name, s.teeError(err))
+		}
+	}
+	s.mirror.keep(name)
+	if err := s.checkFileSize(name, m.Size); err != nil {
+		return s.fileDone(name, s.teeError(err))
 	}
+	if s.newer(name, pend.times) {
+		return s.skipFile(name, ErrNewer)
+	}
+	if skip, err := s.onConflict(name); skip {
+		return s.skipFile(name, ErrNotOverwritten)
+	} else if err != nil {
+		return s.fileDone(name, s.teeError(err))
+	}
+	if err := s.checkSpace(name, m.Size, pend); err != nil {
+		return s.fileDone(name, s.teeError(err))
+	}
+	if err := s.takeQuota(name, m.Size); err != nil {
+		return s.fileDone(name, s.teeError(err))
+	}
+	if into {
+		if err := s.replaceLink(name); err != nil {
+			return s.fileDone(name, s.teeError(err))
+		}
+	}
+	_, err = s.fs.Stat(name)
+	exists := err == nil
 
-	exists := false
-	if st, err := os.Stat(name); err == nil {
-		exists = true
-		if st.IsDir() {
-			name = path.Join(name, subj)
+	s.fileStart(name, m.Size, m.Perm)
+	err = s.recvFile(name, line, m.Perm&^s.mask(), m.Size, exists, pend)
+	if errors.Is(err, ErrChecksum) && s.opts.DeleteCorrupt {
+		s.fs.Remove(name)
+	}
+	if err == nil && pend.link != nil {
+		if s.linked == nil {
+			s.linked = map[int]string{}
 		}
+		s.linked[pend.link.ID] = name
 	}
+	return s.fileDone(name, err)
+}
 
-	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, perm|S_IWUSR)
+func (s *session) recvFile(name, line string, perm os.FileMode, size int64, exists bool, pend attrs) error {
+	file, flag, mode := name, os.O_WRONLY|os.O_CREATE, perm|S_IWUSR
+	tmp, old := s.tempFor(name)
+	if tmp != "" {
+		file, flag, mode = tmp, flag|os.O_EXCL, 0600
+	}
+	f, err := s.fs.OpenFile(file, flag, mode)
 	if err != nil {
-		return teeError(err)
+		return s.teeError(err)
 	}
-	defer f.Close() /* will sync explicitly */
+	defer func() {
+		if f != nil {
+			f.Close() /* will sync explicitly */
+		}
+	}()
 
 	st, err := f.Stat()
 	if err != nil {
-		return teeError(err)
+		if tmp != "" {
+			s.fs.Remove(tmp)
+		}
+		return s.teeError(err)
+	}
+	var p *partialFile
+	if tmp != "" || !exists {
+		p = s.partial(file, st)
+	}
+	if err := s.preallocate(f, st, size, pend); err != nil {
+		p.discard()
+		return s.teeError(fmt.Errorf("%s: %w", name, err))
 	}
 
-	if _, err := fmt.Fprint(out, "\x00"); err != nil {
-		return FatalError(err.Error())
+	sum := s.checksum()
+	off, err := s.ackResume(name, f, st, size, pend, sum)
+	if err != nil {
+		p.discard()
+		return err
+	}
+	if p == nil { /* the old data goes from here on */
+		p = s.partial(file, st)
 	}
 
 	var pendErrs []error
-	if wr, err := io.Copy(f, io.LimitReader(in, size)); err != nil {
-		if _, err := io.Copy(ioutil.Discard, io.LimitReader(in, size-wr)); err != nil {
-			return teeError(FatalError(err.Error()))
+	limited := &io.LimitedReader{N: size - off}
+	if pend.sparse {
+		limited.N = extentsLen(pend.extents)
+	}
+	limited.R = s.open(line, limited.N)
+	data := hashed(limited, sum)
+	dataErr := s.recvData(f, st, data, pend)
+	if dataErr == nil && limited.N > 0 {
+		dataErr = io.ErrUnexpectedEOF
+	}
+	if dataErr != nil {
+		if s.ctx.Err() != nil {
+			p.discard()
+			return canceledErr
 		}
-		pendErrs = append(pendErrs, err)
-	}
-
-	if !exists || st.Mode().IsRegular() {
-		if err := f.Truncate(size); err != nil {
-			pendErrs = append(pendErrs, err)
+		/* drain what is left unread, a failed write may have consumed more than it wrote */
+		_, err := io.Copy(ioutil.Discard, data)
+		if err == nil && limited.N > 0 { /* the stream ended short of the data */
+			err = io.ErrUnexpectedEOF
 		}
+		if err != nil {
+			p.discard()
+			return s.teeError(FatalError{Err: err})
+		}
+		pendErrs = append(pendErrs, dataErr)
 	}
-	if err := f.Sync(); err != nil {
+	if err := s.verify(name, sum); isFatal(err) {
+		p.discard()
+		return err
+	} else if err != nil {
 		pendErrs = append(pendErrs, err)
 	}
-	if *preserveAttrs || !exists {
-		if err := f.Chmod(perm); err != nil {
-			pendErrs = append(pendErrs, err)
+
+	if tmp != "" && dataErr == nil && s.staging() {
+		if f, tmp, dataErr = s.unstage(f, tmp, name, p); dataErr != nil {
+			pendErrs = append(pendErrs, dataErr)
 		}
+		file = tmp
 	}
-	if times != nil {
-		if err := syscall.Utimes(name,
-			[]syscall.Timeval{times.Atime, times.Mtime}); err != nil {
-
-			pendErrs = append(pendErrs, err)
+	if tmp != "" && dataErr != nil {
+		f.Close()
+		f = nil
+		p.discard() /* the old file stays as it was */
+	} else {
+		pendErrs = append(pendErrs, s.settleFile(f, file, perm, size, exists, st, old, pend)...)
+		placed := true
+		if tmp != "" {
+			err := f.Close()
+			f = nil
+			if err == nil {
+				err = s.fs.Rename(tmp, name)
+			}
+			if err != nil {
+				p.discard()
+				pendErrs = append(pendErrs, err)
+				placed = false
+			}
+		}
+		p.done()
+		if placed {
+			if err := s.setFlags(name, pend.flags); err != nil {
+				pendErrs = append(pendErrs, err)
+			}
 		}
 	}
 
-	ackErr := ack()
+	ackErr := s.ack()
 	if isFatal(ackErr) {
 		return ackErr
 	}
@@ -294,12 +1036,12 @@ func sinkFile(name, line string, times *FileTimes) error {
 	var sentErr error
 	if len(pendErrs) > 0 {
 		sentErr = AccError{pendErrs}
-		if err := sendError(sentErr); err != nil {
+		if err := s.sendError(sentErr); err != nil {
 			return err
 		}
 	} else {
-		if _, err := fmt.Fprint(out, "\x00"); err != nil {
-			return FatalError(err.Error())
+		if err := s.enc.Ack(); err != nil {
+			return err
 		}
 	}
 
@@ -309,19 +1051,85 @@ func sinkFile(name, line string, times *FileTimes) error {
 	return sentErr
 }
 
-func prepareDir(name string, perm os.FileMode) (bool, error) {
+/* settleFile completes the data of file, received as name, and applies
+   the attributes that go along; old is what it replaces when not
+   written in place */
+func (s *session) settleFile(f File, file string, perm os.FileMode, size int64, exists bool, st, old os.FileInfo, pend attrs) []error {
+	var errs []error
+	if !exists || st.Mode().IsRegular() {
+		if err := f.Truncate(size); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		errs = append(errs, err)
+	}
+	if pend.owner == nil {
+		s.keepOwner(file, st, old)
+	}
+	if pend.owner != nil || s.opts.Chown != nil { /* ahead of chmod, chown drops setuid bits */
+		if err := s.chown(file, pend.owner); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.setXattrs(file, pend.xattrs); err != nil {
+		errs = append(errs, err)
+	}
+	if s.opts.Preserve || !exists {
+		if err := f.Chmod(perm); err != nil {
+			errs = append(errs, err)
+		}
+	} else if old != nil {
+		if err := f.Chmod(old.Mode().Perm()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.setACLs(file, pend.acls); err != nil {
+		errs = append(errs, err)
+	}
+	if pend.times != nil && s.setsTimes() {
+		if err := s.fs.Chtimes(file, pend.times.Atime, pend.times.Mtime); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+/* recvData writes data to f, only into the extents when the file comes sparse */
+func (s *session) recvData(f File, st os.FileInfo, data io.Reader, pend attrs) error {
+	w := s.countWriter(f)
+	if !pend.sparse {
+		_, err := io.Copy(w, data)
+		return err
+	}
+	if st.Mode().IsRegular() { /* old data must not show through the holes */
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+	}
+	return writeExtents(f, w, data, pend.extents)
+}
+
+func (s *session) prepareDir(name string, perm os.FileMode) (bool, error) {
 	resetPerm := false
-	if st, err := os.Stat(name); err == nil {
+	if st, err := s.fs.Stat(name); err == nil {
 		if !st.IsDir() {
-			return resetPerm, errors.New(name + ": is not a directory")
+			return resetPerm, fmt.Errorf("%s: %w", name, ErrNotDirectory)
 		}
-		if *preserveAttrs {
-			if err := os.Chmod(name, perm); err != nil {
+		if s.opts.Preserve {
+			mode := perm
+			if s.mux != nil { /* other streams may still write into it, see sinkMux */
+				mode |= S_IRWXU
+				resetPerm = true
+			}
+			if err := s.fs.Chmod(name, mode); err != nil {
 				return resetPerm, err
 			}
 		}
 	} else if os.IsNotExist(err) {
-		if err := os.Mkdir(name, perm|S_IRWXU); err != nil {
+		if err := s.fs.Mkdir(name, perm|S_IRWXU); s.mux != nil && os.IsExist(err) {
+			return s.prepareDir(name, perm) /* created by another stream meanwhile */
+		} else if err != nil {
 			return resetPerm, err
 		}
 		resetPerm = true
@@ -331,73 +1139,142 @@ func prepareDir(name string, perm os.FileMode) (bool, error) {
 	return resetPerm, nil
 }
 
-func send(name string) error {
-	f, err := os.Open(name)
+/* send sends local, top when it is one of the paths the source was given */
+func (s *session) send(local string, top bool) error {
+	if !s.follows(top) {
+		if st, err := s.fs.Lstat(local); err == nil && st.Mode()&os.ModeSymlink != 0 {
+			if !s.ext["links"] {
+				s.fileSkipped(local, fmt.Errorf("%s: %w", local, ErrLinkSkipped))
+				return nil
+			}
+			s.fileStart(local, 0, st.Mode())
+			return s.fileDone(local, s.sendLink(local, st))
+		}
+	}
+	if st, err := s.fs.Stat(local); err == nil && isSpecial(st.Mode()) { /* opening a FIFO would block */
+		if !s.ext["specials"] {
+			return s.fileDone(local, s.teeError(fmt.Errorf("%s: %w", st.Name(), ErrNotRegular)))
+		}
+		s.fileStart(local, 0, st.Mode())
+		return s.fileDone(local, s.sendSpecial(local, st))
+	}
+
+	f, err := s.fs.Open(local)
 	if err != nil {
-		return teeError(err)
+		return s.fileDone(local, s.teeError(err))
 	}
 	defer f.Close()
 
 	st, err := f.Stat()
 	if err != nil {
-		return teeError(err)
+		return s.fileDone(local, s.teeError(err))
 	}
-	name = st.Name()
+	name := st.Name()
 
 	if mode := st.Mode(); mode.IsDir() {
-		if *iamRecursive {
-			return sendDir(f, st)
+		if s.opts.Recursive {
+			return s.sendDir(f, st)
 		}
-		return teeError(errors.New(name + ": is a directory"))
+		return s.fileDone(local, s.teeError(fmt.Errorf("%s: %w", name, ErrIsDirectory)))
 	} else if !mode.IsRegular() {
-		return teeError(errors.New(name + ": not a regular file"))
+		return s.fileDone(local, s.teeError(fmt.Errorf("%s: %w", name, ErrNotRegular)))
 	}
 
-	if *preserveAttrs {
-		if err := sendAttr(st); err != nil {
-			return err
-		}
+	if id, seen := s.hardlink(st); seen {
+		s.fileStart(local, 0, st.Mode())
+		return s.fileDone(local, s.sendHardlink(id, st))
 	}
 
-	if _, err := fmt.Fprintf(out, "C%04o %d %s\n",
-		toPosixPerm(st.Mode()), st.Size(), name); err != nil {
+	s.fileStart(local, st.Size(), st.Mode())
+	return s.fileDone(local, s.sendFile(f, st))
+}
 
-		return FatalError(err.Error())
+func (s *session) sendFile(f File, st os.FileInfo) error {
+	name, err := s.wireName(st.Name())
+	if err != nil {
+		return s.teeError(err)
 	}
-	if err := ack(); err != nil {
+
+	exts, sparse := s.extents(f, st)
+	if err := s.sendAttrs(f.Name(), st); err != nil {
 		return err
 	}
-
-	if sent, err := io.Copy(out, f); err != nil {
-		patch := io.LimitReader(ConstReader(0), st.Size()-sent)
-		if _, err := io.Copy(out, patch); err != nil {
-			return FatalError(err.Error())
-		}
-		if err := ack(); err != nil {
+	if sparse {
+		if err := s.sendExtents(exts); err != nil {
 			return err
 		}
-		return teeError(err)
 	}
 
-	if _, err := fmt.Fprint(out, "\x00"); err != nil {
-		return FatalError(err.Error())
+	s.keepalive.pause() /* until the sink has all data */
+	defer s.keepalive.resume()
+	c := protocol.CMsg{Perm: st.Mode(), Size: st.Size(), Name: name}
+	line, _ := c.MarshalText() /* what sealed data is bound to */
+	if err := s.enc.Encode(c); err != nil {
+		return err
+	}
+	off, err := s.resumeAt(st.Size(), sparse)
+	if err == errDeclined {
+		return nil /* the sink keeps what it has */
+	} else if err != nil {
+		return err
 	}
-	return ack()
-}
 
-func sendDir(dir *os.File, st os.FileInfo) error {
-	if *preserveAttrs {
-		if err := sendAttr(st); err != nil {
+	var data io.Reader = io.LimitReader(f, st.Size()-off)
+	size := st.Size() - off
+	if sparse {
+		data, size = &extentReader{f: f, exts: exts}, extentsLen(exts)
+	}
+	out, err := s.seal(string(line), size)
+	if err != nil {
+		return err
+	}
+	sum := s.checksum()
+	var sent int64
+	if err = skip(f, off, sum); err == nil {
+		sent, err = io.Copy(out, s.countReader(hashed(data, sum)))
+	}
+	if err == nil && sent < size {
+		err = fmt.Errorf("%s: %w", f.Name(), io.ErrUnexpectedEOF) /* shrank since stat */
+	}
+	if err != nil {
+		patch := io.LimitReader(ConstReader(0), size-sent)
+		if _, err := io.Copy(out, hashed(patch, sum)); err != nil {
+			return FatalError{Err: err}
+		}
+		if err := s.sendSum(sum); err != nil {
 			return err
 		}
+		/* the error goes in place of the zero byte ending the data */
+		if err := s.sendError(err); err != nil {
+			return err
+		}
+		if ackErr := s.ack(); isFatal(ackErr) {
+			return ackErr
+		}
+		return err
 	}
 
-	if _, err := fmt.Fprintf(out, "D%04o %d %s\n",
-		toPosixPerm(st.Mode()), 0, st.Name()); err != nil {
+	if err := s.sendSum(sum); err != nil {
+		return err
+	}
+	if err := s.enc.Ack(); err != nil {
+		return err
+	}
+	return s.ack()
+}
 
-		return FatalError(err.Error())
+func (s *session) sendDir(dir File, st os.FileInfo) error {
+	if id, ok := s.dirID(st); ok {
+		if s.entered[id] {
+			return s.fileDone(dir.Name(), s.teeError(fmt.Errorf("%s: %w", dir.Name(), ErrDirLoop)))
+		}
+		if s.entered == nil {
+			s.entered = map[inode]bool{}
+		}
+		s.entered[id] = true
+		defer delete(s.entered, id)
 	}
-	if err := ack(); err != nil {
+	if err := s.enterDir(dir.Name(), st); err != nil {
 		return err
 	}
 
@@ -405,173 +1282,184 @@ func sendDir(dir *os.File, st os.FileInfo) error {
 	for {
 		children, err := dir.Readdir(DirScanBatchSize)
 		for _, child := range children {
-			if err := send(path.Join(dir.Name(), child.Name())); isFatal(err) {
+			if err := s.send(path.Join(dir.Name(), child.Name()), false); isFatal(err) {
 				return err
 			} else if err != nil {
-				sendErrs = append(sendErrs, err)
+				sendErrs = s.collect(sendErrs, err)
 			}
 		}
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return teeError(err)
+			return s.teeError(err)
 		}
 	}
 
-	if _, err := fmt.Fprintf(out, "E\n"); err != nil {
-		return FatalError(err.Error())
+	return s.leaveDir(dir.Name(), sendErrs)
+}
+
+/* enterDir sends the D message of the local directory */
+func (s *session) enterDir(local string, st os.FileInfo) error {
+	name, err := s.wireName(st.Name())
+	if err != nil {
+		return s.teeError(err)
+	}
+	if err := s.sendAttrs(local, st); err != nil {
+		return err
+	}
+
+	if err := s.enc.Encode(protocol.DMsg{Perm: st.Mode(), Name: name}); err != nil {
+		return err
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	s.dirEnter(local)
+	return nil
+}
+
+/* leaveDir sends the E message of the local directory, sendErrs are
+   those of its contents */
+func (s *session) leaveDir(local string, sendErrs []error) error {
+	if err := s.enc.Encode(protocol.EMsg{}); err != nil {
+		return err
 	}
-	ackErr := ack()
+	ackErr := s.ack()
 	if isFatal(ackErr) {
 		return ackErr
 	}
 
 	if len(sendErrs) > 0 {
-		return AccError{sendErrs}
+		if ackErr != nil { /* e.g. the directory rolled back for them */
+			sendErrs = s.collect(sendErrs, ackErr)
+		}
+		return s.dirLeave(local, AccError{sendErrs})
 	}
-	return ackErr
+	return s.dirLeave(local, ackErr)
 }
 
-func parseSubj(line string) (perm os.FileMode, size int64, name string, err error) {
-	n := 0
-	pperm := 0
-	if n, err = fmt.Sscanf(line, "%o %d %s", &pperm, &size, &name); err != nil {
-		return
-	} else if n != 3 {
-		err = protocolErr
-		return
+/* sendAttrs sends whatever of T, O, I, A, P and U messages the session calls for */
+func (s *session) sendAttrs(local string, st os.FileInfo) error {
+	var xs []xattr
+	var acls []protocol.PMsg
+	var err error
+	/* read ahead, a failure must not leave attributes pending */
+	if s.ext["xattrs"] {
+		if xs, err = s.xattrs(local); err != nil {
+			return s.teeError(err)
+		}
 	}
-	perm = toStdPerm(pperm)
-	if name == ".." || strings.ContainsRune(name, '/') {
-		err = FatalError(name + ": invalid name")
+	if s.ext["acls"] {
+		if acls, err = s.acls(local); err != nil {
+			return s.teeError(err)
+		}
 	}
-	return
-}
 
-func sendAttr(st os.FileInfo) error {
-	mtime := st.ModTime().Unix()
-	atime := int64(0)
-
-	if sysStat, ok := st.Sys().(*syscall.Stat_t); ok {
-		atime, _ = sysStat.Atim.Unix()
+	if s.opts.Preserve || s.opts.Update {
+		if err := s.sendTimes(st); err != nil {
+			return err
+		}
 	}
-
-	if _, err := fmt.Fprintf(out, "T%d 0 %d 0\n", mtime, atime); err != nil {
-		return FatalError(err.Error())
+	if s.ext["owner"] {
+		if m, ok := s.owner(st); ok {
+			if err := s.enc.Encode(m); err != nil {
+				return err
+			}
+			if err := s.ack(); err != nil {
+				return err
+			}
+		}
 	}
-	return ack()
-}
-
-func ack() error {
-	kind := []byte{0}
-	if _, err := in.Read(kind); err != nil {
-		return FatalError(err.Error())
+	if id := s.linkID(st); id != 0 {
+		if err := s.enc.Encode(protocol.IMsg{ID: id}); err != nil {
+			return err
+		}
+		if err := s.ack(); err != nil {
+			return err
+		}
 	}
-	if kind[0] == 0 {
-		return nil
+	if err := s.sendXattrs(xs); err != nil {
+		return err
 	}
+	for _, m := range acls {
+		if err := s.enc.Encode(m); err != nil {
+			return err
+		}
+		if err := s.ack(); err != nil {
+			return err
+		}
+	}
+	if s.ext["fflags"] {
+		return s.sendFlags(st)
+	}
+	return nil
+}
 
-	l, err := readLine()
-	if err != nil {
-		return FatalError(err.Error())
+func (s *session) sendTimes(st os.FileInfo) error {
+	var m encoding.TextMarshaler = protocol.TMsg{Mtime: st.ModTime(), Atime: s.fs.Atime(st)}
+	if s.ext["nsec"] {
+		m = protocol.NMsg{Mtime: st.ModTime(), Atime: s.fs.Atime(st)}
 	}
+	if err := s.enc.Encode(m); err != nil {
+		return err
+	}
+	return s.ack()
+}
 
-	switch kind[0] {
-	case 1:
-		return errors.New(l)
-	case 2:
-		return FatalError(l)
-	default:
-		return protocolErr
+func (s *session) ack() error {
+	if err := s.flush(); err != nil {
+		return err
 	}
+	return s.dec.Ack()
 }
 
-func teeError(err error) error {
-	if err := sendError(err); err != nil {
+func (s *session) teeError(err error) error {
+	if err := s.sendError(err); err != nil {
 		return err
 	}
 	return err
 }
 
-func sendError(err error) error {
-	line := strings.Replace(err.Error(), "\n", "; ", -1)
+func (s *session) sendError(err error) error {
+	line := Sanitize(strings.Replace(err.Error(), "\n", "; ", -1))
 	/* make complete protocol line with zero terminator (i.e \x01%s\n\x00) fit into MaxErrLen buffer */
 	if len(line) > MaxErrLen-3 {
 		line = line[:MaxErrLen-6] + "..."
 	}
-	if _, err := fmt.Fprintf(out, "\x01%s\n", line); err != nil {
-		return FatalError(err.Error())
-	}
-	return nil
+	return s.enc.Encode(protocol.ErrMsg{Msg: line})
 }
 
-func readLine() (string, error) {
-	l := make([]byte, 0, 64)
-	ch := []byte{0}
-
-	for {
-		if _, err := in.Read(ch); err != nil {
-			return "", err
+/* Sanitize escapes control characters in text going into an error
+   message, a local name could otherwise end the line early and have
+   the rest taken for a message of its own */
+func Sanitize(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; c < ' ' || c == 0x7f {
+			fmt.Fprintf(&b, "\\%03o", c)
 		} else {
-			if ch[0] == '\n' {
-				break
-			}
-			l = append(l, ch[0])
+			b.WriteByte(c)
 		}
 	}
-
-	return string(l), nil
+	return b.String()
 }
 
-func toPosixPerm(perm os.FileMode) int {
-	pp := perm & os.ModePerm
-	if perm&os.ModeSetuid != 0 {
-		pp |= S_ISUID
-	}
-	if perm&os.ModeSetgid != 0 {
-		pp |= S_ISGID
-	}
-	return int(pp)
-}
-
-func toStdPerm(posixPerm int) os.FileMode {
-	perm := os.FileMode(posixPerm) & os.ModePerm
-	if posixPerm&S_ISUID != 0 {
-		perm |= os.ModeSetuid
-	}
-	if posixPerm&S_ISGID != 0 {
-		perm |= os.ModeSetgid
-	}
-	return perm
-}
-
-func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: rscp -f [-pr] [-l limit] file1 ...\n"+
-		"       rscp -t [-prd] [-l limit] directory\n")
-	flag.PrintDefaults()
-	os.Exit(1)
-}
-
-type FileTimes struct {
-	Atime syscall.Timeval
-	Mtime syscall.Timeval
-}
-
-type FatalError string
-
-func (e FatalError) Error() string {
-	return string(e)
-}
+/* FatalError aborts the session, Err tells why */
+type FatalError = protocol.FatalError
 
+/* isFatal tells whether err, or an error it wraps, aborts the session */
 func isFatal(err error) bool {
-	_, isFatal := err.(FatalError)
-	return isFatal
+	return errors.As(err, &FatalError{})
 }
 
 type AccError struct {
 	Errors []error
 }
 
+func (e AccError) Unwrap() []error {
+	return e.Errors
+}
+
 func (e AccError) Error() string {
 	ve := []interface{}{}
 	for _, err := range e.Errors {
@@ -0,0 +1,241 @@
+package rscp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+/* With the sealed extension the source encrypts the data of every file
+   to an X25519 key of the sink, so that whatever relays the transfer sees
+   names, sizes and attributes but not contents. The data of a file of
+   n > 0 bytes goes as the public half of a key made for it alone followed
+   by the n bytes in SealChunk sized pieces, each sealed with AES-256-GCM
+   numbering them from zero in the nonce, its last byte set on the last
+   piece, and the C message and n as additional data: pieces cannot be
+   dropped, reordered or taken to another file unnoticed. The key comes
+   from HKDF-SHA256 over the shared secret of both keys. Anyone with the
+   public key can seal, so this keeps data secret but does not tell who
+   sent it. Digests of --checksum still go in clear. */
+
+const SealChunk = 64 << 10
+
+var (
+	ErrUnsealed   = errors.New("peer cannot take sealed data")
+	ErrNoSealKey  = errors.New("no key for sealed data")
+	ErrSealBroken = errors.New("sealed data fails to authenticate")
+)
+
+func sealAEAD(shared, eph, rcpt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, shared, append(eph[:len(eph):len(eph)], rcpt...), "rscp sealed data", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealNonce(aead cipher.AEAD, chunk uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], chunk)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+/* sealAD is the additional data the pieces of n bytes sent after the C
+   message line are sealed with */
+func sealAD(line string, n int64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(line), uint64(n))
+}
+
+/* seal is where the source writes the n bytes of data of the file it
+   announced with line, sealing them on the way out when the extension
+   is on */
+func (s *session) seal(line string, n int64) (io.Writer, error) {
+	if !s.ext["sealed"] || n == 0 {
+		return s.out, nil
+	}
+	if s.opts.SealTo == nil {
+		return nil, FatalError{Err: ErrNoSealKey}
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, FatalError{Err: err}
+	}
+	shared, err := eph.ECDH(s.opts.SealTo)
+	if err != nil {
+		return nil, FatalError{Err: err}
+	}
+	head := eph.PublicKey().Bytes()
+	aead, err := sealAEAD(shared, head, s.opts.SealTo.Bytes())
+	if err != nil {
+		return nil, FatalError{Err: err}
+	}
+	return &sealer{w: s.out, aead: aead, ad: sealAD(line, n), head: head, left: n}, nil
+}
+
+type sealer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	ad    []byte
+	head  []byte /* written ahead of the first piece */
+	buf   []byte
+	left  int64 /* bytes to be written yet */
+	chunk uint64
+}
+
+func (z *sealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && z.left > 0 {
+		take := SealChunk - len(z.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		if int64(take) > z.left {
+			take = int(z.left)
+		}
+		z.buf = append(z.buf, p[:take]...)
+		p, written, z.left = p[take:], written+take, z.left-int64(take)
+		if len(z.buf) == SealChunk || z.left == 0 {
+			out := z.aead.Seal(z.head, sealNonce(z.aead, z.chunk, z.left == 0), z.buf, z.ad)
+			z.head, z.buf = nil, z.buf[:0]
+			z.chunk++
+			if _, err := z.w.Write(out); err != nil {
+				return written, err
+			}
+		}
+	}
+	if len(p) > 0 {
+		return written, io.ErrShortWrite /* more than announced */
+	}
+	return written, nil
+}
+
+/* open is where the sink reads the n bytes of data of the file announced
+   with line from, opening them when the extension is on */
+func (s *session) open(line string, n int64) io.Reader {
+	if !s.ext["sealed"] || n == 0 {
+		return s.in
+	}
+	return &opener{r: s.in, key: s.opts.OpenWith, ad: sealAD(line, n), left: n}
+}
+
+type opener struct {
+	r     io.Reader
+	key   *ecdh.PrivateKey
+	aead  cipher.AEAD
+	ad    []byte
+	buf   []byte
+	left  int64 /* bytes yet to be opened */
+	chunk uint64
+	err   error /* sticks, the stream is off once a piece is */
+}
+
+func (o *opener) Read(p []byte) (int, error) {
+	if len(o.buf) == 0 {
+		if o.err != nil {
+			return 0, o.err
+		}
+		if o.left == 0 {
+			return 0, io.EOF
+		}
+		if o.err = o.next(); o.err != nil {
+			return 0, o.err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+/* next opens the next piece into buf, taking the key first */
+func (o *opener) next() error {
+	if o.aead == nil {
+		if o.key == nil {
+			return ErrNoSealKey
+		}
+		head := make([]byte, len(o.key.PublicKey().Bytes()))
+		if _, err := io.ReadFull(o.r, head); err != nil {
+			return unexpected(err)
+		}
+		eph, err := ecdh.X25519().NewPublicKey(head)
+		if err != nil {
+			return ErrSealBroken
+		}
+		shared, err := o.key.ECDH(eph)
+		if err != nil {
+			return ErrSealBroken
+		}
+		if o.aead, err = sealAEAD(shared, head, o.key.PublicKey().Bytes()); err != nil {
+			return err
+		}
+	}
+
+	size := int64(SealChunk)
+	if size > o.left {
+		size = o.left
+	}
+	piece := make([]byte, size+int64(o.aead.Overhead()))
+	if _, err := io.ReadFull(o.r, piece); err != nil {
+		return unexpected(err)
+	}
+	buf, err := o.aead.Open(piece[:0], sealNonce(o.aead, o.chunk, size == o.left), piece, o.ad)
+	if err != nil {
+		return ErrSealBroken
+	}
+	o.buf, o.left = buf, o.left-size
+	o.chunk++
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+/* KeyGen makes a key for sealed transfers, returning both halves in hex */
+func KeyGen() (private, public string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(key.Bytes()), hex.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+/* ParseSealKey takes the public half of a key in hex */
+func ParseSealKey(text string) (*ecdh.PublicKey, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+/* ReadOpenKey reads the private half of a key in hex from file */
+func ReadOpenKey(file string) (*ecdh.PrivateKey, error) {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
@@ -0,0 +1,393 @@
+package rscp
+
+import (
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/* Session is a source or sink run over a given transport, see NewSession */
+type Session struct {
+	transport io.ReadWriter
+	opts      Options
+	paths     []string /* source role */
+	target    string   /* sink role */
+	sink      bool
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	closed bool
+}
+
+type SessionOption func(*Session)
+
+var errNoRole = errors.New("session needs AsSource or AsSink")
+
+/* NewSession prepares a session over transport, stdin and stdout when nil */
+func NewSession(transport io.ReadWriter, opts ...SessionOption) *Session {
+	s := &Session{transport: transport}
+	if transport != nil {
+		s.opts.In, s.opts.Out = transport, transport
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func AsSource(paths ...string) SessionOption {
+	return func(s *Session) { s.paths, s.sink = paths, false }
+}
+
+func AsSink(target string) SessionOption {
+	return func(s *Session) { s.target, s.sink = target, true }
+}
+
+func WithRecursive() SessionOption {
+	return func(s *Session) { s.opts.Recursive = true }
+}
+
+func WithPreserve() SessionOption {
+	return func(s *Session) { s.opts.Preserve = true }
+}
+
+/* WithOwner preserves ownership when the peer is rscp, see Options.Owner */
+func WithOwner() SessionOption {
+	return func(s *Session) { s.opts.Owner = true }
+}
+
+/* WithWindowsNames has a sink deal with names Windows cannot take as w says, see WinNames */
+func WithWindowsNames(w WinNames) SessionOption {
+	return func(s *Session) { s.opts.WindowsNames = w }
+}
+
+/* WithIdleTimeout gives up on a peer silent for d, see Options.IdleTimeout */
+func WithIdleTimeout(d time.Duration) SessionOption {
+	return func(s *Session) { s.opts.IdleTimeout = d }
+}
+
+/* WithTimeout ends a transfer taking longer than d, see Options.Timeout */
+func WithTimeout(d time.Duration) SessionOption {
+	return func(s *Session) { s.opts.Timeout = d }
+}
+
+/* WithNormalize has a sink put names into form n, see Options.Normalize */
+func WithNormalize(n Norm) SessionOption {
+	return func(s *Session) { s.opts.Normalize = n }
+}
+
+/* WithNumericIDs has a sink take owners by id, see Options.NumericIDs */
+func WithNumericIDs() SessionOption {
+	return func(s *Session) { s.opts.NumericIDs = true }
+}
+
+/* WithIDOffset has a sink shift the ids of owners by uid and gid, see Options.UidOffset */
+func WithIDOffset(uid, gid int) SessionOption {
+	return func(s *Session) { s.opts.UidOffset, s.opts.GidOffset = uid, gid }
+}
+
+/* WithChown has a sink give all it receives the owner o, see Options.Chown */
+func WithChown(o *Ownership) SessionOption {
+	return func(s *Session) { s.opts.Chown = o }
+}
+
+/* WithXattrs preserves user.* and, when security is set, security.*
+   extended attributes, see Options.Xattrs */
+func WithXattrs(security bool) SessionOption {
+	return func(s *Session) { s.opts.Xattrs, s.opts.SecurityXattrs = true, security }
+}
+
+/* WithACLs preserves POSIX ACLs, taking effect along with WithPreserve */
+func WithACLs() SessionOption {
+	return func(s *Session) { s.opts.ACLs = true }
+}
+
+/* WithLinks sends symlinks as such when the peer is rscp, see Options.Links */
+func WithLinks() SessionOption {
+	return func(s *Session) { s.opts.Links = true }
+}
+
+/* WithNoDereference has the source pass over symlinks instead of following
+   them, see Options.NoDereference */
+func WithNoDereference() SessionOption {
+	return func(s *Session) { s.opts.NoDereference = true }
+}
+
+/* WithDereferenceArgs has the source follow symlinks among the paths it
+   is given and no others, see Options.DereferenceArgs */
+func WithDereferenceArgs() SessionOption {
+	return func(s *Session) { s.opts.DereferenceArgs, s.opts.NoDereference = true, true }
+}
+
+/* WithHardlinks recreates hard links when the peer is rscp, see Options.Hardlinks */
+func WithHardlinks() SessionOption {
+	return func(s *Session) { s.opts.Hardlinks = true }
+}
+
+/* WithSparse sends files with holes sparse when the peer is rscp, see Options.Sparse */
+func WithSparse() SessionOption {
+	return func(s *Session) { s.opts.Sparse = true }
+}
+
+/* WithNanoTimes preserves times to the nanosecond along with WithPreserve */
+func WithNanoTimes() SessionOption {
+	return func(s *Session) { s.opts.NanoTimes = true }
+}
+
+/* WithChecksum verifies each file against its SHA-256 digest when the peer
+   is rscp, removing files failing it if deleteCorrupt is set */
+func WithChecksum(deleteCorrupt bool) SessionOption {
+	return func(s *Session) { s.opts.Checksum, s.opts.DeleteCorrupt = true, deleteCorrupt }
+}
+
+/* WithCompression compresses the transfer when the peer is rscp, see Options.Compress */
+func WithCompression() SessionOption {
+	return func(s *Session) { s.opts.Compress = true }
+}
+
+/* WithStreams sends up to n files at once when the peer is rscp, see Options.Streams */
+func WithStreams(n int) SessionOption {
+	return func(s *Session) { s.opts.Streams = n }
+}
+
+/* WithKeepalive beats every interval of silence when the peer is rscp, see Options.Keepalive */
+func WithKeepalive(interval time.Duration) SessionOption {
+	return func(s *Session) { s.opts.Keepalive = interval }
+}
+
+/* WithResume takes up partial files where they end when the peer is rscp, see Options.Resume */
+func WithResume() SessionOption {
+	return func(s *Session) { s.opts.Resume = true }
+}
+
+/* WithSummary compares what both sides made of the transfer when the peer
+   is rscp and hands both counts to fn, which may be nil; see Options.Summary */
+func WithSummary(fn func(own, peer Tally)) SessionOption {
+	return func(s *Session) { s.opts.Summary, s.opts.OnSummary = true, fn }
+}
+
+/* WithEscapedNames escapes control characters in names when the peer is rscp, see Options.EscapeNames */
+func WithEscapedNames() SessionOption {
+	return func(s *Session) { s.opts.EscapeNames = true }
+}
+
+/* WithNulFraming ends protocol lines with NUL when the peer is rscp, see Options.NulFraming */
+func WithNulFraming() SessionOption {
+	return func(s *Session) { s.opts.NulFraming = true }
+}
+
+/* WithTotals counts what is to be sent first so progress reports totals, see Options.Totals */
+func WithTotals() SessionOption {
+	return func(s *Session) { s.opts.Totals = true }
+}
+
+/* WithSpecials copies FIFOs, sockets and device nodes when the peer is rscp, see Options.Specials */
+func WithSpecials() SessionOption {
+	return func(s *Session) { s.opts.Specials = true }
+}
+
+/* WithSealTo encrypts file data for the holder of the private half of key, see Options.SealTo */
+func WithSealTo(key *ecdh.PublicKey) SessionOption {
+	return func(s *Session) { s.opts.SealTo = key }
+}
+
+/* WithOpenWith decrypts file data sealed to key, see Options.OpenWith */
+func WithOpenWith(key *ecdh.PrivateKey) SessionOption {
+	return func(s *Session) { s.opts.OpenWith = key }
+}
+
+/* WithFileFlags preserves BSD file flags along with WithPreserve when the peer is rscp */
+func WithFileFlags() SessionOption {
+	return func(s *Session) { s.opts.FileFlags = true }
+}
+
+/* WithRscpPeer has extensions offered to the peer, see Options.RscpPeer */
+func WithRscpPeer() SessionOption {
+	return func(s *Session) { s.opts.RscpPeer = true }
+}
+
+/* WithStrict refuses malformed or out of place messages, see Options.Strict */
+func WithStrict() SessionOption {
+	return func(s *Session) { s.opts.Strict = true }
+}
+
+/* WithLenient takes quirks of other scp implementations, see Options.Lenient */
+func WithLenient() SessionOption {
+	return func(s *Session) { s.opts.Lenient = true }
+}
+
+/* WithMaxLineLen gives up on a peer sending protocol lines longer than n bytes */
+func WithMaxLineLen(n int) SessionOption {
+	return func(s *Session) { s.opts.MaxLineLen = n }
+}
+
+/* WithTee has a sink write to dirs as well, see Options.Tee */
+func WithTee(dirs ...string) SessionOption {
+	return func(s *Session) { s.opts.Tee = append(s.opts.Tee, dirs...) }
+}
+
+/* WithInPlace has a sink write into existing files, see Options.InPlace */
+func WithInPlace() SessionOption {
+	return func(s *Session) { s.opts.InPlace = true }
+}
+
+/* WithOnConflict has a sink deal with what it has as c says, see Options.OnConflict */
+func WithOnConflict(c Conflict) SessionOption {
+	return func(s *Session) { s.opts.OnConflict = c }
+}
+
+/* WithUpdate has a sink skip files it has newer, see Options.Update */
+func WithUpdate() SessionOption {
+	return func(s *Session) { s.opts.Update = true }
+}
+
+/* WithCheckSpace has a sink check for free space first, see Options.CheckSpace */
+func WithCheckSpace() SessionOption {
+	return func(s *Session) { s.opts.CheckSpace = true }
+}
+
+/* WithMaxTotalBytes has a sink take no more than n bytes in all, see Options.MaxTotalBytes */
+func WithMaxTotalBytes(n int64) SessionOption {
+	return func(s *Session) { s.opts.MaxTotalBytes = n }
+}
+
+/* WithPreallocate has a sink reserve space for files first, see Options.Preallocate */
+func WithPreallocate() SessionOption {
+	return func(s *Session) { s.opts.Preallocate = true }
+}
+
+/* WithTempDir has a sink receive files into dir first, see Options.TempDir */
+func WithTempDir(dir string) SessionOption {
+	return func(s *Session) { s.opts.TempDir = dir }
+}
+
+/* WithUseUmask has a sink apply its umask to the modes sent, see Options.UseUmask */
+func WithUseUmask() SessionOption {
+	return func(s *Session) { s.opts.UseUmask = true }
+}
+
+/* WithUmask has a sink clear mask from all modes it sets, see Options.Umask */
+func WithUmask(mask os.FileMode) SessionOption {
+	return func(s *Session) { s.opts.Umask = mask }
+}
+
+/* WithNoSpecialBits has a sink clear setuid and setgid bits, see Options.NoSpecialBits */
+func WithNoSpecialBits() SessionOption {
+	return func(s *Session) { s.opts.NoSpecialBits = true }
+}
+
+/* WithMaxFileSize has a sink refuse files of more than n bytes, see Options.MaxFileSize */
+func WithMaxFileSize(n int64) SessionOption {
+	return func(s *Session) { s.opts.MaxFileSize = n }
+}
+
+/* WithDelete has a sink mirror the directories it receives, removing
+   no more than max unless zero, see Options.Delete */
+func WithDelete(max int) SessionOption {
+	return func(s *Session) { s.opts.Delete, s.opts.MaxDelete = true, max }
+}
+
+/* WithTransactional has a sink take each directory whole or not at all,
+   see Options.Transactional */
+func WithTransactional() SessionOption {
+	return func(s *Session) { s.opts.Transactional = true }
+}
+
+/* WithDryRun has a sink write nothing, see Options.DryRun */
+func WithDryRun() SessionOption {
+	return func(s *Session) { s.opts.DryRun = true }
+}
+
+/* WithRequested has a sink refuse what comes at the top of the transfer
+   unless paths, asked of the source, give it; see Options.Requested */
+func WithRequested(paths ...string) SessionOption {
+	return func(s *Session) { s.opts.Requested = paths }
+}
+
+func WithTargetDir() SessionOption {
+	return func(s *Session) { s.opts.TargetDir = true }
+}
+
+/* WithMkdir has the target directory created when missing, see Options.Mkdir */
+func WithMkdir() SessionOption {
+	return func(s *Session) { s.opts.TargetDir, s.opts.Mkdir = true, true }
+}
+
+/* WithParents has what leads to the target created when missing, see Options.Parents */
+func WithParents() SessionOption {
+	return func(s *Session) { s.opts.Parents = true }
+}
+
+/* WithBandwidth limits the transfer to kbits Kbit/s */
+func WithBandwidth(kbits uint) SessionOption {
+	return func(s *Session) { s.opts.BwLimit = kbits }
+}
+
+func WithFS(fs FS) SessionOption {
+	return func(s *Session) { s.opts.FS = fs }
+}
+
+func WithHooks(h Hooks) SessionOption {
+	return func(s *Session) { s.opts.Hooks = h }
+}
+
+func WithStats(st *TransferStats) SessionOption {
+	return func(s *Session) { s.opts.Stats = st }
+}
+
+func WithProgress(ch chan<- Progress, interval time.Duration) SessionOption {
+	return func(s *Session) { s.opts.Progress, s.opts.ProgressInterval = ch, interval }
+}
+
+/* WithResults streams the result of every file to fn, see Options.OnResult */
+func WithResults(fn func(FileResult)) SessionOption {
+	return func(s *Session) { s.opts.OnResult = fn }
+}
+
+/* Options returns the options Run passes to SourceContext or SinkContext */
+func (s *Session) Options() Options {
+	return s.opts
+}
+
+/* Run transfers until done, ctx is done or the session is closed */
+func (s *Session) Run(ctx context.Context) error {
+	if !s.sink && len(s.paths) == 0 {
+		return errNoRole
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return canceledErr
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.mu.Unlock()
+	defer cancel()
+
+	if s.sink {
+		return SinkContext(ctx, s.opts, s.target)
+	}
+	return SourceContext(ctx, s.opts, s.paths)
+}
+
+/* Close aborts a running transfer and closes the transport if it is an io.Closer */
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if c, ok := s.transport.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+/*
+ * SftpFS is an FS on a remote host reached through an SFTP version 3
+ * server, the sftp subsystem of OpenSSH say, for hosts that run no scp.
+ * The source or sink of a transfer then runs here on it. The protocol
+ * is that of github.com/pkg/sftp, which keeps several reads and writes
+ * of a file in flight. Times go to the second, extended attributes,
+ * device nodes and file flags are not supported.
+ */
+type SftpFS struct {
+	c *sftp.Client
+}
+
+var ErrNoSftp = errors.New("SFTP goes over ssh only")
+
+const (
+	SftpChunk  = 32 << 10 /* file data per read or write request */
+	SftpWindow = 64       /* requests for a file in flight at most */
+)
+
+/* NewSftpFS starts an SFTP session with the server reading r and writing w */
+func NewSftpFS(r io.Reader, w io.WriteCloser) (*SftpFS, error) {
+	c, err := sftp.NewClientPipe(r, w,
+		sftp.MaxPacketChecked(SftpChunk),
+		sftp.MaxConcurrentRequestsPerFile(SftpWindow),
+		sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return nil, fmt.Errorf("sftp: %w", err)
+	}
+	return &SftpFS{c}, nil
+}
+
+/* Close ends the session, closing the writer given NewSftpFS */
+func (c *SftpFS) Close() error {
+	return c.c.Close()
+}
+
+/* has tells whether the server has the OpenSSH extension name */
+func (c *SftpFS) has(name string) bool {
+	_, ok := c.c.HasExtension(name)
+	return ok
+}
+
+/* sftpErr is err of the client as the other FS have it, failing op on name */
+func sftpErr(op, name string, err error) error {
+	var status *sftp.StatusError
+	switch {
+	case err == nil, err == io.EOF:
+		return err
+	case errors.As(err, &status):
+		if status.FxCode() == sftp.ErrSSHFxOpUnsupported {
+			err = errors.ErrUnsupported
+		} else {
+			err = errors.New(Sanitize(status.Error())) /* as the server words it */
+		}
+	case errors.Is(err, sftp.ErrSSHFxConnectionLost), errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("sftp: %w", err)
+	}
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (c *SftpFS) Stat(name string) (os.FileInfo, error) {
+	st, err := c.c.Stat(name)
+	return st, sftpErr("stat", name, err)
+}
+
+func (c *SftpFS) Lstat(name string) (os.FileInfo, error) {
+	st, err := c.c.Lstat(name)
+	return st, sftpErr("lstat", name, err)
+}
+
+/* Open opens name for reading, a directory for Readdir */
+func (c *SftpFS) Open(name string) (File, error) {
+	st, err := c.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if st.IsDir() {
+		return &sftpFile{c: c, name: name, dir: true}, nil
+	}
+	f, err := c.c.Open(name)
+	if err != nil {
+		return nil, sftpErr("open", name, err)
+	}
+	return &sftpFile{c: c, name: name, f: f}, nil
+}
+
+/* OpenFile gives a file it creates perm afterwards, the client sending
+   none along */
+func (c *SftpFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	created := flag&os.O_EXCL != 0
+	if flag&os.O_CREATE != 0 && !created {
+		_, err := c.c.Lstat(name)
+		created = errors.Is(err, fs.ErrNotExist)
+	}
+	f, err := c.c.OpenFile(name, flag)
+	if err != nil {
+		return nil, sftpErr("open", name, err)
+	}
+	if created && flag&os.O_CREATE != 0 {
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			return nil, sftpErr("chmod", name, err)
+		}
+	}
+	return &sftpFile{c: c, name: name, f: f}, nil
+}
+
+func (c *SftpFS) Mkdir(name string, perm os.FileMode) error {
+	err := c.c.Mkdir(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		if _, serr := c.c.Lstat(name); serr == nil { /* a failure as far as the protocol goes */
+			return &os.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+	}
+	if err != nil {
+		return sftpErr("mkdir", name, err)
+	}
+	return c.Chmod(name, perm)
+}
+
+func (c *SftpFS) Chmod(name string, perm os.FileMode) error {
+	return sftpErr("chmod", name, c.c.Chmod(name, perm))
+}
+
+func (c *SftpFS) Chtimes(name string, atime, mtime time.Time) error {
+	for _, t := range []time.Time{atime, mtime} {
+		if t.Unix() < 0 || t.Unix() > math.MaxUint32 {
+			return &os.PathError{Op: "chtimes", Path: name, Err: ErrOutOfRange}
+		}
+	}
+	return sftpErr("chtimes", name, c.c.Chtimes(name, atime, mtime))
+}
+
+func (c *SftpFS) Chown(name string, uid, gid int) error {
+	return sftpErr("chown", name, c.c.Chown(name, uid, gid))
+}
+
+/* Lchown is not in the protocol, setting attributes follows symlinks */
+func (c *SftpFS) Lchown(name string, uid, gid int) error {
+	return &os.PathError{Op: "lchown", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (c *SftpFS) Symlink(target, name string) error {
+	return sftpErr("symlink", name, c.c.Symlink(target, name))
+}
+
+/* Link needs the hardlink@openssh.com extension */
+func (c *SftpFS) Link(oldname, newname string) error {
+	if !c.has("hardlink@openssh.com") {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+	}
+	return sftpErr("link", newname, c.c.Link(oldname, newname))
+}
+
+func (c *SftpFS) Readlink(name string) (string, error) {
+	target, err := c.c.ReadLink(name)
+	return target, sftpErr("readlink", name, err)
+}
+
+/* Remove removes a file or else an empty directory */
+func (c *SftpFS) Remove(name string) error {
+	return sftpErr("remove", name, c.c.Remove(name))
+}
+
+/* Rename replaces newname with the posix-rename@openssh.com extension
+   where the server has it; a plain rename fails on an existing newname,
+   which is then removed first and briefly missing */
+func (c *SftpFS) Rename(oldname, newname string) error {
+	if c.has("posix-rename@openssh.com") {
+		return sftpErr("rename", newname, c.c.PosixRename(oldname, newname))
+	}
+	err := c.c.Rename(oldname, newname)
+	if err != nil {
+		if st, serr := c.c.Lstat(newname); serr == nil && !st.IsDir() && c.c.Remove(newname) == nil {
+			err = c.c.Rename(oldname, newname)
+		}
+	}
+	return sftpErr("rename", newname, err)
+}
+
+func (c *SftpFS) Listxattr(name string) ([]string, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (c *SftpFS) Getxattr(name, attr string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (c *SftpFS) Setxattr(name, attr string, value []byte) error {
+	return errors.ErrUnsupported
+}
+
+func (c *SftpFS) Atime(st os.FileInfo) time.Time {
+	if a, ok := st.Sys().(*sftp.FileStat); ok {
+		return a.AccessTime()
+	}
+	return time.Unix(0, 0)
+}
+
+/* Owner takes the ids OpenSSH sends with all attributes */
+func (c *SftpFS) Owner(st os.FileInfo) (int, int, bool) {
+	if a, ok := st.Sys().(*sftp.FileStat); ok {
+		return int(a.UID), int(a.GID), true
+	}
+	return 0, 0, false
+}
+
+func (c *SftpFS) Inode(st os.FileInfo) (uint64, uint64, uint64, bool) {
+	return 0, 0, 0, false
+}
+
+func (c *SftpFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	return &os.PathError{Op: "mknod", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (c *SftpFS) Rdev(st os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
+
+func (c *SftpFS) Flags(st os.FileInfo) (uint32, bool) { return 0, false }
+
+func (c *SftpFS) Chflags(name string, flags uint32) error {
+	return errors.ErrUnsupported
+}
+
+/* Avail needs the statvfs@openssh.com extension */
+func (c *SftpFS) Avail(name string) (int64, error) {
+	if !c.has("statvfs@openssh.com") {
+		return 0, &os.PathError{Op: "statfs", Path: name, Err: errors.ErrUnsupported}
+	}
+	st, err := c.c.StatVFS(name)
+	if err != nil {
+		return 0, sftpErr("statfs", name, err)
+	}
+	return int64(st.Bavail * st.Frsize), nil
+}
+
+/* sftpFile is a File of SftpFS, a directory listed whole on the first Readdir */
+type sftpFile struct {
+	c    *SftpFS
+	name string
+	f    *sftp.File /* nil for a directory */
+
+	dir    bool
+	infos  []os.FileInfo /* of the directory not returned yet */
+	listed bool
+}
+
+func (f *sftpFile) Name() string { return f.name }
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if f.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	n, err := f.f.Read(p)
+	return n, sftpErr("read", f.name, err)
+}
+
+/* WriteTo reads ahead, several requests in flight */
+func (f *sftpFile) WriteTo(w io.Writer) (int64, error) {
+	if f.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	n, err := f.f.WriteTo(w)
+	return n, sftpErr("read", f.name, err)
+}
+
+func (f *sftpFile) Write(p []byte) (int, error) {
+	if f.dir {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EISDIR}
+	}
+	n, err := f.f.Write(p)
+	return n, sftpErr("write", f.name, err)
+}
+
+/* ReadFrom writes behind, several requests in flight */
+func (f *sftpFile) ReadFrom(r io.Reader) (int64, error) {
+	if f.dir {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EISDIR}
+	}
+	n, err := f.f.ReadFrom(r)
+	return n, sftpErr("write", f.name, err)
+}
+
+func (f *sftpFile) Seek(offset int64, whence int) (int64, error) {
+	switch {
+	case f.dir:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EISDIR}
+	case whence > io.SeekEnd: /* no holes to be told */
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.ErrUnsupported}
+	}
+	off, err := f.f.Seek(offset, whence)
+	return off, sftpErr("seek", f.name, err)
+}
+
+func (f *sftpFile) Stat() (os.FileInfo, error) {
+	if f.dir { /* OpenSSH takes no FSTAT of directory handles */
+		return f.c.Stat(f.name)
+	}
+	st, err := f.f.Stat()
+	if err != nil {
+		return nil, sftpErr("stat", f.name, err)
+	}
+	return st, nil
+}
+
+func (f *sftpFile) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.dir {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if !f.listed {
+		infos, err := f.c.c.ReadDir(f.name)
+		if err != nil {
+			return nil, sftpErr("readdir", f.name, err)
+		}
+		f.infos, f.listed = infos, true
+	}
+
+	infos := f.infos
+	if n > 0 {
+		if len(infos) == 0 {
+			return nil, io.EOF
+		}
+		if len(infos) > n {
+			infos = infos[:n]
+		}
+	}
+	f.infos = f.infos[len(infos):]
+	return infos, nil
+}
+
+func (f *sftpFile) Truncate(size int64) error {
+	if f.dir {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EISDIR}
+	}
+	return sftpErr("truncate", f.name, f.f.Truncate(size))
+}
+
+func (f *sftpFile) Chmod(mode os.FileMode) error {
+	if f.dir {
+		return f.c.Chmod(f.name, mode)
+	}
+	return sftpErr("chmod", f.name, f.f.Chmod(mode))
+}
+
+/* Sync has the server sync when it has the fsync@openssh.com extension */
+func (f *sftpFile) Sync() error {
+	if f.dir || !f.c.has("fsync@openssh.com") {
+		return nil
+	}
+	return sftpErr("sync", f.name, f.f.Sync())
+}
+
+func (f *sftpFile) Close() error {
+	if f.dir {
+		return nil
+	}
+	return sftpErr("close", f.name, f.f.Close())
+}
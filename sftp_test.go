@@ -0,0 +1,286 @@
+package rscp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+/* sftpServe is an SftpFS on a server of the host file system over pipes,
+   and the server to close for the connection to drop */
+func sftpServe(t *testing.T) (*SftpFS, *sftp.Server) {
+	t.Helper()
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverIn, serverOut})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	c, err := NewSftpFS(clientIn, clientOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close() /* the client waits for the end of what the server sends */
+		c.Close()
+	})
+	return c, server
+}
+
+/* sftpTree is a directory with files larger than the requests in flight
+   at once, of sizes off their chunks, and empty ones */
+func sftpTree(t *testing.T) (dir string, files map[string][]byte) {
+	t.Helper()
+	dir = filepath.ToSlash(t.TempDir())
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, SftpChunk*SftpWindow*2+12345)
+	rnd.Read(big)
+	files = map[string][]byte{
+		"big":       big,
+		"chunk":     big[:SftpChunk],
+		"odd":       big[:SftpChunk+1],
+		"empty":     nil,
+		"sub/small": []byte("small"),
+		"sub/empty": nil,
+	}
+	os.Mkdir(path.Join(dir, "sub"), 0750)
+	for name, data := range files {
+		if err := os.WriteFile(path.Join(dir, name), data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, files
+}
+
+/* A tree goes up to an SFTP server and down from it whole, modes and
+   times preserved */
+func TestSftpCopy(t *testing.T) {
+	c, _ := sftpServe(t)
+	src, files := sftpTree(t)
+	mtime := time.Unix(1500000000, 0)
+	os.Chtimes(path.Join(src, "big"), mtime, mtime)
+
+	up := filepath.ToSlash(t.TempDir())
+	down := filepath.ToSlash(t.TempDir())
+	opts := Options{Recursive: true, Preserve: true}
+	if err := LoopbackFS(context.Background(), opts, OsFS{}, []string{src}, c, up); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if err := LoopbackFS(context.Background(), opts, c, []string{path.Join(up, path.Base(src))}, OsFS{}, down); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	for _, dir := range []string{up, down} {
+		top := path.Join(dir, path.Base(src))
+		for name, data := range files {
+			got, err := os.ReadFile(path.Join(top, name))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s: %d bytes, %v, want %d", path.Join(top, name), len(got), err, len(data))
+			}
+		}
+		st, err := os.Stat(path.Join(top, "big"))
+		if err != nil || st.Mode().Perm() != 0640 || !st.ModTime().Equal(mtime) {
+			t.Errorf("%s/big: %v, want mode 0640 and time %v", top, st, mtime)
+		}
+		if st, err := os.Stat(path.Join(top, "sub")); err != nil || st.Mode().Perm() != 0750 {
+			t.Errorf("%s/sub: %v, want mode 0750", top, st)
+		}
+	}
+}
+
+/* Reads of any size take the data in order, after seeks too, and a
+   file is written whole through writes of any size */
+func TestSftpReadWrite(t *testing.T) {
+	c, _ := sftpServe(t)
+	dir, files := sftpTree(t)
+	big := files["big"]
+
+	f, err := c.Open(path.Join(dir, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	buf := make([]byte, 1000) /* short of a chunk and not dividing it */
+	for {
+		n, err := f.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, big) {
+		t.Errorf("read %d bytes in short reads, want %d", len(got), len(big))
+	}
+	if off, err := f.Seek(SftpChunk-3, io.SeekStart); err != nil || off != SftpChunk-3 {
+		t.Fatalf("seek: %d, %v", off, err)
+	}
+	if _, err := io.ReadFull(f, buf[:6]); err != nil || !bytes.Equal(buf[:6], big[SftpChunk-3:SftpChunk+3]) {
+		t.Errorf("read across a chunk after seeking: %v", err)
+	}
+	if off, err := f.Seek(-1, io.SeekEnd); err != nil || off != int64(len(big))-1 {
+		t.Errorf("seek from the end: %d, %v", off, err)
+	}
+	if _, err := f.Seek(0, 3); !errors.Is(err, errors.ErrUnsupported) { /* SEEK_DATA */
+		t.Errorf("seek for data: %v, want unsupported", err)
+	}
+	f.Close()
+
+	name := path.Join(dir, "written")
+	w, err := c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, n := big, 1; len(p) > 0; n *= 3 {
+		n = min(n, len(p))
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Truncate(int64(len(big)) - 10); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(name); !bytes.Equal(got, big[:len(big)-10]) {
+		t.Errorf("written %d bytes, want %d", len(got), len(big)-10)
+	}
+	if st, err := os.Stat(name); err != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("created with %v, want 0600", st.Mode())
+	}
+
+	/* the modes of files opened but not created stay */
+	if f, err := c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		t.Error(err)
+	} else {
+		f.Close()
+	}
+	if st, err := os.Stat(name); err != nil || st.Mode().Perm() != 0600 {
+		t.Errorf("reopened with %v, want 0600 kept", st.Mode())
+	}
+}
+
+/* Status codes of the server come back as the errors of the host file
+   system, naming what failed */
+func TestSftpErrors(t *testing.T) {
+	c, _ := sftpServe(t)
+	dir, _ := sftpTree(t)
+
+	missing := path.Join(dir, "missing")
+	var pe *os.PathError
+	if _, err := c.Stat(missing); !errors.Is(err, fs.ErrNotExist) || !errors.As(err, &pe) || pe.Path != missing {
+		t.Errorf("stat: %v, want %s not existing", err, missing)
+	}
+	if _, err := c.Open(missing); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("open: %v", err)
+	}
+	if err := c.Mkdir(path.Join(dir, "sub"), 0755); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("mkdir of an existing directory: %v", err)
+	}
+	if err := c.Mkdir(path.Join(missing, "sub"), 0755); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("mkdir in a missing directory: %v", err)
+	}
+	if err := c.Remove(path.Join(dir, "sub")); err == nil {
+		t.Errorf("removed a directory not empty")
+	}
+	if _, err := c.OpenFile(path.Join(dir, "big"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+		t.Errorf("exclusive create of an existing file")
+	}
+	if err := c.Lchown(path.Join(dir, "big"), 0, 0); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("lchown: %v", err)
+	}
+	d, err := c.Open(path.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Read(make([]byte, 1)); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("read of a directory: %v", err)
+	}
+	infos, err := d.Readdir(1)
+	if err != nil || len(infos) != 1 {
+		t.Errorf("readdir: %d, %v", len(infos), err)
+	}
+	if infos, err = d.Readdir(1); err != nil || len(infos) != 1 {
+		t.Errorf("readdir on: %d, %v", len(infos), err)
+	}
+	if _, err = d.Readdir(1); err != io.EOF {
+		t.Errorf("readdir past the end: %v", err)
+	}
+	d.Close()
+}
+
+/* Renames replace what is there, hard links and free space come with
+   the extensions of OpenSSH */
+func TestSftpExtensions(t *testing.T) {
+	c, _ := sftpServe(t)
+	dir, files := sftpTree(t)
+
+	if err := c.Rename(path.Join(dir, "sub/small"), path.Join(dir, "odd")); err != nil {
+		t.Error(err)
+	}
+	if got, _ := os.ReadFile(path.Join(dir, "odd")); !bytes.Equal(got, files["sub/small"]) {
+		t.Errorf("rename did not replace the file")
+	}
+	if err := c.Link(path.Join(dir, "odd"), path.Join(dir, "link")); err != nil {
+		t.Error(err)
+	}
+	a, _ := os.Stat(path.Join(dir, "odd"))
+	if b, err := os.Stat(path.Join(dir, "link")); err != nil || !os.SameFile(a, b) {
+		t.Errorf("link: %v", err)
+	}
+	if n, err := c.Avail(dir); err != nil || n <= 0 {
+		t.Errorf("avail: %d, %v", n, err)
+	}
+	if err := c.Symlink("odd", path.Join(dir, "symlink")); err != nil {
+		t.Error(err)
+	}
+	if target, err := c.Readlink(path.Join(dir, "symlink")); err != nil || target != "odd" {
+		t.Errorf("readlink: %q, %v", target, err)
+	}
+}
+
+/* A connection dropping fails what is underway rather than hanging it */
+func TestSftpDropped(t *testing.T) {
+	c, server := sftpServe(t)
+	dir, _ := sftpTree(t)
+
+	f, err := c.Open(path.Join(dir, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, f)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("read the file whole off a closed connection")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("read hangs")
+	}
+	if _, err := c.Stat(dir); err == nil {
+		t.Errorf("stat on a closed connection")
+	}
+}
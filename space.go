@@ -0,0 +1,48 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+var ErrNoSpace = errors.New("insufficient space")
+
+/* With CheckSpace the sink goes by what the file system of the target
+   has free for unprivileged users, as statfs tells; where that can not
+   be told nothing is checked. What existing files free by being
+   replaced is not counted, that comes too late. */
+
+/* checkSpace fails the file of size coming as name when its file system
+   has no room for it; in place and resumed the data already there is
+   taken as written, a sparse file needs its data alone */
+func (s *session) checkSpace(name string, size int64, pend attrs) error {
+	if !s.opts.CheckSpace {
+		return nil
+	}
+	need := size
+	if pend.sparse {
+		need = extentsLen(pend.extents)
+	}
+	if s.opts.InPlace || s.ext["resume"] {
+		if st, err := s.fs.Stat(name); err == nil && st.Mode().IsRegular() {
+			need -= st.Size()
+		}
+	}
+	return s.room(name, path.Dir(name), need)
+}
+
+/* room fails name needing need bytes more than dir has free */
+func (s *session) room(name, dir string, need int64) error {
+	if need <= 0 {
+		return nil
+	}
+	have, err := s.fs.Avail(dir)
+	if err != nil {
+		return nil /* the writes tell */
+	}
+	if need > have {
+		return fmt.Errorf("%s: %w: need %d bytes, have %d", name, ErrNoSpace, need, have)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package rscp
+
+import (
+	"errors"
+	"os"
+)
+
+func availSpace(name string) (int64, error) {
+	return 0, &os.PathError{Op: "statfs", Path: name, Err: errors.ErrUnsupported}
+}
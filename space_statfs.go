@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package rscp
+
+import (
+	"os"
+	"syscall"
+)
+
+func availSpace(name string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(name, &st); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: name, Err: err}
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,130 @@
+package rscp
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+const (
+	MaxExtents       = 1 << 16 /* per file, files with more are sent dense */
+	MaxExtentsPerMsg = protocol.MaxExtentsPerMsg
+)
+
+/* dataExtents finds the data of f up to size, false where holes can't be told */
+func dataExtents(f File, size int64) ([]protocol.Extent, bool) {
+	if seekData < 0 {
+		return nil, false
+	}
+	defer f.Seek(0, io.SeekStart)
+
+	var exts []protocol.Extent
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, seekData)
+		if errors.Is(err, errNoMoreData) {
+			break
+		} else if err != nil || data >= size {
+			return exts, err == nil
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, false
+		}
+		if hole > size {
+			hole = size
+		}
+		exts = append(exts, protocol.Extent{Off: data, Len: hole - data})
+		off = hole
+	}
+	return exts, true
+}
+
+/* extents tells the data of a file worth sending sparse */
+func (s *session) extents(f File, st os.FileInfo) ([]protocol.Extent, bool) {
+	if !s.ext["sparse"] || !st.Mode().IsRegular() {
+		return nil, false
+	}
+	exts, ok := dataExtents(f, st.Size())
+	if !ok || len(exts) > MaxExtents || len(exts) == 1 && exts[0] == (protocol.Extent{Off: 0, Len: st.Size()}) {
+		return nil, false
+	}
+	return exts, true
+}
+
+/* sendExtents sends K messages, at least one even for a file of holes only */
+func (s *session) sendExtents(exts []protocol.Extent) error {
+	for first := true; first || len(exts) > 0; first = false {
+		n := min(len(exts), MaxExtentsPerMsg)
+		if err := s.enc.Encode(protocol.KMsg{Extents: exts[:n]}); err != nil {
+			return err
+		}
+		if err := s.ack(); err != nil {
+			return err
+		}
+		exts = exts[n:]
+	}
+	return nil
+}
+
+/* checkExtents refuses extents out of order or past size */
+func checkExtents(exts []protocol.Extent, size int64) error {
+	end := int64(0)
+	for _, e := range exts {
+		if e.Off < end || e.Len > size-e.Off {
+			return protocolErr
+		}
+		end = e.Off + e.Len
+	}
+	return nil
+}
+
+func extentsLen(exts []protocol.Extent) int64 {
+	var n int64
+	for _, e := range exts {
+		n += e.Len
+	}
+	return n
+}
+
+/* extentReader reads the extents of f one after the other */
+type extentReader struct {
+	f    File
+	exts []protocol.Extent
+	cur  io.Reader
+}
+
+func (r *extentReader) Read(p []byte) (int, error) {
+	for r.cur == nil {
+		if len(r.exts) == 0 {
+			return 0, io.EOF
+		}
+		e := r.exts[0]
+		if _, err := r.f.Seek(e.Off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.cur = io.LimitReader(r.f, e.Len)
+	}
+	n, err := r.cur.Read(p)
+	if err == io.EOF {
+		if r.cur.(*io.LimitedReader).N > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		r.cur, r.exts, err = nil, r.exts[1:], nil
+	}
+	return n, err
+}
+
+/* writeExtents writes data into the extents of f, leaving holes between them */
+func writeExtents(f File, w io.Writer, data io.Reader, exts []protocol.Extent) error {
+	for _, e := range exts {
+		if _, err := f.Seek(e.Off, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, data, e.Len); err != nil {
+			return err
+		}
+	}
+	return nil
+}
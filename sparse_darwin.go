@@ -0,0 +1,12 @@
+package rscp
+
+import (
+	"syscall"
+)
+
+const (
+	seekHole = 3
+	seekData = 4
+)
+
+var errNoMoreData = syscall.ENXIO
@@ -0,0 +1,15 @@
+//go:build !(linux || freebsd || dragonfly || solaris || illumos || darwin)
+
+package rscp
+
+import (
+	"errors"
+)
+
+/* holes can't be told here */
+const (
+	seekData = -1
+	seekHole = -1
+)
+
+var errNoMoreData = errors.New("no more data")
@@ -0,0 +1,14 @@
+//go:build linux || freebsd || dragonfly || solaris || illumos
+
+package rscp
+
+import (
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+var errNoMoreData = syscall.ENXIO
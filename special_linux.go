@@ -0,0 +1,48 @@
+package rscp
+
+import (
+	"os"
+	"syscall"
+)
+
+const atFdcwd = -100 /* AT_FDCWD */
+
+/* device numbers split and joined the way glibc does */
+func statRdev(st os.FileInfo) (major, minor uint32, ok bool) {
+	if sysStat, ok := st.Sys().(*syscall.Stat_t); ok {
+		dev := uint64(sysStat.Rdev)
+		return uint32(dev>>8&0xfff | dev>>32&^0xfff), uint32(dev&0xff | dev>>12&^0xff), true
+	}
+	return 0, 0, false
+}
+
+func mknod(name string, mode os.FileMode, major, minor uint32) error {
+	return mknodat(nil, name, mode, major, minor)
+}
+
+/* mknodat is mknod with name relative to dir, the working directory when
+   nil */
+func mknodat(dir *os.File, name string, mode os.FileMode, major, minor uint32) error {
+	var typ uint32
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		typ = syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		typ = syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		typ = syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		typ = syscall.S_IFBLK
+	default:
+		return &os.PathError{Op: "mknod", Path: name, Err: syscall.EINVAL}
+	}
+	dev := uint64(major&0xfff)<<8 | uint64(major&^0xfff)<<32 | uint64(minor&0xff) | uint64(minor&^0xff)<<12
+	fd := atFdcwd
+	if dir != nil {
+		fd = int(dir.Fd())
+	}
+	if err := syscall.Mknodat(fd, name, typ|uint32(mode.Perm()), int(dev)); err != nil {
+		return &os.PathError{Op: "mknod", Path: name, Err: err}
+	}
+	return nil
+}
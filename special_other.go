@@ -0,0 +1,20 @@
+//go:build !unix
+
+package rscp
+
+import (
+	"errors"
+	"os"
+)
+
+func statRdev(st os.FileInfo) (major, minor uint32, ok bool) {
+	return 0, 0, false
+}
+
+func mknodat(dir *os.File, name string, mode os.FileMode, major, minor uint32) error {
+	return &os.PathError{Op: "mknod", Path: name, Err: errors.ErrUnsupported}
+}
+
+func mknod(name string, mode os.FileMode, major, minor uint32) error {
+	return &os.PathError{Op: "mknod", Path: name, Err: errors.ErrUnsupported}
+}
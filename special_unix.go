@@ -0,0 +1,34 @@
+//go:build unix && !linux
+
+package rscp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+/* device numbers are laid out differently on every BSD, only FIFOs are made here */
+func statRdev(st os.FileInfo) (major, minor uint32, ok bool) {
+	return 0, 0, false
+}
+
+/* mknodat is mknod with name relative to dir, there being no mknodat
+   nor mkfifoat in syscall here: its name is taken as it is */
+func mknodat(dir *os.File, name string, mode os.FileMode, major, minor uint32) error {
+	if dir != nil {
+		name = filepath.Join(dir.Name(), name)
+	}
+	return mknod(name, mode, major, minor)
+}
+
+func mknod(name string, mode os.FileMode, major, minor uint32) error {
+	if mode&os.ModeNamedPipe == 0 {
+		return &os.PathError{Op: "mknod", Path: name, Err: errors.ErrUnsupported}
+	}
+	if err := syscall.Mknod(name, syscall.S_IFIFO|uint32(mode.Perm()), 0); err != nil {
+		return &os.PathError{Op: "mknod", Path: name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+var ErrNoDeviceNumbers = errors.New("device numbers unknown")
+
+func isSpecial(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice) != 0
+}
+
+/* sendSpecial sends the FIFO, socket or device node local in an F message */
+func (s *session) sendSpecial(local string, st os.FileInfo) error {
+	var major, minor uint32
+	if st.Mode()&os.ModeDevice != 0 {
+		var ok bool
+		if major, minor, ok = s.fs.Rdev(st); !ok {
+			return s.teeError(fmt.Errorf("%s: %w", local, ErrNoDeviceNumbers))
+		}
+	}
+	name, err := s.wireName(st.Name())
+	if err != nil {
+		return s.teeError(err)
+	}
+	if err := s.sendAttrs(local, st); err != nil {
+		return err
+	}
+	if err := s.enc.Encode(protocol.FMsg{Mode: st.Mode(), Major: major, Minor: minor, Name: name}); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+func (s *session) sinkSpecial(name, line string, pend attrs) error {
+	var m protocol.FMsg
+	var err error
+	if err = m.UnmarshalText([]byte(line)); err != nil || !s.ext["specials"] {
+		return s.teeError(protocolErr)
+	}
+	if m.Name, err = s.localName(m.Name); err != nil {
+		return s.teeError(err)
+	}
+	if err = s.requested(name, m.Name); err != nil {
+		return s.teeError(err)
+	}
+
+	if st, err := s.fs.Stat(name); err == nil && st.IsDir() {
+		if name, err = s.winName(path.Join(name, m.Name)); err != nil {
+			return s.fileDone(name, s.teeError(err))
+		}
+	}
+	s.mirror.keep(name)
+	if skip, err := s.onConflict(name); skip {
+		return s.skipEntry(name)
+	} else if err != nil {
+		return s.fileDone(name, s.teeError(err))
+	}
+	s.fileStart(name, 0, m.Mode)
+	m.Mode &^= s.mask()
+
+	if st, err := s.fs.Lstat(name); err == nil {
+		if st.IsDir() {
+			return s.fileDone(name, s.teeError(&os.PathError{Op: "mknod", Path: name, Err: ErrIsDirectory}))
+		}
+		if err := s.fs.Remove(name); err != nil {
+			return s.fileDone(name, s.teeError(err))
+		}
+	}
+	if err := s.fs.Mknod(name, m.Mode, m.Major, m.Minor); err != nil {
+		return s.fileDone(name, s.teeError(err))
+	}
+	if errs := s.setAttrs(name, m.Mode&^os.ModeType, true, pend); len(errs) > 0 {
+		return s.fileDone(name, s.teeError(AccError{errs}))
+	}
+	return s.fileDone(name, s.enc.Ack())
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package rscp
+
+import (
+	"os"
+)
+
+const oHandle = 0
+
+func statOwner(st os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func statInode(st os.FileInfo) (dev, ino, nlink uint64, ok bool) {
+	return 0, 0, 0, false
+}
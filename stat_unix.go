@@ -0,0 +1,26 @@
+//go:build unix
+
+package rscp
+
+import (
+	"os"
+	"syscall"
+)
+
+/* oHandle opens a file only for calls on its descriptor: not through a
+   symlink it is, nor waiting for a writer to a FIFO */
+const oHandle = syscall.O_NOFOLLOW | syscall.O_NONBLOCK
+
+func statOwner(st os.FileInfo) (uid, gid int, ok bool) {
+	if sysStat, ok := st.Sys().(*syscall.Stat_t); ok {
+		return int(sysStat.Uid), int(sysStat.Gid), true
+	}
+	return 0, 0, false
+}
+
+func statInode(st os.FileInfo) (dev, ino, nlink uint64, ok bool) {
+	if sysStat, ok := st.Sys().(*syscall.Stat_t); ok {
+		return uint64(sysStat.Dev), uint64(sysStat.Ino), uint64(sysStat.Nlink), true
+	}
+	return 0, 0, 0, false
+}
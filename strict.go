@@ -0,0 +1,51 @@
+package rscp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/* messages setting attributes of the next C, D or F message */
+const attrKinds = "TNOAPIUK"
+
+var strictFields = map[byte]*regexp.Regexp{
+	'C': regexp.MustCompile(`^C[0-7]{4} [0-9]{1,19} `),
+	'D': regexp.MustCompile(`^D[0-7]{4} 0 `),
+	'T': regexp.MustCompile(`^T[0-9]{1,19} [0-9]{1,6} [0-9]{1,19} [0-9]{1,6}$`),
+	'F': regexp.MustCompile(`^F[pscb][0-7]{4} [0-9]{1,10} [0-9]{1,10} `),
+}
+
+/* checkStrict refuses what the sink tolerates unless Options.Strict is
+   set, line being the next message and pend what came ahead of it */
+func checkStrict(line string, pend attrs) error {
+	kind := line[0]
+	if re := strictFields[kind]; re != nil && !re.MatchString(line) {
+		return strictErr("malformed %c message", kind)
+	}
+	switch {
+	case (kind == 'T' || kind == 'N') && pend.times != nil,
+		kind == 'O' && pend.owner != nil,
+		kind == 'I' && pend.link != nil,
+		kind == 'U' && pend.flags != nil:
+		return strictErr("duplicate %c message", kind)
+	}
+	if !strings.ContainsRune(attrKinds+"CDF", rune(kind)) {
+		return checkPending(pend)
+	}
+	return nil
+}
+
+/* checkPending refuses attributes left without a C, D or F message to go with */
+func checkPending(pend attrs) error {
+	if pend.times != nil || pend.owner != nil || pend.xattrs != nil || pend.acls != nil ||
+		pend.link != nil || pend.flags != nil || pend.sparse {
+
+		return strictErr("attributes not followed by C, D or F")
+	}
+	return nil
+}
+
+func strictErr(format string, args ...any) error {
+	return FatalError{Err: fmt.Errorf("%w: %s", ErrProtocol, fmt.Sprintf(format, args...))}
+}
@@ -0,0 +1,72 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* Tally counts what one side of a transfer went through */
+type Tally = protocol.Tally
+
+var (
+	ErrPeerFailed      = errors.New("files failed at the peer")
+	ErrSummaryMismatch = errors.New("peer counted differently")
+)
+
+/* sendSummary sends the tally of the source once the last file is through
+   and compares it with the one the sink replies */
+func (s *session) sendSummary() error {
+	if err := s.enc.Encode(protocol.SMsg{Tally: s.tally}); err != nil {
+		return err
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	line, err := s.dec.Next()
+	if err == io.EOF {
+		return FatalError{Err: io.ErrUnexpectedEOF}
+	} else if err != nil {
+		return err
+	}
+	if line[0] == '\x01' || line[0] == '\x02' {
+		return FatalError{Err: RemoteError{Msg: line[1:]}}
+	}
+	var m protocol.SMsg
+	if err := m.UnmarshalText([]byte(line)); err != nil {
+		return err
+	}
+	return s.compare(m.Tally)
+}
+
+/* sinkSummary answers the tally of the source with that of the sink */
+func (s *session) sinkSummary(line string) error {
+	var m protocol.SMsg
+	if err := m.UnmarshalText([]byte(line)); err != nil || !s.ext["summary"] {
+		return s.teeError(protocolErr)
+	}
+	if err := s.enc.Encode(protocol.SMsg{Tally: s.tally}); err != nil {
+		return err
+	}
+	return s.compare(m.Tally)
+}
+
+/* compare makes the run fail on both sides when either counted failures,
+   or when the counts differ although neither did */
+func (s *session) compare(peer Tally) error {
+	own := s.tally
+	if s.opts.OnSummary != nil {
+		s.opts.OnSummary(own, peer)
+	}
+	switch {
+	case own.Failed > 0:
+		return nil /* failing anyway */
+	case peer.Failed > 0:
+		return fmt.Errorf("%d %w", peer.Failed, ErrPeerFailed)
+	case own.Files != peer.Files || own.Bytes != peer.Bytes:
+		return fmt.Errorf("%w: %v here, %v there", ErrSummaryMismatch, own, peer)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package rscp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+/* teeFS has a sink write to each of tees what it writes under target,
+   names under target standing for the same names under the tees. Reads
+   go to target alone, what is already there is told by the first target.
+   An operation fails when it fails on any of them. */
+type teeFS struct {
+	FS
+	target string
+	tees   []string
+}
+
+/* teeTo has the sink into target write to opts.Tee too; with TargetDir
+   or a directory as target the tees must be directories as well */
+func (s *session) teeTo(target string) error {
+	if len(s.opts.Tee) == 0 {
+		return nil
+	}
+	if st, err := s.fs.Stat(target); err == nil && st.IsDir() || s.opts.TargetDir {
+		for _, tee := range s.opts.Tee {
+			if err := makeDirs(s.fs, s.opts, tee); err != nil {
+				return FatalError{Err: err}
+			}
+			if st, err := s.fs.Stat(tee); err != nil {
+				return FatalError{Err: err}
+			} else if !st.IsDir() {
+				return FatalError{Err: fmt.Errorf("%s: %w", tee, ErrNotDirectory)}
+			}
+		}
+	}
+	s.fs = &teeFS{s.fs, path.Clean(target), s.opts.Tee}
+	return nil
+}
+
+/* names are those of name in the tees, none outside target but for
+   the temporary files of target itself */
+func (t *teeFS) names(name string) []string {
+	if strings.HasPrefix(name, tempPrefix(t.target)) {
+		names := make([]string, len(t.tees))
+		for i, tee := range t.tees {
+			names[i] = tempPrefix(tee) + name[len(tempPrefix(t.target)):]
+		}
+		return names
+	}
+	rest, ok := beneath(t.target, name)
+	if !ok {
+		return nil
+	}
+	names := make([]string, len(t.tees))
+	for i, tee := range t.tees {
+		names[i] = path.Join(tee, rest)
+	}
+	return names
+}
+
+/* each runs op on name and the same name in the tees */
+func (t *teeFS) each(name string, op func(name string) error) error {
+	err := op(name)
+	for _, tee := range t.names(name) {
+		if terr := op(tee); err == nil {
+			err = terr
+		}
+	}
+	return err
+}
+
+func (t *teeFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := t.FS.OpenFile(name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	tf := &teeFile{File: f}
+	for _, tee := range t.names(name) {
+		f, err := t.FS.OpenFile(tee, flag, perm)
+		if err != nil {
+			tf.Close()
+			return nil, err
+		}
+		tf.tees = append(tf.tees, f)
+	}
+	return tf, nil
+}
+
+func (t *teeFS) Mkdir(name string, perm os.FileMode) error {
+	return t.each(name, func(name string) error { return t.FS.Mkdir(name, perm) })
+}
+
+func (t *teeFS) Chmod(name string, perm os.FileMode) error {
+	return t.each(name, func(name string) error { return t.FS.Chmod(name, perm) })
+}
+
+func (t *teeFS) Chtimes(name string, atime, mtime time.Time) error {
+	return t.each(name, func(name string) error { return t.FS.Chtimes(name, atime, mtime) })
+}
+
+func (t *teeFS) Chown(name string, uid, gid int) error {
+	return t.each(name, func(name string) error { return t.FS.Chown(name, uid, gid) })
+}
+
+func (t *teeFS) Lchown(name string, uid, gid int) error {
+	return t.each(name, func(name string) error { return t.FS.Lchown(name, uid, gid) })
+}
+
+func (t *teeFS) Symlink(target, name string) error {
+	return t.each(name, func(name string) error { return t.FS.Symlink(target, name) })
+}
+
+/* pair runs op on oldname and newname and the same two in each tee,
+   in those having both */
+func (t *teeFS) pair(oldname, newname string, op func(oldname, newname string) error) error {
+	err := op(oldname, newname)
+	olds, news := t.names(oldname), t.names(newname)
+	for i := range news {
+		if i >= len(olds) {
+			break
+		}
+		if terr := op(olds[i], news[i]); err == nil {
+			err = terr
+		}
+	}
+	return err
+}
+
+func (t *teeFS) Link(oldname, newname string) error {
+	return t.pair(oldname, newname, t.FS.Link)
+}
+
+func (t *teeFS) Rename(oldname, newname string) error {
+	return t.pair(oldname, newname, t.FS.Rename)
+}
+
+func (t *teeFS) Remove(name string) error {
+	return t.each(name, t.FS.Remove)
+}
+
+func (t *teeFS) Setxattr(name, attr string, value []byte) error {
+	return t.each(name, func(name string) error { return t.FS.Setxattr(name, attr, value) })
+}
+
+func (t *teeFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	return t.each(name, func(name string) error { return t.FS.Mknod(name, mode, major, minor) })
+}
+
+func (t *teeFS) Chflags(name string, flags uint32) error {
+	return t.each(name, func(name string) error { return t.FS.Chflags(name, flags) })
+}
+
+/* Avail is the least any of them has */
+func (t *teeFS) Avail(name string) (int64, error) {
+	avail, err := t.FS.Avail(name)
+	for _, tee := range t.names(name) {
+		n, terr := t.FS.Avail(tee)
+		if err == nil {
+			avail, err = min(avail, n), terr
+		}
+	}
+	return avail, err
+}
+
+/* teeFile writes to its File and the tees alike, reads from its File alone */
+type teeFile struct {
+	File
+	tees []File
+}
+
+func (f *teeFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	for _, tee := range f.tees {
+		if _, terr := tee.Write(p[:n]); err == nil {
+			err = terr
+		}
+	}
+	return n, err
+}
+
+func (f *teeFile) Seek(offset int64, whence int) (int64, error) {
+	off, err := f.File.Seek(offset, whence)
+	if err != nil {
+		return off, err
+	}
+	for _, tee := range f.tees {
+		if _, err := tee.Seek(off, io.SeekStart); err != nil {
+			return off, err
+		}
+	}
+	return off, nil
+}
+
+/* all runs op on its File and the tees */
+func (f *teeFile) all(op func(File) error) error {
+	err := op(f.File)
+	for _, tee := range f.tees {
+		if terr := op(tee); err == nil {
+			err = terr
+		}
+	}
+	return err
+}
+
+func (f *teeFile) Truncate(size int64) error {
+	return f.all(func(f File) error { return f.Truncate(size) })
+}
+
+func (f *teeFile) Sync() error {
+	return f.all(File.Sync)
+}
+
+func (f *teeFile) Chmod(mode os.FileMode) error {
+	return f.all(func(f File) error { return f.Chmod(mode) })
+}
+
+func (f *teeFile) Close() error {
+	return f.all(File.Close)
+}
@@ -0,0 +1,111 @@
+package rscp
+
+import (
+	"os"
+	"path"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+/* scan counts the files below paths and their data, what Progress
+   reports as the totals of the transfer. Sparse files and resumed ones
+   count in full, entries failing to stat do not count at all. */
+func (s *session) scan(paths []string) (files int, bytes int64) {
+	seen, entered := map[inode]bool{}, map[inode]bool{}
+
+	var visit func(local string, top bool)
+	visit = func(local string, top bool) {
+		stat := s.fs.Stat
+		if !s.follows(top) {
+			stat = s.fs.Lstat
+		}
+		st, err := stat(local)
+		if err != nil {
+			return
+		}
+		if st.Mode()&os.ModeSymlink != 0 && !s.ext["links"] {
+			return /* passed over */
+		}
+		if !st.IsDir() {
+			files++
+			if !st.Mode().IsRegular() {
+				return
+			}
+			if s.ext["hardlinks"] {
+				if dev, ino, nlink, ok := s.fs.Inode(st); ok && nlink > 1 {
+					if seen[inode{dev, ino}] {
+						return /* sent as a hard link without data */
+					}
+					seen[inode{dev, ino}] = true
+				}
+			}
+			bytes += st.Size()
+			return
+		}
+		if !s.opts.Recursive {
+			return
+		}
+		if id, ok := s.dirID(st); ok {
+			if entered[id] {
+				return /* a loop, not sent either */
+			}
+			entered[id] = true
+			defer delete(entered, id)
+		}
+		dir, err := s.fs.Open(local)
+		if err != nil {
+			return
+		}
+		defer dir.Close()
+		for {
+			children, err := dir.Readdir(DirScanBatchSize)
+			for _, child := range children {
+				visit(path.Join(local, child.Name()), false)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	for _, local := range paths {
+		visit(local, true)
+	}
+	return files, bytes
+}
+
+/* sendTotals scans paths ahead of sending them when asked to, telling
+   the sink too when the totals extension is on */
+func (s *session) sendTotals(paths []string) error {
+	if !s.opts.Totals {
+		return nil
+	}
+	files, bytes := s.scan(paths)
+	s.progress.total(files, bytes)
+	if !s.ext["totals"] {
+		return nil
+	}
+	if err := s.enc.Encode(protocol.GMsg{Files: files, Bytes: bytes}); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+/* sinkTotals takes the totals the source announced for target, with
+   CheckSpace failing the transfer up front when they do not fit */
+func (s *session) sinkTotals(target, line string) error {
+	var m protocol.GMsg
+	if err := m.UnmarshalText([]byte(line)); err != nil || !s.ext["totals"] {
+		return s.teeError(protocolErr)
+	}
+	s.progress.total(m.Files, m.Bytes)
+	if s.opts.CheckSpace {
+		dir := target
+		if st, err := s.fs.Stat(target); err != nil || !st.IsDir() {
+			dir = path.Dir(target)
+		}
+		if err := s.room(target, dir, m.Bytes); err != nil {
+			return s.teeError(FatalError{Err: err})
+		}
+	}
+	return s.enc.Ack()
+}
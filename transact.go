@@ -0,0 +1,81 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+/* A sink with Transactional receives each directory coming into the
+   target directory itself into a staging directory beside its name,
+   registered as partial, and moves it in once all in it came; when
+   anything in it failed, or the transfer broke off, the staging
+   directory is removed and what was there stays as it was. */
+
+var ErrRolledBack = errors.New("not received for the errors in it, nothing of it kept")
+
+/* stageDir is the staging directory name is received into, registered
+   as partial; it does not exist yet */
+func (s *session) stageDir(name string) (string, *partialFile, error) {
+	if st, err := s.fs.Lstat(name); err == nil && !st.IsDir() {
+		return "", nil, fmt.Errorf("%s: %w", name, ErrNotDirectory)
+	}
+	stage := tempPrefix(name) + tempID()
+	return stage, addPartialTree(s.fs, stage), nil
+}
+
+/* commitDir has the staging directory stage take the place of name.
+   What is there moves aside first and is removed after, or with
+   OnConflict backup kept as the name with BackupSuffix; name is missing
+   in between, as renaming cannot swap two directories. */
+func (s *session) commitDir(stage, name string) error {
+	old := ""
+	if _, err := s.fs.Lstat(name); err == nil {
+		old = tempPrefix(name) + tempID()
+		if s.opts.OnConflict == ConflictBackup {
+			old = name + BackupSuffix
+			if err := removeTree(s.fs, old); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := s.fs.Rename(name, old); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := s.fs.Rename(stage, name); err != nil {
+		if old != "" {
+			s.fs.Rename(old, name)
+		}
+		return err
+	}
+	if old != "" && s.opts.OnConflict != ConflictBackup {
+		return removeTree(s.fs, old)
+	}
+	return nil
+}
+
+/* removeTree removes name and what is below it, directories received
+   without write permission too */
+func removeTree(fsys FS, name string) error {
+	st, err := fsys.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		if st.Mode().Perm()&S_IRWXU != S_IRWXU {
+			fsys.Chmod(name, st.Mode().Perm()|S_IRWXU)
+		}
+		names, err := readDir(fsys, name)
+		if err != nil {
+			return err
+		}
+		for _, child := range names {
+			if err := removeTree(fsys, child); err != nil {
+				return err
+			}
+		}
+	}
+	return fsys.Remove(name)
+}
@@ -0,0 +1,40 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+var ErrInvalidMask = errors.New("not an octal mask of mode bits")
+
+/* the umask of the process, read once before anything is created as
+   reading it means setting it */
+var processUmask = readUmask()
+
+/* mask is the mode bits the sink clears from those it is sent: those
+   of Umask, setuid and setgid with NoSpecialBits, and with UseUmask
+   and no Preserve, those of the umask */
+func (s *session) mask() os.FileMode {
+	mask := s.opts.Umask
+	if s.opts.NoSpecialBits {
+		mask |= os.ModeSetuid | os.ModeSetgid
+	}
+	if s.opts.UseUmask && !s.opts.Preserve {
+		mask |= processUmask
+	}
+	return mask
+}
+
+/* ParseMask is the mode bits text gives in octal, like 027, or 1000
+   for the sticky bit */
+func ParseMask(text string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(text, 8, 32)
+	if err != nil || n > 07777 {
+		return 0, fmt.Errorf("%q: %w", text, ErrInvalidMask)
+	}
+	return protocol.ToStdPerm(int(n)), nil
+}
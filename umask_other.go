@@ -0,0 +1,9 @@
+//go:build !unix
+
+package rscp
+
+import "os"
+
+func readUmask() os.FileMode {
+	return 0
+}
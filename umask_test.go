@@ -0,0 +1,56 @@
+package rscp
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+/* Preserve keeps setuid, setgid and sticky bits, NoSpecialBits clears
+   the first two and Umask whichever it has */
+func TestSpecialBits(t *testing.T) {
+	sticky, _ := ParseMask("1000")
+	tests := []struct {
+		what string
+		opts Options
+		mask os.FileMode /* of the special bits, those expected cleared */
+	}{
+		{"preserve", Options{}, 0},
+		{"no special bits", Options{NoSpecialBits: true}, os.ModeSetuid | os.ModeSetgid},
+		{"umask 1000", Options{Umask: sticky}, os.ModeSticky},
+		{"both", Options{NoSpecialBits: true, Umask: sticky}, os.ModeSetuid | os.ModeSetgid | os.ModeSticky},
+	}
+	modes := map[string]os.FileMode{
+		"/src":      os.ModeDir | 0755,
+		"/src/suid": 0755 | os.ModeSetuid,
+		"/src/all":  0755 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky,
+		"/src/sgid": os.ModeDir | 0755 | os.ModeSetgid,
+		"/src/tmp":  os.ModeDir | 0777 | os.ModeSticky,
+	}
+	for _, tt := range tests {
+		src, dst := NewMemFS(), NewMemFS()
+		src.Mkdir("/src", 0755)
+		src.WriteFile("/src/suid", []byte("x"), 0755)
+		src.WriteFile("/src/all", []byte("x"), 0755)
+		src.Mkdir("/src/sgid", 0755)
+		src.Mkdir("/src/tmp", 0777)
+		for name, mode := range modes {
+			src.Chmod(name, mode)
+		}
+		dst.Mkdir("/dst", 0755)
+
+		opts := tt.opts
+		opts.Recursive, opts.Preserve = true, true
+		if err := LoopbackFS(context.Background(), opts, src, []string{"/src"}, dst, "/dst"); err != nil {
+			t.Fatal(err)
+		}
+		for name, mode := range modes {
+			st, err := dst.Stat("/dst" + name)
+			if err != nil {
+				t.Errorf("%s: %v", tt.what, err)
+			} else if want := mode &^ tt.mask; st.Mode() != want {
+				t.Errorf("%s: %s is %v, want %v", tt.what, name, st.Mode(), want)
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package rscp
+
+import (
+	"os"
+	"syscall"
+)
+
+func readUmask() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask) & os.ModePerm
+}
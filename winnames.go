@@ -0,0 +1,113 @@
+package rscp
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* WinNames is what a sink does with names Windows cannot take: those
+   of devices like CON and COM1, with any extension too, those holding
+   characters like : and ?, those ending in dots or spaces, and those
+   differing only in case from one received into the same directory */
+type WinNames int
+
+const (
+	WinNamesAllow  WinNames = iota /* take them as they come, except on Windows where WinNamesError holds */
+	WinNamesError                  /* fail what comes under them */
+	WinNamesRename                 /* receive it under a name Windows takes */
+)
+
+var (
+	ErrWindowsName   = errors.New("not a name Windows can take")
+	ErrCaseCollision = errors.New("differs only in case from a name received before")
+)
+
+/* the names of devices Windows keeps for itself in every directory */
+var winDevices = map[string]bool{"CON": true, "PRN": true, "AUX": true, "NUL": true}
+
+func init() {
+	for i := 1; i <= 9; i++ {
+		winDevices["COM"+strconv.Itoa(i)] = true
+		winDevices["LPT"+strconv.Itoa(i)] = true
+	}
+}
+
+/* winNames is what the sink does about names for Windows */
+func (s *session) winNames() WinNames {
+	if s.opts.WindowsNames == WinNamesAllow && runtime.GOOS == "windows" {
+		return WinNamesError
+	}
+	return s.opts.WindowsNames
+}
+
+/* caseNames are the names a sink checking them for Windows received,
+   shared by the sessions of a mux */
+type caseNames struct {
+	mu     sync.Mutex
+	chosen map[string]string /* names sent to those received under */
+	taken  map[string]bool   /* names received under, lower case */
+}
+
+func newCaseNames() *caseNames {
+	return &caseNames{chosen: map[string]string{}, taken: map[string]bool{}}
+}
+
+/* winName is name, the last element of which came from the source, as
+   winNames has it received: the same, renamed, or failing */
+func (s *session) winName(name string) (string, error) {
+	c := s.caseNames
+	if c == nil {
+		return name, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if chosen, ok := c.chosen[name]; ok { /* entered again by another stream */
+		return chosen, nil
+	}
+
+	dir, base := path.Split(name)
+	safe := winSafe(base)
+	if safe != base && s.winNames() == WinNamesError {
+		return name, fmt.Errorf("%s: %w", name, ErrWindowsName)
+	}
+	chosen := dir + safe
+	if c.taken[strings.ToLower(chosen)] {
+		if s.winNames() == WinNamesError {
+			return name, fmt.Errorf("%s: %w", name, ErrCaseCollision)
+		}
+		ext := path.Ext(safe)
+		for n := 2; c.taken[strings.ToLower(chosen)]; n++ {
+			chosen = dir + strings.TrimSuffix(safe, ext) + "~" + strconv.Itoa(n) + ext
+		}
+	}
+	c.chosen[name] = chosen
+	c.taken[strings.ToLower(chosen)] = true
+	return chosen, nil
+}
+
+/* winSafe is name with what Windows cannot take in it written as % and
+   two hex digits: characters it refuses, dots and spaces at the end,
+   and the last letter of a device name */
+func winSafe(name string) string {
+	var b strings.Builder
+	end := len(strings.TrimRight(name, ". "))
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < ' ' || strings.IndexByte(`<>:"\|?*`, c) >= 0 || i >= end {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	safe := b.String()
+	stem, _, _ := strings.Cut(safe, ".")
+	if stem = strings.TrimRight(stem, " "); winDevices[strings.ToUpper(stem)] {
+		last := len(stem) - 1
+		safe = fmt.Sprintf("%s%%%02X%s", stem[:last], stem[last], safe[last+1:])
+	}
+	return safe
+}
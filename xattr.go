@@ -0,0 +1,94 @@
+package rscp
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/sftpplease/rscp/protocol"
+)
+
+const MaxXattrSize = 64 << 10 /* names and values of a single file */
+
+/* xattr is an extended attribute travelling ahead of a C or D message */
+type xattr struct {
+	name  string
+	value []byte
+}
+
+/* xattrAllowed tells whether opts let attribute name travel */
+func (o Options) xattrAllowed(name string) bool {
+	return o.Xattrs && strings.HasPrefix(name, "user.") ||
+		o.SecurityXattrs && strings.HasPrefix(name, "security.")
+}
+
+/* xattrs reads the allowed attributes of local, none where the FS has none */
+func (s *session) xattrs(local string) ([]xattr, error) {
+	names, err := s.fs.Listxattr(local)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var xs []xattr
+	for _, name := range names {
+		if !s.opts.xattrAllowed(name) {
+			continue
+		}
+		value, err := s.fs.Getxattr(local, name)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, xattr{name, value})
+	}
+	return xs, nil
+}
+
+func (s *session) sendXattrs(xs []xattr) error {
+	for _, x := range xs {
+		s.keepalive.pause()
+		err := s.enc.Encode(protocol.AMsg{Size: len(x.value), Name: x.name})
+		if err == nil {
+			err = s.enc.WriteData(x.value)
+		}
+		s.keepalive.resume()
+		if err != nil {
+			return err
+		}
+		if err := s.ack(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* recvXattr reads the value following an A message, used bounds what a file may carry */
+func (s *session) recvXattr(line string, used int) (xattr, error) {
+	var m protocol.AMsg
+	if err := m.UnmarshalText([]byte(line)); err != nil {
+		return xattr{}, err
+	}
+	if used+len(m.Name)+m.Size > MaxXattrSize {
+		return xattr{}, protocolErr
+	}
+	value := make([]byte, m.Size)
+	if _, err := io.ReadFull(s.in, value); err != nil {
+		return xattr{}, FatalError{Err: err}
+	}
+	return xattr{m.Name, value}, nil
+}
+
+/* setXattrs applies the attributes the sink allows, returning the first failure */
+func (s *session) setXattrs(name string, xs []xattr) error {
+	var first error
+	for _, x := range xs {
+		if !s.opts.xattrAllowed(x.name) {
+			continue
+		}
+		if err := s.fs.Setxattr(name, x.name, x.value); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,132 @@
+package rscp
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+func listxattr(name string) ([]string, error) {
+	for {
+		sz, err := syscall.Listxattr(name, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: name, Err: err}
+		}
+		buf := make([]byte, sz)
+		if sz, err = syscall.Listxattr(name, buf); err == syscall.ERANGE {
+			continue /* grew in between */
+		} else if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: name, Err: err}
+		}
+		return strings.FieldsFunc(string(buf[:sz]), func(r rune) bool { return r == 0 }), nil
+	}
+}
+
+func getxattr(name, attr string) ([]byte, error) {
+	for {
+		sz, err := syscall.Getxattr(name, attr, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: name, Err: err}
+		}
+		buf := make([]byte, sz)
+		if sz, err = syscall.Getxattr(name, attr, buf); err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: name, Err: err}
+		}
+		return buf[:sz], nil
+	}
+}
+
+func setxattr(name, attr string, value []byte) error {
+	if err := syscall.Setxattr(name, attr, value, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: name, Err: err}
+	}
+	return nil
+}
+
+/* flistxattr, fgetxattr and fsetxattr are the calls above on the file f
+   is open on, which syscall has no wrappers for */
+
+func flistxattr(f *os.File) ([]string, error) {
+	for {
+		sz, err := fdCall(f, func(fd uintptr) (uintptr, syscall.Errno) {
+			n, _, errno := syscall.Syscall(syscall.SYS_FLISTXATTR, fd, 0, 0)
+			return n, errno
+		})
+		if err != nil {
+			return nil, &os.PathError{Op: "flistxattr", Path: f.Name(), Err: err}
+		}
+		buf := make([]byte, max(sz, 1))
+		if sz, err = fdCall(f, func(fd uintptr) (uintptr, syscall.Errno) {
+			n, _, errno := syscall.Syscall(syscall.SYS_FLISTXATTR, fd, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+			return n, errno
+		}); err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "flistxattr", Path: f.Name(), Err: err}
+		}
+		return strings.FieldsFunc(string(buf[:sz]), func(r rune) bool { return r == 0 }), nil
+	}
+}
+
+func fgetxattr(f *os.File, attr string) ([]byte, error) {
+	name, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return nil, &os.PathError{Op: "fgetxattr", Path: f.Name(), Err: err}
+	}
+	for {
+		sz, err := fdCall(f, func(fd uintptr) (uintptr, syscall.Errno) {
+			n, _, errno := syscall.Syscall6(syscall.SYS_FGETXATTR, fd, uintptr(unsafe.Pointer(name)), 0, 0, 0, 0)
+			return n, errno
+		})
+		if err != nil {
+			return nil, &os.PathError{Op: "fgetxattr", Path: f.Name(), Err: err}
+		}
+		buf := make([]byte, max(sz, 1))
+		if sz, err = fdCall(f, func(fd uintptr) (uintptr, syscall.Errno) {
+			n, _, errno := syscall.Syscall6(syscall.SYS_FGETXATTR, fd, uintptr(unsafe.Pointer(name)),
+				uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+			return n, errno
+		}); err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "fgetxattr", Path: f.Name(), Err: err}
+		}
+		return buf[:sz], nil
+	}
+}
+
+func fsetxattr(f *os.File, attr string, value []byte) error {
+	name, err := syscall.BytePtrFromString(attr)
+	if err == nil {
+		buf := append(value[:len(value):len(value)], 0) /* somewhere to point at when empty */
+		_, err = fdCall(f, func(fd uintptr) (uintptr, syscall.Errno) {
+			_, _, errno := syscall.Syscall6(syscall.SYS_FSETXATTR, fd, uintptr(unsafe.Pointer(name)),
+				uintptr(unsafe.Pointer(&buf[0])), uintptr(len(value)), 0, 0)
+			return 0, errno
+		})
+	}
+	if err != nil {
+		return &os.PathError{Op: "fsetxattr", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+/* fdCall makes call on the descriptor of f, a count or an errno */
+func fdCall(f *os.File, call func(fd uintptr) (uintptr, syscall.Errno)) (int, error) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var n uintptr
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) { n, errno = call(fd) }); err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package rscp
+
+import (
+	"errors"
+	"os"
+)
+
+func listxattr(name string) ([]string, error) {
+	return nil, &os.PathError{Op: "listxattr", Path: name, Err: errors.ErrUnsupported}
+}
+
+func getxattr(name, attr string) ([]byte, error) {
+	return nil, &os.PathError{Op: "getxattr", Path: name, Err: errors.ErrUnsupported}
+}
+
+func setxattr(name, attr string, value []byte) error {
+	return &os.PathError{Op: "setxattr", Path: name, Err: errors.ErrUnsupported}
+}
+
+func flistxattr(f *os.File) ([]string, error) {
+	return nil, &os.PathError{Op: "flistxattr", Path: f.Name(), Err: errors.ErrUnsupported}
+}
+
+func fgetxattr(f *os.File, attr string) ([]byte, error) {
+	return nil, &os.PathError{Op: "fgetxattr", Path: f.Name(), Err: errors.ErrUnsupported}
+}
+
+func fsetxattr(f *os.File, attr string, value []byte) error {
+	return &os.PathError{Op: "fsetxattr", Path: f.Name(), Err: errors.ErrUnsupported}
+}